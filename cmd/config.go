@@ -0,0 +1,434 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drycc-addons/valkey-cluster-proxy/proxy"
+	"github.com/golang/glog"
+)
+
+// the config file is checked for changes in this interval
+const CONFIG_CHECK_INTERVAL = 5 * time.Second
+
+/*
+Config is the settings of proxy. Each of them is a command line flag, and may also be
+set in the config file with the same name as the flag, eg.
+
+	# proxy.conf
+	addr = "0.0.0.0:8088"
+	startup-nodes = [
+		"10.0.0.1:7001",
+		"10.0.0.2:7001",
+	]
+	connect-timeout = "3s"
+	backend-connections = 8
+	backend-tls = true
+
+Flags given in command line take precedence over the config file.
+*/
+type Config struct {
+	ConfigFile          string
+	Addr                string
+	UnixSocketPerm      string
+	UnixSocketOwner     string
+	ProxyProtocol       string
+	AccessLog           string
+	AccessLogSample     float64
+	AccessLogCommands   string
+	AccessLogRedact     bool
+	SlowlogSlowerThan   int
+	SlowlogMaxLen       int
+	CacheKeys           string
+	CacheCommands       string
+	CacheTTL            time.Duration
+	CacheMaxBytes       int64
+	Password            string
+	ACLFile             string
+	MetricsAddr         string
+	DebugAddr           string
+	StartupNodes        string
+	ConnectTimeout      time.Duration
+	SlotsReloadInterval time.Duration
+	ShutdownGracePeriod time.Duration
+	MaxProcs            int
+	BackendConnections  int
+	ReadPrefer          int
+	BackendProtocol     int
+	TLSCertFile         string
+	TLSKeyFile          string
+	TLSCACertFile       string
+	TLSAuthClients      string
+	BackendTLS          bool
+	BackendTLSCACert    string
+	BackendTLSCert      string
+	BackendTLSKey       string
+	BackendTLSName      string
+	BackendTLSInsecure  bool
+}
+
+// settings applied at runtime once the config file is reloaded, the others need a restart
+var reloadableSettings = map[string]bool{
+	"password":                true,
+	"aclfile":                 true,
+	"connect-timeout":         true,
+	"backend-connections":     true,
+	"read-prefer":             true, // reading replicas needs a restart unless READONLY was sent since started
+	"startup-nodes":           true,
+	"max-procs":               true,
+	"slowlog-log-slower-than": true,
+	"slowlog-max-len":         true,
+}
+
+// bind defines the settings of c as flags of fs with default values
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config", "", "config file of key = value lines of the settings named the same as flags, reloaded on SIGHUP or changed")
+	fs.StringVar(&c.Addr, "addr", "0.0.0.0:8088", "proxy serving addr, comma separated to listen on more, eg. 0.0.0.0:8088,unix:/run/proxy.sock for an unix socket")
+	fs.StringVar(&c.UnixSocketPerm, "unixsocket-perm", "", "permission of unix sockets in octal, eg. 660, given by umask if empty")
+	fs.StringVar(&c.UnixSocketOwner, "unixsocket-owner", "", "owner of unix sockets, eg. user, user:group or :group the same as chown, unchanged if empty")
+	fs.StringVar(&c.ProxyProtocol, "proxy-protocol", "", "comma separated CIDRs or IPs of load balancers sending PROXY protocol v1 or v2 header on TCP listeners, eg. 10.0.0.0/8, disabled if empty")
+	fs.StringVar(&c.AccessLog, "access-log", "", "file to write access log of commands in JSON lines, - for stdout, disabled if empty")
+	fs.Float64Var(&c.AccessLogSample, "access-log-sample", 1, "rate of commands written to access log in [0, 1], commands replied with an error are always written")
+	fs.StringVar(&c.AccessLogCommands, "access-log-commands", "", "comma separated commands written to access log, prefixed with - to exclude, eg. -PING,-INFO, all if empty")
+	fs.BoolVar(&c.AccessLogRedact, "access-log-redact", true, "omit argument values of commands in access log, such as keys")
+	fs.IntVar(&c.SlowlogSlowerThan, "slowlog-log-slower-than", int(proxy.SLOWLOG_LOG_SLOWER_THAN/time.Microsecond), "commands slower than this in microseconds from received to replied are kept in slow log of proxy, negative to disable")
+	fs.IntVar(&c.SlowlogMaxLen, "slowlog-max-len", proxy.SLOWLOG_MAX_LEN, "max number of entries kept in slow log of proxy")
+	fs.StringVar(&c.CacheKeys, "cache-keys", "", "comma separated glob patterns of hot keys whose reads are cached in proxy, eg. user:*,config:*, requires backend-protocol 3, disabled if empty")
+	fs.StringVar(&c.CacheCommands, "cache-commands", proxy.CACHE_COMMANDS, "comma separated read commands cached on keys of cache-keys")
+	fs.DurationVar(&c.CacheTTL, "cache-ttl", proxy.CACHE_TTL, "max time a reply is kept in cache, it's removed once the key is changed anyway")
+	fs.Int64Var(&c.CacheMaxBytes, "cache-max-bytes", proxy.CACHE_MAX_BYTES, "max bytes of replies kept in cache, the least recently used ones are evicted")
+	fs.StringVar(&c.Password, "password", "", "password for backend server, it will send this password to backend server")
+	fs.StringVar(&c.ACLFile, "aclfile", "", "file of proxy users and their permissions in valkey ACL rules, the default user has the password of backend server if not defined")
+	fs.StringVar(&c.StartupNodes, "startup-nodes", "127.0.0.1:7001", "startup nodes used to query cluster topology")
+	fs.DurationVar(&c.ConnectTimeout, "connect-timeout", 10*time.Second, "connect to backend timeout")
+	fs.DurationVar(&c.SlotsReloadInterval, "slots-reload-interval", 30*time.Second, "slots reload interval")
+	fs.DurationVar(&c.ShutdownGracePeriod, "shutdown-grace-period", 20*time.Second, "max time to wait for client requests replied on SIGTERM before closing connections, keep it shorter than the grace period of kubernetes pod")
+	fs.IntVar(&c.MaxProcs, "max-procs", 1, "sets the maximum number of CPUs that can be executing")
+	fs.IntVar(&c.BackendConnections, "backend-connections", 4, "number of multiplexed connections to each backend server")
+	for _, name := range []string{"backend-init-connections", "backend-idle-connections"} {
+		fs.Var(&deprecatedFlag{name: name, target: fs.Lookup("backend-connections")}, name, "`number` of connections to each backend server, deprecated alias of -backend-connections")
+	}
+	fs.IntVar(&c.BackendProtocol, "backend-protocol", 2, "protocol version spoken with backend server, 2 for RESP2 or 3 for RESP3")
+	fs.StringVar(&c.TLSCertFile, "tls-cert-file", "", "certificate file of proxy listener, clients must connect with TLS if set")
+	fs.StringVar(&c.TLSKeyFile, "tls-key-file", "", "private key file of proxy listener")
+	fs.StringVar(&c.TLSCACertFile, "tls-ca-cert-file", "", "CA certificate file to verify client certificates")
+	fs.StringVar(&c.TLSAuthClients, "tls-auth-clients", "no", "whether client certificates are required, eg. no, yes, optional")
+	fs.BoolVar(&c.BackendTLS, "backend-tls", false, "connect to backend server with TLS")
+	fs.StringVar(&c.BackendTLSCACert, "backend-tls-ca-cert-file", "", "CA certificate file to verify backend server, system CAs are used if empty")
+	fs.StringVar(&c.BackendTLSCert, "backend-tls-cert-file", "", "client certificate file presented to backend server")
+	fs.StringVar(&c.BackendTLSKey, "backend-tls-key-file", "", "private key file of client certificate presented to backend server")
+	fs.StringVar(&c.BackendTLSName, "backend-tls-server-name", "", "server name to send as SNI and verify backend certificate with, host of backend address if empty")
+	fs.BoolVar(&c.BackendTLSInsecure, "backend-tls-skip-verify", false, "skip verifying backend certificate, for development only")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", "", "listen address of prometheus metrics endpoint /metrics, default not enabled")
+	fs.StringVar(&c.DebugAddr, "debug-addr", "", "proxy debug listen address for pprof, set log level, inspect slots, backends and sessions, default not enabled")
+	fs.IntVar(&c.ReadPrefer, "read-prefer", proxy.READ_PREFER_MASTER, "where read command to send to, eg. READ_PREFER_MASTER, READ_PREFER_SLAVE, READ_PREFER_SLAVE_IDC")
+}
+
+// deprecatedFlag is a flag replaced by target, setting it sets target with a warning
+type deprecatedFlag struct {
+	name   string
+	target *flag.Flag
+	value  string
+}
+
+func (f *deprecatedFlag) String() string {
+	return f.value
+}
+
+func (f *deprecatedFlag) Set(value string) error {
+	glog.Warningf("flag %s is deprecated, use %s instead", f.name, f.target.Name)
+	if err := f.target.Value.Set(value); err != nil {
+		return err
+	}
+	f.value = value
+	return nil
+}
+
+// flagSet returns a copy of c and the flags bound to the copy to access settings by name
+func (c *Config) flagSet() (*Config, *flag.FlagSet) {
+	cp := &Config{}
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	cp.bind(fs)
+	*cp = *c
+	return cp, fs
+}
+
+func (c *Config) validate() error {
+	if len(proxy.ParseListenAddrs(c.Addr)) == 0 {
+		return fmt.Errorf("no listen address")
+	}
+	if _, err := c.unixSocketPerm(); err != nil {
+		return err
+	}
+	if c.ProxyProtocol != "" {
+		if _, err := proxy.NewProxyProtocol(c.ProxyProtocol); err != nil {
+			return fmt.Errorf("invalid proxy protocol settings, err=%v", err)
+		}
+	}
+	if c.AccessLogSample < 0 || c.AccessLogSample > 1 {
+		return fmt.Errorf("invalid access log sample rate %v", c.AccessLogSample)
+	}
+	if c.SlowlogMaxLen < 0 {
+		return fmt.Errorf("invalid slowlog max len %d", c.SlowlogMaxLen)
+	}
+	if c.CacheKeys != "" {
+		if c.BackendProtocol != 3 {
+			return fmt.Errorf("cache requires backend protocol 3 for invalidations")
+		}
+		if _, err := c.cache(); err != nil {
+			return fmt.Errorf("invalid cache settings, err=%v", err)
+		}
+	}
+	if c.BackendConnections <= 0 {
+		return fmt.Errorf("invalid backend connections settings")
+	}
+	if c.ShutdownGracePeriod < 0 {
+		return fmt.Errorf("invalid shutdown grace period settings")
+	}
+	if c.MaxProcs <= 0 {
+		return fmt.Errorf("invalid max procs settings")
+	}
+	if c.ReadPrefer < proxy.READ_PREFER_MASTER || c.ReadPrefer > proxy.READ_PREFER_SLAVE_IDC {
+		return fmt.Errorf("invalid read prefer %d", c.ReadPrefer)
+	}
+	if c.BackendProtocol != 2 && c.BackendProtocol != 3 {
+		return fmt.Errorf("unsupported protocol version %d", c.BackendProtocol)
+	}
+	if len(c.startupNodes()) == 0 {
+		return fmt.Errorf("no startup nodes")
+	}
+	return nil
+}
+
+// cache returns the cache of hot keys read, nil if disabled
+func (c *Config) cache() (*proxy.Cache, error) {
+	if c.CacheKeys == "" {
+		return nil, nil
+	}
+	return proxy.NewCache(c.CacheKeys, c.CacheCommands, c.CacheTTL, c.CacheMaxBytes)
+}
+
+func (c *Config) slowlogSlowerThan() time.Duration {
+	return time.Duration(c.SlowlogSlowerThan) * time.Microsecond
+}
+
+func (c *Config) unixSocketPerm() (os.FileMode, error) {
+	if c.UnixSocketPerm == "" {
+		return 0, nil
+	}
+	perm, err := strconv.ParseUint(c.UnixSocketPerm, 8, 32)
+	if err != nil || perm == 0 || perm > 0777 {
+		return 0, fmt.Errorf("invalid unix socket permission %s", c.UnixSocketPerm)
+	}
+	return os.FileMode(perm), nil
+}
+
+// unixSocketOwner returns uid and gid of the owner of unix sockets, -1 if not changed
+func (c *Config) unixSocketOwner() (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if c.UnixSocketOwner == "" {
+		return
+	}
+	// the same as chown, group is the login group of user if followed by a colon only
+	name, group, colon := strings.Cut(c.UnixSocketOwner, ":")
+	if name != "" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			if u, err = user.LookupId(name); err != nil {
+				return -1, -1, err
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		if colon && group == "" {
+			gid, _ = strconv.Atoi(u.Gid)
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return -1, -1, err
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return
+}
+
+func (c *Config) startupNodes() []string {
+	var nodes []string
+	for _, node := range strings.Split(c.StartupNodes, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// diff returns the names of settings different from other
+func (c *Config) diff(other *Config) []string {
+	_, fs := c.flagSet()
+	_, otherFs := other.flagSet()
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() != otherFs.Lookup(f.Name).Value.String() {
+			names = append(names, f.Name)
+		}
+	})
+	return names
+}
+
+// loadConfig reads settings from file, flags set in command line take precedence
+func loadConfig(file string, commandLine *flag.FlagSet) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseConfigFile(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", file, err)
+	}
+	c := &Config{}
+	fs := flag.NewFlagSet(file, flag.ContinueOnError)
+	c.bind(fs)
+	for _, entry := range entries {
+		if fs.Lookup(entry.key) == nil || entry.key == "config" {
+			return nil, fmt.Errorf("%s:%d: unknown setting %s", file, entry.line, entry.key)
+		}
+		if err := fs.Set(entry.key, entry.value); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid %s: %v", file, entry.line, entry.key, err)
+		}
+	}
+	commandLine.Visit(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) != nil {
+			fs.Set(f.Name, f.Value.String())
+		}
+	})
+	c.ConfigFile = file
+	return c, c.validate()
+}
+
+type configEntry struct {
+	line  int
+	key   string
+	value string
+}
+
+// parseConfigFile parses lines of key = value, where value is a string quoted with double
+// quotes and escapes or with single quotes literally, a number, a boolean, or an array of them
+// in brackets which may span lines. Comments start with #, and sections are not supported.
+// Values are returned the same as flag values, elements of arrays are joined with comma,
+// and dashes may be written as underscores in keys.
+func parseConfigFile(data string) ([]configEntry, error) {
+	var entries []configEntry
+	line, rest := 0, data
+	for rest != "" {
+		var s string
+		s, rest, _ = strings.Cut(rest, "\n")
+		line++
+		if s = strings.TrimSpace(s); s == "" || s[0] == '#' {
+			continue
+		}
+		if s[0] == '[' {
+			return nil, fmt.Errorf("%d: sections are not supported", line)
+		}
+		key, s, ok := strings.Cut(s, "=")
+		key = strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+		if !ok || key == "" || strings.ContainsAny(key, " \t\"'") {
+			return nil, fmt.Errorf("%d: expected key = value", line)
+		}
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, "[") {
+			// an array continues on the lines up to its closing bracket
+			s, rest = s+"\n"+rest, ""
+		}
+		value, after, err := parseConfigValue(s)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", line, err)
+		}
+		start := line
+		line += strings.Count(s, "\n") - strings.Count(after, "\n")
+		if i := strings.IndexByte(after, '\n'); i >= 0 {
+			after, rest = after[:i], after[i+1:]
+		}
+		if after = strings.TrimSpace(after); after != "" && after[0] != '#' {
+			return nil, fmt.Errorf("%d: unexpected %q after value", line, after)
+		}
+		entries = append(entries, configEntry{line: start, key: key, value: value})
+	}
+	return entries, nil
+}
+
+// parseConfigValue parses the value at the beginning of s and returns the rest of s
+func parseConfigValue(s string) (value, rest string, err error) {
+	if s == "" {
+		return "", "", fmt.Errorf("missing value")
+	}
+	switch s[0] {
+	case '"':
+		for i := 1; i < len(s) && s[i] != '\n'; i++ {
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == '"' {
+				value, err = strconv.Unquote(s[:i+1])
+				return value, s[i+1:], err
+			}
+		}
+		return "", "", fmt.Errorf("unterminated string")
+	case '\'':
+		end := strings.IndexAny(s[1:], "'\n")
+		if end < 0 || s[end+1] != '\'' {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case '[':
+		var values []string
+		rest = skipConfigBlank(s[1:])
+		for !strings.HasPrefix(rest, "]") {
+			if rest == "" {
+				return "", "", fmt.Errorf("unterminated array")
+			}
+			if value, rest, err = parseConfigValue(rest); err != nil {
+				return "", "", err
+			}
+			values = append(values, value)
+			rest = skipConfigBlank(rest)
+			if strings.HasPrefix(rest, ",") {
+				rest = skipConfigBlank(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return "", "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+		return strings.Join(values, ","), rest[1:], nil
+	default:
+		end := strings.IndexAny(s, " \t\r\n,]#")
+		if end < 0 {
+			end = len(s)
+		}
+		value, rest = s[:end], s[end:]
+		if value == "true" || value == "false" {
+			return value, rest, nil
+		}
+		number := strings.ReplaceAll(value, "_", "")
+		if _, err := strconv.ParseFloat(number, 64); err != nil {
+			return "", "", fmt.Errorf("invalid value %s", value)
+		}
+		return number, rest, nil
+	}
+}
+
+// skipConfigBlank skips spaces, line breaks and comments between elements of an array
+func skipConfigBlank(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+		_, s, _ = strings.Cut(s, "\n")
+	}
+}
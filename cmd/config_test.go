@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	entries, err := parseConfigFile(`
+# proxy settings
+addr = "0.0.0.0:6379" # listen on all
+password = 'p"ss#word'
+startup_nodes = ["10.0.0.1:7001", '10.0.0.2:7001', ]
+backend-connections = 1_0
+backend-tls = true
+connect-timeout = "3s"
+cache-keys = [
+  "user:*", # users
+  # settings
+  'config:*',
+]
+max-procs = 2
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []configEntry{
+		{3, "addr", "0.0.0.0:6379"},
+		{4, "password", `p"ss#word`},
+		{5, "startup-nodes", "10.0.0.1:7001,10.0.0.2:7001"},
+		{6, "backend-connections", "10"},
+		{7, "backend-tls", "true"},
+		{8, "connect-timeout", "3s"},
+		{9, "cache-keys", "user:*,config:*"},
+		{14, "max-procs", "2"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %v, got %v", expected, entries)
+	}
+
+	for _, data := range []string{`[proxy]`, `addr`, `addr = "unterminated`, `addr = 0.0.0.0:6379`, `nodes = ["a" "b"]`, `addr = "a" "b"`, "nodes = [\n\"a\",\n", "nodes = [\"a\n\"]", "nodes = [\n\"a\"\n] b"} {
+		if _, err := parseConfigFile(data); err == nil {
+			t.Errorf("expected error parsing %q", data)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "proxy.conf")
+	os.WriteFile(file, []byte("addr = \"127.0.0.1:6379\"\nbackend-connections = 8\nread-prefer = 1\n"), 0600)
+	commandLine := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	(&Config{}).bind(commandLine)
+	commandLine.Parse([]string{"-backend-connections", "2"})
+
+	config, err := loadConfig(file, commandLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Addr != "127.0.0.1:6379" || config.ReadPrefer != 1 || config.ConnectTimeout != 10*time.Second {
+		t.Errorf("unexpected settings %#v", config)
+	}
+	if config.BackendConnections != 2 {
+		t.Errorf("expected command line flag takes precedence, got %d", config.BackendConnections)
+	}
+
+	other := *config
+	other.ReadPrefer, other.Addr = 0, "127.0.0.1:6380"
+	if names := config.diff(&other); !reflect.DeepEqual(names, []string{"addr", "read-prefer"}) {
+		t.Errorf("unexpected changed settings %v", names)
+	}
+
+	os.WriteFile(file, []byte("unknown = 1\n"), 0600)
+	if _, err := loadConfig(file, commandLine); err == nil {
+		t.Error("expected unknown setting refused")
+	}
+	os.WriteFile(file, []byte("read-prefer = 9\n"), 0600)
+	if _, err := loadConfig(file, commandLine); err == nil {
+		t.Error("expected invalid read prefer refused")
+	}
+	os.WriteFile(file, []byte("cache-keys = \"user:*\"\n"), 0600)
+	if _, err := loadConfig(file, commandLine); err == nil {
+		t.Error("expected cache refused without backend protocol 3")
+	}
+	os.WriteFile(file, []byte("cache-keys = \"user:*\"\nbackend-protocol = 3\ncache-commands = \"GET,INCR\"\n"), 0600)
+	if _, err := loadConfig(file, commandLine); err == nil {
+		t.Error("expected write command refused to be cached")
+	}
+}
+
+func TestDeprecatedConnectionFlags(t *testing.T) {
+	config := &Config{}
+	commandLine := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	config.bind(commandLine)
+	if err := commandLine.Parse([]string{"-backend-idle-connections", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if config.BackendConnections != 3 {
+		t.Errorf("expected backend connections 3, got %d", config.BackendConnections)
+	}
+
+	file := filepath.Join(t.TempDir(), "proxy.conf")
+	os.WriteFile(file, []byte("backend-init-connections = 6\n"), 0600)
+	loaded, err := loadConfig(file, flag.NewFlagSet("proxy", flag.ContinueOnError))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.BackendConnections != 6 {
+		t.Errorf("expected backend connections 6 from config file, got %d", loaded.BackendConnections)
+	}
+	// aliases are not reported as changed besides backend-connections
+	if names := loaded.diff(config); !reflect.DeepEqual(names, []string{"backend-connections", "config"}) {
+		t.Errorf("unexpected changed settings %v", names)
+	}
+	if loaded, err = loadConfig(file, commandLine); err != nil || loaded.BackendConnections != 3 {
+		t.Errorf("expected command line flag takes precedence, got %d %v", loaded.BackendConnections, err)
+	}
+}
+
+func TestUnixSocketSettings(t *testing.T) {
+	config := &Config{UnixSocketPerm: "660"}
+	if perm, err := config.unixSocketPerm(); err != nil || perm != 0660 {
+		t.Errorf("expected permission 0660, got %o %v", perm, err)
+	}
+	for _, perm := range []string{"0", "8", "1777", "rw"} {
+		config.UnixSocketPerm = perm
+		if _, err := config.unixSocketPerm(); err == nil {
+			t.Errorf("expected permission %s refused", perm)
+		}
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, _ := strconv.Atoi(current.Uid)
+	gid, _ := strconv.Atoi(current.Gid)
+	for owner, expected := range map[string][2]int{
+		"":                                   {-1, -1},
+		current.Username:                     {uid, -1},
+		current.Uid + ":":                    {uid, gid},
+		":" + current.Gid:                    {-1, gid},
+		current.Username + ":" + current.Gid: {uid, gid},
+	} {
+		config.UnixSocketOwner = owner
+		if u, g, err := config.unixSocketOwner(); err != nil || u != expected[0] || g != expected[1] {
+			t.Errorf("expected %v for owner %q, got %d %d %v", expected, owner, u, g, err)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -14,57 +19,54 @@ import (
 	"github.com/golang/glog"
 )
 
-var config = struct {
-	Addr                   string
-	Password               string
-	StartupNodes           string
-	ConnectTimeout         time.Duration
-	SlotsReloadInterval    time.Duration
-	MaxProcs               int
-	BackendInitConnections int
-	BackendIdleConnections int
-	ReadPrefer             int
-}{}
+// settings given in command line
+var flags Config
 
 func init() {
-	flag.StringVar(&config.Addr, "addr", "0.0.0.0:8088", "proxy serving addr")
-	flag.StringVar(&config.Password, "password", "", "password for backend server, it will send this password to backend server")
-	flag.StringVar(&config.StartupNodes, "startup-nodes", "127.0.0.1:7001", "startup nodes used to query cluster topology")
-	flag.DurationVar(&config.ConnectTimeout, "connect-timeout", 10*time.Second, "connect to backend timeout")
-	flag.DurationVar(&config.SlotsReloadInterval, "slots-reload-interval", 30*time.Second, "slots reload interval")
-	flag.IntVar(&config.MaxProcs, "max-procs", 1, "sets the maximum number of CPUs that can be executing")
-	flag.IntVar(&config.BackendInitConnections, "backend-init-connections", 5, "max number of init connections for each backend server")
-	flag.IntVar(&config.BackendIdleConnections, "backend-idle-connections", 5, "max number of idle connections for each backend server")
-	flag.IntVar(&config.ReadPrefer, "read-prefer", proxy.READ_PREFER_MASTER, "where read command to send to, eg. READ_PREFER_MASTER, READ_PREFER_SLAVE, READ_PREFER_SLAVE_IDC")
+	flags.bind(flag.CommandLine)
 }
 
 func main() {
 	flag.Parse()
-	glog.Infof("%#v", config)
+	config := &flags
+	if flags.ConfigFile != "" {
+		var err error
+		if config, err = loadConfig(flags.ConfigFile, flag.CommandLine); err != nil {
+			glog.Exit(err)
+		}
+	} else if err := config.validate(); err != nil {
+		glog.Exit(err)
+	}
+	glog.Infof("%#v", *config)
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
 	runtime.GOMAXPROCS(config.MaxProcs)
 	glog.Infof("pid %d", os.Getpid())
 
-	if config.BackendInitConnections < 0 || config.BackendIdleConnections < 0 || config.BackendInitConnections > config.BackendIdleConnections {
-		glog.Exit("invalid backend connections settings")
-	}
-
 	// shuffle startup nodes
-	startupNodes := strings.Split(config.StartupNodes, ",")
+	startupNodes := config.startupNodes()
 	indexes := rand.Perm(len(startupNodes))
 	for i, startupNode := range startupNodes {
 		startupNodes[i] = startupNodes[indexes[i]]
 		startupNodes[indexes[i]] = startupNode
 	}
 	conn := proxy.NewValkeyConn(
-		config.BackendInitConnections,
-		config.BackendIdleConnections,
+		config.BackendConnections,
 		config.ConnectTimeout,
 		config.Password,
 		config.ReadPrefer != proxy.READ_PREFER_MASTER,
 	)
+	if err := conn.SetProtocol(config.BackendProtocol); err != nil {
+		glog.Exit(err)
+	}
+	if config.BackendTLS {
+		tlsConfig, err := proxy.NewClientTLSConfig(config.BackendTLSCACert, config.BackendTLSCert, config.BackendTLSKey, config.BackendTLSName, config.BackendTLSInsecure)
+		if err != nil {
+			glog.Exit(err)
+		}
+		conn.SetTLSConfig(tlsConfig)
+	}
 
 	dispatcher := proxy.NewDispatcher(startupNodes, config.SlotsReloadInterval, conn, config.ReadPrefer)
 	if err := dispatcher.InitSlotTable(); err != nil {
@@ -72,10 +74,226 @@ func main() {
 	}
 	go dispatcher.Run()
 
+	var tlsConfig *tls.Config
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		var err error
+		if tlsConfig, err = proxy.NewServerTLSConfig(config.TLSCertFile, config.TLSKeyFile, config.TLSCACertFile, config.TLSAuthClients); err != nil {
+			glog.Exit(err)
+		}
+	}
+
+	acl, err := loadACL(config, conn)
+	if err != nil {
+		glog.Exit(err)
+	}
+
+	var pp *proxy.ProxyProtocol
+	if config.ProxyProtocol != "" {
+		if pp, err = proxy.NewProxyProtocol(config.ProxyProtocol); err != nil {
+			glog.Exit(err)
+		}
+	}
+
+	var accessLog *proxy.AccessLog
+	if config.AccessLog != "" {
+		if accessLog, err = proxy.NewAccessLog(config.AccessLog, config.AccessLogSample, config.AccessLogCommands, config.AccessLogRedact); err != nil {
+			glog.Exit(err)
+		}
+	}
+
+	cache, err := config.cache()
+	if err != nil {
+		glog.Exit(err)
+	}
+
 	proxy := proxy.NewProxy(config.Addr, dispatcher, conn)
-	go proxy.Run()
+	if cache != nil {
+		proxy.SetCache(cache)
+	}
+	if tlsConfig != nil {
+		proxy.SetTLSConfig(tlsConfig)
+	}
+	proxy.SetACL(acl)
+	proxy.SlowLog().Configure(config.slowlogSlowerThan(), config.SlowlogMaxLen)
+	if pp != nil {
+		proxy.SetProxyProtocol(pp)
+	}
+	if accessLog != nil {
+		proxy.SetAccessLog(accessLog)
+	}
+	perm, _ := config.unixSocketPerm()
+	proxy.SetUnixSocketPerm(perm)
+	uid, gid, err := config.unixSocketOwner()
+	if err != nil {
+		glog.Exit(fmt.Errorf("invalid unix socket owner %s, err=%v", config.UnixSocketOwner, err))
+	}
+	proxy.SetUnixSocketOwner(uid, gid)
+	listeners, err := inheritedListeners()
+	if err != nil {
+		glog.Exit(err)
+	}
+	proxy.SetListenerFiles(listeners)
+	if err := proxy.Listen(); err != nil {
+		glog.Fatal(err)
+	}
+	go proxy.Serve()
+
+	upgrading := listeners != nil
+	if config.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", proxy.ServeMetrics)
+		go listenAndServe(config.MetricsAddr, mux, upgrading)
+	}
+	if config.DebugAddr != "" {
+		go listenAndServe(config.DebugAddr, proxy.AdminHandler(), upgrading)
+	}
+	if upgrading {
+		notifyReady()
+	}
 
-	sig := <-sigChan
-	glog.Infof("terminated by %#v", sig)
-	proxy.Exit()
+	if config.ConfigFile != "" {
+		r := &reloader{config: config, conn: conn, dispatcher: dispatcher, proxy: proxy}
+		go r.watch()
+	}
+
+	upgrade := notifyUpgrade()
+	for {
+		select {
+		case <-upgrade:
+			glog.Infof("upgrade binary")
+			if err := upgradeBinary(proxy); err != nil {
+				glog.Errorf("upgrade binary failed, keep serving, err=%v", err)
+				continue
+			}
+			glog.Infof("upgraded, shutdown in %v", config.ShutdownGracePeriod)
+		case sig := <-sigChan:
+			glog.Infof("terminated by %#v, shutdown in %v", sig, config.ShutdownGracePeriod)
+		}
+		break
+	}
+	done := make(chan struct{})
+	go func() {
+		proxy.Shutdown(config.ShutdownGracePeriod)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case sig := <-sigChan:
+		glog.Warningf("terminated by %#v again, exit immediately", sig)
+	}
+	glog.Flush()
+}
+
+// listenAndServe serves http on addr, the addr may be still held by the parent process
+// while upgrading binary, it's retried until the parent exits
+func listenAndServe(addr string, handler http.Handler, upgrading bool) {
+	for {
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			glog.Fatal(http.Serve(l, handler))
+		}
+		if !upgrading || !errors.Is(err, syscall.EADDRINUSE) {
+			glog.Fatal(err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// loadACL returns users of aclfile and the default user with password of backend server
+func loadACL(config *Config, conn *proxy.ValkeyConn) (*proxy.ACL, error) {
+	acl := proxy.NewACL(config.Password, conn)
+	if config.ACLFile != "" {
+		if err := acl.LoadACLFile(config.ACLFile, conn); err != nil {
+			return nil, fmt.Errorf("load acl file %s failed, err=%v", config.ACLFile, err)
+		}
+	}
+	return acl, nil
+}
+
+// reloader applies changes of the config file at runtime
+type reloader struct {
+	config     *Config
+	modTime    time.Time
+	conn       *proxy.ValkeyConn
+	dispatcher *proxy.Dispatcher
+	proxy      *proxy.Proxy
+}
+
+// watch reloads the config file on SIGHUP or once it's modified
+func (r *reloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(CONFIG_CHECK_INTERVAL)
+	defer ticker.Stop()
+	r.modTime = configModTime(r.config.ConfigFile)
+	for {
+		select {
+		case <-hup:
+			glog.Infof("reload config file %s on SIGHUP", r.config.ConfigFile)
+		case <-ticker.C:
+			modTime := configModTime(r.config.ConfigFile)
+			if !modTime.After(r.modTime) {
+				continue
+			}
+			glog.Infof("reload config file %s on changed", r.config.ConfigFile)
+		}
+		r.modTime = configModTime(r.config.ConfigFile)
+		r.reload()
+	}
+}
+
+func configModTime(file string) time.Time {
+	if info, err := os.Stat(file); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+// reload validates the config file and applies the settings changeable at runtime,
+// the others are reported to take effect after restart
+func (r *reloader) reload() {
+	config, err := loadConfig(r.config.ConfigFile, flag.CommandLine)
+	if err != nil {
+		glog.Errorf("reload config failed, keep current settings, err=%v", err)
+		return
+	}
+	// users are reloaded even if the file name is not changed
+	acl, err := loadACL(config, r.conn)
+	if err != nil {
+		glog.Errorf("reload config failed, keep current settings, err=%v", err)
+		return
+	}
+
+	current, currentFs := r.config.flagSet()
+	_, fs := config.flagSet()
+	var restart []string
+	for _, name := range r.config.diff(config) {
+		if !reloadableSettings[name] {
+			restart = append(restart, name)
+			continue
+		}
+		// replicas can't be read from by connections which didn't send READONLY once connected
+		if name == "read-prefer" && config.ReadPrefer != proxy.READ_PREFER_MASTER && !r.conn.SendReadOnly() {
+			restart = append(restart, name)
+			continue
+		}
+		currentFs.Set(name, fs.Lookup(name).Value.String())
+		glog.Infof("setting %s changed", name)
+	}
+	r.conn.SetPassword(current.Password)
+	r.conn.SetConnTimeout(current.ConnectTimeout)
+	r.dispatcher.SetStartupNodes(current.startupNodes())
+	if current.ReadPrefer != r.config.ReadPrefer {
+		r.dispatcher.SetReadPrefer(current.ReadPrefer)
+	}
+	if current.BackendConnections != r.config.BackendConnections {
+		r.dispatcher.SetBackendConnections(current.BackendConnections)
+	}
+	runtime.GOMAXPROCS(current.MaxProcs)
+	r.proxy.SetACL(acl)
+	r.proxy.SlowLog().Configure(current.slowlogSlowerThan(), current.SlowlogMaxLen)
+	r.config = current
+	if len(restart) > 0 {
+		glog.Warningf("settings changed but require restart to take effect: %s", strings.Join(restart, ", "))
+	}
 }
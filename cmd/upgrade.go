@@ -0,0 +1,157 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/drycc-addons/valkey-cluster-proxy/proxy"
+	"github.com/golang/glog"
+)
+
+const (
+	// environment variables telling the new process which inherited fds are the listener
+	// sockets and the pipe to report it's ready on, listeners are given as addr=fd,addr=fd
+	LISTENER_FDS_ENV = "VALKEY_PROXY_LISTENER_FDS"
+	READY_FD_ENV     = "VALKEY_PROXY_READY_FD"
+	// max time to wait for the new process to be ready before giving up upgrading
+	UPGRADE_READY_TIMEOUT = 30 * time.Second
+)
+
+// notifyUpgrade returns the channel notified on SIGUSR2 to upgrade binary
+func notifyUpgrade() <-chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	return c
+}
+
+// inheritedListeners returns the listener sockets by addr passed by the parent process, nil if not upgrading
+func inheritedListeners() (map[string]*os.File, error) {
+	value, ok := os.LookupEnv(LISTENER_FDS_ENV)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(LISTENER_FDS_ENV)
+	files := make(map[string]*os.File)
+	for _, listener := range strings.Split(value, ",") {
+		i := strings.LastIndexByte(listener, '=')
+		fd, err := strconv.Atoi(listener[i+1:])
+		if i <= 0 || err != nil || fd < 3 {
+			return nil, fmt.Errorf("invalid %s %q", LISTENER_FDS_ENV, value)
+		}
+		files[listener[:i]] = os.NewFile(uintptr(fd), listener[:i])
+		glog.Infof("listener %s inherited from parent process %d", listener[:i], os.Getppid())
+	}
+	return files, nil
+}
+
+// notifyReady tells the parent process it can drain its sessions and exit
+func notifyReady() {
+	f, err := inheritedFile(READY_FD_ENV, "ready")
+	if err != nil {
+		glog.Error(err)
+	}
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		glog.Errorf("notify parent process ready failed, err=%v", err)
+	}
+}
+
+func inheritedFile(env, name string) (*os.File, error) {
+	value, ok := os.LookupEnv(env)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(env)
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 3 {
+		return nil, fmt.Errorf("invalid %s %q", env, value)
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+/*
+upgradeBinary starts the binary of the same path with the same arguments, which
+accepts connections on the listener sockets of p as well. It returns once the new
+process is ready, so that the caller drains its sessions and exits. The current
+process keeps serving if the new one fails to start or exits before ready.
+*/
+func upgradeBinary(p *proxy.Proxy) error {
+	listeners, err := p.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range listeners {
+			f.Close()
+		}
+	}()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		w.Close()
+		return err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// ExtraFiles[i] is fd 3+i of the new process
+	var fds []string
+	for addr, f := range listeners {
+		fds = append(fds, fmt.Sprintf("%s=%d", addr, 3+len(cmd.ExtraFiles)))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, LISTENER_FDS_ENV+"=") && !strings.HasPrefix(env, READY_FD_ENV+"=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		LISTENER_FDS_ENV+"="+strings.Join(fds, ","),
+		fmt.Sprintf("%s=%d", READY_FD_ENV, 3+len(cmd.ExtraFiles)))
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	glog.Infof("started new process %d of %s", cmd.Process.Pid, path)
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			ready <- fmt.Errorf("new process exited before ready")
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(UPGRADE_READY_TIMEOUT):
+		err = fmt.Errorf("new process is not ready in %v", UPGRADE_READY_TIMEOUT)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	// reap the new process if it exits while this one is draining
+	go cmd.Wait()
+	return nil
+}
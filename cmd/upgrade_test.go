@@ -0,0 +1,54 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestInheritedListeners(t *testing.T) {
+	if files, err := inheritedListeners(); files != nil || err != nil {
+		t.Fatalf("expected no listener inherited, got %v %v", files, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	os.Setenv(LISTENER_FDS_ENV, "unix:/run/a=b.sock="+strconv.Itoa(int(f.Fd())))
+	files, err := inheritedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := os.LookupEnv(LISTENER_FDS_ENV); ok {
+		t.Error("expected env removed from children")
+	}
+	inherited := files["unix:/run/a=b.sock"]
+	if inherited == nil {
+		t.Fatalf("expected listener inherited by addr, got %v", files)
+	}
+	fl, err := net.FileListener(inherited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+	if fl.Addr().String() != l.Addr().String() {
+		t.Errorf("expected listener on %s, got %s", l.Addr(), fl.Addr())
+	}
+
+	for _, value := range []string{"0.0.0.0:8088=1", "0.0.0.0:8088", "=3"} {
+		os.Setenv(LISTENER_FDS_ENV, value)
+		if _, err := inheritedListeners(); err == nil {
+			t.Errorf("expected %q refused", value)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/drycc-addons/valkey-cluster-proxy/proxy"
+)
+
+// binary upgrade is not supported on windows, which can not pass sockets to child process
+
+func notifyUpgrade() <-chan os.Signal {
+	return nil
+}
+
+func inheritedListeners() (map[string]*os.File, error) {
+	return nil, nil
+}
+
+func notifyReady() {}
+
+func upgradeBinary(p *proxy.Proxy) error {
+	return fmt.Errorf("binary upgrade is not supported on windows")
+}
@@ -48,3 +48,8 @@ func ApplySocketOptions(lc *ListenConfig) controlFunc {
 		return err
 	}
 }
+
+// umask sets the file mode creation mask of the process and returns the previous one
+func umask(mask int) int {
+	return syscall.Umask(mask)
+}
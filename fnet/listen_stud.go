@@ -13,3 +13,8 @@ type controlFunc func(network, address string, c syscall.RawConn) error
 func ApplySocketOptions(_ *ListenConfig) controlFunc {
 	return nil
 }
+
+// umask sets the file mode creation mask of the process and returns the previous one
+func umask(mask int) int {
+	return syscall.Umask(mask)
+}
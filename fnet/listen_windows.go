@@ -35,3 +35,8 @@ func ApplySocketOptions(lc *ListenConfig) controlFunc {
 		return err
 	}
 }
+
+// umask does nothing since there is no file mode creation mask on windows
+func umask(_ int) int {
+	return 0
+}
@@ -13,11 +13,15 @@ package fnet
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/maurice2k/ultrapool"
@@ -25,9 +29,9 @@ import (
 
 // Server struct
 type Server struct {
-	listenAddr           *net.TCPAddr
-	listener             *net.TCPListener
-	shutdown             bool
+	listenAddr           net.Addr
+	listener             net.Listener
+	shutdown             atomic.Bool
 	shutdownDeadline     time.Time
 	requestHandler       RequestHandlerFunc
 	connectionCreator    ConnectionCreatorFunc
@@ -44,8 +48,14 @@ type Server struct {
 	wp                   *ultrapool.WorkerPool
 	allowThreadLocking   bool
 	ballast              []byte
+	unixSocketPerm       os.FileMode
+	unixSocketUID        int
+	unixSocketGID        int
 }
 
+// guards the file mode creation mask of the process changed while creating unix sockets
+var umaskLock sync.Mutex
+
 // Connection interface
 type Connection interface {
 	net.Conn
@@ -99,17 +109,25 @@ var defaultListenConfig *ListenConfig = &ListenConfig{
 	SocketReusePort: true,
 }
 
-// Creates a new server instance
+// Creates a new server instance, listenAddr prefixed with "unix:" is the path of an unix socket
 func NewServer(listenAddr string) (*Server, error) {
-	la, err := net.ResolveTCPAddr("tcp", listenAddr)
-	if err != nil {
-		return nil, fmt.Errorf("error resolving address '%s': %s", listenAddr, err)
+	var la net.Addr
+	if path, ok := strings.CutPrefix(listenAddr, "unix:"); ok {
+		la = &net.UnixAddr{Name: path, Net: "unix"}
+	} else {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", listenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving address '%s': %s", listenAddr, err)
+		}
+		la = tcpAddr
 	}
 	var s *Server
 
 	s = &Server{
-		listenAddr:   la,
-		listenConfig: defaultListenConfig,
+		listenAddr:    la,
+		listenConfig:  defaultListenConfig,
+		unixSocketUID: -1,
+		unixSocketGID: -1,
 		connStructPool: sync.Pool{
 			New: func() interface{} {
 				conn := s.connectionCreator()
@@ -160,8 +178,11 @@ func (s *Server) GetListenConfig() *ListenConfig {
 
 // Starts listening
 func (s *Server) Listen() (err error) {
+	if ua, ok := s.listenAddr.(*net.UnixAddr); ok {
+		return s.listenUnix(ua.Name)
+	}
 	network := "tcp4"
-	if IsIPv6Addr(s.listenAddr) {
+	if IsIPv6Addr(s.listenAddr.(*net.TCPAddr)) {
 		network = "tcp6"
 	}
 
@@ -179,6 +200,68 @@ func (s *Server) Listen() (err error) {
 	return nil
 }
 
+// Sets permission and owner of the unix socket created by Listen, perm 0 keeps the one
+// given by umask, uid or gid -1 keeps it unchanged
+func (s *Server) SetUnixSocketMode(perm os.FileMode, uid, gid int) {
+	s.unixSocketPerm, s.unixSocketUID, s.unixSocketGID = perm, uid, gid
+}
+
+// Starts listening on unix socket path, a socket file left by previous run is removed,
+// while the one a live process listens on is refused. Socket options of listen config
+// only apply to TCP.
+//
+// If permission or owner is set, the socket is created accessible by the process only,
+// and is not opened to others until its owner and permission are changed.
+func (s *Server) listenUnix(path string) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return fmt.Errorf("unix socket %s is in use by another process", path)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	restricted := s.unixSocketPerm != 0 || s.unixSocketUID != -1 || s.unixSocketGID != -1
+	var lc net.ListenConfig
+	var mask int
+	if restricted {
+		umaskLock.Lock()
+		mask = umask(0177)
+	}
+	l, err := lc.Listen(*s.GetContext(), "unix", path)
+	if restricted {
+		umask(mask)
+		umaskLock.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+	if restricted {
+		perm := s.unixSocketPerm
+		if perm == 0 {
+			perm = os.FileMode(0777 &^ mask)
+		}
+		// change owner first, so that permission is never granted to the previous group
+		if s.unixSocketUID != -1 || s.unixSocketGID != -1 {
+			err = os.Chown(path, s.unixSocketUID, s.unixSocketGID)
+		}
+		if err == nil {
+			err = os.Chmod(path, perm)
+		}
+		if err != nil {
+			l.Close()
+			return err
+		}
+	}
+	s.listener = l
+	return nil
+}
+
 // Starts listening using TLS
 func (s *Server) ListenTLS() (err error) {
 	err = s.EnableTLS()
@@ -188,6 +271,40 @@ func (s *Server) ListenTLS() (err error) {
 	return s.Listen()
 }
 
+// Starts listening on an inherited listener socket, eg. passed by the parent process
+func (s *Server) ListenFile(f *os.File) error {
+	l, err := net.FileListener(f)
+	if err != nil {
+		return err
+	}
+	switch l := l.(type) {
+	case *net.TCPListener:
+	case *net.UnixListener:
+		// the socket file is taken over from the other process
+		l.SetUnlinkOnClose(true)
+	default:
+		l.Close()
+		return fmt.Errorf("listener must be of type net.TCPListener or net.UnixListener")
+	}
+	s.listener = l
+	s.listenAddr = l.Addr()
+	return nil
+}
+
+// Returns a duplicate of the listener socket to be passed to another process,
+// closing either of them does not affect the other
+func (s *Server) ListenerFile() (*os.File, error) {
+	switch l := s.listener.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		// the socket file is still used by the other process
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	}
+	return nil, fmt.Errorf("no valid listener found; call Listen() or ListenTLS() first")
+}
+
 // Sets maximum number of connections that are being accepted before the
 // server automatically shutdowns
 func (s *Server) SetMaxAcceptConnections(limit int32) {
@@ -196,20 +313,20 @@ func (s *Server) SetMaxAcceptConnections(limit int32) {
 
 // Returns number of currently active connections
 func (s *Server) GetActiveConnections() int32 {
-	return s.activeConnections
+	return atomic.LoadInt32(&s.activeConnections)
 }
 
 // Returns number of accepted connections
 func (s *Server) GetAcceptedConnections() int32 {
-	return s.acceptedConnections
+	return atomic.LoadInt32(&s.acceptedConnections)
 }
 
-// Returns listening address
-func (s *Server) GetListenAddr() *net.TCPAddr {
+// Returns listening address, either *net.TCPAddr or *net.UnixAddr
+func (s *Server) GetListenAddr() net.Addr {
 	if s.listener == nil {
 		return nil
 	}
-	return s.listener.Addr().(*net.TCPAddr)
+	return s.listener.Addr()
 }
 
 // Gracefully shutdown server but wait no longer than d for active connections.
@@ -219,7 +336,7 @@ func (s *Server) Shutdown(d time.Duration) (err error) {
 	if d > 0 {
 		s.shutdownDeadline = time.Now().Add(d)
 	}
-	s.shutdown = true
+	s.shutdown.Store(true)
 	err = s.listener.Close()
 	if err != nil {
 		return err
@@ -267,7 +384,7 @@ func (s *Server) Serve() error {
 		}
 	}
 
-	if s.activeConnections == 0 {
+	if atomic.LoadInt32(&s.activeConnections) == 0 {
 		return nil
 	}
 
@@ -342,7 +459,7 @@ func (s *Server) SetBallast(sizeInMiB int) {
 func (s *Server) acceptLoop(_ int) error {
 	var (
 		tempDelay time.Duration
-		tcpConn   net.Conn
+		conn      net.Conn
 		err       error
 	)
 
@@ -351,12 +468,12 @@ func (s *Server) acceptLoop(_ int) error {
 			s.Shutdown(0)
 		}
 
-		if s.shutdown {
+		if s.shutdown.Load() {
 			_ = s.listener.Close()
 			break
 		}
 
-		tcpConn, err = s.listener.AcceptTCP()
+		conn, err = s.listener.Accept()
 		if err != nil {
 			if opErr, ok := err.(*net.OpError); ok {
 
@@ -365,7 +482,7 @@ func (s *Server) acceptLoop(_ int) error {
 					continue
 				}
 
-				if !(opErr.Temporary() && opErr.Timeout()) && s.shutdown {
+				if !(opErr.Temporary() && opErr.Timeout()) && s.shutdown.Load() {
 					break
 				}
 
@@ -398,13 +515,13 @@ func (s *Server) acceptLoop(_ int) error {
 			// the fact that we use multiple accept loops without locking.
 			// In this case we just close the connection (we shouldn't have accepted
 			// in the first place) and continue for shutting down the server.
-			tcpConn.Close()
+			conn.Close()
 			continue
 		}
 
-		s.wp.AddTask(tcpConn)
-		//go s.serveConn(tcpConn)
-		tcpConn = nil
+		s.wp.AddTask(conn)
+		//go s.serveConn(conn)
+		conn = nil
 	}
 	return nil
 }
@@ -429,14 +546,16 @@ func (s *Server) serveConn(task ultrapool.Task) {
 	s.connStructPool.Put(conn)
 }
 
-// Returns client IP and port
+// Returns client IP and port, nil if accepted on unix socket
 func (conn *TCPConn) GetClientAddr() *net.TCPAddr {
-	return conn.RemoteAddr().(*net.TCPAddr)
+	addr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	return addr
 }
 
-// Returns server IP and port (the addr the connection was accepted at)
+// Returns server IP and port (the addr the connection was accepted at), nil if accepted on unix socket
 func (conn *TCPConn) GetServerAddr() *net.TCPAddr {
-	return conn.LocalAddr().(*net.TCPAddr)
+	addr, _ := conn.LocalAddr().(*net.TCPAddr)
+	return addr
 }
 
 // Returns start timestamp
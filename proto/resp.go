@@ -16,6 +16,24 @@ const (
 	T_Integer      = ':'
 	T_BulkString   = '$'
 	T_Array        = '*'
+
+	// RESP3 types
+	T_Null           = '_'
+	T_Double         = ','
+	T_Boolean        = '#'
+	T_BlobError      = '!'
+	T_VerbatimString = '='
+	T_BigNumber      = '('
+	T_Map            = '%'
+	T_Set            = '~'
+	T_Attribute      = '|'
+	T_Push           = '>'
+)
+
+// protocol versions negotiated with HELLO
+const (
+	RESP2 = 2
+	RESP3 = 3
 )
 
 var (
@@ -122,31 +140,55 @@ func ReadCommand(r *bufio.Reader) (*Command, error) {
 	return NewCommand(commandArgs...)
 }
 
-// a resp package
+/*
+a resp package
+
+RESP3 types are mapped onto the same fields:
+  - Map and Attribute keep their key/value pairs flattened in Array
+  - Set and Push keep their elements in Array
+  - Double, BigNumber, VerbatimString and BlobError keep their payload in String
+  - Boolean keeps 1 or 0 in Integer
+
+Attrs holds the flattened attribute pairs sent before the value, if any.
+*/
 type Data struct {
 	T       byte
 	String  []byte
 	Integer int64
 	Array   []*Data
 	IsNil   bool
+	Attrs   []*Data
 }
 
 // format Data into resp string
 func (d Data) Format() []byte {
 	ret := new(bytes.Buffer)
+	d.writeTo(ret)
+	return ret.Bytes()
+}
+
+func (d Data) writeTo(ret *bytes.Buffer) {
+	if len(d.Attrs) > 0 {
+		ret.WriteByte(T_Attribute)
+		ret.WriteString(strconv.Itoa(len(d.Attrs) / 2))
+		ret.Write(CRLF)
+		for index := range d.Attrs {
+			d.Attrs[index].writeTo(ret)
+		}
+	}
 
 	ret.WriteByte(d.T)
 	if d.IsNil {
 		ret.WriteString("-1")
 		ret.Write(CRLF)
-		return ret.Bytes()
+		return
 	}
 
 	switch d.T {
-	case T_SimpleString, T_Error:
+	case T_SimpleString, T_Error, T_Double, T_BigNumber:
 		ret.Write(d.String)
 		ret.Write(CRLF)
-	case T_BulkString:
+	case T_BulkString, T_BlobError, T_VerbatimString:
 		ret.WriteString(strconv.Itoa(len(d.String)))
 		ret.Write(CRLF)
 		ret.Write(d.String)
@@ -154,14 +196,120 @@ func (d Data) Format() []byte {
 	case T_Integer:
 		ret.WriteString(strconv.FormatInt(d.Integer, 10))
 		ret.Write(CRLF)
-	case T_Array:
+	case T_Boolean:
+		if d.Integer != 0 {
+			ret.WriteByte('t')
+		} else {
+			ret.WriteByte('f')
+		}
+		ret.Write(CRLF)
+	case T_Null:
+		ret.Write(CRLF)
+	case T_Array, T_Set, T_Push:
 		ret.WriteString(strconv.Itoa(len(d.Array)))
 		ret.Write(CRLF)
 		for index := range d.Array {
-			ret.Write(d.Array[index].Format())
+			d.Array[index].writeTo(ret)
+		}
+	case T_Map, T_Attribute:
+		ret.WriteString(strconv.Itoa(len(d.Array) / 2))
+		ret.Write(CRLF)
+		for index := range d.Array {
+			d.Array[index].writeTo(ret)
 		}
 	}
-	return ret.Bytes()
+}
+
+// IsError reports whether the data is a simple or a blob error
+func (d *Data) IsError() bool {
+	return d.T == T_Error || d.T == T_BlobError
+}
+
+// Downgrade converts RESP3 data into its RESP2 equivalent the same way valkey does
+// for clients that did not negotiate RESP3, attributes are dropped. Null becomes a nil
+// bulk string, callers knowing the command turn it into a nil array where it replies one
+func (d *Data) Downgrade() *Data {
+	ret := &Data{T: d.T, String: d.String, Integer: d.Integer, IsNil: d.IsNil}
+	switch d.T {
+	case T_Null:
+		ret.T = T_BulkString
+		ret.IsNil = true
+	case T_Double, T_BigNumber:
+		ret.T = T_BulkString
+	case T_VerbatimString:
+		ret.T = T_BulkString
+		// strip the three bytes format and the colon, eg. "txt:"
+		if len(d.String) >= 4 {
+			ret.String = d.String[4:]
+		}
+	case T_BlobError:
+		ret.T = T_Error
+	case T_Boolean:
+		ret.T = T_Integer
+	case T_Map, T_Set, T_Push, T_Attribute:
+		ret.T = T_Array
+	}
+	if d.Array != nil {
+		ret.Array = make([]*Data, len(d.Array))
+		for index := range d.Array {
+			ret.Array[index] = d.Array[index].Downgrade()
+		}
+	}
+	return ret
+}
+
+// IsProtocolNeutral reports whether raw is a single data encoded the same in RESP2 and
+// RESP3, which is made of simple strings, errors, integers, bulk strings and arrays that
+// are not nil, so that it needs no conversion between the protocols
+func IsProtocolNeutral(raw []byte) bool {
+	rest, ok := skipNeutral(raw)
+	return ok && len(rest) == 0
+}
+
+// skipNeutral returns the bytes following the protocol neutral data at the start of raw
+func skipNeutral(raw []byte) ([]byte, bool) {
+	end := bytes.IndexByte(raw, '\n')
+	if end < 2 || raw[end-1] != '\r' {
+		return nil, false
+	}
+	line, rest := raw[:end-1], raw[end+1:]
+	switch line[0] {
+	case T_SimpleString, T_Error, T_Integer:
+		return rest, true
+	case T_BulkString:
+		n, ok := parseLen(line[1:])
+		if !ok || len(rest) < n+2 {
+			return nil, false
+		}
+		return rest[n+2:], true
+	case T_Array:
+		n, ok := parseLen(line[1:])
+		if !ok {
+			return nil, false
+		}
+		for i := 0; i < n; i++ {
+			if rest, ok = skipNeutral(rest); !ok {
+				return nil, false
+			}
+		}
+		return rest, true
+	}
+	return nil, false
+}
+
+// parseLen parses the length of a bulk string or an array, which is not nil
+func parseLen(b []byte) (int, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' || n > (1<<31)/10 {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
 }
 
 // get a data from bufio.Reader
@@ -171,7 +319,8 @@ func ReadData(r *bufio.Reader) (*Data, error) {
 		return nil, err
 	}
 
-	if len(buf) < 2 {
+	// RESP3 null is a single type byte
+	if len(buf) < 2 && (len(buf) == 0 || buf[0] != T_Null) {
 		return nil, errors.New("invalid Data Source: " + string(buf))
 	}
 
@@ -188,34 +337,52 @@ func readDataForSpecType(r *bufio.Reader, line []byte) (*Data, error) {
 		ret.T = T_SimpleString
 		ret.String = line[1:]
 
-	case T_Error:
-		ret.T = T_Error
+	case T_Error, T_Double, T_BigNumber:
+		ret.T = line[0]
 		ret.String = line[1:]
 
 	case T_Integer:
 		ret.T = T_Integer
 		ret.Integer, err = strconv.ParseInt(string(line[1:]), 10, 64)
 
-	case T_BulkString:
+	case T_Boolean:
+		ret.T = T_Boolean
+		switch string(line[1:]) {
+		case "t":
+			ret.Integer = 1
+		case "f":
+		default:
+			err = errProtocol
+		}
+
+	case T_Null:
+		ret.T = T_Null
+
+	case T_BulkString, T_BlobError, T_VerbatimString:
 		var lenBulkString int64
 		lenBulkString, err = strconv.ParseInt(string(line[1:]), 10, 64)
-		ret.T = T_BulkString
-		if lenBulkString != -1 {
-			data := make([]byte, lenBulkString+2)
-			readRespN(r, &data)
-			ret.String = data[:lenBulkString]
-		} else {
-			ret.IsNil = true
+		ret.T = line[0]
+		if nil == err {
+			if lenBulkString != -1 {
+				data := make([]byte, lenBulkString+2)
+				err = readRespN(r, &data)
+				ret.String = data[:lenBulkString]
+			} else {
+				ret.IsNil = true
+			}
 		}
 
-	case T_Array:
+	case T_Array, T_Set, T_Push, T_Map, T_Attribute:
 		var lenArray int64
 		var i int64
 		lenArray, err = strconv.ParseInt(string(line[1:]), 10, 64)
 
-		ret.T = T_Array
+		ret.T = line[0]
 		if nil == err {
 			if lenArray != -1 {
+				if ret.T == T_Map || ret.T == T_Attribute {
+					lenArray *= 2
+				}
 				ret.Array = make([]*Data, lenArray)
 				for i = 0; i < lenArray && nil == err; i++ {
 					ret.Array[i], err = ReadData(r)
@@ -224,6 +391,14 @@ func readDataForSpecType(r *bufio.Reader, line []byte) (*Data, error) {
 				ret.IsNil = true
 			}
 		}
+		// an attribute is an out of band reply decorating the value that follows it
+		if nil == err && ret.T == T_Attribute {
+			var value *Data
+			if value, err = ReadData(r); nil == err {
+				value.Attrs = append(ret.Array, value.Attrs...)
+				ret = value
+			}
+		}
 
 	default: //Maybe you are Inline Command
 		err = errors.New("unexpected type ")
@@ -234,9 +409,9 @@ func readDataForSpecType(r *bufio.Reader, line []byte) (*Data, error) {
 
 func readDataBytesForSpecType(r *bufio.Reader, line []byte, obj *Object) error {
 	switch line[0] {
-	case T_SimpleString, T_Error, T_Integer:
+	case T_SimpleString, T_Error, T_Integer, T_Double, T_Boolean, T_BigNumber, T_Null:
 		return nil
-	case T_BulkString:
+	case T_BulkString, T_BlobError, T_VerbatimString:
 		lenBulkString, err := strconv.ParseInt(string(line[1:]), 10, 64)
 		if err != nil {
 			return err
@@ -252,11 +427,14 @@ func readDataBytesForSpecType(r *bufio.Reader, line []byte, obj *Object) error {
 		}
 		// else if nil
 
-	case T_Array:
+	case T_Array, T_Set, T_Push, T_Map, T_Attribute:
 		lenArray, err := strconv.ParseInt(string(line[1:]), 10, 64)
 		if err != nil {
 			return err
 		}
+		if line[0] == T_Map || line[0] == T_Attribute {
+			lenArray *= 2
+		}
 		var i int64
 		if lenArray != -1 {
 			for i = 0; i < lenArray; i++ {
@@ -267,6 +445,11 @@ func readDataBytesForSpecType(r *bufio.Reader, line []byte, obj *Object) error {
 		}
 		// else is nil
 
+		// the value decorated by the attribute belongs to the same object
+		if line[0] == T_Attribute {
+			return ReadDataBytes(r, obj)
+		}
+
 	default:
 		return errors.New("unexpected type ")
 	}
@@ -352,7 +535,7 @@ func ReadDataBytes(r *bufio.Reader, obj *Object) error {
 		return err
 	}
 
-	if len(buf) < 2 {
+	if len(buf) < 2 && (len(buf) == 0 || buf[0] != T_Null) {
 		return errors.New("invalid Data Source: " + string(buf))
 	}
 
@@ -26,6 +26,33 @@ var (
 
 	respArray     = Data{T: T_Array, Array: []*Data{&respSimpleString, &respInteger}}
 	respArrayText = "*2\r\n" + respSimpleStringText + respIntegerText
+
+	respNull     = Data{T: T_Null}
+	respNullText = "_\r\n"
+
+	respDouble     = Data{T: T_Double, String: []byte("3.14")}
+	respDoubleText = ",3.14\r\n"
+
+	respBoolean     = Data{T: T_Boolean, Integer: 1}
+	respBooleanText = "#t\r\n"
+
+	respBigNumber     = Data{T: T_BigNumber, String: []byte("3492890328409238509324850943850943825024385")}
+	respBigNumberText = "(3492890328409238509324850943850943825024385\r\n"
+
+	respBlobError     = Data{T: T_BlobError, String: []byte("SYNTAX invalid syntax")}
+	respBlobErrorText = "!21\r\nSYNTAX invalid syntax\r\n"
+
+	respVerbatim     = Data{T: T_VerbatimString, String: []byte("txt:Some string")}
+	respVerbatimText = "=15\r\ntxt:Some string\r\n"
+
+	respMap     = Data{T: T_Map, Array: []*Data{&respSimpleString, &respInteger, &respBulkString, &respBoolean}}
+	respMapText = "%2\r\n" + respSimpleStringText + respIntegerText + respBulkStringText + respBooleanText
+
+	respSet     = Data{T: T_Set, Array: []*Data{&respBulkString, &respDouble}}
+	respSetText = "~2\r\n" + respBulkStringText + respDoubleText
+
+	respPush     = Data{T: T_Push, Array: []*Data{&respBulkString, &respNull}}
+	respPushText = ">2\r\n" + respBulkStringText + respNullText
 )
 
 var validCommand map[string]string
@@ -165,6 +192,85 @@ func TestReadDataBytes(t *testing.T) {
 	}
 }
 
+func TestReadAttribute(t *testing.T) {
+	text := "|1\r\n+key-popularity\r\n%1\r\n$1\r\na\r\n,0.1923\r\n*2\r\n:2039123\r\n:9543892\r\n"
+	d, err := ReadData(bufio.NewReader(bytes.NewBufferString(text)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.T != T_Array || len(d.Array) != 2 || len(d.Attrs) != 2 {
+		t.Errorf("unexpected attribute decorated data: %v", d)
+	}
+	if string(d.Format()) != text {
+		t.Errorf("expected: %q, got: %q", text, d.Format())
+	}
+
+	o := NewObject()
+	if err := ReadDataBytes(bufio.NewReader(bytes.NewBufferString(text)), o); err != nil {
+		t.Fatal(err)
+	}
+	if string(o.Raw()) != text {
+		t.Errorf("expected: %q, got: %q", text, o.Raw())
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	cases := map[string]string{
+		respNullText:      respNilBulkStringText,
+		respDoubleText:    "$4\r\n3.14\r\n",
+		respBooleanText:   ":1\r\n",
+		respBlobErrorText: "-SYNTAX invalid syntax\r\n",
+		respVerbatimText:  "$11\r\nSome string\r\n",
+		respMapText:       "*4\r\n" + respSimpleStringText + respIntegerText + respBulkStringText + ":1\r\n",
+		respSetText:       "*2\r\n" + respBulkStringText + "$4\r\n3.14\r\n",
+		respArrayText:     respArrayText,
+	}
+	for text, expected := range cases {
+		d, err := ReadData(bufio.NewReader(bytes.NewBufferString(text)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(d.Downgrade().Format()); got != expected {
+			t.Errorf("expected: %q, got: %q", expected, got)
+		}
+	}
+}
+
+func TestIsProtocolNeutral(t *testing.T) {
+	cases := map[string]bool{
+		respSimpleStringText: true,
+		respErrorText:        true,
+		respIntegerText:      true,
+		respBulkStringText:   true,
+		respArrayText:        true,
+		"*0\r\n":             true,
+		"$0\r\n\r\n":         true,
+		"*2\r\n" + respArrayText + respBulkStringText: true,
+		respNilBulkStringText:                         false,
+		"*-1\r\n":                                     false,
+		"*2\r\n" + respBulkStringText + respNilBulkStringText: false,
+		respNullText:           false,
+		respDoubleText:         false,
+		respBooleanText:        false,
+		respBigNumberText:      false,
+		respBlobErrorText:      false,
+		respVerbatimText:       false,
+		respMapText:            false,
+		respSetText:            false,
+		respPushText:           false,
+		"*1\r\n" + respMapText: false,
+		// truncated or trailing data
+		"$6\r\nfoo\r\n":                   false,
+		"*2\r\n" + respIntegerText:        false,
+		respIntegerText + respIntegerText: false,
+	}
+	for text, expected := range cases {
+		if neutral := IsProtocolNeutral([]byte(text)); neutral != expected {
+			t.Errorf("expected %q neutral %v, got %v", text, expected, neutral)
+		}
+	}
+}
+
 func TestReadCommand(t *testing.T) {
 	r := bufio.NewReader(bytes.NewBufferString("\r\n"))
 	if _, err := ReadCommand(r); err != nil {
@@ -213,5 +319,14 @@ func init() {
 		respNilBulkStringText: respNilBulkString,
 		respIntegerText:       respInteger,
 		respArrayText:         respArray,
+		respNullText:          respNull,
+		respDoubleText:        respDouble,
+		respBooleanText:       respBoolean,
+		respBigNumberText:     respBigNumber,
+		respBlobErrorText:     respBlobError,
+		respVerbatimText:      respVerbatim,
+		respMapText:           respMap,
+		respSetText:           respSet,
+		respPushText:          respPush,
 	}
 }
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+const (
+	// number of entries queued to be written, entries are dropped once it's full
+	ACCESS_LOG_QUEUE_SIZE = 8192
+	// buffered entries are written to the file in this interval
+	ACCESS_LOG_FLUSH_INTERVAL = time.Second
+	ACCESS_LOG_BUFFER_SIZE    = 64 * 1024
+	// arguments logged of a command if not redacted, and bytes logged of each argument
+	ACCESS_LOG_MAX_ARGS       = 16
+	ACCESS_LOG_MAX_ARG_LENGTH = 64
+	// bytes logged of an error reply
+	ACCESS_LOG_MAX_ERROR_LENGTH = 128
+)
+
+// arguments of these commands are never logged since they may carry passwords
+var accessLogSecretCmds = map[string]bool{
+	"AUTH":    true,
+	"HELLO":   true,
+	"ACL":     true,
+	"CONFIG":  true,
+	"MIGRATE": true,
+}
+
+// names of reply types in access log by the first byte of reply
+var accessLogReplyTypes = map[byte]string{
+	resp.T_SimpleString:   "simple",
+	resp.T_Error:          "error",
+	resp.T_Integer:        "integer",
+	resp.T_BulkString:     "bulk",
+	resp.T_Array:          "array",
+	resp.T_Null:           "null",
+	resp.T_Double:         "double",
+	resp.T_Boolean:        "boolean",
+	resp.T_BlobError:      "error",
+	resp.T_VerbatimString: "verbatim",
+	resp.T_BigNumber:      "bignumber",
+	resp.T_Map:            "map",
+	resp.T_Set:            "set",
+	resp.T_Attribute:      "attribute",
+	resp.T_Push:           "push",
+}
+
+/*
+AccessLog writes a JSON line for each command replied, eg.
+
+	{"time":"2024-05-01T08:00:00.000001Z","id":12,"client":"10.0.0.5:52114","user":"default","cmd":"GET","argc":1,"slot":866,"backend":"10.0.1.2:7001","latency_us":312,"reply_type":"bulk","reply_size":11}
+
+Commands are sampled by rate, while commands replied with an error are always logged.
+Arguments are only counted unless redaction is disabled, and the ones of commands which
+may carry passwords are never logged. Entries are queued and written by a background
+goroutine in buffer, they are dropped rather than blocking sessions if the queue is full.
+*/
+type AccessLog struct {
+	w       io.WriteCloser
+	sample  float64
+	include map[string]bool
+	exclude map[string]bool
+	redact  bool
+	entries chan *AccessEntry
+	quit    chan struct{}
+	done    chan struct{}
+	closed  sync.Once
+	dropped atomic.Uint64
+}
+
+// AccessEntry is an entry of access log
+type AccessEntry struct {
+	Time      time.Time `json:"time"`
+	ID        int64     `json:"id"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Cmd       string    `json:"cmd"`
+	Argc      int       `json:"argc"`
+	Args      []string  `json:"args,omitempty"`
+	Slot      int       `json:"slot"`
+	Backend   string    `json:"backend,omitempty"`
+	LatencyUs int64     `json:"latency_us"`
+	ReplyType string    `json:"reply_type,omitempty"`
+	ReplySize int       `json:"reply_size"`
+	Error     string    `json:"error,omitempty"`
+}
+
+/*
+NewAccessLog returns the access log written to file, "-" for stdout. sample is the
+rate of commands logged in [0, 1]. commands is a comma separated list of command
+names to log, names prefixed with "-" are excluded, eg. "-PING,-INFO", all commands
+are logged if empty. redact omits argument values.
+*/
+func NewAccessLog(file string, sample float64, commands string, redact bool) (*AccessLog, error) {
+	if sample < 0 || sample > 1 {
+		return nil, fmt.Errorf("invalid sample rate %v", sample)
+	}
+	l := &AccessLog{
+		sample:  sample,
+		include: make(map[string]bool),
+		exclude: make(map[string]bool),
+		redact:  redact,
+		entries: make(chan *AccessEntry, ACCESS_LOG_QUEUE_SIZE),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, name := range strings.Split(commands, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if excluded, ok := strings.CutPrefix(name, "-"); ok {
+			l.exclude[excluded] = true
+		} else if name != "" {
+			l.include[name] = true
+		}
+	}
+	if file == "-" {
+		l.w = nopCloser{os.Stdout}
+	} else {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		l.w = f
+	}
+	go l.loop()
+	return l, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Sampled returns whether cmd is logged, a command replied with an error is
+// logged if filtered in even if not sampled
+func (l *AccessLog) Sampled(cmd *resp.Command, failed bool) bool {
+	if len(l.include) > 0 && !l.include[cmd.Name()] || l.exclude[cmd.Name()] {
+		return false
+	}
+	return failed || l.sample >= 1 || rand.Float64() < l.sample
+}
+
+// Log queues the entry of cmd to be written, the entry is dropped if the queue is full
+func (l *AccessLog) Log(cmd *resp.Command, entry *AccessEntry) {
+	entry.Cmd, entry.Argc = cmd.Name(), len(cmd.Args)-1
+	args := cmd.Args[1:]
+	if spec := (*commandTable.Load())[cmd.Name()]; spec != nil && len(spec.Subcommands) > 0 && len(args) > 0 {
+		entry.Cmd, entry.Argc = entry.Cmd+"|"+strings.ToUpper(args[0]), entry.Argc-1
+		args = args[1:]
+	}
+	if !l.redact && !accessLogSecretCmds[cmd.Name()] {
+		if len(args) > ACCESS_LOG_MAX_ARGS {
+			args = args[:ACCESS_LOG_MAX_ARGS]
+		}
+		entry.Args = make([]string, len(args))
+		for i, arg := range args {
+			if len(arg) > ACCESS_LOG_MAX_ARG_LENGTH {
+				arg = arg[:ACCESS_LOG_MAX_ARG_LENGTH] + "..."
+			}
+			entry.Args[i] = arg
+		}
+	}
+	select {
+	case l.entries <- entry:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of entries dropped since the queue is full
+func (l *AccessLog) Dropped() uint64 {
+	return l.dropped.Load()
+}
+
+func (l *AccessLog) loop() {
+	defer close(l.done)
+	w := bufio.NewWriterSize(l.w, ACCESS_LOG_BUFFER_SIZE)
+	enc := json.NewEncoder(w)
+	ticker := time.NewTicker(ACCESS_LOG_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-l.entries:
+			if err := enc.Encode(entry); err != nil {
+				glog.Errorf("write access log failed, err=%v", err)
+			}
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				glog.Errorf("write access log failed, err=%v", err)
+			}
+		case <-l.quit:
+			// entries queued before closing are still written
+			for len(l.entries) > 0 {
+				enc.Encode(<-l.entries)
+			}
+			if err := w.Flush(); err != nil {
+				glog.Errorf("write access log failed, err=%v", err)
+			}
+			l.w.Close()
+			return
+		}
+	}
+}
+
+// Close writes entries queued and closes the file, entries logged after are never written
+func (l *AccessLog) Close() {
+	l.closed.Do(func() {
+		close(l.quit)
+	})
+	<-l.done
+}
+
+// accessReplyType returns the name of reply type in access log
+func accessReplyType(reply []byte) string {
+	if len(reply) == 0 {
+		return ""
+	}
+	if prefix := string(reply[:min(3, len(reply))]); prefix == "$-1" || prefix == "*-1" {
+		return "null"
+	}
+	return accessLogReplyTypes[reply[0]]
+}
+
+// accessError returns the message of error reply logged
+func accessError(reply []byte) string {
+	msg := reply[1:]
+	if reply[0] == resp.T_BlobError {
+		// the message follows the length
+		if i := bytes.IndexByte(msg, '\n'); i >= 0 {
+			msg = msg[i+1:]
+		}
+	}
+	if i := bytes.IndexByte(msg, '\r'); i >= 0 {
+		msg = msg[:i]
+	}
+	if len(msg) > ACCESS_LOG_MAX_ERROR_LENGTH {
+		msg = msg[:ACCESS_LOG_MAX_ERROR_LENGTH]
+	}
+	return string(msg)
+}
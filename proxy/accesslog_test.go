@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func readAccessLog(t *testing.T, file string) []AccessEntry {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []AccessEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AccessEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid entry %q, err=%v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAccessLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewAccessLog(file, 0, "-PING", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get, _ := resp.NewCommand("GET", "user:1")
+	ping, _ := resp.NewCommand("PING")
+	if l.Sampled(get, false) {
+		t.Error("expected command not sampled at rate 0")
+	}
+	if !l.Sampled(get, true) {
+		t.Error("expected command replied with an error logged")
+	}
+	if l.Sampled(ping, true) {
+		t.Error("expected command excluded")
+	}
+
+	auth, _ := resp.NewCommand("AUTH", "user", "secret")
+	object, _ := resp.NewCommand("OBJECT", "encoding", "user:1")
+	l.Log(get, &AccessEntry{Slot: 1})
+	l.Log(auth, &AccessEntry{Slot: -1})
+	l.Log(object, &AccessEntry{Slot: 1})
+	l.Close()
+
+	entries := readAccessLog(t, file)
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", entries)
+	}
+	if entries[0].Cmd != "GET" || !reflect.DeepEqual(entries[0].Args, []string{"user:1"}) {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+	if entries[1].Cmd != "AUTH" || entries[1].Argc != 2 || entries[1].Args != nil {
+		t.Errorf("expected arguments of AUTH never logged, got %+v", entries[1])
+	}
+	if entries[2].Cmd != "OBJECT|ENCODING" || entries[2].Argc != 1 || !reflect.DeepEqual(entries[2].Args, []string{"user:1"}) {
+		t.Errorf("unexpected entry %+v", entries[2])
+	}
+}
+
+func TestSessionAccessLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewAccessLog(file, 1, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, client := net.Pipe()
+	defer conn.Close()
+	defer client.Close()
+	s := &Session{Conn: conn, id: 7, accessLog: l}
+	s.acl = NewACL("", NewValkeyConn(1, 0, "", false))
+	s.user.Store(s.acl.DefaultUser())
+
+	mget, _ := resp.NewCommand("MGET", "a", "b")
+	s.track(mget)
+	s.route(15495, "127.0.0.1:7001")
+	s.route(3300, "127.0.0.1:7002")
+	s.trackSeq(0, 1)
+	s.replied(&PipelineRequest{seq: 0}, []byte("*2\r\n$1\r\n1\r\n$-1\r\n"))
+	set, _ := resp.NewCommand("SET", "a", "1")
+	s.track(set)
+	s.route(15495, "127.0.0.1:7001")
+	s.trackSeq(1, 2)
+	s.replied(&PipelineRequest{seq: 1}, []byte("-OOM command not allowed\r\n"))
+	l.Close()
+
+	entries := readAccessLog(t, file)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+	e := entries[0]
+	if e.ID != 7 || e.User != "default" || e.Cmd != "MGET" || e.Argc != 2 || e.Args != nil || e.Slot != -1 ||
+		e.Backend != "127.0.0.1:7001,127.0.0.1:7002" || e.ReplyType != "array" || e.ReplySize != 16 || e.Error != "" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	e = entries[1]
+	if e.Slot != 15495 || e.ReplyType != "error" || e.Error != "OOM command not allowed" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
@@ -0,0 +1,482 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// name of the user sessions are authenticated as by AUTH <password>
+const ACL_DEFAULT_USER = "default"
+
+// access of key patterns
+const (
+	ACL_KEY_READ = 1 << iota
+	ACL_KEY_WRITE
+)
+
+var (
+	WRONGPASS_ERR      = []byte("WRONGPASS invalid username-password pair or user is disabled.")
+	NOPERM_KEY_ERR     = []byte("NOPERM No permissions to access a key")
+	NOPERM_CHANNEL_ERR = []byte("NOPERM No permissions to access a channel")
+)
+
+/*
+ACL users are described with a subset of valkey's ACL rules, one user per line
+the same as valkey's aclfile, eg.
+
+	user alice on >secret ~cache:* %R~config:* &news.* +@read +set -debug backend=team-a:secret
+
+on and off enable or disable the user. >password and <password add or remove a
+password, #sha256 and !sha256 a hashed one, nopass allows any password and resetpass
+removes all. ~pattern, %R~pattern, %W~pattern and %RW~pattern grant access to keys,
+allkeys is ~* and resetkeys revokes all. &pattern grants access to pub/sub channels,
+allchannels is &* and resetchannels revokes all, no channel is granted by default the same
+as valkey, and channels are never checked against key patterns, eg. of SSUBSCRIBE.
++command, -command, +command|subcommand and +@category, -@category allow or deny commands
+with later rules overriding earlier ones, allcommands is +@all and nocommands is -@all.
+Categories are all, read, write, keyspace, pubsub, blocking, transaction and connection.
+
+backend=user:password is specific to the proxy, backend connections of the user's
+sessions are authenticated as that ACL user instead of the password of backend server.
+*/
+type ACLUser struct {
+	Name       string
+	enabled    bool
+	nopass     bool
+	passwords  map[string]bool
+	commands   []aclCommandRule
+	keys       []aclKeyPattern
+	channels   []string
+	valkeyConn *ValkeyConn
+}
+
+type aclCommandRule struct {
+	allow    bool
+	category string
+	name     string
+	sub      string
+}
+
+type aclKeyPattern struct {
+	pattern string
+	access  int
+}
+
+// ACL holds proxy users, sessions authenticate with them and are restricted by their rules
+type ACL struct {
+	users map[string]*ACLUser
+}
+
+// NewACL creates an ACL of the default user with password and full permissions,
+// the default user needs no password if password is empty
+func NewACL(password string, valkeyConn *ValkeyConn) *ACL {
+	acl := &ACL{users: make(map[string]*ACLUser)}
+	rules := []string{"on", "~*", "&*", "+@all"}
+	if password == "" {
+		rules = append(rules, "nopass")
+	} else {
+		rules = append(rules, ">"+password)
+	}
+	user, _ := newACLUser(ACL_DEFAULT_USER, rules, valkeyConn)
+	acl.users[user.Name] = user
+	return acl
+}
+
+// LoadACLFile adds users in file to acl, the default user is replaced if defined in file.
+// Users mapped to backend users connect to backend servers with a copy of valkeyConn.
+func (acl *ACL) LoadACLFile(file string, valkeyConn *ValkeyConn) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return acl.Load(f, valkeyConn)
+}
+
+// Load adds users described in r to acl, see LoadACLFile
+func (acl *ACL) Load(r io.Reader, valkeyConn *ValkeyConn) error {
+	users := make(map[string]*ACLUser)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return fmt.Errorf("line %d: should start with user <name>", lineNum)
+		}
+		if _, ok := users[fields[1]]; ok {
+			return fmt.Errorf("line %d: duplicate user %s", lineNum, fields[1])
+		}
+		user, err := newACLUser(fields[1], fields[2:], valkeyConn)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		users[user.Name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for name, user := range users {
+		acl.users[name] = user
+	}
+	return nil
+}
+
+// Authenticate returns the enabled user matching name and password, nil if not matched
+func (acl *ACL) Authenticate(name, password string) *ACLUser {
+	user, ok := acl.users[name]
+	if !ok || !user.enabled {
+		return nil
+	}
+	if user.nopass || user.passwords[hashPassword(password)] {
+		return user
+	}
+	return nil
+}
+
+// DefaultUser returns the user new sessions are authenticated as, nil if a password is required
+func (acl *ACL) DefaultUser() *ACLUser {
+	if user, ok := acl.users[ACL_DEFAULT_USER]; ok && user.enabled && user.nopass {
+		return user
+	}
+	return nil
+}
+
+func newACLUser(name string, rules []string, valkeyConn *ValkeyConn) (*ACLUser, error) {
+	user := &ACLUser{Name: name, passwords: make(map[string]bool), valkeyConn: valkeyConn}
+	for _, rule := range rules {
+		if err := user.setRule(rule, valkeyConn); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+func (u *ACLUser) setRule(rule string, valkeyConn *ValkeyConn) error {
+	lower := strings.ToLower(rule)
+	switch {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = make(map[string]bool)
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = make(map[string]bool)
+	case strings.HasPrefix(rule, ">"):
+		u.nopass = false
+		u.passwords[hashPassword(rule[1:])] = true
+	case strings.HasPrefix(rule, "<"):
+		delete(u.passwords, hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "#"), strings.HasPrefix(rule, "!"):
+		hash := strings.ToLower(rule[1:])
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return fmt.Errorf("invalid password hash %s", rule)
+		}
+		if rule[0] == '#' {
+			u.nopass = false
+			u.passwords[hash] = true
+		} else {
+			delete(u.passwords, hash)
+		}
+	case lower == "allkeys":
+		u.keys = append(u.keys, aclKeyPattern{pattern: "*", access: ACL_KEY_READ | ACL_KEY_WRITE})
+	case lower == "resetkeys":
+		u.keys = nil
+	case strings.HasPrefix(rule, "~"):
+		u.keys = append(u.keys, aclKeyPattern{pattern: rule[1:], access: ACL_KEY_READ | ACL_KEY_WRITE})
+	case strings.HasPrefix(rule, "%"):
+		i := strings.Index(rule, "~")
+		if i < 0 {
+			return fmt.Errorf("invalid key pattern %s", rule)
+		}
+		access := 0
+		for _, c := range strings.ToUpper(rule[1:i]) {
+			switch c {
+			case 'R':
+				access |= ACL_KEY_READ
+			case 'W':
+				access |= ACL_KEY_WRITE
+			default:
+				return fmt.Errorf("invalid key pattern %s", rule)
+			}
+		}
+		if access == 0 {
+			return fmt.Errorf("invalid key pattern %s", rule)
+		}
+		u.keys = append(u.keys, aclKeyPattern{pattern: rule[i+1:], access: access})
+	case lower == "allchannels":
+		u.channels = append(u.channels, "*")
+	case lower == "resetchannels":
+		u.channels = nil
+	case strings.HasPrefix(rule, "&"):
+		u.channels = append(u.channels, rule[1:])
+	case lower == "allcommands":
+		u.commands = append(u.commands, aclCommandRule{allow: true, category: "all"})
+	case lower == "nocommands":
+		u.commands = append(u.commands, aclCommandRule{allow: false, category: "all"})
+	case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+		cr := aclCommandRule{allow: rule[0] == '+'}
+		if strings.HasPrefix(lower[1:], "@") {
+			cr.category = lower[2:]
+			if !aclCategories[cr.category] {
+				return fmt.Errorf("unknown command category %s", cr.category)
+			}
+		} else {
+			name, sub, _ := strings.Cut(rule[1:], "|")
+			if name == "" {
+				return fmt.Errorf("invalid command rule %s", rule)
+			}
+			cr.name, cr.sub = strings.ToUpper(name), strings.ToUpper(sub)
+		}
+		u.commands = append(u.commands, cr)
+	case strings.HasPrefix(lower, "backend="):
+		name, password, ok := strings.Cut(rule[len("backend="):], ":")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid backend user %s, should be backend=user:password", rule)
+		}
+		u.valkeyConn = valkeyConn.WithUser(name, password)
+	default:
+		return fmt.Errorf("unsupported rule %s", rule)
+	}
+	return nil
+}
+
+var aclCategories = map[string]bool{
+	"all":         true,
+	"read":        true,
+	"write":       true,
+	"keyspace":    true,
+	"pubsub":      true,
+	"blocking":    true,
+	"transaction": true,
+	"connection":  true,
+}
+
+// inCategory returns whether cmd belongs to the category
+func inCategory(cmd *resp.Command, spec *CommandSpec, category string) bool {
+	switch category {
+	case "all":
+		return true
+	case "read":
+		return spec != nil && spec.Flags&COMMAND_FLAG_READONLY != 0
+	case "write":
+		return spec != nil && spec.Flags&COMMAND_FLAG_WRITE != 0
+	case "keyspace":
+		return spec != nil && len(spec.KeySpecs) > 0
+	case "pubsub":
+		switch cmd.Name() {
+		case "PUBLISH", "SPUBLISH", "PUBSUB":
+			return true
+		}
+		return CmdPubSub(cmd)
+	case "blocking":
+		return CmdBlocking(cmd)
+	case "transaction":
+		return CmdTransaction(cmd)
+	case "connection":
+		switch cmd.Name() {
+		case "AUTH", "HELLO", "PING", "ECHO", "SELECT", "QUIT", "RESET", "CLIENT", "READONLY", "READWRITE":
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns the NOPERM error if the user is not allowed to run cmd or access its keys
+func (u *ACLUser) Check(cmd *resp.Command) []byte {
+	spec := LookupCommand(cmd)
+	allowed := false
+	for _, cr := range u.commands {
+		var matched bool
+		if cr.category != "" {
+			matched = inCategory(cmd, spec, cr.category)
+		} else {
+			matched = cr.name == cmd.Name() &&
+				(cr.sub == "" || (len(cmd.Args) > 1 && strings.EqualFold(cr.sub, cmd.Args[1])))
+		}
+		if matched {
+			allowed = cr.allow
+		}
+	}
+	if !allowed {
+		name := strings.ToLower(cmd.Name())
+		if spec != nil && spec.Name != cmd.Name() {
+			// subcommand
+			name += "|" + strings.ToLower(cmd.Args[1])
+		}
+		return []byte(fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", u.Name, name))
+	}
+
+	if channels, patterns, ok := cmdChannels(cmd); ok {
+		// channels are not keys even if located by key specs, eg. of SSUBSCRIBE
+		for _, channel := range channels {
+			if !u.channelAllowed(channel, patterns) {
+				return NOPERM_CHANNEL_ERR
+			}
+		}
+		return nil
+	}
+
+	// commands without flags may either read or write keys
+	access := ACL_KEY_READ | ACL_KEY_WRITE
+	if spec != nil && spec.Flags&COMMAND_FLAG_READONLY != 0 {
+		access = ACL_KEY_READ
+	} else if spec != nil && spec.Flags&COMMAND_FLAG_WRITE != 0 {
+		access = ACL_KEY_WRITE
+	}
+	if _, proxied := proxyCmdTable[cmd.Name()]; spec == nil && !proxied && !u.allKeysAllowed(access) {
+		// keys of a command without spec are unknown, only a user of all keys may run it
+		return NOPERM_KEY_ERR
+	}
+	for _, key := range CmdKeys(cmd) {
+		if !u.keyAllowed(key, access) {
+			return NOPERM_KEY_ERR
+		}
+	}
+	return nil
+}
+
+// allKeysAllowed returns whether access is granted on every key, eg. by allkeys
+func (u *ACLUser) allKeysAllowed(access int) bool {
+	granted := 0
+	for _, kp := range u.keys {
+		if kp.pattern == "*" {
+			granted |= kp.access
+		}
+	}
+	return granted&access == access
+}
+
+func (u *ACLUser) keyAllowed(key string, access int) bool {
+	granted := 0
+	for _, kp := range u.keys {
+		if StringMatch(kp.pattern, key) {
+			granted |= kp.access
+		}
+	}
+	return granted&access == access
+}
+
+// cmdChannels returns the channels cmd publishes or subscribes, whether they are patterns,
+// and whether cmd is a pub/sub command addressing channels
+func cmdChannels(cmd *resp.Command) (channels []string, patterns bool, ok bool) {
+	switch cmd.Name() {
+	case "PUBLISH", "SPUBLISH":
+		if len(cmd.Args) > 1 {
+			channels = cmd.Args[1:2]
+		}
+		return channels, false, true
+	case "SUBSCRIBE", "SSUBSCRIBE":
+		return cmd.Args[1:], false, true
+	case "PSUBSCRIBE":
+		return cmd.Args[1:], true, true
+	case "UNSUBSCRIBE", "SUNSUBSCRIBE", "PUNSUBSCRIBE":
+		// leaving channels is always allowed
+		return nil, false, true
+	}
+	return nil, false, false
+}
+
+// channelAllowed returns whether channel matches a channel pattern of the user,
+// a pattern subscribed must be one of them literally unless all channels are granted
+func (u *ACLUser) channelAllowed(channel string, pattern bool) bool {
+	for _, cp := range u.channels {
+		if cp == "*" || (!pattern && StringMatch(cp, channel)) || (pattern && cp == channel) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// StringMatch returns whether str matches the glob style pattern, the same as valkey's
+// KEYS pattern: * matches any characters, ? any single character, [abc], [^a] and
+// [a-z] a set of characters, and \ escapes the following character
+func StringMatch(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if StringMatch(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				if pattern[0] == '\\' && len(pattern) > 1 {
+					pattern = pattern[1:]
+					match = match || pattern[0] == str[0]
+				} else if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					match = match || (str[0] >= start && str[0] <= end)
+					pattern = pattern[2:]
+				} else {
+					match = match || pattern[0] == str[0]
+				}
+				pattern = pattern[1:]
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+			if len(pattern) == 0 {
+				// unterminated set
+				return len(str) == 0
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(str) == 0
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestStringMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		str     string
+		matched bool
+	}{
+		{"*", "", true},
+		{"cache:*", "cache:user:1", true},
+		{"cache:*", "session:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"*:*:1", "a:b:1", true},
+	}
+	for _, c := range cases {
+		if matched := StringMatch(c.pattern, c.str); matched != c.matched {
+			t.Errorf("expected %s matching %s %v, got %v", c.pattern, c.str, c.matched, matched)
+		}
+	}
+}
+
+func TestACLAuthenticate(t *testing.T) {
+	valkeyConn := NewValkeyConn(1, 0, "secret", false)
+	acl := NewACL("secret", valkeyConn)
+	if acl.DefaultUser() != nil {
+		t.Error("expected default user requires password")
+	}
+	if acl.Authenticate(ACL_DEFAULT_USER, "secret") == nil {
+		t.Error("expected default user authenticated")
+	}
+	users := `
+# team users
+user alice on >alice-pass ~* +@all backend=team-a:backend-pass
+user bob off >bob-pass ~* +@all
+user carol on #` + hashPassword("carol-pass") + ` ~* +@all
+`
+	if err := acl.Load(strings.NewReader(users), valkeyConn); err != nil {
+		t.Fatal(err)
+	}
+	alice := acl.Authenticate("alice", "alice-pass")
+	if alice == nil {
+		t.Fatal("expected alice authenticated")
+	}
+	if alice.valkeyConn == valkeyConn || alice.valkeyConn.user != "team-a" || alice.valkeyConn.userPassword != "backend-pass" {
+		t.Error("expected alice mapped to backend user team-a")
+	}
+	if acl.Authenticate("alice", "secret") != nil {
+		t.Error("expected wrong password refused")
+	}
+	if acl.Authenticate("bob", "bob-pass") != nil {
+		t.Error("expected disabled user refused")
+	}
+	if acl.Authenticate("carol", "carol-pass") == nil {
+		t.Error("expected hashed password authenticated")
+	}
+	if acl.Authenticate(ACL_DEFAULT_USER, "secret").valkeyConn != valkeyConn {
+		t.Error("expected default user kept")
+	}
+
+	for _, line := range []string{"alice on", "user alice unknown", "user alice %X~*", "user alice +@unknown", "user alice backend=team-a"} {
+		if err := acl.Load(strings.NewReader(line), valkeyConn); err == nil {
+			t.Errorf("expected error loading %q", line)
+		}
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	acl := NewACL("", nil)
+	users := `
+user reader on nopass %R~* +@read -hgetall
+user writer on nopass ~cache:* %R~config:* +@all -@blocking -xgroup +xgroup|create
+user subscriber on nopass ~cache:* &news.* +@all
+`
+	if err := acl.Load(strings.NewReader(users), nil); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		user string
+		args []string
+		err  string
+	}{
+		{ACL_DEFAULT_USER, []string{"SET", "a", "1"}, ""},
+		{"reader", []string{"GET", "a"}, ""},
+		{"reader", []string{"SET", "a", "1"}, "NOPERM User reader has no permissions to run the 'set' command"},
+		{"reader", []string{"HGETALL", "a"}, "NOPERM User reader has no permissions to run the 'hgetall' command"},
+		{"writer", []string{"SET", "cache:1", "1"}, ""},
+		{"writer", []string{"SET", "config:1", "1"}, string(NOPERM_KEY_ERR)},
+		{"writer", []string{"GET", "config:1"}, ""},
+		{"writer", []string{"MGET", "cache:1", "session:1"}, string(NOPERM_KEY_ERR)},
+		{"writer", []string{"BLPOP", "cache:1", "0"}, "NOPERM User writer has no permissions to run the 'blpop' command"},
+		{"writer", []string{"XGROUP", "CREATE", "cache:s", "g", "$"}, ""},
+		{"writer", []string{"XGROUP", "DESTROY", "cache:s", "g"}, "NOPERM User writer has no permissions to run the 'xgroup|destroy' command"},
+		// keys of a command without spec are unknown
+		{"writer", []string{"UNKNOWNCMD", "cache:1"}, string(NOPERM_KEY_ERR)},
+		{"writer", []string{"PING"}, ""},
+		{ACL_DEFAULT_USER, []string{"UNKNOWNCMD", "a"}, ""},
+		// channels are checked against channel patterns only, no channel is granted by default
+		{ACL_DEFAULT_USER, []string{"PSUBSCRIBE", "weather.*"}, ""},
+		{"writer", []string{"SUBSCRIBE", "news.sports"}, string(NOPERM_CHANNEL_ERR)},
+		{"subscriber", []string{"PUBLISH", "news.sports", "hello"}, ""},
+		{"subscriber", []string{"PUBLISH", "weather", "hello"}, string(NOPERM_CHANNEL_ERR)},
+		{"subscriber", []string{"SUBSCRIBE", "news.sports", "weather"}, string(NOPERM_CHANNEL_ERR)},
+		{"subscriber", []string{"SSUBSCRIBE", "news.1"}, ""},
+		{"subscriber", []string{"SPUBLISH", "cache:1", "hello"}, string(NOPERM_CHANNEL_ERR)},
+		{"subscriber", []string{"PSUBSCRIBE", "news.*"}, ""},
+		{"subscriber", []string{"PSUBSCRIBE", "news.s*"}, string(NOPERM_CHANNEL_ERR)},
+		{"subscriber", []string{"SUNSUBSCRIBE", "weather"}, ""},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		user := acl.Authenticate(c.user, "")
+		if err := user.Check(cmd); string(err) != c.err {
+			t.Errorf("expected %s %v error %q, got %q", c.user, c.args, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+/*
+Admin API served on the debug listener:
+
+	GET  /debug/pprof/   runtime profiles of net/http/pprof
+	GET  /metrics        prometheus metrics
+	GET  /loglevel       current glog verbosity
+	POST /loglevel?v=N   set glog verbosity
+	GET  /slots          slot ranges and the servers serving them
+	POST /slots/reload   trigger reloading slot table
+	GET  /backends       connections kept to backend servers
+	GET  /sessions       connected client sessions
+*/
+
+// AdminHandler returns the handler of the admin API
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /metrics", p.ServeMetrics)
+	mux.HandleFunc("GET /loglevel", p.serveLogLevel)
+	mux.HandleFunc("POST /loglevel", p.serveSetLogLevel)
+	mux.HandleFunc("GET /slots", p.serveSlots)
+	mux.HandleFunc("POST /slots/reload", p.serveSlotsReload)
+	mux.HandleFunc("GET /backends", p.serveBackends)
+	mux.HandleFunc("GET /sessions", p.serveSessions)
+	return mux
+}
+
+func (p *Proxy) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"v": flag.Lookup("v").Value.String()})
+}
+
+func (p *Proxy) serveSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	v := r.FormValue("v")
+	if level, err := strconv.Atoi(v); err != nil || level < 0 {
+		http.Error(w, fmt.Sprintf("invalid log level %q", v), http.StatusBadRequest)
+		return
+	}
+	if err := flag.Set("v", v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	glog.Infof("log level set to %s", v)
+	p.serveLogLevel(w, r)
+}
+
+func (p *Proxy) serveSlots(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p.dispatcher.slotTable.Ranges())
+}
+
+func (p *Proxy) serveSlotsReload(w http.ResponseWriter, r *http.Request) {
+	p.dispatcher.TriggerReloadSlots()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type backendInfo struct {
+	Node         string `json:"node"`
+	Connections  int    `json:"connections"`
+	Queued       int    `json:"queued"`
+	Dials        uint64 `json:"dials"`
+	DialFailures uint64 `json:"dial_failures"`
+}
+
+func (p *Proxy) serveBackends(w http.ResponseWriter, r *http.Request) {
+	backends := []backendInfo{}
+	for server, stats := range p.dispatcher.backendServerPool.Stats() {
+		info := backendInfo{Node: server, Connections: stats.Connections, Queued: stats.Queued}
+		if value, ok := metrics.backends.Load(server); ok {
+			info.Dials = value.(*backendMetrics).dials.Load()
+			info.DialFailures = value.(*backendMetrics).dialFailures.Load()
+		}
+		backends = append(backends, info)
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].Node < backends[j].Node })
+	writeJSON(w, backends)
+}
+
+type sessionInfo struct {
+	ID        int64  `json:"id"`
+	Addr      string `json:"addr"`
+	LocalAddr string `json:"laddr"`
+	Name      string `json:"name"`
+	User      string `json:"user"`
+	Age       int64  `json:"age"`
+}
+
+func (p *Proxy) serveSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := []sessionInfo{}
+	p.sessions.Range(func(key, value any) bool {
+		s := value.(*Session)
+		info := sessionInfo{
+			ID:        s.id,
+			Addr:      s.RemoteAddr().String(),
+			LocalAddr: s.LocalAddr().String(),
+			Age:       int64(time.Since(s.createTime).Seconds()),
+		}
+		s.trackLock.Lock()
+		info.Name = s.name
+		s.trackLock.Unlock()
+		if user := s.user.Load(); user != nil {
+			info.User = user.Name
+		}
+		sessions = append(sessions, info)
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	writeJSON(w, sessions)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Error(err)
+	}
+}
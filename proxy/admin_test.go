@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminHandler(t *testing.T) {
+	dispatcher := NewDispatcher(nil, time.Second, NewValkeyConn(1, 0, "", false), READ_PREFER_MASTER)
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: "127.0.0.1:7001"})
+	p := &Proxy{dispatcher: dispatcher}
+	handler := p.AdminHandler()
+	do := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	var ranges []SlotRange
+	if w := do("GET", "/slots"); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	} else if err := json.Unmarshal(w.Body.Bytes(), &ranges); err != nil || len(ranges) != 1 || ranges[0].End != NumSlots-1 {
+		t.Errorf("unexpected slot ranges %s", w.Body)
+	}
+
+	level := flag.Lookup("v").Value.String()
+	defer flag.Set("v", level)
+	if w := do("POST", "/loglevel?v=3"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"v":"3"`) {
+		t.Errorf("unexpected set log level reply %d %s", w.Code, w.Body)
+	}
+	if w := do("POST", "/loglevel?v=x"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid log level refused, got %d", w.Code)
+	}
+
+	if w := do("POST", "/slots/reload"); w.Code != http.StatusAccepted || len(dispatcher.slotReloadChan) != 1 {
+		t.Errorf("expected reload triggered, got %d", w.Code)
+	}
+	if w := do("GET", "/slots/reload"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET reload not allowed, got %d", w.Code)
+	}
+	if w := do("GET", "/sessions"); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("unexpected sessions %s", w.Body)
+	}
+}
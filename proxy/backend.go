@@ -2,129 +2,327 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
 	"container/list"
 	"errors"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
 	"github.com/golang/glog"
 )
 
+const (
+	// max number of requests queued for a backend connection before writer catches up
+	BACKEND_QUEUE_SIZE = 4096
+	// max number of requests written to backend in one flush
+	BACKEND_BATCH_SIZE = 256
+	// wait before reconnecting to a failed backend
+	BACKEND_RECONNECT_INTERVAL = 100 * time.Millisecond
+)
+
+var errBackendClosed = errors.New("backend server closed")
+
+/*
+BackendServer is a long lived connection to a backend node shared by sessions.
+
+Requests are queued by sessions and written by the writer goroutine, which
+batches everything queued into one flush. The reader goroutine reads replies
+and matches them FIFO against the inflight list, then hands them off to the backQ
+of their sessions without blocking, replies of a session too slow to take them
+are queued for it so that it never stalls the other sessions. On any error all the inflight requests fail and the
+connection is re-established, requests queued meanwhile wait for it or fail
+if the backend can not be reached.
+
+If cache is set, the connection turns on CLIENT TRACKING and cacheable requests
+are preceded by CLIENT CACHING YES, whose replies are skipped by the reader.
+Invalidations pushed by backend are read in between replies and handled by cache.
+*/
 type BackendServer struct {
-	inflight   *list.List
 	server     string
-	conn       net.Conn
-	r          *bufio.Reader
-	w          *bufio.Writer
 	valkeyConn *ValkeyConn
+	cache      *Cache
+	reqs       chan *PipelineRequest
+	lock       sync.RWMutex
+	closed     bool
+	quit       chan struct{}
+	// removed from pool, sessions stop sending to it once their requests are replied
+	removed atomic.Bool
+	// requests written to backend and waiting for replies
+	inflightLock sync.Mutex
+	inflight     *list.List
+	// responses waiting for the backQ of slow sessions, in the order delivered
+	overflowLock sync.Mutex
+	overflow     map[chan *PipelineResponse][]*PipelineResponse
 }
 
-func NewBackendServer(server string, valkeyConn *ValkeyConn) *BackendServer {
+// NewBackendServer returns a connection to server, replies of cacheable requests are kept
+// in cache if it's not nil
+func NewBackendServer(server string, valkeyConn *ValkeyConn, cache *Cache) *BackendServer {
 	tr := &BackendServer{
-		inflight:   list.New(),
 		server:     server,
 		valkeyConn: valkeyConn,
+		cache:      cache,
+		reqs:       make(chan *PipelineRequest, BACKEND_QUEUE_SIZE),
+		quit:       make(chan struct{}),
+		inflight:   list.New(),
+		overflow:   make(map[chan *PipelineResponse][]*PipelineResponse),
 	}
+	go tr.run()
+	return tr
+}
 
-	if conn, err := valkeyConn.Conn(server); err != nil {
-		glog.Error(tr.server, err)
-	} else {
-		tr.initRWConn(conn)
+// Request queues req to be sent, its response is delivered to req.backQ
+func (tr *BackendServer) Request(req *PipelineRequest) error {
+	tr.lock.RLock()
+	defer tr.lock.RUnlock()
+	if tr.closed {
+		return errBackendClosed
 	}
-
-	return tr
+	tr.reqs <- req
+	return nil
 }
 
-func (tr *BackendServer) Request(req *PipelineRequest) (*PipelineResponse, error) {
-	if err := tr.writeToBackend(req); err != nil {
-		glog.Error(err)
-		if err := tr.tryRecover(err); err != nil {
-			return nil, err
+func (tr *BackendServer) run() {
+	for {
+		conn, err := tr.valkeyConn.Conn(tr.server)
+		metrics.ObserveDial(tr.server, err)
+		if err == nil && tr.cache != nil {
+			if _, err = tr.valkeyConn.Request(VALKEY_CMD_TRACKING_OPTIN, conn); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			glog.Error(tr.server, err)
+			if !tr.failQueued(err) {
+				break
+			}
+			continue
 		}
-		return nil, err
+		if !tr.serve(conn) {
+			break
+		}
+		glog.Infof("reconnect to %s", tr.server)
+	}
+	// no request is queued any more after closed
+	for len(tr.reqs) > 0 {
+		req := <-tr.reqs
+		tr.deliver(&PipelineResponse{ctx: req, err: errBackendClosed})
 	}
-	rsp := resp.NewObject()
+}
 
-	if err := resp.ReadDataBytes(tr.r, rsp); err != nil {
-		glog.Error(err)
-		if err := tr.tryRecover(err); err != nil {
-			return nil, err
+// serve runs reader and writer on conn until either of them fails or server is closed,
+// it returns false if server is closed
+func (tr *BackendServer) serve(conn net.Conn) bool {
+	done := make(chan error, 1)
+	go func() {
+		err := tr.readLoop(bufio.NewReaderSize(conn, 1024*512))
+		// unblock the writer
+		conn.Close()
+		done <- err
+	}()
+	alive, err := tr.writeLoop(bufio.NewWriterSize(conn, 1024*512), done)
+	conn.Close()
+	if readErr := <-done; err == nil {
+		err = readErr
+	}
+	if tr.cache != nil {
+		// keys tracked by the connection are not invalidated any more
+		tr.cache.Flush()
+	}
+	if err != io.EOF {
+		glog.Error(tr.server, err)
+	}
+	tr.cleanupInflight(err)
+	return alive
+}
+
+func (tr *BackendServer) writeLoop(w *bufio.Writer, done chan error) (bool, error) {
+	for {
+		select {
+		case req := <-tr.reqs:
+			if err := tr.write(w, req); err != nil {
+				return true, err
+			}
+			// batch all the requests already queued
+			for i := 1; i < BACKEND_BATCH_SIZE && len(tr.reqs) > 0; i++ {
+				if err := tr.write(w, <-tr.reqs); err != nil {
+					return true, err
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return true, err
+			}
+		case err := <-done:
+			// give the reader's error back to serve
+			done <- err
+			return true, nil
+		case <-tr.quit:
+			return false, errBackendClosed
 		}
-		return nil, err
 	}
-	plReq := tr.inflight.Remove(tr.inflight.Front()).(*PipelineRequest)
-	return &PipelineResponse{ctx: plReq, rsp: rsp}, nil
 }
 
-func (tr *BackendServer) writeToBackend(plReq *PipelineRequest) error {
-	var err error
+func (tr *BackendServer) write(w *bufio.Writer, req *PipelineRequest) error {
 	// always put req into inflight list first
-	tr.inflight.PushBack(plReq)
+	tr.inflightLock.Lock()
+	if req.cacheable && tr.cache != nil {
+		// the reply of CLIENT CACHING is skipped by the reader
+		tr.inflight.PushBack(&PipelineRequest{cmd: VALKEY_CMD_CACHING_YES})
+	}
+	tr.inflight.PushBack(req)
+	tr.inflightLock.Unlock()
+	req.sent = time.Now()
+	if req.cacheable && tr.cache != nil {
+		if _, err := w.Write(VALKEY_CMD_CACHING_YES.Format()); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(req.cmd.Format())
+	return err
+}
 
-	if tr.w == nil {
-		err = errors.New("init task runner connection error")
-		glog.Error(err)
-		return err
+func (tr *BackendServer) readLoop(r *bufio.Reader) error {
+	for {
+		rsp := resp.NewObject()
+		if err := resp.ReadDataBytes(r, rsp); err != nil {
+			return err
+		}
+		if raw := rsp.Raw(); raw[0] == resp.T_Push {
+			tr.handlePush(raw)
+			continue
+		}
+		tr.inflightLock.Lock()
+		e := tr.inflight.Front()
+		if e != nil {
+			tr.inflight.Remove(e)
+		}
+		tr.inflightLock.Unlock()
+		if e == nil {
+			return errors.New("unexpected reply without request")
+		}
+		plReq := e.Value.(*PipelineRequest)
+		if plReq.backQ == nil {
+			if raw := rsp.Raw(); raw[0] == resp.T_Error {
+				glog.Errorf("%s %s failed, %s", tr.server, plReq.cmd.Name(), bytes.TrimSpace(raw))
+			}
+			continue
+		}
+		plReq.received = time.Now()
+		if plReq.cacheable && tr.cache != nil {
+			// cached before any invalidation of the key read after the reply
+			tr.cache.put(tr.valkeyConn.user, plReq.cmd, rsp.Raw())
+		}
+		tr.deliver(&PipelineResponse{ctx: plReq, rsp: rsp})
 	}
-	buf := plReq.cmd.Format()
-	if _, err = tr.w.Write(buf); err != nil {
-		glog.Error(err)
-		return err
+}
+
+// deliver hands rsp off to the backQ of its session without blocking, it's queued
+// if backQ is full and sent by another goroutine in order
+func (tr *BackendServer) deliver(rsp *PipelineResponse) {
+	backQ := rsp.ctx.backQ
+	tr.overflowLock.Lock()
+	defer tr.overflowLock.Unlock()
+	if queued, ok := tr.overflow[backQ]; ok {
+		tr.overflow[backQ] = append(queued, rsp)
+		return
 	}
-	err = tr.w.Flush()
-	if err != nil {
-		glog.Error("flush error", err)
+	select {
+	case backQ <- rsp:
+		return
+	default:
 	}
-	return err
+	glog.V(2).Infof("%s queue replies of a slow session", tr.server)
+	tr.overflow[backQ] = []*PipelineResponse{rsp}
+	go tr.flushOverflow(backQ)
 }
 
-func (tr *BackendServer) tryRecover(err error) error {
-	tr.cleanupInflight(err)
+// flushOverflow sends the responses queued for backQ until none is left, backQ is
+// not closed before they are sent since the session waits for all its requests
+func (tr *BackendServer) flushOverflow(backQ chan *PipelineResponse) {
+	for {
+		tr.overflowLock.Lock()
+		queued := tr.overflow[backQ]
+		if len(queued) == 0 {
+			delete(tr.overflow, backQ)
+			tr.overflowLock.Unlock()
+			return
+		}
+		tr.overflow[backQ] = queued[1:]
+		tr.overflowLock.Unlock()
+		backQ <- queued[0]
+	}
+}
 
-	//try to recover
-	if conn, err := tr.valkeyConn.Conn(tr.server); err != nil {
-		glog.Error("try to recover from error failed", tr.server, err)
-		time.Sleep(100 * time.Millisecond)
-		return err
-	} else {
-		glog.Info("recover success", tr.server)
-		tr.initRWConn(conn)
+// handlePush handles a push frame out of band of replies, eg. invalidations of keys cached
+func (tr *BackendServer) handlePush(raw []byte) {
+	if tr.cache == nil {
+		return
 	}
+	data, err := resp.ReadData(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		glog.Errorf("%s re-parse push err=%s", tr.server, err)
+		return
+	}
+	tr.cache.handlePush(data)
+}
 
-	return nil
+// failQueued fails requests queued while backend is unreachable until it's time to reconnect,
+// it returns false if server is closed
+func (tr *BackendServer) failQueued(err error) bool {
+	timer := time.NewTimer(BACKEND_RECONNECT_INTERVAL)
+	defer timer.Stop()
+	for {
+		select {
+		case req := <-tr.reqs:
+			tr.deliver(&PipelineResponse{ctx: req, err: err})
+		case <-timer.C:
+			return true
+		case <-tr.quit:
+			return false
+		}
+	}
 }
 
 func (tr *BackendServer) cleanupInflight(err error) {
-	for e := tr.inflight.Front(); e != nil; {
+	tr.inflightLock.Lock()
+	defer tr.inflightLock.Unlock()
+	for e := tr.inflight.Front(); e != nil; e = e.Next() {
 		plReq := e.Value.(*PipelineRequest)
-		if err != io.EOF {
-			glog.Error("clean up", plReq)
+		if plReq.backQ == nil {
+			continue
 		}
-		plRsp := &PipelineResponse{
-			ctx: plReq,
-			err: err,
-		}
-		plReq.backQ <- plRsp
-		next := e.Next()
-		tr.inflight.Remove(e)
-		e = next
+		tr.deliver(&PipelineResponse{ctx: plReq, err: err})
 	}
+	tr.inflight.Init()
 }
 
-func (tr *BackendServer) initRWConn(conn net.Conn) {
-	if tr.conn != nil {
-		tr.conn.Close()
+// Drain closes the connection once requests queued and inflight are replied, or after timeout
+func (tr *BackendServer) Drain(timeout time.Duration) {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline) && !tr.idle(); {
+		time.Sleep(BACKEND_RECONNECT_INTERVAL)
 	}
-	tr.conn = conn
-	tr.r = bufio.NewReaderSize(tr.conn, 1024*512)
-	tr.w = bufio.NewWriterSize(tr.conn, 1024*512)
+	tr.Close()
+}
+
+// idle returns whether no request is queued or waiting for reply
+func (tr *BackendServer) idle() bool {
+	tr.inflightLock.Lock()
+	defer tr.inflightLock.Unlock()
+	return len(tr.reqs) == 0 && tr.inflight.Len() == 0
 }
 
+// Close stops the connection, requests queued or inflight fail
 func (tr *BackendServer) Close() error {
-	if tr.conn != nil {
-		return tr.conn.Close()
+	tr.removed.Store(true)
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	if !tr.closed {
+		tr.closed = true
+		close(tr.quit)
 	}
 	return nil
 }
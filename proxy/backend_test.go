@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// echoBackend replies the first argument of each command as a bulk string
+func echoBackend(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					cmd, err := resp.ReadCommand(r)
+					if err != nil {
+						return
+					}
+					reply := "+OK\r\n"
+					if len(cmd.Args) > 1 {
+						reply = fmt.Sprintf("$%d\r\n%s\r\n", len(cmd.Args[1]), cmd.Args[1])
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestBackendServerPipeline(t *testing.T) {
+	l := echoBackend(t)
+	defer l.Close()
+	tr := NewBackendServer(l.Addr().String(), NewValkeyConn(1, time.Second, "", false), nil)
+	defer tr.Close()
+
+	var wg sync.WaitGroup
+	for s := 0; s < 4; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			backQ := make(chan *PipelineResponse, 100)
+			for i := 0; i < 100; i++ {
+				cmd, _ := resp.NewCommand("GET", fmt.Sprintf("%d-%d", s, i))
+				if err := tr.Request(&PipelineRequest{cmd: cmd, seq: int64(i), backQ: backQ}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			for i := 0; i < 100; i++ {
+				rsp := <-backQ
+				expected := fmt.Sprintf("%d-%d", s, i)
+				if rsp.err != nil || rsp.ctx.seq != int64(i) || string(rsp.rsp.Raw()) != fmt.Sprintf("$%d\r\n%s\r\n", len(expected), expected) {
+					t.Errorf("unexpected response %d of session %d: %q %v", i, s, rsp.rsp.Raw(), rsp.err)
+					return
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	tr.Close()
+	cmd, _ := resp.NewCommand("GET", "k")
+	if err := tr.Request(&PipelineRequest{cmd: cmd}); err != errBackendClosed {
+		t.Errorf("expected closed error, got %v", err)
+	}
+}
+
+func TestBackendServerSlowSession(t *testing.T) {
+	l := echoBackend(t)
+	defer l.Close()
+	tr := NewBackendServer(l.Addr().String(), NewValkeyConn(1, time.Second, "", false), nil)
+	defer tr.Close()
+	request := func(backQ chan *PipelineResponse, n int) {
+		for i := 0; i < n; i++ {
+			cmd, _ := resp.NewCommand("GET", fmt.Sprint(i))
+			if err := tr.Request(&PipelineRequest{cmd: cmd, seq: int64(i), backQ: backQ}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// replies of a session not taking them must not stall the others
+	slowQ := make(chan *PipelineResponse, 1)
+	request(slowQ, 10)
+	backQ := make(chan *PipelineResponse, 1)
+	request(backQ, 10)
+	for i := 0; i < 10; i++ {
+		select {
+		case rsp := <-backQ:
+			if rsp.err != nil || rsp.ctx.seq != int64(i) {
+				t.Fatalf("unexpected response %d: %v", i, rsp.err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("stalled by a slow session")
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if rsp := <-slowQ; rsp.err != nil || rsp.ctx.seq != int64(i) {
+			t.Fatalf("unexpected response %d of slow session: %v", i, rsp.err)
+		}
+	}
+	if !tr.idle() {
+		t.Error("expected idle once all replied")
+	}
+}
+
+func TestSessionPoolResized(t *testing.T) {
+	b := newSequenceBackend(t)
+	defer b.Close()
+	conn, client := net.Pipe()
+	defer client.Close()
+	valkeyConn := NewValkeyConn(2, time.Second, "", false)
+	dispatcher := NewDispatcher(nil, 0, valkeyConn, 0)
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: b.Addr().String()})
+	s := newTestSession(conn)
+	s.dispatcher, s.valkeyConn, s.id = dispatcher, valkeyConn, 1
+	s.acl = NewACL("", valkeyConn)
+	s.user.Store(s.acl.DefaultUser())
+	serveSession(s)
+	r := bufio.NewReader(client)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// the connection of the session is removed while DEL is executing
+	client.Write([]byte("DEL q\r\n"))
+	time.Sleep(20 * time.Millisecond)
+	dispatcher.backendServerPool.Resize(1)
+	client.Write([]byte("RPUSH q a\r\n"))
+	for i := 0; i < 2; i++ {
+		if line, err := r.ReadString('\n'); err != nil || line != ":1\r\n" {
+			t.Fatalf("unexpected reply %q %v", line, err)
+		}
+	}
+	if sequence := b.sequence(); sequence != "DEL RPUSH" {
+		t.Errorf("expected requests kept in order while resizing, got %s", sequence)
+	}
+}
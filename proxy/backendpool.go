@@ -3,76 +3,141 @@ package proxy
 import (
 	"sync"
 	"time"
-
-	"github.com/drycc-addons/valkey-cluster-proxy/proxy/connpool"
 )
 
+// max time to wait for requests replied before closing a connection removed from pool
+const BACKEND_DRAIN_TIMEOUT = 10 * time.Second
+
+// BackendServerPool keeps a fixed number of multiplexed connections for each backend server,
+// connections authenticated as different backend users are kept apart
 type BackendServerPool struct {
 	lock           sync.Mutex
 	valkeyConn     *ValkeyConn
 	backendServers sync.Map
+	// replies of cacheable requests are kept if set
+	cache *Cache
+}
+
+type backendKey struct {
+	server   string
+	user     string
+	password string
+}
+
+type backendConns struct {
+	valkeyConn *ValkeyConn
+	conns      []*BackendServer
 }
 
 func NewBackendServerPool(valkeyConn *ValkeyConn) *BackendServerPool {
 	return &BackendServerPool{valkeyConn: valkeyConn}
 }
 
-func (b *BackendServerPool) Init(server string) (*connpool.Pool, error) {
-	pool, err := connpool.NewChannelPool(&connpool.Config{
-		InitCap: b.valkeyConn.initCap,
-		MaxIdle: b.valkeyConn.maxIdle,
-		Factory: func() (interface{}, error) {
-			return NewBackendServer(server, b.valkeyConn), nil
-		},
-		Close:       func(v interface{}) error { return v.(*BackendServer).Close() },
-		IdleTimeout: 60 * time.Second,
-	})
-	if err != nil {
-		return nil, err
+// Sets the cache of replies read by connections, it must be set before any connection is made
+func (b *BackendServerPool) SetCache(cache *Cache) {
+	b.cache = cache
+}
+
+func (b *BackendServerPool) Init(key backendKey, valkeyConn *ValkeyConn) *backendConns {
+	conns := make([]*BackendServer, valkeyConn.Connections())
+	for i := range conns {
+		conns[i] = NewBackendServer(key.server, valkeyConn, b.cache)
 	}
-	b.backendServers.Store(server, &pool)
-	return &pool, nil
+	bc := &backendConns{valkeyConn: valkeyConn, conns: conns}
+	b.backendServers.Store(key, bc)
+	return bc
 }
 
-func (b *BackendServerPool) Get(server string) (*BackendServer, error) {
-	var err error
-	var pool *connpool.Pool
-	value, ok := b.backendServers.Load(server)
-	if ok {
-		pool = value.(*connpool.Pool)
-	} else {
+// Get returns the connection to server for session with the id, requests of a session
+// to the same server always go through the same connection to keep them in order.
+// valkeyConn is the credentials of session's user, nil for the default ones of pool.
+func (b *BackendServerPool) Get(valkeyConn *ValkeyConn, server string, id int64) *BackendServer {
+	if valkeyConn == nil {
+		valkeyConn = b.valkeyConn
+	}
+	key := backendKey{server: server, user: valkeyConn.user, password: valkeyConn.userPassword}
+	value, ok := b.backendServers.Load(key)
+	if !ok {
 		b.lock.Lock()
-		defer b.lock.Unlock()
-		value, ok := b.backendServers.Load(server)
-		if !ok {
-			pool, err = b.Init(server)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			pool = value.(*connpool.Pool)
+		if value, ok = b.backendServers.Load(key); !ok {
+			value = b.Init(key, valkeyConn)
 		}
+		b.lock.Unlock()
 	}
-	backendServer, err := (*pool).Get()
-	return backendServer.(*BackendServer), err
+	conns := value.(*backendConns).conns
+	return conns[uint64(id)%uint64(len(conns))]
 }
 
-func (b *BackendServerPool) Put(server *BackendServer) error {
-	value, ok := b.backendServers.Load(server.server)
-	if ok {
-		pool := *(value.(*connpool.Pool))
-		return pool.Put(server)
-	}
-	return nil
+func (b *BackendServerPool) Reload(servers map[string]bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.backendServers.Range(func(key, value any) bool {
+		if !servers[key.(backendKey).server] {
+			b.backendServers.Delete(key)
+			for _, conn := range value.(*backendConns).conns {
+				conn.Close()
+			}
+		}
+		return true
+	})
 }
 
-func (b *BackendServerPool) Reload(servers map[string]bool) {
+// Close closes connections to all backend servers, requests not replied yet fail
+func (b *BackendServerPool) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.backendServers.Range(func(key, value any) bool {
+		b.backendServers.Delete(key)
+		for _, conn := range value.(*backendConns).conns {
+			conn.Close()
+		}
+		return true
+	})
+}
+
+// Resize changes the number of connections to each backend server, connections removed
+// are closed after their requests replied. A session keeps sending to the connection
+// removed until its requests are replied before moving to another one, see Session.pin.
+func (b *BackendServerPool) Resize(size int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.backendServers.Range(func(key, value any) bool {
+		bc := value.(*backendConns)
+		if len(bc.conns) == size {
+			return true
+		}
+		conns := make([]*BackendServer, size)
+		n := copy(conns, bc.conns)
+		for i := n; i < size; i++ {
+			conns[i] = NewBackendServer(key.(backendKey).server, bc.valkeyConn, b.cache)
+		}
+		for _, conn := range bc.conns[n:] {
+			conn.removed.Store(true)
+			go conn.Drain(BACKEND_DRAIN_TIMEOUT)
+		}
+		b.backendServers.Store(key, &backendConns{valkeyConn: bc.valkeyConn, conns: conns})
+		return true
+	})
+}
+
+// BackendStats is the state of connections to a backend server
+type BackendStats struct {
+	Connections int
+	Queued      int
+}
+
+// Stats returns the state of connections to each backend server
+func (b *BackendServerPool) Stats() map[string]BackendStats {
+	stats := make(map[string]BackendStats)
 	b.backendServers.Range(func(key, value any) bool {
-		server, pool := key.(string), *(value.(*connpool.Pool))
-		if _, ok := servers[server]; !ok {
-			pool.Release()
-			b.backendServers.Delete(server)
+		server := key.(backendKey).server
+		st := stats[server]
+		for _, conn := range value.(*backendConns).conns {
+			st.Connections++
+			st.Queued += len(conn.reqs)
 		}
+		stats[server] = st
 		return true
 	})
+	return stats
 }
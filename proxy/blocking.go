@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+const (
+	// extra time to wait for backend after the timeout of a blocking command
+	BLOCKING_TIMEOUT_GRACE = time.Second
+	// max number of MOVED or ASK redirections followed for a blocking command
+	BLOCKING_MAX_REDIRECTS = 5
+)
+
+var errBlockerClosed = errors.New("blocking command cancelled by client")
+
+/*
+Blocker runs blocking commands of a session, eg. BLPOP or XREAD BLOCK.
+
+Blocking commands never run on pooled backend servers, they would freeze the
+connection for every other session. Instead they are executed one by one in
+request order on connections set aside for the session, so that a blocked
+client never delays others. The timeout of each command is enforced by a read
+deadline, and the running command is cancelled by closing its connection
+when client disconnects.
+*/
+type Blocker struct {
+	session *Session
+	reqs    chan *PipelineRequest
+	// idle dedicated connections keyed by server, only used by the loop
+	conns   map[string]net.Conn
+	lock    sync.Mutex
+	current net.Conn
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func NewBlocker(session *Session) *Blocker {
+	b := &Blocker{
+		session: session,
+		reqs:    make(chan *PipelineRequest, 128),
+		conns:   make(map[string]net.Conn),
+	}
+	b.wg.Add(1)
+	go b.loop()
+	return b
+}
+
+func (b *Blocker) Schedule(req *PipelineRequest) {
+	b.reqs <- req
+}
+
+// Close cancels the running command, fails the queued ones and
+// waits for all of their responses sent to session
+func (b *Blocker) Close() {
+	b.lock.Lock()
+	b.closed = true
+	if b.current != nil {
+		b.current.Close()
+	}
+	b.lock.Unlock()
+	close(b.reqs)
+	b.wg.Wait()
+}
+
+func (b *Blocker) loop() {
+	defer b.wg.Done()
+	for req := range b.reqs {
+		b.session.backQ <- b.do(req)
+	}
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+}
+
+func (b *Blocker) do(req *PipelineRequest) *PipelineResponse {
+	server := b.session.dispatcher.slotTable.WriteServer(req.slot)
+	timeout := BlockingTimeout(req.cmd)
+	ask := false
+	req.sent = time.Now()
+	defer func() {
+		req.received = time.Now()
+	}()
+	for i := 0; i <= BLOCKING_MAX_REDIRECTS; i++ {
+		rsp, err := b.request(server, req.cmd, timeout, ask)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				glog.Warningf("blocking %s on %s is timeout", req.cmd.Name(), server)
+				return &PipelineResponse{ctx: req, rsp: resp.NewObjectFromData(b.timeoutData(req.cmd))}
+			}
+			return &PipelineResponse{ctx: req, err: err}
+		}
+		raw := rsp.Raw()
+		if bytes.HasPrefix(raw, MOVED) || bytes.HasPrefix(raw, ASK) {
+			req.redirects = append(req.redirects, redirectHop(raw))
+		}
+		if bytes.HasPrefix(raw, MOVED) {
+			_, server = ParseRedirectInfo(string(raw))
+			b.session.dispatcher.TriggerReloadSlots()
+			ask = false
+		} else if bytes.HasPrefix(raw, ASK) {
+			_, server = ParseRedirectInfo(string(raw))
+			ask = true
+		} else {
+			return &PipelineResponse{ctx: req, rsp: rsp}
+		}
+	}
+	return &PipelineResponse{ctx: req, err: errors.New("too many redirections")}
+}
+
+// request sends cmd on the dedicated connection to server and waits for its reply
+func (b *Blocker) request(server string, cmd *resp.Command, timeout time.Duration, ask bool) (*resp.Object, error) {
+	conn, ok := b.conns[server]
+	if ok {
+		delete(b.conns, server)
+	} else {
+		var err error
+		if conn, err = b.session.backend().Conn(server); err != nil {
+			return nil, err
+		}
+	}
+
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		conn.Close()
+		return nil, errBlockerClosed
+	}
+	b.current = conn
+	b.lock.Unlock()
+
+	obj, err := b.roundTrip(conn, cmd, timeout, ask)
+
+	b.lock.Lock()
+	b.current = nil
+	b.lock.Unlock()
+	if err != nil {
+		// the connection state is unknown after error or timeout
+		conn.Close()
+		return nil, err
+	}
+	b.conns[server] = conn
+	return obj, nil
+}
+
+func (b *Blocker) roundTrip(conn net.Conn, cmd *resp.Command, timeout time.Duration, ask bool) (*resp.Object, error) {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout + BLOCKING_TIMEOUT_GRACE)
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	buf := cmd.Format()
+	if ask {
+		buf = append(VALKEY_CMD_ASKING.Format(), buf...)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	if ask {
+		if _, err := resp.ReadData(r); err != nil {
+			return nil, err
+		}
+	}
+	obj := resp.NewObject()
+	if err := resp.ReadDataBytes(r, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// timeoutData is the reply of a blocking command timed out, encoded in backend's protocol
+func (b *Blocker) timeoutData(cmd *resp.Command) *resp.Data {
+	if b.session.valkeyConn.Protocol() == resp.RESP3 {
+		return &resp.Data{T: resp.T_Null}
+	}
+	switch cmd.Name() {
+	case "BRPOPLPUSH", "BLMOVE":
+		return &resp.Data{T: resp.T_BulkString, IsNil: true}
+	default:
+		return &resp.Data{T: resp.T_Array, IsNil: true}
+	}
+}
+
+// BlockingTimeout returns the timeout of a blocking command, 0 means blocking forever
+func BlockingTimeout(cmd *resp.Command) time.Duration {
+	var seconds float64
+	switch cmd.Name() {
+	case "BLMPOP", "BZMPOP":
+		seconds, _ = strconv.ParseFloat(cmd.Value(1), 64)
+	case "XREAD", "XREADGROUP":
+		for i := 1; i < len(cmd.Args)-1; i++ {
+			if strings.EqualFold(cmd.Args[i], "BLOCK") {
+				ms, _ := strconv.ParseInt(cmd.Args[i+1], 10, 64)
+				return time.Duration(ms) * time.Millisecond
+			}
+			if strings.EqualFold(cmd.Args[i], "STREAMS") {
+				break
+			}
+		}
+	default:
+		seconds, _ = strconv.ParseFloat(cmd.Value(len(cmd.Args)-1), 64)
+	}
+	if seconds <= 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
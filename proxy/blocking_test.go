@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestBlockingCmd(t *testing.T) {
+	cases := []struct {
+		args     []string
+		blocking bool
+		key      string
+		timeout  time.Duration
+	}{
+		{[]string{"BLPOP", "q1", "q2", "1.5"}, true, "q1", 1500 * time.Millisecond},
+		{[]string{"BRPOPLPUSH", "src", "dst", "0"}, true, "src", 0},
+		{[]string{"BLMOVE", "src", "dst", "LEFT", "RIGHT", "2"}, true, "src", 2 * time.Second},
+		{[]string{"BZMPOP", "3", "2", "z1", "z2", "MIN"}, true, "z1", 3 * time.Second},
+		{[]string{"XREAD", "COUNT", "2", "BLOCK", "100", "STREAMS", "s1", "$"}, true, "s1", 100 * time.Millisecond},
+		{[]string{"XREADGROUP", "GROUP", "g", "c", "block", "0", "STREAMS", "s1", ">"}, true, "s1", 0},
+		{[]string{"XREAD", "STREAMS", "block", "0"}, false, "block", 0},
+		{[]string{"GET", "k"}, false, "k", 0},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		if CmdBlocking(cmd) != c.blocking {
+			t.Errorf("%v blocking expected: %v", c.args, c.blocking)
+		}
+		if !c.blocking {
+			continue
+		}
+		if key := CmdKeys(cmd)[0]; key != c.key {
+			t.Errorf("%v key expected: %s, got: %s", c.args, c.key, key)
+		}
+		if timeout := BlockingTimeout(cmd); timeout != c.timeout {
+			t.Errorf("%v timeout expected: %v, got: %v", c.args, c.timeout, timeout)
+		}
+	}
+}
+
+// sequenceBackend records the commands processed in order by all connections,
+// DEL takes a while to let a command on another connection overtake it, and
+// BLPOP times out at once
+type sequenceBackend struct {
+	net.Listener
+	lock sync.Mutex
+	cmds []string
+}
+
+func newSequenceBackend(t *testing.T) *sequenceBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &sequenceBackend{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				protocol := resp.RESP2
+				for {
+					cmd, err := resp.ReadCommand(r)
+					if err != nil {
+						return
+					}
+					reply := "+OK\r\n"
+					switch cmd.Name() {
+					case "HELLO":
+						protocol, reply = resp.RESP3, "%0\r\n"
+					case "RPUSH", "DEL", "BLPOP":
+						if cmd.Name() == "DEL" {
+							time.Sleep(100 * time.Millisecond)
+						}
+						b.lock.Lock()
+						b.cmds = append(b.cmds, cmd.Name())
+						b.lock.Unlock()
+						reply = ":1\r\n"
+						if cmd.Name() == "BLPOP" && protocol == resp.RESP3 {
+							reply = "_\r\n"
+						} else if cmd.Name() == "BLPOP" {
+							reply = "*-1\r\n"
+						}
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return b
+}
+
+func (b *sequenceBackend) sequence() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return strings.Join(b.cmds, " ")
+}
+
+func TestSessionBlockingAfterPipelined(t *testing.T) {
+	b := newSequenceBackend(t)
+	defer b.Close()
+	conn, client := net.Pipe()
+	defer client.Close()
+	valkeyConn := NewValkeyConn(1, time.Second, "", false)
+	dispatcher := NewDispatcher(nil, 0, valkeyConn, 0)
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: b.Addr().String()})
+	s := newTestSession(conn)
+	s.dispatcher, s.valkeyConn = dispatcher, valkeyConn
+	serveSession(s)
+	go client.Write([]byte("RPUSH q a\r\nDEL q\r\nBLPOP q 1\r\n"))
+	r := bufio.NewReader(client)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, expected := range []string{":1\r\n", ":1\r\n", "*-1\r\n"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected {
+			t.Errorf("expected %q, got %q", expected, line)
+		}
+	}
+	// the blocking command runs after the pipelined ones before it
+	if sequence := b.sequence(); sequence != "RPUSH DEL BLPOP" {
+		t.Errorf("unexpected order %s", sequence)
+	}
+}
+
+func TestSessionBlockingTimeoutResp3Backend(t *testing.T) {
+	b := newSequenceBackend(t)
+	defer b.Close()
+	conn, client := net.Pipe()
+	defer client.Close()
+	valkeyConn := NewValkeyConn(1, time.Second, "", false)
+	valkeyConn.SetProtocol(resp.RESP3)
+	dispatcher := NewDispatcher(nil, 0, valkeyConn, 0)
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: b.Addr().String()})
+	s := newTestSession(conn)
+	s.dispatcher, s.valkeyConn = dispatcher, valkeyConn
+	s.acl = NewACL("", valkeyConn)
+	s.user.Store(s.acl.DefaultUser())
+	serveSession(s)
+	go client.Write([]byte("BLPOP q 1\r\n"))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// the null of RESP3 is a nil array for BLPOP of RESP2 clients
+	if line, err := bufio.NewReader(client).ReadString('\n'); err != nil || line != "*-1\r\n" {
+		t.Errorf("expected nil array, got %q %v", line, err)
+	}
+}
@@ -0,0 +1,382 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+const (
+	// read commands cached by default, all of them read exactly one key
+	CACHE_COMMANDS = "GET,GETRANGE,STRLEN,HGET,HMGET,HGETALL,HEXISTS,HLEN,HKEYS,HVALS,HSTRLEN," +
+		"LRANGE,LINDEX,LLEN,SMEMBERS,SISMEMBER,SMISMEMBER,SCARD,ZRANGE,ZSCORE,ZMSCORE,ZRANK,ZCARD"
+	CACHE_TTL       = 5 * time.Second
+	CACHE_MAX_BYTES = 64 * 1024 * 1024
+	// bytes counted for each entry besides its request and reply
+	CACHE_ENTRY_OVERHEAD = 128
+)
+
+var (
+	VALKEY_CMD_TRACKING_OPTIN *resp.Command
+	VALKEY_CMD_CACHING_YES    *resp.Command
+)
+
+func init() {
+	VALKEY_CMD_TRACKING_OPTIN, _ = resp.NewCommand("CLIENT", "TRACKING", "ON", "OPTIN")
+	VALKEY_CMD_CACHING_YES, _ = resp.NewCommand("CLIENT", "CACHING", "YES")
+}
+
+/*
+Cache keeps replies of read commands on hot keys in proxy, so that the shard of a hot key
+is not saturated by reading it.
+
+Only the commands and keys configured are cached. Backend connections of the pool turn on
+CLIENT TRACKING in OPTIN mode, a read to be cached is preceded by CLIENT CACHING YES, and
+its reply is cached by the reader of the connection. Backend pushes an invalidation on the
+same connection once the key is changed, which is read after the reply cached, so an entry
+never outlives the value read. Entries of a connection lost are not invalidated any more,
+the whole cache is flushed then.
+
+Entries are kept per backend user which the sessions connect to backends as, so that
+a reply is never hit by a session whose backend user is not allowed to read it.
+
+A key being written through proxy is neither cached nor hit until the write is replied,
+so that a client always reads what it wrote. Entries expire after TTL at most, and the
+least recently used ones are evicted once the cache grows over max bytes.
+*/
+type Cache struct {
+	patterns []string
+	commands map[string]bool
+	ttl      time.Duration
+	maxBytes int64
+	lock     sync.Mutex
+	// entries by backend user and request, the least recently used at the back
+	entries map[string]*list.Element
+	lru     *list.List
+	// entries by key, and the number of writes not replied yet by key
+	keys    map[string]map[*cacheEntry]bool
+	writing map[string]int
+	bytes   int64
+	// statistics
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	evictions     atomic.Uint64
+	expirations   atomic.Uint64
+	invalidations atomic.Uint64
+	flushes       atomic.Uint64
+}
+
+type cacheEntry struct {
+	request string
+	key     string
+	reply   *resp.Object
+	expire  time.Time
+	size    int64
+}
+
+// CacheStats is the statistics of cache
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Expirations   uint64
+	Invalidations uint64
+	Flushes       uint64
+	Keys          int
+	Entries       int
+	Bytes         int64
+}
+
+// NewCache returns a cache of the comma separated commands on keys matching any of the
+// comma separated glob patterns
+func NewCache(patterns, commands string, ttl time.Duration, maxBytes int64) (*Cache, error) {
+	c := &Cache{
+		commands: make(map[string]bool),
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		keys:     make(map[string]map[*cacheEntry]bool),
+		writing:  make(map[string]int),
+	}
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			c.patterns = append(c.patterns, pattern)
+		}
+	}
+	if len(c.patterns) == 0 {
+		return nil, fmt.Errorf("no key pattern")
+	}
+	for _, name := range strings.Split(commands, ",") {
+		if name = strings.ToUpper(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		spec := LookupCommand(&resp.Command{Args: []string{name}})
+		if spec == nil || spec.Flags&COMMAND_FLAG_READONLY == 0 {
+			return nil, fmt.Errorf("%s is not a read command", name)
+		}
+		c.commands[name] = true
+	}
+	if len(c.commands) == 0 {
+		return nil, fmt.Errorf("no command")
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid ttl %v", ttl)
+	}
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("invalid max bytes %d", maxBytes)
+	}
+	return c, nil
+}
+
+// matches returns whether key matches any pattern of cached keys
+func (c *Cache) matches(key string) bool {
+	for _, pattern := range c.patterns {
+		if StringMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cacheable returns whether the reply of cmd is cached, cmd must be one of the commands
+// reading a single key matching the patterns
+func (c *Cache) Cacheable(cmd *resp.Command) bool {
+	if !c.commands[cmd.Name()] {
+		return false
+	}
+	keys := CmdKeys(cmd)
+	return len(keys) == 1 && c.matches(keys[0])
+}
+
+// cacheRequest returns the key of the entry of cmd read as backend user
+func cacheRequest(user string, cmd *resp.Command) string {
+	return user + " " + string(cmd.Format())
+}
+
+// Get returns the reply of a cacheable cmd read as backend user in backend's protocol,
+// nil if it's not cached
+func (c *Cache) Get(user string, cmd *resp.Command) *resp.Object {
+	request := cacheRequest(user, cmd)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[request]; ok {
+		entry := e.Value.(*cacheEntry)
+		if time.Now().Before(entry.expire) {
+			c.lru.MoveToFront(e)
+			c.hits.Add(1)
+			return entry.reply
+		}
+		c.remove(entry)
+		c.expirations.Add(1)
+	}
+	c.misses.Add(1)
+	return nil
+}
+
+// put caches reply of a cacheable cmd read as backend user, called by the reader of the
+// backend connection tracking the key before any invalidation read after the reply
+func (c *Cache) put(user string, cmd *resp.Command, reply []byte) {
+	if len(reply) == 0 || reply[0] == resp.T_Error || reply[0] == resp.T_BlobError {
+		return
+	}
+	key := CmdKeys(cmd)[0]
+	request := cacheRequest(user, cmd)
+	size := int64(len(request)+len(key)+len(reply)) + CACHE_ENTRY_OVERHEAD
+	if size > c.maxBytes {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// the reply may be older than a write not replied yet, or the one already cached
+	if c.writing[key] > 0 {
+		return
+	}
+	if _, ok := c.entries[request]; ok {
+		return
+	}
+	entry := &cacheEntry{
+		request: request,
+		key:     key,
+		reply:   &resp.Object{},
+		expire:  time.Now().Add(c.ttl),
+		size:    size,
+	}
+	entry.reply.Append(reply)
+	c.entries[request] = c.lru.PushFront(entry)
+	if c.keys[key] == nil {
+		c.keys[key] = make(map[*cacheEntry]bool)
+	}
+	c.keys[key][entry] = true
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+		c.evictions.Add(1)
+	}
+}
+
+// remove removes entry, the lock must be held
+func (c *Cache) remove(entry *cacheEntry) {
+	e, ok := c.entries[entry.request]
+	if !ok {
+		return
+	}
+	c.lru.Remove(e)
+	delete(c.entries, entry.request)
+	if entries := c.keys[entry.key]; entries != nil {
+		delete(entries, entry)
+		if len(entries) == 0 {
+			delete(c.keys, entry.key)
+		}
+	}
+	c.bytes -= entry.size
+}
+
+// invalidate removes the entries of keys, the lock must be held
+func (c *Cache) invalidate(keys []string) {
+	for _, key := range keys {
+		for entry := range c.keys[key] {
+			c.remove(entry)
+			c.invalidations.Add(1)
+		}
+	}
+}
+
+// Invalidate removes the entries of keys
+func (c *Cache) Invalidate(keys []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.invalidate(keys)
+}
+
+// Flush removes all the entries
+func (c *Cache) Flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.keys = make(map[string]map[*cacheEntry]bool)
+	c.bytes = 0
+	c.flushes.Add(1)
+}
+
+// handlePush handles a push frame read from a backend connection, it's either an
+// invalidation of keys or a flush if keys are null
+func (c *Cache) handlePush(data *resp.Data) {
+	if len(data.Array) < 2 || !strings.EqualFold(string(data.Array[0].String), "invalidate") {
+		return
+	}
+	keys := data.Array[1]
+	if keys.T == resp.T_Null || keys.IsNil {
+		// FLUSHALL or FLUSHDB
+		c.Flush()
+		return
+	}
+	names := make([]string, len(keys.Array))
+	for i, key := range keys.Array {
+		names[i] = string(key.String)
+	}
+	c.Invalidate(names)
+}
+
+// BeginWrite invalidates keys about to be written, they are neither cached nor hit
+// until EndWrite, it returns the keys cached which EndWrite must be called with
+func (c *Cache) BeginWrite(keys []string) []string {
+	var writing []string
+	for _, key := range keys {
+		if c.matches(key) {
+			writing = append(writing, key)
+		}
+	}
+	if len(writing) == 0 {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.invalidate(writing)
+	for _, key := range writing {
+		c.writing[key]++
+	}
+	return writing
+}
+
+// EndWrite is called once the write of keys begun is replied
+func (c *Cache) EndWrite(keys []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range keys {
+		if c.writing[key]--; c.writing[key] <= 0 {
+			delete(c.writing, key)
+		}
+	}
+}
+
+// Stats returns the statistics of cache
+func (c *Cache) Stats() CacheStats {
+	c.lock.Lock()
+	keys, entries, bytes := len(c.keys), len(c.entries), c.bytes
+	c.lock.Unlock()
+	return CacheStats{
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Evictions:     c.evictions.Load(),
+		Expirations:   c.expirations.Load(),
+		Invalidations: c.invalidations.Load(),
+		Flushes:       c.flushes.Load(),
+		Keys:          keys,
+		Entries:       entries,
+		Bytes:         bytes,
+	}
+}
+
+// cacheWrites returns the keys cmd writes, which are the keys of commands queued
+// in a transaction for EXEC, called by reader only
+func (s *Session) cacheWrites(cmd *resp.Command) []string {
+	if cmd.Name() == "EXEC" {
+		if s.tx == nil {
+			return nil
+		}
+		var keys []string
+		for _, queued := range s.tx.queued {
+			keys = append(keys, writtenKeys(queued)...)
+		}
+		return keys
+	}
+	if s.tx != nil && s.tx.Multi() {
+		return nil
+	}
+	return writtenKeys(cmd)
+}
+
+// writtenKeys returns the keys of cmd sent to backend which may write them
+func writtenKeys(cmd *resp.Command) []string {
+	switch CmdFlag(cmd) {
+	case CMD_FLAG_GENERAL, CMD_FLAG_BLOCKING:
+		return CmdKeys(cmd)
+	default:
+		return nil
+	}
+}
+
+// handleCachedCmd replies cmd from cache, it returns false if the reply is not cached
+func (s *Session) handleCachedCmd(cmd *resp.Command) bool {
+	reply := s.cache.Get(s.backend().user, cmd)
+	if reply == nil {
+		return false
+	}
+	s.reqWg.Add(1)
+	s.backQ <- &PipelineResponse{
+		rsp: reply,
+		ctx: &PipelineRequest{
+			cmd: cmd,
+			seq: s.getNextReqSeq(),
+			wg:  s.reqWg,
+		},
+	}
+	return true
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestCache(t *testing.T) {
+	if _, err := NewCache("user:*", "GET,SET", time.Second, 1024); err == nil {
+		t.Error("expected write command rejected")
+	}
+	cache, err := NewCache("user:*, config", "get,hgetall", time.Second, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := func(args ...string) *resp.Command {
+		cmd, _ := resp.NewCommand(args...)
+		return cmd
+	}
+	for _, c := range []struct {
+		cmd       *resp.Command
+		cacheable bool
+	}{
+		{command("GET", "user:1"), true},
+		{command("HGETALL", "config"), true},
+		{command("GET", "order:1"), false},
+		{command("STRLEN", "user:1"), false},
+		{command("MGET", "user:1", "user:2"), false},
+	} {
+		if cacheable := cache.Cacheable(c.cmd); cacheable != c.cacheable {
+			t.Errorf("expected %v cacheable %v", c.cmd.Args, c.cacheable)
+		}
+	}
+
+	get := command("GET", "user:1")
+	if cache.Get("", get) != nil {
+		t.Error("expected miss")
+	}
+	cache.put("", get, []byte("$1\r\na\r\n"))
+	if reply := cache.Get("", get); reply == nil || string(reply.Raw()) != "$1\r\na\r\n" {
+		t.Errorf("expected hit, got %v", reply)
+	}
+	cache.put("", command("GET", "user:2"), []byte("-ERR\r\n"))
+	if cache.Get("", command("GET", "user:2")) != nil {
+		t.Error("expected error not cached")
+	}
+
+	// a key being written is neither cached nor hit until replied
+	writes := cache.BeginWrite([]string{"user:1", "order:1"})
+	if len(writes) != 1 || writes[0] != "user:1" {
+		t.Errorf("expected user:1 written, got %v", writes)
+	}
+	cache.put("", get, []byte("$1\r\na\r\n"))
+	if cache.Get("", get) != nil {
+		t.Error("expected miss while writing")
+	}
+	cache.EndWrite(writes)
+	cache.put("", get, []byte("$1\r\nb\r\n"))
+	if reply := cache.Get("", get); reply == nil || string(reply.Raw()) != "$1\r\nb\r\n" {
+		t.Errorf("expected hit after written, got %v", reply)
+	}
+
+	cache.handlePush(&resp.Data{T: resp.T_Push, Array: []*resp.Data{
+		{T: resp.T_BulkString, String: []byte("invalidate")},
+		{T: resp.T_Array, Array: []*resp.Data{{T: resp.T_BulkString, String: []byte("user:1")}}},
+	}})
+	if cache.Get("", get) != nil {
+		t.Error("expected invalidated")
+	}
+
+	// the least recently used entries are evicted
+	for _, key := range []string{"user:1", "user:2", "user:3"} {
+		cache.put("", command("GET", key), make([]byte, 150))
+	}
+	cache.Get("", command("GET", "user:1"))
+	cache.put("", command("GET", "user:4"), make([]byte, 150))
+	if cache.Get("", command("GET", "user:2")) != nil || cache.Get("", command("GET", "user:1")) == nil {
+		t.Error("expected the least recently used evicted")
+	}
+	stats := cache.Stats()
+	if stats.Entries != 3 || stats.Bytes > 1024 || stats.Evictions != 1 || stats.Invalidations != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	cache.handlePush(&resp.Data{T: resp.T_Push, Array: []*resp.Data{
+		{T: resp.T_BulkString, String: []byte("invalidate")},
+		{T: resp.T_Null},
+	}})
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Keys != 0 || stats.Bytes != 0 || stats.Flushes != 1 {
+		t.Errorf("expected flushed, got %+v", stats)
+	}
+
+	cache.ttl = time.Millisecond
+	cache.put("", get, []byte("$1\r\na\r\n"))
+	time.Sleep(2 * time.Millisecond)
+	if cache.Get("", get) != nil || cache.Stats().Expirations != 1 {
+		t.Error("expected expired")
+	}
+
+	// a reply read as a backend user is not hit by sessions of the others
+	cache.ttl = time.Second
+	cache.put("team-a", get, []byte("$1\r\nc\r\n"))
+	if cache.Get("team-b", get) != nil || cache.Get("", get) != nil {
+		t.Error("expected miss of other backend users")
+	}
+	if reply := cache.Get("team-a", get); reply == nil || string(reply.Raw()) != "$1\r\nc\r\n" {
+		t.Errorf("expected hit of the same backend user, got %v", reply)
+	}
+}
+
+// trackingBackend replies GET with the value of key, and invalidates the key on DEL
+// before replying it like a connection with tracking on
+func trackingBackend(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					cmd, err := resp.ReadCommand(r)
+					if err != nil {
+						return
+					}
+					var reply string
+					switch cmd.Name() {
+					case "GET":
+						reply = "$1\r\nv\r\n"
+					case "DEL":
+						reply = fmt.Sprintf(">2\r\n$10\r\ninvalidate\r\n*1\r\n$%d\r\n%s\r\n:1\r\n", len(cmd.Args[1]), cmd.Args[1])
+					default:
+						reply = "+OK\r\n"
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestBackendServerCache(t *testing.T) {
+	l := trackingBackend(t)
+	defer l.Close()
+	cache, _ := NewCache("*", "GET", time.Minute, 1024)
+	tr := NewBackendServer(l.Addr().String(), NewValkeyConn(1, time.Second, "", false), cache)
+	defer tr.Close()
+	backQ := make(chan *PipelineResponse, 10)
+	request := func(cacheable bool, args ...string) string {
+		t.Helper()
+		cmd, _ := resp.NewCommand(args...)
+		if err := tr.Request(&PipelineRequest{cmd: cmd, backQ: backQ, cacheable: cacheable}); err != nil {
+			t.Fatal(err)
+		}
+		rsp := <-backQ
+		if rsp.err != nil {
+			t.Fatal(rsp.err)
+		}
+		return string(rsp.rsp.Raw())
+	}
+
+	get, _ := resp.NewCommand("GET", "k")
+	if reply := request(true, "GET", "k"); reply != "$1\r\nv\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := cache.Get("", get); reply == nil || string(reply.Raw()) != "$1\r\nv\r\n" {
+		t.Errorf("expected cached, got %v", reply)
+	}
+	// the invalidation is read before the reply of DEL
+	if reply := request(false, "DEL", "k"); reply != ":1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if cache.Get("", get) != nil {
+		t.Error("expected invalidated")
+	}
+
+	request(true, "GET", "k")
+	tr.Close()
+	for deadline := time.Now().Add(time.Second); cache.Stats().Entries > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cache.Stats().Entries > 0 {
+		t.Error("expected flushed once the connection is lost")
+	}
+}
@@ -1,4 +1,598 @@
 package proxy
 
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+/*
+Channel holds the dedicated backend connections of a session in subscriber mode.
+
+Classic subscriptions share one link to a random master, messages are propagated
+to the whole cluster so any node works. Sharded subscriptions are fanned out to
+one link per owner of the channel slot, and their frames are merged onto the
+client connection with subscription counts rewritten from the proxy's view.
+
+Subscriptions are tracked at proxy side, so that when a link is broken, its
+node leaves the cluster or a slot moves after a topology reload, channel
+reconnects and resubscribes silently, swallowing confirmations client never
+asked for.
+
+Sharded channels are moved by the channel's own goroutine, topology changes and
+broken links only record the channels to move, so that neither the dispatcher nor
+the reading loops wait for dialing the new owners.
+*/
 type Channel struct {
+	session *Session
+	lock    sync.Mutex
+	classic *channelLink
+	// links of sharded channels keyed by server
+	shards   map[string]*channelLink
+	channels map[string]bool
+	patterns map[string]bool
+	// sharded channel -> the link it is subscribed through, nil if pending
+	shardChannels map[string]*channelLink
+	// number of classic subscribe confirmations to swallow
+	silent int
+	// sharded channel -> number of ssubscribe confirmations to swallow
+	shardSilent map[string]int
+	// number of sharded subscriptions reported to client
+	shardCount int
+	// sharded channels pending to move to their new owners
+	moving map[string]shardMove
+	// all servers of the latest topology not applied yet
+	topology atomic.Pointer[map[string]bool]
+	// wakes up the moving loop
+	moveSignal chan struct{}
+	done       chan struct{}
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// shardMove is the owner a sharded channel is moving to, and whether its
+// ssubscribe confirmation is swallowed
+type shardMove struct {
+	server string
+	silent bool
+}
+
+type channelLink struct {
+	server string
+	conn   net.Conn
+	shard  bool
+	// sharded channels subscribed through this link
+	channels map[string]bool
+	closing  bool
+}
+
+func NewChannel(session *Session) *Channel {
+	c := &Channel{
+		session:       session,
+		shards:        make(map[string]*channelLink),
+		channels:      make(map[string]bool),
+		patterns:      make(map[string]bool),
+		shardChannels: make(map[string]*channelLink),
+		shardSilent:   make(map[string]int),
+		moving:        make(map[string]shardMove),
+		moveSignal:    make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.moveLoop()
+	session.dispatcher.AddTopologyListener(c, c.onTopologyChanged)
+	return c
+}
+
+// Subscribed returns whether any channel, pattern or sharded channel is subscribed
+func (c *Channel) Subscribed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.channels)+len(c.patterns)+len(c.shardChannels) > 0
+}
+
+// Request records the subscription change of cmd and sends it to backend.
+// A broken link is recovered by its reading loop, which also resubscribes
+// with the subscriptions recorded here.
+func (c *Channel) Request(cmd *resp.Command) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch cmd.Name() {
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if c.classic == nil {
+			link, err := c.openLink(c.session.dispatcher.slotTable.WriteServer(rand.Intn(NumSlots)), false)
+			if err != nil {
+				return err
+			}
+			c.classic = link
+		}
+		if cmd.Name() == "SUBSCRIBE" {
+			c.record(c.channels, cmd.Args[1:], true)
+		} else {
+			c.record(c.patterns, cmd.Args[1:], true)
+		}
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		if c.classic == nil {
+			c.unsubscribeNothing(cmd, 0)
+			return nil
+		}
+		if cmd.Name() == "UNSUBSCRIBE" {
+			c.record(c.channels, cmd.Args[1:], false)
+		} else {
+			c.record(c.patterns, cmd.Args[1:], false)
+		}
+	case "SSUBSCRIBE":
+		return c.shardSubscribe(cmd.Args[1:])
+	case "SUNSUBSCRIBE":
+		c.shardUnsubscribe(cmd)
+		return nil
+	default:
+		return fmt.Errorf("unexpected command %s", cmd.Name())
+	}
+	c.write(c.classic, cmd)
+	return nil
+}
+
+func (c *Channel) record(subscriptions map[string]bool, names []string, subscribe bool) {
+	if !subscribe && len(names) == 0 {
+		clear(subscriptions)
+	}
+	for _, name := range names {
+		if subscribe {
+			subscriptions[name] = true
+		} else {
+			delete(subscriptions, name)
+		}
+	}
+}
+
+// shardSubscribe subscribes sharded channels on the owner of their slots,
+// valkey requires the channels of one SSUBSCRIBE to be in the same slot
+func (c *Channel) shardSubscribe(names []string) error {
+	slots := make(map[int][]string)
+	var order []int
+	for _, name := range names {
+		slot := Key2Slot(name)
+		if _, ok := slots[slot]; !ok {
+			order = append(order, slot)
+		}
+		slots[slot] = append(slots[slot], name)
+	}
+	for _, slot := range order {
+		link, err := c.shardLink(c.session.dispatcher.slotTable.WriteServer(slot))
+		if err != nil {
+			return err
+		}
+		for _, name := range slots[slot] {
+			if old := c.shardChannels[name]; old != nil && old != link {
+				delete(old.channels, name)
+			}
+			c.shardChannels[name] = link
+			link.channels[name] = true
+		}
+		cmd, _ := resp.NewCommand(append([]string{"SSUBSCRIBE"}, slots[slot]...)...)
+		c.write(link, cmd)
+	}
+	return nil
+}
+
+func (c *Channel) shardUnsubscribe(cmd *resp.Command) {
+	if len(cmd.Args) == 1 {
+		if len(c.shardChannels) == 0 {
+			c.unsubscribeNothing(cmd, 0)
+			return
+		}
+		for name, link := range c.shardChannels {
+			if link == nil {
+				// pending to resubscribe, no server confirms it
+				c.shardCount--
+				delete(c.shardSilent, name)
+				c.unsubscribeNothing(&resp.Command{Args: []string{cmd.Name(), name}}, c.shardCount)
+			}
+		}
+		clear(c.shardChannels)
+		for _, link := range c.shards {
+			if len(link.channels) > 0 {
+				clear(link.channels)
+				c.write(link, cmd)
+			}
+		}
+		return
+	}
+	for _, name := range cmd.Args[1:] {
+		link, ok := c.shardChannels[name]
+		delete(c.shardChannels, name)
+		if link == nil {
+			// never subscribed or pending to resubscribe
+			if ok {
+				c.shardCount--
+				delete(c.shardSilent, name)
+			}
+			c.unsubscribeNothing(&resp.Command{Args: []string{cmd.Name(), name}}, c.shardCount)
+			continue
+		}
+		delete(link.channels, name)
+		unsubscribe, _ := resp.NewCommand("SUNSUBSCRIBE", name)
+		c.write(link, unsubscribe)
+	}
+}
+
+// unsubscribeNothing replies unsubscribe confirmations of channels not subscribed
+func (c *Channel) unsubscribeNothing(cmd *resp.Command, count int) {
+	kind := &resp.Data{T: resp.T_BulkString, String: []byte(strings.ToLower(cmd.Name()))}
+	total := &resp.Data{T: resp.T_Integer, Integer: int64(count)}
+	if len(cmd.Args) == 1 {
+		c.session.push(&resp.Data{T: resp.T_Push, Array: []*resp.Data{kind, {T: resp.T_Null}, total}})
+	}
+	for _, name := range cmd.Args[1:] {
+		c.session.push(&resp.Data{T: resp.T_Push, Array: []*resp.Data{kind, {T: resp.T_BulkString, String: []byte(name)}, total}})
+	}
+}
+
+// moveShardChannel resubscribes a sharded channel on server in the moving loop,
+// the confirmation is swallowed if silent
+func (c *Channel) moveShardChannel(name, server string, silent bool) {
+	if old := c.shardChannels[name]; old != nil {
+		if old.server == server {
+			return
+		}
+		delete(old.channels, name)
+		// its sunsubscribe confirmation is swallowed since the channel is still wanted
+		unsubscribe, _ := resp.NewCommand("SUNSUBSCRIBE", name)
+		c.write(old, unsubscribe)
+		c.closeIdleLink(old)
+	}
+	c.shardChannels[name] = nil
+	if move, ok := c.moving[name]; ok {
+		// the client still waits for the confirmation of a move not swallowed
+		silent = silent && move.silent
+	}
+	c.moving[name] = shardMove{server: server, silent: silent}
+	c.signalMove()
+}
+
+func (c *Channel) signalMove() {
+	select {
+	case c.moveSignal <- struct{}{}:
+	default:
+	}
+}
+
+// moveLoop applies topology changes and moves the pending sharded channels,
+// links to new owners are dialed without holding the lock
+func (c *Channel) moveLoop() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.moveSignal:
+		}
+		c.lock.Lock()
+		if servers := c.topology.Swap(nil); servers != nil {
+			c.applyTopology(*servers)
+		}
+		dials := make(map[string]bool)
+		for _, move := range c.moving {
+			if c.shards[move.server] == nil {
+				dials[move.server] = true
+			}
+		}
+		c.lock.Unlock()
+
+		conns := make(map[string]net.Conn)
+		for server := range dials {
+			conn, err := c.session.backend().Conn(server)
+			if err != nil {
+				glog.Errorf("open sharded channel link to %s failed: %v", server, err)
+				continue
+			}
+			conns[server] = conn
+		}
+
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return
+		}
+		for server, conn := range conns {
+			if c.shards[server] != nil {
+				conn.Close()
+				continue
+			}
+			c.shards[server] = c.startLink(server, conn, true)
+		}
+		pending := false
+		for name, move := range c.moving {
+			if link, wanted := c.shardChannels[name]; !wanted || link != nil {
+				// unsubscribed or subscribed again by client meanwhile
+				delete(c.moving, name)
+				continue
+			}
+			link := c.shards[move.server]
+			if link == nil {
+				pending = true
+				continue
+			}
+			delete(c.moving, name)
+			glog.Infof("move sharded channel %s to %s", name, move.server)
+			c.shardChannels[name] = link
+			link.channels[name] = true
+			if move.silent {
+				c.shardSilent[name]++
+			}
+			subscribe, _ := resp.NewCommand("SSUBSCRIBE", name)
+			c.write(link, subscribe)
+		}
+		for server := range conns {
+			c.closeIdleLink(c.shards[server])
+		}
+		c.lock.Unlock()
+		if pending {
+			// leave them pending, they are retried after next topology reload
+			c.session.dispatcher.TriggerReloadSlots()
+		}
+	}
+}
+
+func (c *Channel) shardLink(server string) (*channelLink, error) {
+	if link, ok := c.shards[server]; ok {
+		return link, nil
+	}
+	link, err := c.openLink(server, true)
+	if err != nil {
+		return nil, err
+	}
+	c.shards[server] = link
+	return link, nil
+}
+
+func (c *Channel) openLink(server string, shard bool) (*channelLink, error) {
+	conn, err := c.session.backend().Conn(server)
+	if err != nil {
+		return nil, err
+	}
+	return c.startLink(server, conn, shard), nil
+}
+
+// startLink starts the reading loop of a link on conn, the lock must be held
+func (c *Channel) startLink(server string, conn net.Conn, shard bool) *channelLink {
+	link := &channelLink{server: server, conn: conn, shard: shard, channels: make(map[string]bool)}
+	c.wg.Add(1)
+	go c.loop(link)
+	return link
+}
+
+func (c *Channel) closeIdleLink(link *channelLink) {
+	if link != nil && link.shard && len(link.channels) == 0 {
+		link.closing = true
+		link.conn.Close()
+		delete(c.shards, link.server)
+	}
+}
+
+func (c *Channel) write(link *channelLink, cmd *resp.Command) {
+	if _, err := link.conn.Write(cmd.Format()); err != nil {
+		glog.Errorf("write %s to channel %s failed: %v", cmd.Name(), link.server, err)
+		link.conn.Close()
+	}
+}
+
+// Close closes all backend links and waits for their reading loops to exit
+func (c *Channel) Close() {
+	c.session.dispatcher.RemoveTopologyListener(c)
+	c.lock.Lock()
+	if !c.closed {
+		close(c.done)
+	}
+	c.closed = true
+	if c.classic != nil {
+		c.classic.conn.Close()
+	}
+	for _, link := range c.shards {
+		link.conn.Close()
+	}
+	c.lock.Unlock()
+	c.wg.Wait()
+}
+
+func (c *Channel) loop(link *channelLink) {
+	defer c.wg.Done()
+	for {
+		c.lock.Lock()
+		r := bufio.NewReader(link.conn)
+		c.lock.Unlock()
+		for {
+			data, err := resp.ReadData(r)
+			if err != nil {
+				glog.V(2).Infof("read channel: %v", err)
+				break
+			}
+			if c.handleFrame(link, data) {
+				c.session.push(data)
+			}
+		}
+		if !c.recover(link) {
+			return
+		}
+	}
+}
+
+// handleFrame updates subscription state with a frame read from link and
+// returns whether it should be forwarded to client
+func (c *Channel) handleFrame(link *channelLink, data *resp.Data) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if data.IsError() {
+		if link.shard && bytes.HasPrefix(data.String, MOVED[1:]) {
+			slot, server := ParseRedirectInfo(string(data.String))
+			c.session.dispatcher.TriggerReloadSlots()
+			for name := range link.channels {
+				if Key2Slot(name) == slot {
+					c.moveShardChannel(name, server, false)
+				}
+			}
+			return false
+		}
+		return true
+	}
+	if len(data.Array) < 2 {
+		return true
+	}
+	name := string(data.Array[1].String)
+	switch strings.ToLower(string(data.Array[0].String)) {
+	case "subscribe", "psubscribe":
+		if c.silent > 0 {
+			c.silent--
+			return false
+		}
+	case "ssubscribe":
+		if c.shardSilent[name] > 0 {
+			if c.shardSilent[name]--; c.shardSilent[name] == 0 {
+				delete(c.shardSilent, name)
+			}
+			return false
+		}
+		c.shardCount++
+		c.rewriteCount(data)
+	case "sunsubscribe":
+		if _, wanted := c.shardChannels[name]; wanted {
+			// unsubscribed by server on slot migration, or by proxy on moving
+			if c.shardChannels[name] == link {
+				delete(link.channels, name)
+				c.shardChannels[name] = nil
+				c.session.dispatcher.TriggerReloadSlots()
+				// otherwise it is pending until slot table is reloaded
+				if server := c.session.dispatcher.slotTable.WriteServer(Key2Slot(name)); server != link.server {
+					c.moveShardChannel(name, server, true)
+				}
+			}
+			return false
+		}
+		if c.shardCount > 0 {
+			c.shardCount--
+		}
+		c.rewriteCount(data)
+	case "smessage":
+		// drop duplicates delivered by the old owner while moving
+		return c.shardChannels[name] == link
+	}
+	return true
+}
+
+func (c *Channel) rewriteCount(data *resp.Data) {
+	if len(data.Array) == 3 {
+		data.Array[2] = &resp.Data{T: resp.T_Integer, Integer: int64(c.shardCount)}
+	}
+}
+
+// recover reconnects and resubscribes a broken link, it returns whether the
+// reading loop should continue on the link
+func (c *Channel) recover(link *channelLink) bool {
+	for {
+		c.lock.Lock()
+		if c.closed || link.closing {
+			c.lock.Unlock()
+			return false
+		}
+		if link.shard {
+			c.recoverShard(link)
+			c.lock.Unlock()
+			return false
+		}
+		link.conn.Close()
+		server := c.session.dispatcher.slotTable.WriteServer(rand.Intn(NumSlots))
+		c.lock.Unlock()
+
+		// dial without the lock, frames of the other links keep flowing meanwhile
+		conn, err := c.session.backend().Conn(server)
+		if err == nil {
+			c.lock.Lock()
+			if c.closed {
+				c.lock.Unlock()
+				conn.Close()
+				return false
+			}
+			err = c.resubscribe(link, server, conn)
+			c.lock.Unlock()
+			if err == nil {
+				return true
+			}
+		}
+		glog.Errorf("resubscribe failed: %v", err)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// resubscribe moves classic link to conn of a random master
+func (c *Channel) resubscribe(link *channelLink, server string, conn net.Conn) error {
+	link.server, link.conn = server, conn
+	glog.Infof("resubscribe %d channels and %d patterns on %s", len(c.channels), len(c.patterns), server)
+	c.silent = 0
+	for name, subscriptions := range map[string]map[string]bool{"SUBSCRIBE": c.channels, "PSUBSCRIBE": c.patterns} {
+		if len(subscriptions) == 0 {
+			continue
+		}
+		args := []string{name}
+		for subscription := range subscriptions {
+			args = append(args, subscription)
+		}
+		cmd, _ := resp.NewCommand(args...)
+		if _, err := conn.Write(cmd.Format()); err != nil {
+			return err
+		}
+		c.silent += len(subscriptions)
+	}
+	return nil
+}
+
+// recoverShard moves the sharded channels of a broken link to their owners,
+// new links are opened with their own reading loops
+func (c *Channel) recoverShard(link *channelLink) {
+	if c.shards[link.server] == link {
+		delete(c.shards, link.server)
+	}
+	link.closing = true
+	c.session.dispatcher.TriggerReloadSlots()
+	for name := range link.channels {
+		if c.shardChannels[name] == link {
+			c.shardChannels[name] = nil
+			c.moveShardChannel(name, c.session.dispatcher.slotTable.WriteServer(Key2Slot(name)), true)
+		}
+	}
+}
+
+// onTopologyChanged records servers of the new topology for the moving loop,
+// it's called by dispatcher and never waits for the lock
+func (c *Channel) onTopologyChanged(servers map[string]bool) {
+	c.topology.Store(&servers)
+	c.signalMove()
+}
+
+// applyTopology closes the classic link if its server left cluster, and records
+// the sharded channels whose slots moved, the lock must be held
+func (c *Channel) applyTopology(servers map[string]bool) {
+	if c.classic != nil && !servers[c.classic.server] {
+		glog.Infof("channel server %s left cluster", c.classic.server)
+		// the reading loop will reconnect and resubscribe
+		c.classic.conn.Close()
+	}
+	for name, link := range c.shardChannels {
+		server := c.session.dispatcher.slotTable.WriteServer(Key2Slot(name))
+		if link == nil || link.server != server {
+			c.moveShardChannel(name, server, true)
+		}
+	}
 }
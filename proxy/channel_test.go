@@ -0,0 +1,415 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// kind of subscriptions by command, prefixing subscriptions recorded by pubsubBackend
+var pubsubKinds = map[string]string{
+	"SUBSCRIBE": "channel", "UNSUBSCRIBE": "channel",
+	"PSUBSCRIBE": "p", "PUNSUBSCRIBE": "p",
+	"SSUBSCRIBE": "s", "SUNSUBSCRIBE": "s",
+}
+
+// pubsubBackend is a node replying subscribe commands like valkey in RESP2, every
+// command it reads is logged
+type pubsubBackend struct {
+	l        net.Listener
+	lock     sync.Mutex
+	conns    map[net.Conn]map[string]bool
+	commands []string
+}
+
+func newPubsubBackend(t *testing.T) *pubsubBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &pubsubBackend{l: l, conns: make(map[net.Conn]map[string]bool)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.lock.Lock()
+			b.conns[conn] = make(map[string]bool)
+			b.lock.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *pubsubBackend) addr() string {
+	return b.l.Addr().String()
+}
+
+func (b *pubsubBackend) serve(conn net.Conn) {
+	defer func() {
+		b.lock.Lock()
+		delete(b.conns, conn)
+		b.lock.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		cmd, err := resp.ReadCommand(r)
+		if err != nil {
+			return
+		}
+		b.lock.Lock()
+		b.commands = append(b.commands, strings.Join(cmd.Args, " "))
+		var reply []byte
+		switch name := cmd.Name(); name {
+		case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE":
+			kind := pubsubKinds[name]
+			subscriptions := b.conns[conn]
+			names := cmd.Args[1:]
+			if len(names) == 0 {
+				for subscription := range subscriptions {
+					if prefix := kind + ":"; strings.HasPrefix(subscription, prefix) {
+						names = append(names, strings.TrimPrefix(subscription, prefix))
+					}
+				}
+			}
+			for _, n := range names {
+				if strings.Contains(name, "UNSUBSCRIBE") {
+					delete(subscriptions, kind+":"+n)
+				} else {
+					subscriptions[kind+":"+n] = true
+				}
+				reply = append(reply, pubsubFrame(strings.ToLower(name), n, b.count(conn, kind == "s"))...)
+			}
+		default:
+			reply = []byte("+OK\r\n")
+		}
+		b.lock.Unlock()
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// count returns the number of classic or sharded subscriptions of conn, the lock must be held
+func (b *pubsubBackend) count(conn net.Conn, shard bool) int {
+	n := 0
+	for subscription := range b.conns[conn] {
+		if strings.HasPrefix(subscription, "s:") == shard {
+			n++
+		}
+	}
+	return n
+}
+
+// publish sends message to the connections subscribed to channel, sharded if smessage
+func (b *pubsubBackend) publish(kind, channel, message string) {
+	subscription := "channel:" + channel
+	if kind == "smessage" {
+		subscription = "s:" + channel
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for conn, subscriptions := range b.conns {
+		if subscriptions[subscription] {
+			conn.Write(pubsubFrame(kind, channel, message))
+		}
+	}
+}
+
+// subscribed returns the number of connections with subscription, which is the name
+// prefixed with its kind
+func (b *pubsubBackend) subscribed(subscription string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n := 0
+	for _, subscriptions := range b.conns {
+		if subscriptions[subscription] {
+			n++
+		}
+	}
+	return n
+}
+
+// received returns the commands read by backend
+func (b *pubsubBackend) received() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string(nil), b.commands...)
+}
+
+// closeConns breaks all the connections accepted
+func (b *pubsubBackend) closeConns() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+func (b *pubsubBackend) Close() {
+	b.l.Close()
+	b.closeConns()
+}
+
+func pubsubFrame(kind, name string, last any) []byte {
+	frame := "*3\r\n$" + strconv.Itoa(len(kind)) + "\r\n" + kind + "\r\n$" + strconv.Itoa(len(name)) + "\r\n" + name + "\r\n"
+	if count, ok := last.(int); ok {
+		return []byte(frame + ":" + strconv.Itoa(count) + "\r\n")
+	}
+	message := last.(string)
+	return []byte(frame + "$" + strconv.Itoa(len(message)) + "\r\n" + message + "\r\n")
+}
+
+// pubsubClient is a client of a session served with slots 0-8191 on backend a
+// and the rest on backend b
+type pubsubClient struct {
+	t          *testing.T
+	conn       net.Conn
+	r          *bufio.Reader
+	dispatcher *Dispatcher
+	session    *Session
+}
+
+func newPubsubClient(t *testing.T, a, b *pubsubBackend) *pubsubClient {
+	conn, client := net.Pipe()
+	valkeyConn := NewValkeyConn(1, time.Second, "", false)
+	dispatcher := NewDispatcher(nil, 0, valkeyConn, 0)
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: 8191, write: a.addr()})
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 8192, end: NumSlots - 1, write: b.addr()})
+	s := newTestSession(conn)
+	s.dispatcher, s.valkeyConn = dispatcher, valkeyConn
+	serveSession(s)
+	t.Cleanup(func() { client.Close() })
+	return &pubsubClient{t: t, conn: client, r: bufio.NewReader(client), dispatcher: dispatcher, session: s}
+}
+
+func (c *pubsubClient) send(args ...string) {
+	cmd, _ := resp.NewCommand(args...)
+	if _, err := c.conn.Write(cmd.Format()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read returns the next frame with its elements joined by space
+func (c *pubsubClient) read() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := resp.ReadData(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if data.T != resp.T_Array {
+		return string(data.Format())
+	}
+	elements := make([]string, len(data.Array))
+	for i, element := range data.Array {
+		if element.T == resp.T_Integer {
+			elements[i] = strconv.FormatInt(element.Integer, 10)
+		} else {
+			elements[i] = string(element.String)
+		}
+	}
+	return strings.Join(elements, " ")
+}
+
+// expect reads the next frames and checks them
+func (c *pubsubClient) expect(frames ...string) {
+	c.t.Helper()
+	for _, frame := range frames {
+		if got := c.read(); got != frame {
+			c.t.Fatalf("expected %q, got %q", frame, got)
+		}
+	}
+}
+
+// shardChannel returns a channel named with prefix in the slots served by backend a
+// or b, the first half of slots
+func shardChannel(prefix string, first bool) string {
+	for i := 0; ; i++ {
+		name := prefix + strconv.Itoa(i)
+		if (Key2Slot(name) < 8192) == first {
+			return name
+		}
+	}
+}
+
+func TestChannelShardPing(t *testing.T) {
+	a, b := newPubsubBackend(t), newPubsubBackend(t)
+	defer a.Close()
+	defer b.Close()
+	c := newPubsubClient(t, a, b)
+	channel := shardChannel("news", true)
+	c.send("SSUBSCRIBE", channel)
+	c.expect("ssubscribe " + channel + " 1")
+	// a subscriber of sharded channels only has no classic link to ping through
+	c.send("PING")
+	c.expect("pong ")
+	c.send("PING", "hello")
+	c.expect("pong hello")
+}
+
+// waitSubscribed waits until subscription is made on n connections of backend
+func waitSubscribed(t *testing.T, b *pubsubBackend, subscription string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); b.subscribed(subscription) != n; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s subscribed on %d connections of %s, got %d", subscription, n, b.addr(), b.subscribed(subscription))
+		}
+	}
+}
+
+func TestChannelSubscribe(t *testing.T) {
+	a, b := newPubsubBackend(t), newPubsubBackend(t)
+	defer a.Close()
+	defer b.Close()
+	c := newPubsubClient(t, a, b)
+	c.send("SUBSCRIBE", "news", "sports")
+	c.expect("subscribe news 1", "subscribe sports 2")
+	c.send("PSUBSCRIBE", "weather.*")
+	c.expect("psubscribe weather.* 3")
+	// classic messages are propagated to the whole cluster, any node works
+	a.publish("message", "news", "hello")
+	b.publish("message", "news", "hello")
+	c.expect("message news hello")
+	c.send("UNSUBSCRIBE", "news")
+	c.expect("unsubscribe news 2")
+	c.send("PUNSUBSCRIBE")
+	c.expect("punsubscribe weather.* 1")
+	c.send("PING")
+	c.expect("pong ")
+}
+
+func TestChannelResubscribe(t *testing.T) {
+	a, b := newPubsubBackend(t), newPubsubBackend(t)
+	defer a.Close()
+	defer b.Close()
+	c := newPubsubClient(t, a, b)
+	c.send("SUBSCRIBE", "news")
+	c.expect("subscribe news 1")
+	a.closeConns()
+	b.closeConns()
+	resubscribed := func() bool {
+		n := 0
+		for _, cmd := range append(a.received(), b.received()...) {
+			if cmd == "SUBSCRIBE news" {
+				n++
+			}
+		}
+		return n == 2 && a.subscribed("channel:news")+b.subscribed("channel:news") == 1
+	}
+	for deadline := time.Now().Add(2 * time.Second); !resubscribed(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected resubscribed after the link is broken")
+		}
+	}
+	// confirmations of resubscribing are swallowed
+	a.publish("message", "news", "again")
+	b.publish("message", "news", "again")
+	c.expect("message news again")
+}
+
+func TestChannelShardRouting(t *testing.T) {
+	a, b := newPubsubBackend(t), newPubsubBackend(t)
+	defer a.Close()
+	defer b.Close()
+	c := newPubsubClient(t, a, b)
+	first, second := shardChannel("news", true), shardChannel("news", false)
+	c.send("SSUBSCRIBE", first)
+	c.expect("ssubscribe " + first + " 1")
+	// counts are rewritten from the view of proxy, backend b counts only one
+	c.send("SSUBSCRIBE", second)
+	c.expect("ssubscribe " + second + " 2")
+	if a.subscribed("s:"+first) != 1 || b.subscribed("s:"+first) != 0 {
+		t.Errorf("expected %s subscribed on its owner only", first)
+	}
+	if a.subscribed("s:"+second) != 0 || b.subscribed("s:"+second) != 1 {
+		t.Errorf("expected %s subscribed on its owner only", second)
+	}
+	b.publish("smessage", second, "hello")
+	c.expect("smessage " + second + " hello")
+	c.send("SUNSUBSCRIBE", first)
+	c.expect("sunsubscribe " + first + " 1")
+}
+
+func TestChannelShardMove(t *testing.T) {
+	a, b := newPubsubBackend(t), newPubsubBackend(t)
+	defer a.Close()
+	defer b.Close()
+	c := newPubsubClient(t, a, b)
+	channel := shardChannel("news", true)
+	c.send("SSUBSCRIBE", channel)
+	c.expect("ssubscribe " + channel + " 1")
+
+	// the slot of channel moves to backend b
+	c.dispatcher.handleSlotInfoChanged([]*SlotInfo{{start: 0, end: NumSlots - 1, write: b.addr()}})
+	waitSubscribed(t, b, "s:"+channel, 1)
+	waitSubscribed(t, a, "s:"+channel, 0)
+	b.publish("smessage", channel, "moved")
+	// confirmations of moving are swallowed
+	c.expect("smessage " + channel + " moved")
+	c.send("SUNSUBSCRIBE")
+	c.expect("sunsubscribe " + channel + " 0")
+}
+
+func TestChannelShardUnsubscribeAllMoving(t *testing.T) {
+	a, b := newPubsubBackend(t), newPubsubBackend(t)
+	defer a.Close()
+	defer b.Close()
+	c := newPubsubClient(t, a, b)
+	first, second := shardChannel("news", true), shardChannel("news", false)
+	c.send("SSUBSCRIBE", first)
+	c.expect("ssubscribe " + first + " 1")
+	c.send("SSUBSCRIBE", second)
+	c.expect("ssubscribe " + second + " 2")
+
+	// the new owner of first is down, it's pending to move
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	down.Close()
+	c.session.channel.lock.Lock()
+	c.session.channel.moveShardChannel(first, down.Addr().String(), true)
+	c.session.channel.lock.Unlock()
+	waitSubscribed(t, a, "s:"+first, 0)
+
+	c.send("SUNSUBSCRIBE")
+	c.expect("sunsubscribe "+first+" 1", "sunsubscribe "+second+" 0")
+	c.send("PING")
+	c.expect("+PONG\r\n")
+}
+
+func TestChannelTopologyChangedAsync(t *testing.T) {
+	a, b := newPubsubBackend(t), newPubsubBackend(t)
+	defer a.Close()
+	defer b.Close()
+	c := newPubsubClient(t, a, b)
+	channel := shardChannel("news", true)
+	c.send("SSUBSCRIBE", channel)
+	c.expect("ssubscribe " + channel + " 1")
+
+	// dispatcher never waits for a channel busy, eg. reading a frame
+	c.session.channel.lock.Lock()
+	done := make(chan struct{})
+	go func() {
+		c.dispatcher.handleSlotInfoChanged([]*SlotInfo{{start: 0, end: NumSlots - 1, write: b.addr()}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("expected topology change not blocked by channel")
+	}
+	c.session.channel.lock.Unlock()
+	<-done
+	waitSubscribed(t, b, "s:"+channel, 1)
+	waitSubscribed(t, a, "s:"+channel, 0)
+	b.publish("smessage", channel, "moved")
+	c.expect("smessage " + channel + " moved")
+}
@@ -0,0 +1,413 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+var (
+	NO_SUCH_CLIENT_ERR = []byte("ERR No such client")
+	CLIENT_NAME_ERR    = []byte("ERR Client names cannot contain spaces, newlines or special characters.")
+)
+
+var CLIENT_HELP = []string{
+	"CLIENT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"GETNAME",
+	"    Return the name of the current connection.",
+	"ID",
+	"    Return the ID of the current connection.",
+	"INFO",
+	"    Return information about the current client connection.",
+	"KILL <ip:port>",
+	"    Kill connection made from <ip:port>.",
+	"KILL <option> <value> [<option> <value> [...]]",
+	"    Kill connections. Options are:",
+	"    * ADDR (<ip:port>|<unixsocket>:0)",
+	"      Kill connections made from the specified address",
+	"    * LADDR (<ip:port>|<unixsocket>:0)",
+	"      Kill connections made to specified local address",
+	"    * TYPE (NORMAL|PUBSUB)",
+	"      Kill connections by type.",
+	"    * USER <username>",
+	"      Kill connections authenticated by <username>.",
+	"    * ID <client-id>",
+	"      Kill connections by client id.",
+	"    * MAXAGE <maxage>",
+	"      Kill connections older than the specified age.",
+	"    * SKIPME (YES|NO)",
+	"      Skip killing current connection (default: yes).",
+	"LIST [options ...]",
+	"    Return information about client connections of the proxy. Options:",
+	"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+	"      Return clients of specified type.",
+	"    * ID <client-id> [<client-id> ...]",
+	"      Return clients of specified IDs only.",
+	"NO-EVICT (ON|OFF)",
+	"    Protect current client connection from eviction.",
+	"SETNAME <name>",
+	"    Assign the name <name> to the current connection.",
+	"SETINFO <option> <value>",
+	"    Set client meta attr. Options are:",
+	"    * LIB-NAME: the client lib name.",
+	"    * LIB-VER: the client lib version.",
+	"HELP",
+	"    Print this help.",
+}
+
+/*
+CLIENT is answered by the proxy from its own sessions rather than any backend, since
+backend connections are shared by sessions. Attributes of a session listed by other
+sessions are guarded by its trackLock, and its state is saved by the reader each time
+a command is handled.
+*/
+
+// clientState is the state of a session after the last command is handled
+type clientState struct {
+	cmd      string
+	time     time.Time
+	qbuf     int
+	qbufFree int
+	protocol int
+	multi    bool
+	pubsub   bool
+}
+
+// handleClientCmd answers CLIENT subcommands from the sessions of the proxy
+func (s *Session) handleClientCmd(cmd *resp.Command) {
+	if len(cmd.Args) < 2 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	switch sub := strings.ToUpper(cmd.Args[1]); {
+	case sub == "HELP" && len(cmd.Args) == 2:
+		help := make([]*resp.Data, len(CLIENT_HELP))
+		for i, line := range CLIENT_HELP {
+			help[i] = &resp.Data{T: resp.T_SimpleString, String: []byte(line)}
+		}
+		s.handleDataCmd(&resp.Data{T: resp.T_Array, Array: help})
+	case sub == "ID" && len(cmd.Args) == 2:
+		s.handleDataCmd(&resp.Data{T: resp.T_Integer, Integer: s.id})
+	case sub == "GETNAME" && len(cmd.Args) == 2:
+		s.trackLock.Lock()
+		name := s.name
+		s.trackLock.Unlock()
+		if name == "" {
+			s.handleDataCmd(&resp.Data{T: resp.T_Null})
+			return
+		}
+		s.handleDataCmd(&resp.Data{T: resp.T_BulkString, String: []byte(name)})
+	case sub == "SETNAME" && len(cmd.Args) == 3:
+		if !validClientName(cmd.Args[2]) {
+			s.handleErrorCmd(CLIENT_NAME_ERR)
+			return
+		}
+		s.setName(cmd.Args[2])
+		s.handleSimpleStringCmd(OK)
+	case sub == "SETINFO" && len(cmd.Args) == 4:
+		attr, value := strings.ToUpper(cmd.Args[2]), cmd.Args[3]
+		if attr != "LIB-NAME" && attr != "LIB-VER" {
+			s.handleErrorCmd([]byte(fmt.Sprintf("ERR Unrecognized option '%s'", cmd.Args[2])))
+			return
+		}
+		if !validClientName(value) {
+			s.handleErrorCmd([]byte(fmt.Sprintf("ERR %s cannot contain spaces, newlines or special characters.", strings.ToLower(attr))))
+			return
+		}
+		s.trackLock.Lock()
+		if attr == "LIB-NAME" {
+			s.libName = value
+		} else {
+			s.libVer = value
+		}
+		s.trackLock.Unlock()
+		s.handleSimpleStringCmd(OK)
+	case sub == "NO-EVICT" && len(cmd.Args) == 3:
+		var on bool
+		switch strings.ToUpper(cmd.Args[2]) {
+		case "ON":
+			on = true
+		case "OFF":
+		default:
+			s.handleErrorCmd(SYNTAX_ERR)
+			return
+		}
+		s.trackLock.Lock()
+		s.noEvict = on
+		s.trackLock.Unlock()
+		s.handleSimpleStringCmd(OK)
+	case sub == "INFO" && len(cmd.Args) == 2:
+		s.handleDataCmd(&resp.Data{T: resp.T_VerbatimString, String: []byte("txt:" + s.clientInfo() + "\n")})
+	case sub == "LIST":
+		s.handleClientListCmd(cmd)
+	case sub == "KILL" && len(cmd.Args) >= 3:
+		s.handleClientKillCmd(cmd)
+	case sub == "TRACKING" && len(cmd.Args) >= 3:
+		s.handleClientTrackingCmd(cmd)
+	case sub == "TRACKINGINFO" && len(cmd.Args) == 2:
+		s.handleClientTrackingInfoCmd()
+	case sub == "GETREDIR" && len(cmd.Args) == 2:
+		redirect := int64(-1)
+		if on, _, _, id, _ := s.tracker.info(s); on {
+			redirect = id
+		}
+		s.handleDataCmd(&resp.Data{T: resp.T_Integer, Integer: redirect})
+	case sub == "CACHING" && len(cmd.Args) == 3:
+		s.handleErrorCmd(TRACKING_CACHING_ERR)
+	default:
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try CLIENT HELP.", cmd.Args[1])))
+	}
+}
+
+func (s *Session) handleClientListCmd(cmd *resp.Command) {
+	var clientType string
+	var ids map[int64]bool
+	for i := 2; i < len(cmd.Args); i++ {
+		switch strings.ToUpper(cmd.Args[i]) {
+		case "TYPE":
+			if i+1 >= len(cmd.Args) {
+				s.handleErrorCmd(SYNTAX_ERR)
+				return
+			}
+			clientType = strings.ToLower(cmd.Args[i+1])
+			switch clientType {
+			case "normal", "master", "replica", "slave", "pubsub":
+			default:
+				s.handleErrorCmd([]byte(fmt.Sprintf("ERR Unknown client type '%s'", cmd.Args[i+1])))
+				return
+			}
+			i++
+		case "ID":
+			if i+1 >= len(cmd.Args) {
+				s.handleErrorCmd(SYNTAX_ERR)
+				return
+			}
+			ids = make(map[int64]bool)
+			for i++; i < len(cmd.Args); i++ {
+				id, err := strconv.ParseInt(cmd.Args[i], 10, 64)
+				if err != nil || id <= 0 {
+					s.handleErrorCmd([]byte("ERR Invalid client ID"))
+					return
+				}
+				ids[id] = true
+			}
+		default:
+			s.handleErrorCmd(SYNTAX_ERR)
+			return
+		}
+	}
+	var b strings.Builder
+	for _, c := range s.clients() {
+		if (ids != nil && !ids[c.id]) || (clientType != "" && c.clientType() != clientType) {
+			continue
+		}
+		b.WriteString(c.clientInfo())
+		b.WriteByte('\n')
+	}
+	s.handleDataCmd(&resp.Data{T: resp.T_VerbatimString, String: []byte("txt:" + b.String())})
+}
+
+// handleClientKillCmd closes the sessions matched, the session itself is closed once
+// the reply is written
+func (s *Session) handleClientKillCmd(cmd *resp.Command) {
+	// old form CLIENT KILL <ip:port> replies OK or an error
+	if len(cmd.Args) == 3 {
+		for _, c := range s.clients() {
+			if c.RemoteAddr().String() == cmd.Args[2] {
+				s.handleSimpleStringCmd(OK)
+				s.kill(c)
+				return
+			}
+		}
+		s.handleErrorCmd(NO_SUCH_CLIENT_ERR)
+		return
+	}
+	if len(cmd.Args)%2 != 0 {
+		s.handleErrorCmd(SYNTAX_ERR)
+		return
+	}
+	var filters []func(c *Session) bool
+	skipMe := true
+	for i := 2; i < len(cmd.Args); i += 2 {
+		value := cmd.Args[i+1]
+		switch strings.ToUpper(cmd.Args[i]) {
+		case "ID":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || id <= 0 {
+				s.handleErrorCmd([]byte("ERR client-id should be greater than 0"))
+				return
+			}
+			filters = append(filters, func(c *Session) bool { return c.id == id })
+		case "ADDR":
+			filters = append(filters, func(c *Session) bool { return c.RemoteAddr().String() == value })
+		case "LADDR":
+			filters = append(filters, func(c *Session) bool { return c.LocalAddr().String() == value })
+		case "TYPE":
+			clientType := strings.ToLower(value)
+			switch clientType {
+			case "normal", "master", "replica", "slave", "pubsub":
+			default:
+				s.handleErrorCmd([]byte(fmt.Sprintf("ERR Unknown client type '%s'", value)))
+				return
+			}
+			filters = append(filters, func(c *Session) bool { return c.clientType() == clientType })
+		case "USER":
+			filters = append(filters, func(c *Session) bool {
+				user := c.user.Load()
+				return user != nil && user.Name == value
+			})
+		case "MAXAGE":
+			maxAge, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				s.handleErrorCmd(SYNTAX_ERR)
+				return
+			}
+			filters = append(filters, func(c *Session) bool {
+				return int64(time.Since(c.createTime).Seconds()) >= maxAge
+			})
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				s.handleErrorCmd(SYNTAX_ERR)
+				return
+			}
+		default:
+			s.handleErrorCmd(SYNTAX_ERR)
+			return
+		}
+	}
+	var killed []*Session
+	for _, c := range s.clients() {
+		matched := !(skipMe && c == s)
+		for _, filter := range filters {
+			matched = matched && filter(c)
+		}
+		if matched {
+			killed = append(killed, c)
+		}
+	}
+	s.handleDataCmd(&resp.Data{T: resp.T_Integer, Integer: int64(len(killed))})
+	for _, c := range killed {
+		s.kill(c)
+	}
+}
+
+// kill closes session c killed by CLIENT KILL of s, its reader fails and cleans up
+func (s *Session) kill(c *Session) {
+	glog.Infof("client %d %s killed by client %d %s", c.id, c.RemoteAddr(), s.id, s.RemoteAddr())
+	if c == s {
+		// replies before are written by the writer once the reader exits
+		s.closeAfterReply = true
+		return
+	}
+	c.Conn.Close()
+}
+
+// clients returns the sessions of the proxy sorted by id, only s itself in tests
+func (s *Session) clients() []*Session {
+	if s.proxy == nil {
+		return []*Session{s}
+	}
+	var clients []*Session
+	s.proxy.sessions.Range(func(key, value any) bool {
+		clients = append(clients, value.(*Session))
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+// clientType returns the type of CLIENT LIST and CLIENT KILL, always normal or pubsub
+func (s *Session) clientType() string {
+	s.trackLock.Lock()
+	defer s.trackLock.Unlock()
+	if s.state.pubsub {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// clientInfo returns the line of the session in CLIENT LIST
+func (s *Session) clientInfo() string {
+	now := time.Now()
+	s.trackLock.Lock()
+	name, libName, libVer, noEvict, state := s.name, s.libName, s.libVer, s.noEvict, s.state
+	s.trackLock.Unlock()
+	if state.time.IsZero() {
+		state.time = s.createTime
+	}
+	var flags string
+	if state.multi {
+		flags += "x"
+	}
+	if state.pubsub {
+		flags += "P"
+	}
+	if noEvict {
+		flags += "e"
+	}
+	redirect := int64(-1)
+	if s.tracker != nil {
+		if on, bcast, _, id, broken := s.tracker.info(s); on {
+			flags += "t"
+			if bcast {
+				flags += "B"
+			}
+			if broken {
+				flags += "R"
+			}
+			redirect = id
+		}
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	multi := -1
+	if state.multi {
+		multi = 0
+	}
+	var user string
+	if u := s.user.Load(); u != nil {
+		user = u.Name
+	}
+	cmd := state.cmd
+	if cmd == "" {
+		cmd = "NULL"
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=0 multi=%d qbuf=%d qbuf-free=%d oll=%d cmd=%s user=%s redir=%d resp=%d lib-name=%s lib-ver=%s",
+		s.id, s.RemoteAddr(), s.LocalAddr(), name, int64(now.Sub(s.createTime).Seconds()), int64(now.Sub(state.time).Seconds()),
+		flags, multi, state.qbuf, state.qbufFree, len(s.backQ), cmd, user, redirect, state.protocol, libName, libVer)
+}
+
+// validClientName returns whether name is allowed by CLIENT SETNAME and SETINFO, the
+// same as valkey, characters are printable without spaces
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// respVersion returns the protocol of the session for other goroutines
+func (s *Session) respVersion() int {
+	s.trackLock.Lock()
+	defer s.trackLock.Unlock()
+	return s.state.protocol
+}
+
+func (s *Session) setName(name string) {
+	s.trackLock.Lock()
+	s.name = name
+	s.trackLock.Unlock()
+}
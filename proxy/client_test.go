@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestClientCmd(t *testing.T) {
+	conn, client := net.Pipe()
+	defer client.Close()
+	s, done := serveTestSession(conn)
+	s.id = 5
+	r := bufio.NewReader(client)
+	request := func(args ...string) *resp.Data {
+		cmd, _ := resp.NewCommand(args...)
+		client.Write(cmd.Format())
+		data, err := resp.ReadData(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	if reply := request("CLIENT", "SETNAME", "bad name"); string(reply.String) != string(CLIENT_NAME_ERR) {
+		t.Errorf("expected invalid name, got %+v", reply)
+	}
+	if reply := request("CLIENT", "GETNAME"); !reply.IsNil {
+		t.Errorf("expected no name, got %+v", reply)
+	}
+	for _, args := range [][]string{
+		{"CLIENT", "SETNAME", "worker"},
+		{"CLIENT", "SETINFO", "lib-name", "go-valkey"},
+		{"CLIENT", "SETINFO", "LIB-VER", "9.0.0"},
+		{"CLIENT", "NO-EVICT", "on"},
+	} {
+		if reply := request(args...); string(reply.String) != "OK" {
+			t.Errorf("unexpected reply %+v of %v", reply, args)
+		}
+	}
+	if reply := request("CLIENT", "GETNAME"); string(reply.String) != "worker" {
+		t.Errorf("expected name, got %+v", reply)
+	}
+	if reply := request("CLIENT", "ID"); reply.Integer != 5 {
+		t.Errorf("expected id 5, got %+v", reply)
+	}
+	info := string(request("CLIENT", "INFO").String)
+	for _, field := range []string{"id=5 ", " name=worker ", " flags=e ", " cmd=client ", " user=default ", " resp=2 ", " lib-name=go-valkey ", " lib-ver=9.0.0\n"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("expected %q in %q", field, info)
+		}
+	}
+	if list := string(request("CLIENT", "LIST", "ID", "5").String); !strings.HasPrefix(list, "id=5 ") || strings.Count(list, "\n") != 1 {
+		t.Errorf("expected client listed, got %q", list)
+	}
+	if list := request("CLIENT", "LIST", "TYPE", "pubsub"); len(list.String) != 0 {
+		t.Errorf("expected no pubsub client, got %q", list.String)
+	}
+	if reply := request("CLIENT", "KILL", "ID", "5"); reply.Integer != 0 {
+		t.Errorf("expected current client skipped, got %+v", reply)
+	}
+
+	if reply := request("CLIENT", "KILL", "ID", "5", "SKIPME", "no"); reply.Integer != 1 {
+		t.Errorf("expected current client killed, got %+v", reply)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected session closed")
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// offset of cluster bus port to data port, the same as valkey's default
+const CLUSTER_BUS_PORT_OFFSET = 10000
+
+var (
+	INVALID_SLOT_ERR   = []byte("ERR Invalid or out of range slot")
+	CLUSTER_NO_TCP_ERR = []byte("ERR cluster topology is only served on TCP listeners of proxy")
+)
+
+/*
+Cluster mode clients are served with a topology of a single master which is the
+proxy itself owning all the slots, so that they send every command to the proxy.
+The node is announced with the address client connects to, and its id is derived
+from the address to be stable across sessions and restarts. Sessions of unix sockets
+have no address to announce, the topology is refused to them.
+*/
+
+// handleClusterCmd answers CLUSTER subcommands for cluster mode clients
+func (s *Session) handleClusterCmd(cmd *resp.Command) {
+	if len(cmd.Args) < 2 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	host, port, tcp := s.clusterAddr()
+	id := clusterNodeID(host, port)
+	sub := strings.ToUpper(cmd.Args[1])
+	if !tcp && (sub == "SLOTS" || sub == "SHARDS" || sub == "NODES") {
+		s.handleErrorCmd(CLUSTER_NO_TCP_ERR)
+		return
+	}
+	switch sub {
+	case "SLOTS":
+		s.handleDataCmd(clusterSlots(host, port, id))
+	case "SHARDS":
+		s.handleDataCmd(clusterShards(host, port, id))
+	case "NODES":
+		s.handleDataCmd(&resp.Data{T: resp.T_BulkString, String: []byte(clusterNodes(host, port, id))})
+	case "INFO":
+		s.handleDataCmd(&resp.Data{T: resp.T_BulkString, String: []byte(s.clusterInfo())})
+	case "MYID":
+		s.handleDataCmd(&resp.Data{T: resp.T_BulkString, String: []byte(id)})
+	case "KEYSLOT":
+		if len(cmd.Args) != 3 {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+			return
+		}
+		s.handleDataCmd(&resp.Data{T: resp.T_Integer, Integer: int64(Key2Slot(cmd.Args[2]))})
+	case "COUNTKEYSINSLOT", "GETKEYSINSLOT":
+		if (sub == "COUNTKEYSINSLOT" && len(cmd.Args) != 3) || (sub == "GETKEYSINSLOT" && len(cmd.Args) != 4) {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+			return
+		}
+		slot, err := strconv.Atoi(cmd.Args[2])
+		if err != nil || slot < 0 || slot >= NumSlots {
+			s.handleErrorCmd(INVALID_SLOT_ERR)
+			return
+		}
+		// forwarded to the owner of the slot
+		plReq := &PipelineRequest{
+			cmd:      cmd,
+			readOnly: true,
+			slot:     slot,
+			seq:      s.getNextReqSeq(),
+			backQ:    s.backQ,
+			wg:       s.reqWg,
+		}
+		s.reqWg.Add(1)
+		s.Schedule(plReq)
+	default:
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", cmd.Args[1])))
+	}
+}
+
+// clusterAddr returns the proxy address the session connects to, and whether it's
+// a TCP address clients are able to connect to
+func (s *Session) clusterAddr() (string, int, bool) {
+	if addr, ok := s.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP.String(), addr.Port, true
+	}
+	return "127.0.0.1", 0, false
+}
+
+func clusterNodeID(host string, port int) string {
+	sum := sha1.Sum([]byte(net.JoinHostPort(host, strconv.Itoa(port))))
+	return hex.EncodeToString(sum[:])
+}
+
+func clusterSlots(host string, port int, id string) *resp.Data {
+	node := &resp.Data{T: resp.T_Array, Array: []*resp.Data{
+		{T: resp.T_BulkString, String: []byte(host)},
+		{T: resp.T_Integer, Integer: int64(port)},
+		{T: resp.T_BulkString, String: []byte(id)},
+		{T: resp.T_Map},
+	}}
+	return &resp.Data{T: resp.T_Array, Array: []*resp.Data{
+		{T: resp.T_Array, Array: []*resp.Data{
+			{T: resp.T_Integer, Integer: 0},
+			{T: resp.T_Integer, Integer: NumSlots - 1},
+			node,
+		}},
+	}}
+}
+
+func clusterShards(host string, port int, id string) *resp.Data {
+	bulk := func(s string) *resp.Data {
+		return &resp.Data{T: resp.T_BulkString, String: []byte(s)}
+	}
+	node := &resp.Data{T: resp.T_Map, Array: []*resp.Data{
+		bulk("id"), bulk(id),
+		bulk("port"), {T: resp.T_Integer, Integer: int64(port)},
+		bulk("ip"), bulk(host),
+		bulk("endpoint"), bulk(host),
+		bulk("role"), bulk("master"),
+		bulk("replication-offset"), {T: resp.T_Integer},
+		bulk("health"), bulk("online"),
+	}}
+	return &resp.Data{T: resp.T_Array, Array: []*resp.Data{
+		{T: resp.T_Map, Array: []*resp.Data{
+			bulk("slots"), {T: resp.T_Array, Array: []*resp.Data{
+				{T: resp.T_Integer, Integer: 0},
+				{T: resp.T_Integer, Integer: NumSlots - 1},
+			}},
+			bulk("nodes"), {T: resp.T_Array, Array: []*resp.Data{node}},
+		}},
+	}}
+}
+
+func clusterNodes(host string, port int, id string) string {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	return fmt.Sprintf("%s %s@%d myself,master - 0 0 1 connected 0-%d\n", id, addr, port+CLUSTER_BUS_PORT_OFFSET, NumSlots-1)
+}
+
+func (s *Session) clusterInfo() string {
+	assigned := s.dispatcher.slotTable.AssignedSlots()
+	state := "ok"
+	if assigned < NumSlots {
+		state = "fail"
+	}
+	fields := []string{
+		"cluster_state:" + state,
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned),
+		"cluster_slots_pfail:0",
+		"cluster_slots_fail:0",
+		"cluster_known_nodes:1",
+		"cluster_size:1",
+		"cluster_current_epoch:1",
+		"cluster_my_epoch:1",
+	}
+	return strings.Join(fields, "\r\n") + "\r\n"
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestClusterTopology(t *testing.T) {
+	id := clusterNodeID("10.0.0.1", 8088)
+	if len(id) != 40 || id != clusterNodeID("10.0.0.1", 8088) {
+		t.Errorf("unexpected node id %s", id)
+	}
+	expected := "*1\r\n*3\r\n:0\r\n:16383\r\n*4\r\n$8\r\n10.0.0.1\r\n:8088\r\n$40\r\n" + id + "\r\n*0\r\n"
+	if raw := string(clusterSlots("10.0.0.1", 8088, id).Downgrade().Format()); raw != expected {
+		t.Errorf("unexpected cluster slots %q", raw)
+	}
+	nodes := clusterNodes("10.0.0.1", 8088, id)
+	if nodes != id+" 10.0.0.1:8088@18088 myself,master - 0 0 1 connected 0-16383\n" {
+		t.Errorf("unexpected cluster nodes %q", nodes)
+	}
+	shards := clusterShards("10.0.0.1", 8088, id).Downgrade()
+	if len(shards.Array) != 1 || len(shards.Array[0].Array) != 4 {
+		t.Errorf("unexpected cluster shards %q", shards.Format())
+	}
+}
+
+func TestSessionClusterNoTCP(t *testing.T) {
+	conn, client := net.Pipe()
+	defer client.Close()
+	serveTestSession(conn)
+	r := bufio.NewReader(client)
+	for _, sub := range []string{"SLOTS", "SHARDS", "NODES"} {
+		client.Write([]byte("CLUSTER " + sub + "\r\n"))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "-"+string(CLUSTER_NO_TCP_ERR)+"\r\n" {
+			t.Errorf("expected CLUSTER %s refused without a TCP address, got %q", sub, line)
+		}
+	}
+	client.Write([]byte("CLUSTER KEYSLOT k\r\n"))
+	if line, _ := r.ReadString('\n'); line != ":7629\r\n" {
+		t.Errorf("unexpected CLUSTER KEYSLOT %q", line)
+	}
+}
@@ -2,8 +2,10 @@ package proxy
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/drycc-addons/valkey-cluster-proxy/fnet"
@@ -12,27 +14,105 @@ import (
 )
 
 type ValkeyConn struct {
-	initCap      int
-	maxIdle      int
-	connTimeout  time.Duration
-	password     string
+	// settings changeable at runtime, shared with copies of WithUser
+	settings *connSettings
+	// ACL user authenticated as instead of the password of settings
+	user         string
+	userPassword string
 	sendReadOnly bool
+	protocol     int
+	tlsConfig    *tls.Config
 }
 
-func NewValkeyConn(initCap, maxIdle int, connTimeout time.Duration, password string, sendReadOnly bool) *ValkeyConn {
+type connSettings struct {
+	lock        sync.RWMutex
+	conns       int
+	connTimeout time.Duration
+	password    string
+}
+
+func NewValkeyConn(conns int, connTimeout time.Duration, password string, sendReadOnly bool) *ValkeyConn {
 	p := &ValkeyConn{
-		initCap:      initCap,
-		maxIdle:      maxIdle,
-		password:     password,
-		connTimeout:  connTimeout,
+		settings: &connSettings{
+			conns:       conns,
+			password:    password,
+			connTimeout: connTimeout,
+		},
 		sendReadOnly: sendReadOnly,
+		protocol:     proto.RESP2,
 	}
 	return p
 }
 
+// Sets the protocol version spoken with backend servers, RESP2 or RESP3
+func (cp *ValkeyConn) SetProtocol(protocol int) error {
+	if protocol != proto.RESP2 && protocol != proto.RESP3 {
+		return fmt.Errorf("unsupported protocol version %d", protocol)
+	}
+	cp.protocol = protocol
+	return nil
+}
+
+// Returns the protocol version spoken with backend servers
+func (cp *ValkeyConn) Protocol() int {
+	return cp.protocol
+}
+
+// Returns whether READONLY is sent once connected to read from replicas
+func (cp *ValkeyConn) SendReadOnly() bool {
+	return cp.sendReadOnly
+}
+
+// Sets TLS config of backend connections, backend servers are connected with TLS if set
+func (cp *ValkeyConn) SetTLSConfig(config *tls.Config) {
+	cp.tlsConfig = config
+}
+
+// Sets the number of multiplexed connections to each backend server
+func (cp *ValkeyConn) SetConnections(conns int) {
+	cp.settings.lock.Lock()
+	defer cp.settings.lock.Unlock()
+	cp.settings.conns = conns
+}
+
+// Returns the number of multiplexed connections to each backend server
+func (cp *ValkeyConn) Connections() int {
+	cp.settings.lock.RLock()
+	defer cp.settings.lock.RUnlock()
+	return cp.settings.conns
+}
+
+// Sets timeout of connecting to backend servers
+func (cp *ValkeyConn) SetConnTimeout(connTimeout time.Duration) {
+	cp.settings.lock.Lock()
+	defer cp.settings.lock.Unlock()
+	cp.settings.connTimeout = connTimeout
+}
+
+// Returns timeout of connecting to backend servers
+func (cp *ValkeyConn) ConnTimeout() time.Duration {
+	cp.settings.lock.RLock()
+	defer cp.settings.lock.RUnlock()
+	return cp.settings.connTimeout
+}
+
+// Sets the password of backend servers, connections established later authenticate with it
+func (cp *ValkeyConn) SetPassword(password string) {
+	cp.settings.lock.Lock()
+	defer cp.settings.lock.Unlock()
+	cp.settings.password = password
+}
+
+// Returns the password of backend servers
+func (cp *ValkeyConn) Password() string {
+	cp.settings.lock.RLock()
+	defer cp.settings.lock.RUnlock()
+	return cp.settings.password
+}
+
 func (cp *ValkeyConn) Conn(server string) (net.Conn, error) {
 	dialer := net.Dialer{
-		Timeout: cp.connTimeout,
+		Timeout: cp.ConnTimeout(),
 		Control: fnet.ApplySocketOptions(&fnet.ListenConfig{
 			SocketReusePort:   true,
 			SocketFastOpen:    true,
@@ -43,25 +123,74 @@ func (cp *ValkeyConn) Conn(server string) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	if cp.tlsConfig != nil {
+		if conn, err = cp.handshake(conn, server); err != nil {
+			return nil, err
+		}
+	}
 	return cp.postConnect(conn)
 }
 
-func (cp *ValkeyConn) Auth(password string) bool {
-	return cp.password == password
+// handshake starts TLS on conn, server name is the host of server unless configured
+func (cp *ValkeyConn) handshake(conn net.Conn, server string) (net.Conn, error) {
+	config := cp.tlsConfig
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(server)
+	}
+	tlsConn := tls.Client(conn, config)
+	if connTimeout := cp.ConnTimeout(); connTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(connTimeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s failed: %v", server, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// WithUser returns a copy of cp authenticating backend connections as the ACL user
+func (cp *ValkeyConn) WithUser(user, password string) *ValkeyConn {
+	c := *cp
+	c.user, c.userPassword = user, password
+	return &c
 }
 
 func (cp *ValkeyConn) postConnect(conn net.Conn) (net.Conn, error) {
-	if cp.password != "" {
-		cmd, _ := proto.NewCommand("AUTH", cp.password)
+	// a stalled server fails the handshake in time instead of blocking the caller
+	if connTimeout := cp.ConnTimeout(); connTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(connTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	if cp.user != "" {
+		cmd, _ := proto.NewCommand("AUTH", cp.user, cp.userPassword)
+		if _, err := cp.Request(cmd, conn); err != nil {
+			defer conn.Close()
+			return nil, err
+		}
+	} else if password := cp.Password(); password != "" {
+		cmd, _ := proto.NewCommand("AUTH", password)
 		if _, err := cp.Request(cmd, conn); err != nil {
 			defer conn.Close()
 			return nil, err
 		}
 	}
 
-	if _, err := cp.Request(VALKEY_CMD_READ_ONLY, conn); err != nil {
-		defer conn.Close()
-		return nil, err
+	if cp.protocol == proto.RESP3 {
+		cmd, _ := proto.NewCommand("HELLO", "3")
+		if _, err := cp.Request(cmd, conn); err != nil {
+			defer conn.Close()
+			return nil, err
+		}
+	}
+
+	// replicas refuse reads of connections without READONLY, it's fixed once connected
+	if cp.sendReadOnly {
+		if _, err := cp.Request(VALKEY_CMD_READ_ONLY, conn); err != nil {
+			defer conn.Close()
+			return nil, err
+		}
 	}
 	return conn, nil
 }
@@ -80,7 +209,7 @@ func (cp *ValkeyConn) Request(command *proto.Command, conn net.Conn) (*proto.Dat
 		return nil, err
 	}
 
-	if data.T == proto.T_Error {
+	if data.IsError() {
 		glog.Errorf("%s resp is not OK, addr: %s, msg: %s", command.Name(), conn.RemoteAddr().String(), data.String)
 		return nil, fmt.Errorf("post connect error: %s resp is not OK", command.Name())
 	}
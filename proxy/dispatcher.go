@@ -36,12 +36,16 @@ var (
 	VALKEY_CMD_CLUSTER_SLOTS *resp.Command
 	VALKEY_CMD_CLUSTER_NODES *resp.Command
 	VALKEY_CMD_READ_ONLY     *resp.Command
+	VALKEY_CMD_ASKING        *resp.Command
+	VALKEY_CMD_COMMAND       *resp.Command
 )
 
 func init() {
 	VALKEY_CMD_READ_ONLY, _ = resp.NewCommand("READONLY")
+	VALKEY_CMD_ASKING, _ = resp.NewCommand("ASKING")
 	VALKEY_CMD_CLUSTER_NODES, _ = resp.NewCommand("CLUSTER", "NODES")
 	VALKEY_CMD_CLUSTER_SLOTS, _ = resp.NewCommand("CLUSTER", "SLOTS")
+	VALKEY_CMD_COMMAND, _ = resp.NewCommand("COMMAND")
 }
 
 type Dispatcher struct {
@@ -55,6 +59,10 @@ type Dispatcher struct {
 	readPrefer        int
 	lock              sync.Mutex
 	backendServerPool *BackendServerPool
+	// callbacks notified with all alive servers after topology reloaded
+	topologyListeners sync.Map
+	// guards startup nodes and read prefer changed at runtime
+	settingsLock sync.RWMutex
 }
 
 func NewDispatcher(startupNodes []string, slotReloadInterval time.Duration, valkeyConn *ValkeyConn, readPrefer int) *Dispatcher {
@@ -79,9 +87,39 @@ func (d *Dispatcher) InitSlotTable() error {
 			d.slotTable.SetSlotInfo(si)
 		}
 	}
+	d.loadCommandTable()
 	return nil
 }
 
+// loadCommandTable fetches key specs of all commands from cluster,
+// the built-in command table is kept if none of start up nodes answers
+func (d *Dispatcher) loadCommandTable() {
+	startupNodes := d.StartupNodes()
+	for _, index := range rand.Perm(len(startupNodes)) {
+		server := startupNodes[index]
+		conn, err := d.valkeyConn.Conn(server)
+		if err != nil {
+			glog.Error(server, err)
+			continue
+		}
+		data, err := d.valkeyConn.Request(VALKEY_CMD_COMMAND, conn)
+		conn.Close()
+		if err != nil {
+			glog.Errorf("query command table from %s failed, err=%v", server, err)
+			continue
+		}
+		table, err := ParseCommandTable(data)
+		if err != nil {
+			glog.Errorf("parse command table from %s failed, err=%v", server, err)
+			continue
+		}
+		SetCommandTable(table)
+		glog.Infof("load %d commands from %s", len(table), server)
+		return
+	}
+	glog.Warning("use built-in command table")
+}
+
 func (d *Dispatcher) Run() {
 	go d.slotsReloadLoop()
 	for info := range d.slotInfoChan {
@@ -102,6 +140,20 @@ func (d *Dispatcher) handleSlotInfoChanged(slotInfos []*SlotInfo) {
 		}
 	}
 	d.backendServerPool.Reload(newServers)
+	d.topologyListeners.Range(func(key, value any) bool {
+		value.(func(map[string]bool))(newServers)
+		return true
+	})
+}
+
+// AddTopologyListener registers fn to be called with all servers of the new topology
+// every time slot table is reloaded, key is used to remove the listener
+func (d *Dispatcher) AddTopologyListener(key any, fn func(servers map[string]bool)) {
+	d.topologyListeners.Store(key, fn)
+}
+
+func (d *Dispatcher) RemoveTopologyListener(key any) {
+	d.topologyListeners.Delete(key)
 }
 
 // wait for the slot reload chan and reload cluster topology
@@ -137,15 +189,54 @@ func (d *Dispatcher) slotsReloadLoop() {
 // try each start up nodes until the first success one
 func (d *Dispatcher) reloadTopology() (slotInfos []*SlotInfo, err error) {
 	glog.Info("reload slot table")
-	indexes := rand.Perm(len(d.startupNodes))
+	defer func(start time.Time) {
+		metrics.ObserveSlotsReload(time.Since(start), err)
+	}(time.Now())
+	startupNodes := d.StartupNodes()
+	indexes := rand.Perm(len(startupNodes))
 	for _, index := range indexes {
-		if slotInfos, err = d.doReload(d.startupNodes[index]); err == nil {
+		if slotInfos, err = d.doReload(startupNodes[index]); err == nil {
 			break
 		}
 	}
 	return
 }
 
+// Sets the nodes to query cluster topology, used since the next reload
+func (d *Dispatcher) SetStartupNodes(startupNodes []string) {
+	d.settingsLock.Lock()
+	defer d.settingsLock.Unlock()
+	d.startupNodes = startupNodes
+}
+
+// Returns the nodes to query cluster topology
+func (d *Dispatcher) StartupNodes() []string {
+	d.settingsLock.RLock()
+	defer d.settingsLock.RUnlock()
+	return d.startupNodes
+}
+
+// Sets the number of connections to each backend server
+func (d *Dispatcher) SetBackendConnections(conns int) {
+	d.valkeyConn.SetConnections(conns)
+	d.backendServerPool.Resize(conns)
+}
+
+// Sets where read commands are sent to, slot table is reloaded to apply it
+func (d *Dispatcher) SetReadPrefer(readPrefer int) {
+	d.settingsLock.Lock()
+	d.readPrefer = readPrefer
+	d.settingsLock.Unlock()
+	d.TriggerReloadSlots()
+}
+
+// Returns where read commands are sent to
+func (d *Dispatcher) ReadPrefer() int {
+	d.settingsLock.RLock()
+	defer d.settingsLock.RUnlock()
+	return d.readPrefer
+}
+
 /*
 *
 获取cluster slots信息，并利用cluster nodes信息来将failed的slave过滤掉
@@ -202,10 +293,11 @@ func (d *Dispatcher) doReload(server string) (slotInfos []*SlotInfo, err error)
 			glog.Warningf("node fails: %s", elements[1])
 		}
 	}
+	readPrefer := d.ReadPrefer()
 	for _, si := range slotInfos {
-		if d.readPrefer == READ_PREFER_MASTER {
+		if readPrefer == READ_PREFER_MASTER {
 			si.read = []string{si.write}
-		} else if d.readPrefer == READ_PREFER_SLAVE || d.readPrefer == READ_PREFER_SLAVE_IDC {
+		} else if readPrefer == READ_PREFER_SLAVE || readPrefer == READ_PREFER_SLAVE_IDC {
 			localIPPrefix := LocalIP()
 			if len(localIPPrefix) > 0 {
 				segments := strings.SplitN(localIPPrefix, ".", 3)
@@ -218,7 +310,7 @@ func (d *Dispatcher) doReload(server string) (slotInfos []*SlotInfo, err error)
 					glog.Infof("filter %s since it's not alive", node)
 					continue
 				}
-				if d.readPrefer == READ_PREFER_SLAVE_IDC {
+				if readPrefer == READ_PREFER_SLAVE_IDC {
 					// ips are regarded as in the same idc if they have the same first two segments, eg 10.4.x.x
 					if !strings.HasPrefix(node, localIPPrefix) {
 						glog.Infof("filter %s by read prefer slave idc", node)
@@ -0,0 +1,428 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+var (
+	// sections of the proxy itself
+	INFO_PROXY_SECTIONS = []string{"server", "clients", "stats", "commandstats", "backends", "topology"}
+	// sections aggregated across masters, and the sections of INFO they are built from
+	INFO_CLUSTER_SECTIONS = map[string]string{
+		"keyspace":             "keyspace",
+		"memory":               "memory",
+		"cluster_commandstats": "commandstats",
+	}
+	INFO_DEFAULT_SECTIONS = []string{"server", "clients", "stats", "backends", "topology", "memory", "keyspace"}
+	// fields of each master listed in the breakdown of aggregated sections
+	INFO_MEMORY_NODE_FIELDS = []string{"used_memory", "used_memory_rss", "used_memory_peak", "maxmemory"}
+)
+
+// infoSection is the fields of a section of INFO in order
+type infoSection struct {
+	name   string
+	fields [][2]string
+}
+
+func (is *infoSection) add(name string, value any) {
+	is.fields = append(is.fields, [2]string{name, fmt.Sprint(value)})
+}
+
+// infoSections returns the sections requested by INFO arguments in order, the same
+// as valkey, no argument or "default" is the default sections, "all" and "everything"
+// are all sections, and unknown ones are ignored
+func infoSections(args []string) []string {
+	if len(args) == 0 {
+		args = []string{"default"}
+	}
+	var sections []string
+	seen := make(map[string]bool)
+	add := func(names ...string) {
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				sections = append(sections, name)
+			}
+		}
+	}
+	for _, arg := range args {
+		switch arg = strings.ToLower(arg); arg {
+		case "default":
+			add(INFO_DEFAULT_SECTIONS...)
+		case "all", "everything":
+			add(INFO_PROXY_SECTIONS...)
+			add("memory", "keyspace", "cluster_commandstats")
+		default:
+			if _, ok := INFO_CLUSTER_SECTIONS[arg]; ok || slices.Contains(INFO_PROXY_SECTIONS, arg) {
+				add(arg)
+			}
+		}
+	}
+	return sections
+}
+
+/*
+handleInfoCmd answers INFO with sections of the proxy itself, and sections of keyspace,
+memory and commandstats of masters aggregated, followed by fields of each master. Sections
+of masters are queried on the multiplexed connections of the pool like SLOWLOG, so that
+INFO never dials a master by itself.
+*/
+func (s *Session) handleInfoCmd(cmd *resp.Command) {
+	sections := infoSections(cmd.Args[1:])
+	info := &infoRequest{order: sections}
+	args := []string{"INFO"}
+	for _, name := range sections {
+		if source, ok := INFO_CLUSTER_SECTIONS[name]; ok {
+			info.clusterSections = append(info.clusterSections, name)
+			args = append(args, source)
+		} else {
+			info.proxySections = append(info.proxySections, s.infoProxySection(name))
+		}
+	}
+	if len(info.clusterSections) == 0 {
+		s.handleDataCmd(infoData(sections, info.proxySections))
+		return
+	}
+
+	backendCmd, _ := resp.NewCommand(args...)
+	slots := s.dispatcher.slotTable.ServerSlots()
+	for _, slot := range slots {
+		info.masters = append(info.masters, s.dispatcher.slotTable.WriteServer(slot))
+	}
+	mc := NewMultiCmd(s, backendCmd, len(slots))
+	mc.info = info
+	s.scheduleReadAll(mc, slots, false)
+}
+
+// infoRequest is the sections of INFO requested, the sections of masters are aggregated
+// from the replies of masters once all of them are read
+type infoRequest struct {
+	order           []string
+	proxySections   []*infoSection
+	clusterSections []string
+	// master of each sub request in order
+	masters []string
+}
+
+// coalesceInfoRsp aggregates INFO replied by masters into the sections requested,
+// the reply is built in client's protocol
+func (mc *MultiCmd) coalesceInfoRsp() *PipelineResponse {
+	info := mc.info
+	replies := make([]infoReply, len(mc.subCmdRsps))
+	for i, subCmdRsp := range mc.subCmdRsps {
+		replies[i] = parseInfoReply(subCmdRsp)
+	}
+	sections := info.proxySections
+	for _, name := range info.clusterSections {
+		sections = append(sections, aggregateInfoSection(name, info.masters, replies))
+	}
+	data := infoData(info.order, sections)
+	if mc.session.protocol == resp.RESP2 {
+		data = data.Downgrade()
+	}
+	return &PipelineResponse{rsp: resp.NewObjectFromData(data)}
+}
+
+// infoData formats sections in the order requested
+func infoData(order []string, sections []*infoSection) *resp.Data {
+	byName := make(map[string]*infoSection)
+	for _, section := range sections {
+		byName[section.name] = section
+	}
+	var b strings.Builder
+	for _, name := range order {
+		section := byName[name]
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + strings.ToUpper(name[:1]) + name[1:] + "\r\n")
+		for _, field := range section.fields {
+			b.WriteString(field[0] + ":" + field[1] + "\r\n")
+		}
+	}
+	return &resp.Data{T: resp.T_VerbatimString, String: []byte("txt:" + b.String())}
+}
+
+func (s *Session) infoProxySection(name string) *infoSection {
+	section := &infoSection{name: name}
+	p := s.proxy
+	switch name {
+	case "server":
+		section.add("redis_version", SERVER_VERSION)
+		section.add("valkey_version", SERVER_VERSION)
+		section.add("server_mode", "cluster_proxy")
+		section.add("go_version", runtime.Version())
+		section.add("process_id", os.Getpid())
+		section.add("gomaxprocs", runtime.GOMAXPROCS(0))
+		if p != nil {
+			uptime := time.Since(p.startTime)
+			section.add("listeners", strings.Join(p.addrs, ","))
+			section.add("uptime_in_seconds", int64(uptime.Seconds()))
+			section.add("uptime_in_days", int64(uptime.Hours()/24))
+		}
+	case "clients":
+		if p != nil {
+			section.add("connected_clients", p.sessionCount())
+		}
+		if s.tracker != nil {
+			clients, _, _ := s.tracker.Stats()
+			section.add("tracking_clients", clients)
+		}
+	case "stats":
+		var calls, errors uint64
+		metrics.commands.Range(func(key, value any) bool {
+			calls += value.(*commandMetrics).calls.Load()
+			errors += value.(*commandMetrics).errors.Load()
+			return true
+		})
+		if p != nil {
+			var accepted int32
+			for _, server := range p.listeners() {
+				accepted += server.GetAcceptedConnections()
+			}
+			section.add("total_connections_received", accepted)
+		}
+		section.add("total_commands_processed", calls)
+		section.add("total_error_replies", errors)
+		section.add("moved_redirections", metrics.movedTotal.Load())
+		section.add("ask_redirections", metrics.askTotal.Load())
+		section.add("slots_reloads", metrics.reloadsTotal.Load())
+		section.add("slots_reload_failures", metrics.reloadsFailed.Load())
+		if s.slowLog != nil {
+			section.add("slowlog_len", s.slowLog.Len())
+		}
+		if s.accessLog != nil {
+			section.add("access_log_dropped", s.accessLog.Dropped())
+		}
+		if s.tracker != nil {
+			_, keys, prefixes := s.tracker.Stats()
+			section.add("tracking_total_keys", keys)
+			section.add("tracking_total_prefixes", prefixes)
+		}
+		if s.cache != nil {
+			stats := s.cache.Stats()
+			section.add("cache_hits", stats.Hits)
+			section.add("cache_misses", stats.Misses)
+			section.add("cache_evictions", stats.Evictions)
+			section.add("cache_expirations", stats.Expirations)
+			section.add("cache_invalidations", stats.Invalidations)
+			section.add("cache_flushes", stats.Flushes)
+			section.add("cache_keys", stats.Keys)
+			section.add("cache_entries", stats.Entries)
+			section.add("cache_bytes", stats.Bytes)
+		}
+	case "commandstats":
+		var names []string
+		metrics.commands.Range(func(key, value any) bool {
+			names = append(names, key.(string))
+			return true
+		})
+		sort.Strings(names)
+		for _, name := range names {
+			value, _ := metrics.commands.Load(name)
+			cm := value.(*commandMetrics)
+			calls := cm.calls.Load()
+			usec := cm.latency.sum.Load() / uint64(time.Microsecond)
+			section.add("cmdstat_"+name, fmt.Sprintf("calls=%d,usec=%d,usec_per_call=%.2f,failed_calls=%d",
+				calls, usec, float64(usec)/float64(max(calls, 1)), cm.errors.Load()))
+		}
+	case "backends":
+		stats := s.dispatcher.backendServerPool.Stats()
+		servers := make([]string, 0, len(stats))
+		for server := range stats {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+		for i, server := range servers {
+			var dials, failures uint64
+			if value, ok := metrics.backends.Load(server); ok {
+				dials = value.(*backendMetrics).dials.Load()
+				failures = value.(*backendMetrics).dialFailures.Load()
+			}
+			section.add(fmt.Sprintf("backend%d", i), fmt.Sprintf("addr=%s,connections=%d,queued=%d,dials=%d,dial_failures=%d",
+				server, stats[server].Connections, stats[server].Queued, dials, failures))
+		}
+	case "topology":
+		ranges := s.dispatcher.slotTable.Ranges()
+		slots := make(map[string]int)
+		replicas := make(map[string]map[string]bool)
+		for _, r := range ranges {
+			slots[r.Write] += r.End - r.Start + 1
+			if replicas[r.Write] == nil {
+				replicas[r.Write] = make(map[string]bool)
+			}
+			for _, read := range r.Read {
+				if read != r.Write {
+					replicas[r.Write][read] = true
+				}
+			}
+		}
+		masters := s.dispatcher.slotTable.Masters()
+		section.add("cluster_masters", len(masters))
+		section.add("cluster_slots_assigned", s.dispatcher.slotTable.AssignedSlots())
+		section.add("read_prefer", s.dispatcher.ReadPrefer())
+		for i, master := range masters {
+			var reads []string
+			for read := range replicas[master] {
+				reads = append(reads, read)
+			}
+			sort.Strings(reads)
+			section.add(fmt.Sprintf("master%d", i), fmt.Sprintf("addr=%s,slots=%d,read_replicas=%s",
+				master, slots[master], strings.Join(reads, ";")))
+		}
+	}
+	return section
+}
+
+// infoReply is the sections of INFO replied by a master, or the error querying it
+type infoReply struct {
+	sections map[string][][2]string
+	err      error
+}
+
+// parseInfoReply returns the sections of INFO replied by a master, or the error replied
+func parseInfoReply(rsp *PipelineResponse) infoReply {
+	if rsp.err != nil {
+		return infoReply{err: rsp.err}
+	}
+	data, err := resp.ReadData(bufio.NewReader(bytes.NewReader(rsp.rsp.Raw())))
+	if err != nil {
+		return infoReply{err: err}
+	}
+	if data.IsError() {
+		return infoReply{err: fmt.Errorf("%s", data.String)}
+	}
+	text := string(data.String)
+	if data.T == resp.T_VerbatimString {
+		text = strings.TrimPrefix(text, "txt:")
+	}
+	return infoReply{sections: parseInfo(text)}
+}
+
+// parseInfo returns the fields of each section by lower case name
+func parseInfo(text string) map[string][][2]string {
+	sections := make(map[string][][2]string)
+	var name string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			name = strings.ToLower(strings.TrimSpace(line[1:]))
+			continue
+		}
+		if field, value, ok := strings.Cut(line, ":"); ok && name != "" {
+			sections[name] = append(sections[name], [2]string{field, value})
+		}
+	}
+	return sections
+}
+
+// parseInfoValues parses values like keys=1,expires=0,avg_ttl=0 of keyspace and commandstats
+func parseInfoValues(value string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, kv := range strings.Split(value, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				values[k] = f
+			}
+		}
+	}
+	return values
+}
+
+/*
+aggregateInfoSection sums the section of each master, followed by a field of each
+master named node<i> with its address and breakdown, or the error querying it:
+
+  - keyspace: keys and expires of each db, avg_ttl is weighted by expires
+  - memory: every integer field, eg. used_memory
+  - cluster_commandstats: calls, usec, rejected_calls and failed_calls of each command
+*/
+func aggregateInfoSection(name string, masters []string, replies []infoReply) *infoSection {
+	section := &infoSection{name: name}
+	source := INFO_CLUSTER_SECTIONS[name]
+	// totals by field in the order first seen
+	var order []string
+	totals := make(map[string]map[string]float64)
+	total := func(field string) map[string]float64 {
+		if totals[field] == nil {
+			totals[field] = make(map[string]float64)
+			order = append(order, field)
+		}
+		return totals[field]
+	}
+	nodes := make([]string, len(masters))
+	for i, reply := range replies {
+		nodes[i] = "addr=" + masters[i]
+		if reply.err != nil {
+			nodes[i] += ",error=" + strings.ReplaceAll(reply.err.Error(), "\r\n", " ")
+			continue
+		}
+		node := make(map[string]float64)
+		for _, field := range reply.sections[source] {
+			switch name {
+			case "keyspace":
+				values := parseInfoValues(field[1])
+				t := total(field[0])
+				t["keys"] += values["keys"]
+				t["expires"] += values["expires"]
+				t["ttl"] += values["avg_ttl"] * values["expires"]
+				node["keys"] += values["keys"]
+				node["expires"] += values["expires"]
+			case "memory":
+				if v, err := strconv.ParseInt(field[1], 10, 64); err == nil {
+					total(field[0])[""] += float64(v)
+					node[field[0]] = float64(v)
+				}
+			case "cluster_commandstats":
+				values := parseInfoValues(field[1])
+				t := total(field[0])
+				for _, k := range []string{"calls", "usec", "rejected_calls", "failed_calls"} {
+					t[k] += values[k]
+				}
+				node["calls"] += values["calls"]
+				node["usec"] += values["usec"]
+			}
+		}
+		switch name {
+		case "keyspace":
+			nodes[i] += fmt.Sprintf(",keys=%.0f,expires=%.0f", node["keys"], node["expires"])
+		case "memory":
+			for _, field := range INFO_MEMORY_NODE_FIELDS {
+				nodes[i] += fmt.Sprintf(",%s=%.0f", field, node[field])
+			}
+		case "cluster_commandstats":
+			nodes[i] += fmt.Sprintf(",calls=%.0f,usec=%.0f", node["calls"], node["usec"])
+		}
+	}
+	for _, field := range order {
+		t := totals[field]
+		switch name {
+		case "keyspace":
+			avgTTL := 0.0
+			if t["expires"] > 0 {
+				avgTTL = t["ttl"] / t["expires"]
+			}
+			section.add(field, fmt.Sprintf("keys=%.0f,expires=%.0f,avg_ttl=%.0f", t["keys"], t["expires"], avgTTL))
+		case "memory":
+			section.add(field, fmt.Sprintf("%.0f", t[""]))
+		case "cluster_commandstats":
+			section.add(field, fmt.Sprintf("calls=%.0f,usec=%.0f,usec_per_call=%.2f,rejected_calls=%.0f,failed_calls=%.0f",
+				t["calls"], t["usec"], t["usec"]/max(t["calls"], 1), t["rejected_calls"], t["failed_calls"]))
+		}
+	}
+	for i, node := range nodes {
+		section.add(fmt.Sprintf("node%d", i), node)
+	}
+	return section
+}
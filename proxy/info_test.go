@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestInfoSections(t *testing.T) {
+	cases := []struct {
+		args     []string
+		sections []string
+	}{
+		{nil, INFO_DEFAULT_SECTIONS},
+		{[]string{"Server", "keyspace", "server", "unknown"}, []string{"server", "keyspace"}},
+		{[]string{"everything"}, append(append([]string{}, INFO_PROXY_SECTIONS...), "memory", "keyspace", "cluster_commandstats")},
+	}
+	for _, c := range cases {
+		if sections := infoSections(c.args); !reflect.DeepEqual(sections, c.sections) {
+			t.Errorf("expected sections %v of %v, got %v", c.sections, c.args, sections)
+		}
+	}
+}
+
+func TestAggregateInfoSection(t *testing.T) {
+	masters := []string{"127.0.0.1:7001", "127.0.0.1:7002", "127.0.0.1:7003"}
+	replies := []infoReply{
+		{sections: parseInfo("# Memory\r\nused_memory:100\r\nused_memory_human:100B\r\nmaxmemory:1000\r\n\r\n" +
+			"# Keyspace\r\ndb0:keys=10,expires=2,avg_ttl=100\r\n\r\n" +
+			"# Commandstats\r\ncmdstat_get:calls=4,usec=40,usec_per_call=10.00,rejected_calls=0,failed_calls=1\r\n")},
+		{sections: parseInfo("# Memory\r\nused_memory:50\r\nmaxmemory:1000\r\n\r\n" +
+			"# Keyspace\r\ndb0:keys=5,expires=2,avg_ttl=300\r\n\r\n" +
+			"# Commandstats\r\ncmdstat_get:calls=6,usec=20,usec_per_call=3.33,rejected_calls=1,failed_calls=0\r\n")},
+		{err: errors.New("connection refused")},
+	}
+	expected := map[string][][2]string{
+		"memory": {
+			{"used_memory", "150"},
+			{"maxmemory", "2000"},
+			{"node0", "addr=127.0.0.1:7001,used_memory=100,used_memory_rss=0,used_memory_peak=0,maxmemory=1000"},
+			{"node1", "addr=127.0.0.1:7002,used_memory=50,used_memory_rss=0,used_memory_peak=0,maxmemory=1000"},
+			{"node2", "addr=127.0.0.1:7003,error=connection refused"},
+		},
+		"keyspace": {
+			{"db0", "keys=15,expires=4,avg_ttl=200"},
+			{"node0", "addr=127.0.0.1:7001,keys=10,expires=2"},
+			{"node1", "addr=127.0.0.1:7002,keys=5,expires=2"},
+			{"node2", "addr=127.0.0.1:7003,error=connection refused"},
+		},
+		"cluster_commandstats": {
+			{"cmdstat_get", "calls=10,usec=60,usec_per_call=6.00,rejected_calls=1,failed_calls=1"},
+			{"node0", "addr=127.0.0.1:7001,calls=4,usec=40"},
+			{"node1", "addr=127.0.0.1:7002,calls=6,usec=20"},
+			{"node2", "addr=127.0.0.1:7003,error=connection refused"},
+		},
+	}
+	for name, fields := range expected {
+		if section := aggregateInfoSection(name, masters, replies); !reflect.DeepEqual(section.fields, fields) {
+			t.Errorf("expected %s %v, got %v", name, fields, section.fields)
+		}
+	}
+}
+
+func TestSessionInfo(t *testing.T) {
+	conn, client := net.Pipe()
+	defer client.Close()
+	serveTestSession(conn)
+	r := bufio.NewReader(client)
+	client.Write([]byte("INFO server stats\r\n"))
+	var size int
+	if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	text := string(buf)
+	if !strings.HasPrefix(text, "# Server\r\nredis_version:"+SERVER_VERSION+"\r\n") || !strings.Contains(text, "\r\n\r\n# Stats\r\ntotal_commands_processed:") {
+		t.Errorf("unexpected INFO %q", text)
+	}
+}
+
+// infoBackend replies INFO with keys in db0, and counts the connections accepted
+func infoBackend(t *testing.T, keys int, conns *atomic.Int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					cmd, err := resp.ReadCommand(r)
+					if err != nil {
+						return
+					}
+					reply := "+OK\r\n"
+					if cmd.Name() == "INFO" {
+						text := fmt.Sprintf("# Keyspace\r\ndb0:keys=%d,expires=0,avg_ttl=0\r\n", keys)
+						reply = fmt.Sprintf("$%d\r\n%s\r\n", len(text), text)
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestSessionInfoMasters(t *testing.T) {
+	var conns atomic.Int32
+	a, b := infoBackend(t, 2, &conns), infoBackend(t, 3, &conns)
+	defer a.Close()
+	defer b.Close()
+	replica := namedBackend(t, "replica")
+	defer replica.Close()
+	conn, client := net.Pipe()
+	defer client.Close()
+	valkeyConn := NewValkeyConn(1, time.Second, "", false)
+	dispatcher := NewDispatcher(nil, 0, valkeyConn, READ_PREFER_SLAVE)
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: 8191, write: a.Addr().String(), read: []string{replica.Addr().String()}})
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 8192, end: NumSlots - 1, write: b.Addr().String(), read: []string{replica.Addr().String()}})
+	s := newTestSession(conn)
+	s.dispatcher, s.valkeyConn = dispatcher, valkeyConn
+	serveSession(s)
+	r := bufio.NewReader(client)
+	for i := 0; i < 3; i++ {
+		client.Write([]byte("INFO keyspace\r\n"))
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		if text := string(buf); !strings.HasPrefix(text, "# Keyspace\r\ndb0:keys=5,expires=0,avg_ttl=0\r\n") {
+			t.Errorf("unexpected INFO %q", text)
+		}
+	}
+	// masters are queried on the connections of the pool instead of dialed by each INFO
+	if n := conns.Load(); n != 2 {
+		t.Errorf("expected a connection of each master, got %d", n)
+	}
+}
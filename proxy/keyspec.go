@@ -0,0 +1,455 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// command flags, a subset of valkey's command flags which matters to routing
+const (
+	COMMAND_FLAG_READONLY = 1 << iota
+	COMMAND_FLAG_WRITE
+	COMMAND_FLAG_BLOCKING
+	COMMAND_FLAG_MOVABLEKEYS
+)
+
+// types of key spec begin search and find keys
+const (
+	KEY_SPEC_BEGIN_INDEX = iota
+	KEY_SPEC_BEGIN_KEYWORD
+	KEY_SPEC_FIND_RANGE
+	KEY_SPEC_FIND_KEYNUM
+	KEY_SPEC_UNKNOWN
+)
+
+/*
+KeySpec tells where the keys of a command are, see https://valkey.io/topics/key-specs/
+
+begin search locates the first key candidate, either at a fixed index or right after
+a keyword, find keys then takes a range of arguments or reads the number of keys
+from an argument.
+*/
+type KeySpec struct {
+	BeginType int
+	// index of begin search index
+	Index int
+	// keyword and where to start searching it of begin search keyword
+	Keyword   string
+	StartFrom int
+	FindType  int
+	// last key, step and limit of find keys range
+	LastKey int
+	Step    int
+	Limit   int
+	// key number index, first key and key step of find keys keynum
+	KeyNumIdx int
+	FirstKey  int
+	KeyStep   int
+}
+
+// CommandSpec describes routing information of a command or a subcommand
+type CommandSpec struct {
+	Name        string
+	Flags       int
+	KeySpecs    []KeySpec
+	Subcommands map[string]*CommandSpec
+}
+
+type CommandTable map[string]*CommandSpec
+
+var commandTable atomic.Pointer[CommandTable]
+
+func init() {
+	table := BuiltinCommandTable()
+	commandTable.Store(&table)
+}
+
+// SetCommandTable replaces the command table used by routing, commands missing in
+// table or without key specs keep their built-in specs
+func SetCommandTable(table CommandTable) {
+	merged := BuiltinCommandTable()
+	for name, spec := range table {
+		if builtin, ok := merged[name]; ok {
+			// servers before redis 7 neither flag blocking commands nor describe movable keys
+			spec.Flags |= builtin.Flags & COMMAND_FLAG_BLOCKING
+			if spec.Flags&COMMAND_FLAG_MOVABLEKEYS != 0 && len(spec.KeySpecs) == 0 {
+				spec.KeySpecs = builtin.KeySpecs
+			}
+		}
+		merged[name] = spec
+	}
+	commandTable.Store(&merged)
+}
+
+// LookupCommand returns the spec of cmd, or its subcommand if there is one, nil if unknown
+func LookupCommand(cmd *resp.Command) *CommandSpec {
+	spec, ok := (*commandTable.Load())[cmd.Name()]
+	if !ok {
+		return nil
+	}
+	if len(spec.Subcommands) > 0 && len(cmd.Args) > 1 {
+		if sub, ok := spec.Subcommands[strings.ToUpper(cmd.Args[1])]; ok {
+			return sub
+		}
+	}
+	return spec
+}
+
+// KeyIndexes returns the indexes of keys in args, the same way valkey extracts keys with key specs
+func (spec *CommandSpec) KeyIndexes(args []string) []int {
+	var indexes []int
+	argc := len(args)
+	for _, ks := range spec.KeySpecs {
+		var first int
+		switch ks.BeginType {
+		case KEY_SPEC_BEGIN_INDEX:
+			first = ks.Index
+		case KEY_SPEC_BEGIN_KEYWORD:
+			first = -1
+			start, end := ks.StartFrom, argc-1
+			if ks.StartFrom < 0 {
+				start, end = argc+ks.StartFrom, 0
+			}
+			for i := start; i != end; {
+				if i >= argc || i < 1 {
+					break
+				}
+				if strings.EqualFold(args[i], ks.Keyword) {
+					first = i + 1
+					break
+				}
+				if start <= end {
+					i++
+				} else {
+					i--
+				}
+			}
+			if first < 0 {
+				continue
+			}
+		default:
+			continue
+		}
+
+		var last, step int
+		switch ks.FindType {
+		case KEY_SPEC_FIND_RANGE:
+			step = ks.Step
+			if ks.LastKey >= 0 {
+				last = first + ks.LastKey
+			} else if ks.Limit == 0 {
+				last = argc + ks.LastKey
+			} else {
+				last = first + ((argc-first)/ks.Limit + ks.LastKey)
+			}
+		case KEY_SPEC_FIND_KEYNUM:
+			if first+ks.KeyNumIdx >= argc {
+				continue
+			}
+			numKeys, err := strconv.Atoi(args[first+ks.KeyNumIdx])
+			if err != nil || numKeys <= 0 {
+				continue
+			}
+			step = ks.KeyStep
+			first += ks.FirstKey
+			last = first + (numKeys-1)*step
+		default:
+			continue
+		}
+		if step <= 0 {
+			step = 1
+		}
+		for i := first; i <= last && i < argc; i += step {
+			if i > 0 {
+				indexes = append(indexes, i)
+			}
+		}
+	}
+	return indexes
+}
+
+// ParseCommandTable parses the reply of COMMAND or COMMAND INFO
+func ParseCommandTable(data *resp.Data) (CommandTable, error) {
+	if data.IsError() {
+		return nil, fmt.Errorf("%s", data.String)
+	}
+	table := make(CommandTable)
+	for _, entry := range data.Array {
+		spec, err := parseCommandSpec(entry)
+		if err != nil {
+			return nil, err
+		}
+		if spec != nil {
+			table[spec.Name] = spec
+		}
+	}
+	return table, nil
+}
+
+/*
+command info entry example
+
+ 1. "object|encoding"  name
+ 2. (integer) 3        arity
+ 3. 1) readonly        flags
+ 4. (integer) 2        first key
+ 5. (integer) 2        last key
+ 6. (integer) 1        step
+ 7. 1) @keyspace       acl categories
+ 8. (empty array)      tips
+ 9. 1) 1) "flags" ...  key specs
+ 10. (empty array)     subcommands
+*/
+func parseCommandSpec(entry *resp.Data) (*CommandSpec, error) {
+	if entry.IsNil || entry.T == resp.T_Null {
+		// unknown command of COMMAND INFO
+		return nil, nil
+	}
+	if len(entry.Array) < 6 {
+		return nil, fmt.Errorf("invalid command info entry size %d", len(entry.Array))
+	}
+	name := strings.ToUpper(string(entry.Array[0].String))
+	if pos := strings.IndexByte(name, '|'); pos >= 0 {
+		name = name[pos+1:]
+	}
+	spec := &CommandSpec{Name: name}
+	for _, flag := range entry.Array[2].Array {
+		switch string(flag.String) {
+		case "readonly":
+			spec.Flags |= COMMAND_FLAG_READONLY
+		case "write":
+			spec.Flags |= COMMAND_FLAG_WRITE
+		case "blocking":
+			spec.Flags |= COMMAND_FLAG_BLOCKING
+		case "movablekeys":
+			spec.Flags |= COMMAND_FLAG_MOVABLEKEYS
+		}
+	}
+
+	if len(entry.Array) > 8 {
+		for _, ks := range entry.Array[8].Array {
+			spec.KeySpecs = append(spec.KeySpecs, parseKeySpec(ks))
+		}
+	} else if first := int(entry.Array[3].Integer); first > 0 {
+		// legacy (first key, last key, step) of servers before key specs
+		last := int(entry.Array[4].Integer)
+		if last >= 0 {
+			last -= first
+		}
+		spec.KeySpecs = []KeySpec{{
+			BeginType: KEY_SPEC_BEGIN_INDEX, Index: first,
+			FindType: KEY_SPEC_FIND_RANGE, LastKey: last, Step: int(entry.Array[5].Integer),
+		}}
+	}
+
+	if len(entry.Array) > 9 && len(entry.Array[9].Array) > 0 {
+		spec.Subcommands = make(map[string]*CommandSpec)
+		for _, subEntry := range entry.Array[9].Array {
+			sub, err := parseCommandSpec(subEntry)
+			if err != nil {
+				return nil, err
+			}
+			spec.Subcommands[sub.Name] = sub
+		}
+	}
+	return spec, nil
+}
+
+// parseKeySpec parses a key spec map, eg.
+// flags [RO ACCESS] begin_search [type index spec [index 1]] find_keys [type range spec [lastkey 0 step 1 limit 0]]
+func parseKeySpec(data *resp.Data) KeySpec {
+	ks := KeySpec{BeginType: KEY_SPEC_UNKNOWN, FindType: KEY_SPEC_UNKNOWN}
+	fields := pairs(data)
+	if begin := pairs(fields["begin_search"]); begin != nil {
+		spec := pairs(begin["spec"])
+		switch string(begin["type"].String) {
+		case "index":
+			ks.BeginType = KEY_SPEC_BEGIN_INDEX
+			ks.Index = integer(spec["index"])
+		case "keyword":
+			ks.BeginType = KEY_SPEC_BEGIN_KEYWORD
+			ks.Keyword = string(spec["keyword"].String)
+			ks.StartFrom = integer(spec["startfrom"])
+		}
+	}
+	if find := pairs(fields["find_keys"]); find != nil {
+		spec := pairs(find["spec"])
+		switch string(find["type"].String) {
+		case "range":
+			ks.FindType = KEY_SPEC_FIND_RANGE
+			ks.LastKey = integer(spec["lastkey"])
+			ks.Step = integer(spec["step"])
+			ks.Limit = integer(spec["limit"])
+		case "keynum":
+			ks.FindType = KEY_SPEC_FIND_KEYNUM
+			ks.KeyNumIdx = integer(spec["keynumidx"])
+			ks.FirstKey = integer(spec["firstkey"])
+			ks.KeyStep = integer(spec["keystep"])
+		}
+	}
+	return ks
+}
+
+// pairs turns a RESP3 map or its RESP2 flattened array into a go map
+func pairs(data *resp.Data) map[string]*resp.Data {
+	if data == nil || len(data.Array) == 0 {
+		return nil
+	}
+	ret := make(map[string]*resp.Data, len(data.Array)/2)
+	for i := 0; i+1 < len(data.Array); i += 2 {
+		ret[string(data.Array[i].String)] = data.Array[i+1]
+	}
+	return ret
+}
+
+func integer(data *resp.Data) int {
+	if data == nil {
+		return 0
+	}
+	return int(data.Integer)
+}
+
+/*
+builtinCommands is the fallback of key specs when COMMAND is not available,
+each line is: name flags keyspec...
+
+flags: r readonly, w write, b blocking, - none
+keyspec: <begin search>:<find keys>
+  - begin search: i<index> or k<keyword>,<startfrom>
+  - find keys: r<lastkey>[,<step>[,<limit>]] or n<keynumidx>,<firstkey>,<keystep>
+
+subcommands are named as container|subcommand
+*/
+var builtinCommands = []string{
+	// string
+	"APPEND w i1:r0", "DECR w i1:r0", "DECRBY w i1:r0", "GET r i1:r0", "GETDEL w i1:r0",
+	"GETEX w i1:r0", "GETRANGE r i1:r0", "GETSET w i1:r0", "INCR w i1:r0", "INCRBY w i1:r0",
+	"INCRBYFLOAT w i1:r0", "LCS r i1:r1", "MGET r i1:r-1", "MSET w i1:r-1,2", "MSETNX w i1:r-1,2",
+	"PSETEX w i1:r0", "SET w i1:r0", "SETEX w i1:r0", "SETNX w i1:r0", "SETRANGE w i1:r0",
+	"STRLEN r i1:r0", "SUBSTR r i1:r0",
+	// generic
+	"COPY w i1:r1", "DEL w i1:r-1", "DUMP r i1:r0", "EXISTS r i1:r-1", "EXPIRE w i1:r0",
+	"EXPIREAT w i1:r0", "EXPIRETIME r i1:r0", "PERSIST w i1:r0", "PEXPIRE w i1:r0",
+	"PEXPIREAT w i1:r0", "PEXPIRETIME r i1:r0", "PTTL r i1:r0", "RENAME w i1:r1",
+	"RENAMENX w i1:r1", "RESTORE w i1:r0", "SORT w i1:r0", "SORT_RO r i1:r0", "TOUCH r i1:r-1",
+	"TTL r i1:r0", "TYPE r i1:r0", "UNLINK w i1:r-1", "WATCH - i1:r-1",
+	"OBJECT|ENCODING r i2:r0", "OBJECT|FREQ r i2:r0", "OBJECT|IDLETIME r i2:r0", "OBJECT|REFCOUNT r i2:r0",
+	"MEMORY|USAGE r i2:r0",
+	// hash
+	"HDEL w i1:r0", "HEXISTS r i1:r0", "HGET r i1:r0", "HGETALL r i1:r0", "HINCRBY w i1:r0",
+	"HINCRBYFLOAT w i1:r0", "HKEYS r i1:r0", "HLEN r i1:r0", "HMGET r i1:r0", "HMSET w i1:r0",
+	"HRANDFIELD r i1:r0", "HSCAN r i1:r0", "HSET w i1:r0", "HSETNX w i1:r0", "HSTRLEN r i1:r0",
+	"HVALS r i1:r0",
+	// list
+	"BLMOVE wb i1:r1", "BLMPOP wb i2:n0,1,1", "BLPOP wb i1:r-2", "BRPOP wb i1:r-2", "BRPOPLPUSH wb i1:r1",
+	"LINDEX r i1:r0", "LINSERT w i1:r0", "LLEN r i1:r0", "LMOVE w i1:r1", "LMPOP w i1:n0,1,1",
+	"LPOP w i1:r0", "LPOS r i1:r0", "LPUSH w i1:r0", "LPUSHX w i1:r0", "LRANGE r i1:r0",
+	"LREM w i1:r0", "LSET w i1:r0", "LTRIM w i1:r0", "RPOP w i1:r0", "RPOPLPUSH w i1:r1",
+	"RPUSH w i1:r0", "RPUSHX w i1:r0",
+	// set
+	"SADD w i1:r0", "SCARD r i1:r0", "SDIFF r i1:r-1", "SDIFFSTORE w i1:r-1", "SINTER r i1:r-1",
+	"SINTERCARD r i1:n0,1,1", "SINTERSTORE w i1:r-1", "SISMEMBER r i1:r0", "SMEMBERS r i1:r0",
+	"SMISMEMBER r i1:r0", "SMOVE w i1:r1", "SPOP w i1:r0", "SRANDMEMBER r i1:r0", "SREM w i1:r0",
+	"SSCAN r i1:r0", "SUNION r i1:r-1", "SUNIONSTORE w i1:r-1",
+	// sorted set
+	"BZMPOP wb i2:n0,1,1", "BZPOPMAX wb i1:r-2", "BZPOPMIN wb i1:r-2", "ZADD w i1:r0", "ZCARD r i1:r0",
+	"ZCOUNT r i1:r0", "ZDIFF r i1:n0,1,1", "ZDIFFSTORE w i1:r0 i2:n0,1,1", "ZINCRBY w i1:r0",
+	"ZINTER r i1:n0,1,1", "ZINTERCARD r i1:n0,1,1", "ZINTERSTORE w i1:r0 i2:n0,1,1", "ZLEXCOUNT r i1:r0",
+	"ZMPOP w i1:n0,1,1", "ZMSCORE r i1:r0", "ZPOPMAX w i1:r0", "ZPOPMIN w i1:r0", "ZRANDMEMBER r i1:r0",
+	"ZRANGE r i1:r0", "ZRANGEBYLEX r i1:r0", "ZRANGEBYSCORE r i1:r0", "ZRANGESTORE w i1:r1",
+	"ZRANK r i1:r0", "ZREM w i1:r0", "ZREMRANGEBYLEX w i1:r0", "ZREMRANGEBYRANK w i1:r0",
+	"ZREMRANGEBYSCORE w i1:r0", "ZREVRANGE r i1:r0", "ZREVRANGEBYLEX r i1:r0", "ZREVRANGEBYSCORE r i1:r0",
+	"ZREVRANK r i1:r0", "ZSCAN r i1:r0", "ZSCORE r i1:r0", "ZUNION r i1:n0,1,1",
+	"ZUNIONSTORE w i1:r0 i2:n0,1,1",
+	// stream
+	"XACK w i1:r0", "XADD w i1:r0", "XAUTOCLAIM w i1:r0", "XCLAIM w i1:r0", "XDEL w i1:r0",
+	"XLEN r i1:r0", "XPENDING r i1:r0", "XRANGE r i1:r0", "XREAD rb kSTREAMS,1:r-1,1,2",
+	"XREADGROUP wb kSTREAMS,4:r-1,1,2", "XREVRANGE r i1:r0", "XSETID w i1:r0", "XTRIM w i1:r0",
+	"XGROUP|CREATE w i2:r0", "XGROUP|CREATECONSUMER w i2:r0", "XGROUP|DELCONSUMER w i2:r0",
+	"XGROUP|DESTROY w i2:r0", "XGROUP|SETID w i2:r0",
+	"XINFO|CONSUMERS r i2:r0", "XINFO|GROUPS r i2:r0", "XINFO|STREAM r i2:r0",
+	// bitmap
+	"BITCOUNT r i1:r0", "BITFIELD w i1:r0", "BITFIELD_RO r i1:r0", "BITOP w i2:r-1", "BITPOS r i1:r0",
+	"GETBIT r i1:r0", "SETBIT w i1:r0",
+	// hyperloglog
+	"PFADD w i1:r0", "PFCOUNT r i1:r-1", "PFMERGE w i1:r-1",
+	// geo
+	"GEOADD w i1:r0", "GEODIST r i1:r0", "GEOHASH r i1:r0", "GEOPOS r i1:r0",
+	"GEORADIUS w i1:r0 kSTORE,6:r0 kSTOREDIST,6:r0", "GEORADIUS_RO r i1:r0",
+	"GEORADIUSBYMEMBER w i1:r0 kSTORE,5:r0 kSTOREDIST,5:r0", "GEORADIUSBYMEMBER_RO r i1:r0",
+	"GEOSEARCH r i1:r0", "GEOSEARCHSTORE w i1:r1",
+	// scripting
+	"EVAL - i2:n0,1,1", "EVALSHA - i2:n0,1,1", "EVAL_RO r i2:n0,1,1", "EVALSHA_RO r i2:n0,1,1",
+	"FCALL - i2:n0,1,1", "FCALL_RO r i2:n0,1,1",
+	// pubsub
+	"PUBLISH -", "PUBSUB -", "SPUBLISH - i1:r0", "SSUBSCRIBE - i1:r-1", "SUNSUBSCRIBE - i1:r-1",
+	// keyless
+	"COMMAND -", "ECHO -", "FUNCTION -", "INFO -", "LATENCY -", "LOLWUT r", "MEMORY -", "TIME -",
+}
+
+// BuiltinCommandTable parses builtinCommands into a command table
+func BuiltinCommandTable() CommandTable {
+	table := make(CommandTable)
+	for _, line := range builtinCommands {
+		fields := strings.Fields(line)
+		spec := &CommandSpec{Name: fields[0]}
+		for _, flag := range fields[1] {
+			switch flag {
+			case 'r':
+				spec.Flags |= COMMAND_FLAG_READONLY
+			case 'w':
+				spec.Flags |= COMMAND_FLAG_WRITE
+			case 'b':
+				spec.Flags |= COMMAND_FLAG_BLOCKING
+			}
+		}
+		for _, field := range fields[2:] {
+			spec.KeySpecs = append(spec.KeySpecs, parseBuiltinKeySpec(field))
+		}
+		if container, sub, ok := strings.Cut(spec.Name, "|"); ok {
+			parent, ok := table[container]
+			if !ok {
+				parent = &CommandSpec{Name: container, Subcommands: make(map[string]*CommandSpec)}
+				table[container] = parent
+			}
+			spec.Name = sub
+			parent.Subcommands[sub] = spec
+		} else {
+			if container, ok := table[spec.Name]; ok {
+				spec.Subcommands = container.Subcommands
+			}
+			table[spec.Name] = spec
+		}
+	}
+	return table
+}
+
+func parseBuiltinKeySpec(field string) KeySpec {
+	begin, find, _ := strings.Cut(field, ":")
+	ks := KeySpec{}
+	if begin[0] == 'i' {
+		ks.BeginType = KEY_SPEC_BEGIN_INDEX
+		ks.Index, _ = strconv.Atoi(begin[1:])
+	} else {
+		ks.BeginType = KEY_SPEC_BEGIN_KEYWORD
+		keyword, startFrom, _ := strings.Cut(begin[1:], ",")
+		ks.Keyword = keyword
+		ks.StartFrom, _ = strconv.Atoi(startFrom)
+	}
+	numbers := []int{0, 1, 0}
+	for i, number := range strings.Split(find[1:], ",") {
+		numbers[i], _ = strconv.Atoi(number)
+	}
+	if find[0] == 'r' {
+		ks.FindType = KEY_SPEC_FIND_RANGE
+		ks.LastKey, ks.Step, ks.Limit = numbers[0], numbers[1], numbers[2]
+	} else {
+		ks.FindType = KEY_SPEC_FIND_KEYNUM
+		ks.KeyNumIdx, ks.FirstKey, ks.KeyStep = numbers[0], numbers[1], numbers[2]
+	}
+	return ks
+}
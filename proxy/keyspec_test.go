@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestBuiltinKeys(t *testing.T) {
+	cases := []struct {
+		args []string
+		keys []string
+	}{
+		{[]string{"GET", "k"}, []string{"k"}},
+		{[]string{"MSET", "k1", "v1", "k2", "v2"}, []string{"k1", "k2"}},
+		{[]string{"EVAL", "return 1", "2", "k1", "k2", "a1"}, []string{"k1", "k2"}},
+		{[]string{"EVAL", "return 1", "0", "a1"}, nil},
+		{[]string{"XREAD", "COUNT", "1", "STREAMS", "s1", "s2", "0", "0"}, []string{"s1", "s2"}},
+		{[]string{"ZUNIONSTORE", "dst", "2", "z1", "z2", "WEIGHTS", "1", "2"}, []string{"dst", "z1", "z2"}},
+		{[]string{"OBJECT", "ENCODING", "k"}, []string{"k"}},
+		{[]string{"MEMORY", "usage", "k"}, []string{"k"}},
+		{[]string{"GEORADIUS", "g", "0", "0", "1", "km", "STORE", "dst"}, []string{"g", "dst"}},
+		{[]string{"BITOP", "AND", "dst", "k1", "k2"}, []string{"dst", "k1", "k2"}},
+		{[]string{"PUBLISH", "ch", "msg"}, nil},
+		{[]string{"UNKNOWNCMD", "k", "v"}, nil},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		if keys := CmdKeys(cmd); !reflect.DeepEqual(keys, c.keys) {
+			t.Errorf("%v keys expected: %v, got: %v", c.args, c.keys, keys)
+		}
+	}
+}
+
+func TestCmdSlot(t *testing.T) {
+	cmd, _ := resp.NewCommand("RENAME", "{a}1", "{a}2")
+	if slot, crossSlot := CmdSlot(cmd); crossSlot || slot != Key2Slot("a") {
+		t.Errorf("unexpected slot %d, cross slot %v", slot, crossSlot)
+	}
+	cmd, _ = resp.NewCommand("RENAME", "a", "b")
+	if _, crossSlot := CmdSlot(cmd); !crossSlot {
+		t.Error("cross slot expected")
+	}
+	cmd, _ = resp.NewCommand("TIME")
+	if slot, crossSlot := CmdSlot(cmd); crossSlot || slot != -1 {
+		t.Errorf("unexpected slot %d, cross slot %v", slot, crossSlot)
+	}
+}
+
+func TestCmdFlag(t *testing.T) {
+	cases := map[string]int{
+		"GET":     CMD_FLAG_READ,
+		"SET":     CMD_FLAG_GENERAL,
+		"BLPOP":   CMD_FLAG_BLOCKING,
+		"KEYS":    CMD_FLAG_READ_ALL,
+		"FLUSHDB": CMD_FLAG_UNKNOWN,
+		"HELLO":   CMD_FLAG_PROXY,
+		"FOO":     CMD_FLAG_GENERAL,
+	}
+	for name, flag := range cases {
+		cmd, _ := resp.NewCommand(name, "k")
+		if CmdFlag(cmd) != flag {
+			t.Errorf("%s flag expected: %d, got: %d", name, flag, CmdFlag(cmd))
+		}
+	}
+}
+
+// commands refused by the command table before key specs, now routed by their keys or
+// to a random node if they have none, unless they change a single node, eg. FUNCTION LOAD
+func TestRoutedByKeySpecs(t *testing.T) {
+	cases := []struct {
+		args      []string
+		flag      int
+		keys      []string
+		crossSlot bool
+	}{
+		{[]string{"MSETNX", "{a}1", "1", "{a}2", "2"}, CMD_FLAG_GENERAL, []string{"{a}1", "{a}2"}, false},
+		{[]string{"MSETNX", "a", "1", "b", "2"}, CMD_FLAG_GENERAL, []string{"a", "b"}, true},
+		{[]string{"RENAME", "{a}1", "{a}2"}, CMD_FLAG_GENERAL, []string{"{a}1", "{a}2"}, false},
+		{[]string{"RENAMENX", "a", "b"}, CMD_FLAG_GENERAL, []string{"a", "b"}, true},
+		{[]string{"BITOP", "OR", "{a}dst", "{a}1"}, CMD_FLAG_GENERAL, []string{"{a}dst", "{a}1"}, false},
+		{[]string{"OBJECT", "ENCODING", "k"}, CMD_FLAG_READ, []string{"k"}, false},
+		{[]string{"OBJECT", "HELP"}, CMD_FLAG_GENERAL, nil, false},
+		{[]string{"ECHO", "k"}, CMD_FLAG_GENERAL, nil, false},
+		{[]string{"TIME"}, CMD_FLAG_GENERAL, nil, false},
+		{[]string{"PUBLISH", "ch", "msg"}, CMD_FLAG_GENERAL, nil, false},
+		{[]string{"FUNCTION", "LIST"}, CMD_FLAG_GENERAL, nil, false},
+		{[]string{"FUNCTION", "load", "#!lua name=lib"}, CMD_FLAG_UNKNOWN, nil, false},
+		{[]string{"FUNCTION", "FLUSH"}, CMD_FLAG_UNKNOWN, nil, false},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		if flag := CmdFlag(cmd); flag != c.flag {
+			t.Errorf("%v flag expected: %d, got: %d", c.args, c.flag, flag)
+		}
+		if keys := CmdKeys(cmd); !reflect.DeepEqual(keys, c.keys) {
+			t.Errorf("%v keys expected: %v, got: %v", c.args, c.keys, keys)
+		}
+		if slot, crossSlot := CmdSlot(cmd); crossSlot != c.crossSlot || (c.keys == nil && slot != -1) {
+			t.Errorf("%v unexpected slot %d, cross slot %v", c.args, slot, crossSlot)
+		}
+	}
+}
+
+func TestParseCommandTable(t *testing.T) {
+	reply := []string{
+		"*2",
+		// valkey 7 entry with key specs and subcommands
+		"*10", "$6", "object", ":-2", "*0", ":0", ":0", ":0", "*0", "*0", "*0",
+		"*1",
+		"*10", "$15", "object|encoding", ":3", "*1", "+readonly", ":2", ":2", ":1", "*0", "*0",
+		"*1", "*6",
+		"$5", "flags", "*2", "+RO", "+ACCESS",
+		"$12", "begin_search", "*4", "$4", "type", "$5", "index", "$4", "spec", "*2", "$5", "index", ":2",
+		"$9", "find_keys", "*4", "$4", "type", "$5", "range", "$4", "spec",
+		"*6", "$7", "lastkey", ":0", "$4", "step", ":1", "$5", "limit", ":0",
+		"*0",
+		// legacy entry
+		"*6", "$4", "mset", ":-3", "*1", "+write", ":1", ":-1", ":2",
+	}
+	data, err := resp.ReadData(bufio.NewReader(strings.NewReader(strings.Join(reply, "\r\n") + "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := ParseCommandTable(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetCommandTable(table)
+	defer SetCommandTable(nil)
+
+	cmd, _ := resp.NewCommand("OBJECT", "encoding", "k")
+	if spec := LookupCommand(cmd); spec == nil || spec.Flags != COMMAND_FLAG_READONLY {
+		t.Errorf("unexpected object encoding spec %+v", spec)
+	}
+	if keys := CmdKeys(cmd); !reflect.DeepEqual(keys, []string{"k"}) {
+		t.Errorf("unexpected object encoding keys %v", keys)
+	}
+	cmd, _ = resp.NewCommand("MSET", "k1", "v1", "k2", "v2")
+	if keys := CmdKeys(cmd); !reflect.DeepEqual(keys, []string{"k1", "k2"}) {
+		t.Errorf("unexpected mset keys %v", keys)
+	}
+	// commands missing in the fetched table fall back to built-in ones
+	cmd, _ = resp.NewCommand("GET", "k")
+	if CmdFlag(cmd) != CMD_FLAG_READ {
+		t.Error("built-in GET expected")
+	}
+}
+
+func TestSessionRoutedByKeySpecs(t *testing.T) {
+	a, b := namedBackend(t, "a"), namedBackend(t, "b")
+	defer a.Close()
+	defer b.Close()
+	conn, client := net.Pipe()
+	defer client.Close()
+	valkeyConn := NewValkeyConn(1, time.Second, "", false)
+	dispatcher := NewDispatcher(nil, 0, valkeyConn, 0)
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: 8191, write: a.Addr().String()})
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 8192, end: NumSlots - 1, write: b.Addr().String()})
+	s := newTestSession(conn)
+	s.dispatcher, s.valkeyConn = dispatcher, valkeyConn
+	serveSession(s)
+	r := bufio.NewReader(client)
+	for _, c := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"MSETNX", "a", "1", "b", "2"}, "-" + string(CROSSSLOT_ERR) + "\r\n"},
+		{[]string{"RENAME", "{a}1", "{a}2"}, "+OK\r\n"},
+		{[]string{"ECHO", "hi"}, "+OK\r\n"},
+		{[]string{"TIME"}, "+OK\r\n"},
+		{[]string{"PUBLISH", "ch", "msg"}, "+OK\r\n"},
+		{[]string{"UNKNOWNCMD", "k"}, "+OK\r\n"},
+	} {
+		cmd, _ := resp.NewCommand(c.args...)
+		client.Write(cmd.Format())
+		if line, _ := r.ReadString('\n'); line != c.reply {
+			t.Errorf("%v expected %q, got %q", c.args, c.reply, line)
+		}
+	}
+}
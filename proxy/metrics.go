@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// upper bounds in seconds of latency histogram buckets
+var LATENCY_BUCKETS = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// content type of prometheus text exposition format
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// metrics collects the statistics of all sessions, backends and the dispatcher
+var metrics = NewMetrics()
+
+/*
+Metrics are kept in atomic counters and exposed in prometheus text format, so that
+recording on the hot path takes no lock except the first time a label is seen.
+*/
+type Metrics struct {
+	commands      sync.Map // command name -> *commandMetrics
+	backends      sync.Map // server -> *backendMetrics
+	movedTotal    atomic.Uint64
+	askTotal      atomic.Uint64
+	reloadsTotal  atomic.Uint64
+	reloadsFailed atomic.Uint64
+	reloadLatency *histogram
+}
+
+type commandMetrics struct {
+	calls   atomic.Uint64
+	errors  atomic.Uint64
+	latency *histogram
+}
+
+type backendMetrics struct {
+	dials        atomic.Uint64
+	dialFailures atomic.Uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{reloadLatency: newHistogram()}
+}
+
+// ObserveCommand records a command replied after d, failed if any reply is an error
+func (m *Metrics) ObserveCommand(name string, d time.Duration, failed bool) {
+	value, ok := m.commands.Load(name)
+	if !ok {
+		value, _ = m.commands.LoadOrStore(name, &commandMetrics{latency: newHistogram()})
+	}
+	cm := value.(*commandMetrics)
+	cm.calls.Add(1)
+	if failed {
+		cm.errors.Add(1)
+	}
+	cm.latency.Observe(d)
+}
+
+// ObserveDial records a connection established to server, or failed with err
+func (m *Metrics) ObserveDial(server string, err error) {
+	value, ok := m.backends.Load(server)
+	if !ok {
+		value, _ = m.backends.LoadOrStore(server, &backendMetrics{})
+	}
+	bm := value.(*backendMetrics)
+	if err != nil {
+		bm.dialFailures.Add(1)
+	} else {
+		bm.dials.Add(1)
+	}
+}
+
+// ObserveRedirect records a MOVED or ASK redirection
+func (m *Metrics) ObserveRedirect(ask bool) {
+	if ask {
+		m.askTotal.Add(1)
+	} else {
+		m.movedTotal.Add(1)
+	}
+}
+
+// ObserveSlotsReload records a slot table reload taking d, failed with err
+func (m *Metrics) ObserveSlotsReload(d time.Duration, err error) {
+	m.reloadsTotal.Add(1)
+	if err != nil {
+		m.reloadsFailed.Add(1)
+	}
+	m.reloadLatency.Observe(d)
+}
+
+// metricCommandName returns the label of cmd, unknown commands share one label
+// to keep the number of series bounded
+func metricCommandName(cmd *resp.Command) string {
+	if _, ok := proxyCmdTable[cmd.Name()]; !ok && LookupCommand(cmd) == nil {
+		return "unknown"
+	}
+	return strings.ToLower(cmd.Name())
+}
+
+// WriteTo writes metrics of m, proxy p and its backends in prometheus text format
+func (m *Metrics) WriteTo(w io.Writer, p *Proxy) error {
+	bw := bufio.NewWriter(w)
+
+	var names []string
+	m.commands.Range(func(key, value any) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+	writeHeader(bw, "valkey_proxy_commands_total", "counter", "Commands processed by the proxy.")
+	for _, name := range names {
+		cm, _ := m.commands.Load(name)
+		writeSample(bw, "valkey_proxy_commands_total", label("command", name), float64(cm.(*commandMetrics).calls.Load()))
+	}
+	writeHeader(bw, "valkey_proxy_command_errors_total", "counter", "Commands replied with an error.")
+	for _, name := range names {
+		cm, _ := m.commands.Load(name)
+		writeSample(bw, "valkey_proxy_command_errors_total", label("command", name), float64(cm.(*commandMetrics).errors.Load()))
+	}
+	writeHeader(bw, "valkey_proxy_command_duration_seconds", "histogram", "Latency from receiving a command to writing its reply.")
+	for _, name := range names {
+		cm, _ := m.commands.Load(name)
+		cm.(*commandMetrics).latency.write(bw, "valkey_proxy_command_duration_seconds", label("command", name))
+	}
+
+	if servers := p.listeners(); len(servers) > 0 {
+		var active, accepted int32
+		for _, server := range servers {
+			active += server.GetActiveConnections()
+			accepted += server.GetAcceptedConnections()
+		}
+		writeHeader(bw, "valkey_proxy_connections_active", "gauge", "Client connections currently open.")
+		writeSample(bw, "valkey_proxy_connections_active", "", float64(active))
+		writeHeader(bw, "valkey_proxy_connections_accepted_total", "counter", "Client connections accepted.")
+		writeSample(bw, "valkey_proxy_connections_accepted_total", "", float64(accepted))
+	}
+
+	pool := p.dispatcher.backendServerPool.Stats()
+	servers := make([]string, 0, len(pool))
+	for server := range pool {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	writeHeader(bw, "valkey_proxy_backend_connections", "gauge", "Multiplexed connections kept to the backend node.")
+	for _, server := range servers {
+		writeSample(bw, "valkey_proxy_backend_connections", label("node", server), float64(pool[server].Connections))
+	}
+	writeHeader(bw, "valkey_proxy_backend_queued_requests", "gauge", "Requests queued to be written to the backend node.")
+	for _, server := range servers {
+		writeSample(bw, "valkey_proxy_backend_queued_requests", label("node", server), float64(pool[server].Queued))
+	}
+
+	servers = servers[:0]
+	m.backends.Range(func(key, value any) bool {
+		servers = append(servers, key.(string))
+		return true
+	})
+	sort.Strings(servers)
+	writeHeader(bw, "valkey_proxy_backend_dials_total", "counter", "Connections established to the backend node.")
+	for _, server := range servers {
+		bm, _ := m.backends.Load(server)
+		writeSample(bw, "valkey_proxy_backend_dials_total", label("node", server), float64(bm.(*backendMetrics).dials.Load()))
+	}
+	writeHeader(bw, "valkey_proxy_backend_dial_failures_total", "counter", "Failed attempts to connect to the backend node.")
+	for _, server := range servers {
+		bm, _ := m.backends.Load(server)
+		writeSample(bw, "valkey_proxy_backend_dial_failures_total", label("node", server), float64(bm.(*backendMetrics).dialFailures.Load()))
+	}
+
+	writeHeader(bw, "valkey_proxy_redirects_total", "counter", "MOVED and ASK redirections followed.")
+	writeSample(bw, "valkey_proxy_redirects_total", label("type", "moved"), float64(m.movedTotal.Load()))
+	writeSample(bw, "valkey_proxy_redirects_total", label("type", "ask"), float64(m.askTotal.Load()))
+
+	if p.accessLog != nil {
+		writeHeader(bw, "valkey_proxy_access_log_dropped_total", "counter", "Access log entries dropped since the queue is full.")
+		writeSample(bw, "valkey_proxy_access_log_dropped_total", "", float64(p.accessLog.Dropped()))
+	}
+
+	if p.cache != nil {
+		stats := p.cache.Stats()
+		writeHeader(bw, "valkey_proxy_cache_hits_total", "counter", "Reads replied from the cache of proxy.")
+		writeSample(bw, "valkey_proxy_cache_hits_total", "", float64(stats.Hits))
+		writeHeader(bw, "valkey_proxy_cache_misses_total", "counter", "Cacheable reads sent to backend since not cached.")
+		writeSample(bw, "valkey_proxy_cache_misses_total", "", float64(stats.Misses))
+		writeHeader(bw, "valkey_proxy_cache_evictions_total", "counter", "Cache entries removed before invalidated.")
+		writeSample(bw, "valkey_proxy_cache_evictions_total", label("reason", "size"), float64(stats.Evictions))
+		writeSample(bw, "valkey_proxy_cache_evictions_total", label("reason", "ttl"), float64(stats.Expirations))
+		writeHeader(bw, "valkey_proxy_cache_invalidations_total", "counter", "Cache entries invalidated since their keys changed.")
+		writeSample(bw, "valkey_proxy_cache_invalidations_total", "", float64(stats.Invalidations))
+		writeHeader(bw, "valkey_proxy_cache_flushes_total", "counter", "Cache flushed since backend connections lost or databases flushed.")
+		writeSample(bw, "valkey_proxy_cache_flushes_total", "", float64(stats.Flushes))
+		writeHeader(bw, "valkey_proxy_cache_entries", "gauge", "Replies kept in the cache.")
+		writeSample(bw, "valkey_proxy_cache_entries", "", float64(stats.Entries))
+		writeHeader(bw, "valkey_proxy_cache_bytes", "gauge", "Bytes of replies kept in the cache.")
+		writeSample(bw, "valkey_proxy_cache_bytes", "", float64(stats.Bytes))
+	}
+
+	writeHeader(bw, "valkey_proxy_slots_reloads_total", "counter", "Slot table reloads.")
+	writeSample(bw, "valkey_proxy_slots_reloads_total", "", float64(m.reloadsTotal.Load()))
+	writeHeader(bw, "valkey_proxy_slots_reload_failures_total", "counter", "Slot table reloads failed.")
+	writeSample(bw, "valkey_proxy_slots_reload_failures_total", "", float64(m.reloadsFailed.Load()))
+	writeHeader(bw, "valkey_proxy_slots_reload_duration_seconds", "histogram", "Time taken to reload the slot table.")
+	m.reloadLatency.write(bw, "valkey_proxy_slots_reload_duration_seconds", "")
+	return bw.Flush()
+}
+
+// ServeMetrics is the http handler of the prometheus endpoint
+func (p *Proxy) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	metrics.WriteTo(w, p)
+}
+
+type histogram struct {
+	// counts of each bucket, the last one is +Inf
+	counts []atomic.Uint64
+	// sum of observations in nanoseconds
+	sum atomic.Uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]atomic.Uint64, len(LATENCY_BUCKETS)+1)}
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(LATENCY_BUCKETS, seconds)
+	h.counts[i].Add(1)
+	h.sum.Add(uint64(d))
+}
+
+func (h *histogram) write(w *bufio.Writer, name, labels string) {
+	var count uint64
+	for i := range h.counts {
+		count += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(LATENCY_BUCKETS) {
+			le = strconv.FormatFloat(LATENCY_BUCKETS[i], 'g', -1, 64)
+		}
+		bucketLabels := `le="` + le + `"`
+		if labels != "" {
+			bucketLabels = labels + "," + bucketLabels
+		}
+		writeSample(w, name+"_bucket", bucketLabels, float64(count))
+	}
+	writeSample(w, name+"_sum", labels, time.Duration(h.sum.Load()).Seconds())
+	writeSample(w, name+"_count", labels, float64(count))
+}
+
+func writeHeader(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	w.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name, value string) string {
+	return name + `="` + labelValueEscaper.Replace(value) + `"`
+}
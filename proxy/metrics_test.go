@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogram()
+	h.Observe(50 * time.Microsecond)
+	h.Observe(3 * time.Millisecond)
+	h.Observe(time.Minute)
+	var sb strings.Builder
+	w := bufio.NewWriter(&sb)
+	h.write(w, "latency_seconds", label("command", "get"))
+	w.Flush()
+	out := sb.String()
+	for _, line := range []string{
+		`latency_seconds_bucket{command="get",le="0.0001"} 1`,
+		`latency_seconds_bucket{command="get",le="0.0025"} 1`,
+		`latency_seconds_bucket{command="get",le="0.005"} 2`,
+		`latency_seconds_bucket{command="get",le="10"} 2`,
+		`latency_seconds_bucket{command="get",le="+Inf"} 3`,
+		`latency_seconds_sum{command="get"} 60.00305`,
+		`latency_seconds_count{command="get"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected %s in\n%s", line, out)
+		}
+	}
+}
+
+func TestSessionTrack(t *testing.T) {
+	calls := func(name string) (uint64, uint64) {
+		if value, ok := metrics.commands.Load(name); ok {
+			cm := value.(*commandMetrics)
+			return cm.calls.Load(), cm.errors.Load()
+		}
+		return 0, 0
+	}
+	s := &Session{}
+	get, _ := resp.NewCommand("GET", "a")
+	calls0, errors0 := calls("get")
+
+	// a command with two replies, finished after both written
+	s.track(get)
+	s.reqSeq = 2
+	s.trackSeq(0, 2)
+	s.replied(&PipelineRequest{seq: 0}, []byte("-ERR failed\r\n"))
+	if c, _ := calls("get"); c != calls0 {
+		t.Fatal("expected command not finished")
+	}
+	s.replied(&PipelineRequest{seq: 1}, []byte("+OK\r\n"))
+	if c, e := calls("get"); c != calls0+1 || e != errors0+1 {
+		t.Fatalf("expected failed command observed, got calls %d errors %d", c-calls0, e-errors0)
+	}
+
+	// replied before the command is handled
+	s.track(get)
+	s.replied(&PipelineRequest{seq: 2}, []byte("+OK\r\n"))
+	s.reqSeq = 3
+	s.trackSeq(2, 3)
+	// nothing to reply
+	s.track(get)
+	s.trackSeq(3, 3)
+	if c, e := calls("get"); c != calls0+3 || e != errors0+1 || len(s.tracked) != 0 {
+		t.Errorf("expected commands observed, got calls %d errors %d tracked %d", c-calls0, e-errors0, len(s.tracked))
+	}
+}
+
+func TestMetricCommandName(t *testing.T) {
+	for args, name := range map[string]string{"GET": "get", "MULTI": "multi", "NOSUCHCOMMAND": "unknown"} {
+		cmd, _ := resp.NewCommand(args)
+		if got := metricCommandName(cmd); got != name {
+			t.Errorf("expected %s for %s, got %s", name, args, got)
+		}
+	}
+}
@@ -12,7 +12,8 @@ import (
 )
 
 /*
-multi key cmd被拆分成numKeys个子请求按普通的pipeline request发送，最后在写出response时进行合并
+multi key cmd的key按slot分组，每组拆成一个子请求按普通的pipeline request发送，最后在写出response时按原始key的顺序进行合并
+valkey拒绝跨slot的multi key cmd，所以不能按节点分组，但同一节点的子请求会在同一次写入中批量发送
 当最后一个子请求的response到来时，整个multi key cmd完成，拼接最终response并写出
 
 只要有一个子请求失败，都认定整个请求失败
@@ -26,6 +27,19 @@ type MultiCmd struct {
 	numSubCmds        int
 	numPendingSubCmds int
 	subCmdRsps        []*PipelineResponse
+	// keys grouped by slot for multi key commands
+	groups []*keyGroup
+	// reply of proxy's slow log merged into SLOWLOG replies of masters, nil if not merged
+	slowlog *resp.Data
+	// sections of INFO which replies of masters are aggregated into, nil if not INFO
+	info *infoRequest
+}
+
+// keyGroup is the keys of a multi key command in the same slot,
+// indexes are the positions of the keys in the command
+type keyGroup struct {
+	slot    int
+	indexes []int
 }
 
 func NewMultiCmd(session *Session, cmd *resp.Command, numSubCmds int) *MultiCmd {
@@ -42,6 +56,34 @@ func NewMultiCmd(session *Session, cmd *resp.Command, numSubCmds int) *MultiCmd
 	return mc
 }
 
+// NewMultiKeyCmd creates a multi key cmd whose sub commands are the keys grouped by slot
+func NewMultiKeyCmd(session *Session, cmd *resp.Command) *MultiCmd {
+	var groups []*keyGroup
+	bySlot := make(map[int]*keyGroup)
+	step := multiKeyStep(cmd)
+	for i := 0; 1+i*step < len(cmd.Args); i++ {
+		slot := Key2Slot(cmd.Args[1+i*step])
+		group, ok := bySlot[slot]
+		if !ok {
+			group = &keyGroup{slot: slot}
+			bySlot[slot] = group
+			groups = append(groups, group)
+		}
+		group.indexes = append(group.indexes, i)
+	}
+	mc := NewMultiCmd(session, cmd, len(groups))
+	mc.groups = groups
+	return mc
+}
+
+// multiKeyStep returns the number of arguments of each key, eg. key and value of MSET
+func multiKeyStep(cmd *resp.Command) int {
+	if cmd.Name() == "MSET" {
+		return 2
+	}
+	return 1
+}
+
 func (mc *MultiCmd) OnSubCmdFinished(rsp *PipelineResponse) {
 	mc.subCmdRsps[rsp.ctx.subSeq] = rsp
 	mc.numPendingSubCmds--
@@ -52,6 +94,9 @@ func (mc *MultiCmd) Finished() bool {
 }
 
 func (mc *MultiCmd) CoalesceRsp() *PipelineResponse {
+	if mc.info != nil {
+		return mc.coalesceInfoRsp()
+	}
 	rsp := mc.newRespData()
 	for index, subCmdRsp := range mc.subCmdRsps {
 		if subCmdRsp.err != nil {
@@ -65,10 +110,14 @@ func (mc *MultiCmd) CoalesceRsp() *PipelineResponse {
 			rsp = &resp.Data{T: resp.T_Error, String: []byte(err.Error())}
 			break
 		}
-		if data.T == resp.T_Error {
+		if data.IsError() {
 			rsp = data
 			break
 		}
+		if getMultiCmdType(mc.cmd) == "MGET" && len(data.Array) != len(mc.groups[index].indexes) {
+			rsp = &resp.Data{T: resp.T_Error, String: []byte("ERR unexpected reply size")}
+			break
+		}
 		switch getMultiCmdType(mc.cmd) {
 		case "SLOWLOG":
 			rsp = mc.coalesceSlowlogRsp(rsp, data)
@@ -78,25 +127,33 @@ func (mc *MultiCmd) CoalesceRsp() *PipelineResponse {
 			}
 		case "SCAN":
 			rsp = mc.coalesceScanRsp(index, subCmdRsp, rsp, data)
-		case "EXEC", "MGET":
-			rsp.Array = append(rsp.Array, data)
-		case "MSET", "DEL":
+		case "MGET":
+			for i, keyIndex := range mc.groups[index].indexes {
+				rsp.Array[keyIndex] = data.Array[i]
+			}
+		case "MSET":
+		case "DEL", "UNLINK", "EXISTS", "TOUCH":
 			rsp.Integer += data.Integer
 		default:
 			panic("invalid multi key cmd name")
 		}
 	}
-	return &PipelineResponse{rsp: resp.NewObjectFromData(rsp)}
+	if mc.slowlog != nil && !rsp.IsError() {
+		rsp = mc.mergeSlowlogRsp(rsp)
+	}
+	return &PipelineResponse{rsp: resp.NewObjectFromData(mc.session.convertReply(mc.cmd, rsp))}
 }
 
 func (mc *MultiCmd) newRespData() *resp.Data {
 	var rsp *resp.Data
 	switch getMultiCmdType(mc.cmd) {
-	case "EXEC", "SLOWLOG", "SCAN", "READALL", "MGET":
+	case "SLOWLOG", "SCAN", "READALL":
 		rsp = &resp.Data{T: resp.T_Array}
+	case "MGET":
+		rsp = &resp.Data{T: resp.T_Array, Array: make([]*resp.Data, len(mc.cmd.Args)-1)}
 	case "MSET":
 		rsp = OK_DATA
-	case "DEL":
+	case "DEL", "UNLINK", "EXISTS", "TOUCH":
 		rsp = &resp.Data{T: resp.T_Integer}
 	default:
 		panic("invalid multi key cmd name")
@@ -106,12 +163,13 @@ func (mc *MultiCmd) newRespData() *resp.Data {
 
 func (mc *MultiCmd) SubCmd(index, size int) (*resp.Command, error) {
 	switch getMultiCmdType(mc.cmd) {
-	case "MGET":
-		return resp.NewCommand("GET", mc.cmd.Value(index+1))
-	case "MSET":
-		return resp.NewCommand("SET", mc.cmd.Value(2*index+1), mc.cmd.Value((2*index + 2)))
-	case "DEL":
-		return resp.NewCommand("DEL", mc.cmd.Value(index+1))
+	case "MGET", "MSET", "DEL", "UNLINK", "EXISTS", "TOUCH":
+		step := multiKeyStep(mc.cmd)
+		args := []string{mc.cmd.Name()}
+		for _, keyIndex := range mc.groups[index].indexes {
+			args = append(args, mc.cmd.Args[1+keyIndex*step:1+(keyIndex+1)*step]...)
+		}
+		return resp.NewCommand(args...)
 	case "SCAN":
 		var err error
 		var cursor int64
@@ -143,7 +201,7 @@ func (mc *MultiCmd) coalesceSlowlogRsp(rsp, data *resp.Data) *resp.Data {
 			if err != nil {
 				panic(err)
 			}
-			if len(rsp.Array) > count {
+			if count >= 0 && len(rsp.Array) > count {
 				rsp.Array = rsp.Array[:count]
 			}
 		}
@@ -179,12 +237,14 @@ func (mc *MultiCmd) coalesceScanRsp(index int, subCmdRsp *PipelineResponse, rsp,
 func IsMultiCmd(cmd *resp.Command) (multiKey bool, numKeys int) {
 	multiKey = true
 	switch getMultiCmdType(cmd) {
-	case "EXEC", "SLOWLOG", "READALL", "MGET", "SCAN":
+	case "SLOWLOG", "INFO", "READALL", "MGET", "SCAN", "DEL", "UNLINK", "EXISTS", "TOUCH":
 		numKeys = len(cmd.Args) - 1
 	case "MSET":
+		// let backend reply the error of missing value
+		if len(cmd.Args)%2 == 0 {
+			return false, 0
+		}
 		numKeys = (len(cmd.Args) - 1) / 2
-	case "DEL":
-		numKeys = len(cmd.Args) - 1
 	default:
 		multiKey = false
 	}
@@ -193,7 +253,7 @@ func IsMultiCmd(cmd *resp.Command) (multiKey bool, numKeys int) {
 
 func getMultiCmdType(cmd *resp.Command) string {
 	switch cmd.Name() {
-	case "EXEC", "SLOWLOG", "MGET", "MSET", "DEL", "SCAN":
+	case "SLOWLOG", "INFO", "MGET", "MSET", "DEL", "UNLINK", "EXISTS", "TOUCH", "SCAN":
 		return cmd.Name()
 	default:
 		if CmdReadAll(cmd) {
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestMultiKeyCmdGroups(t *testing.T) {
+	s := &Session{protocol: resp.RESP2, valkeyConn: NewValkeyConn(1, 0, "", false)}
+	// slot of "a" is 15495, slot of "b" is 3300
+	cmd, _ := resp.NewCommand("MSET", "{a}1", "v1", "b", "v2", "{a}2", "v3")
+	mc := NewMultiKeyCmd(s, cmd)
+	if len(mc.groups) != 2 {
+		t.Fatalf("expected 2 groups, got %d", len(mc.groups))
+	}
+	expected := [][]string{{"MSET", "{a}1", "v1", "{a}2", "v3"}, {"MSET", "b", "v2"}}
+	for i := range mc.groups {
+		subCmd, _ := mc.SubCmd(i, len(mc.groups))
+		if !reflect.DeepEqual(subCmd.Args, expected[i]) {
+			t.Errorf("expected sub command %v, got %v", expected[i], subCmd.Args)
+		}
+	}
+
+	cmd, _ = resp.NewCommand("MGET", "{a}1", "b", "{a}2")
+	mc = NewMultiKeyCmd(s, cmd)
+	replies := []*resp.Data{
+		{T: resp.T_Array, Array: []*resp.Data{
+			{T: resp.T_BulkString, String: []byte("v1")},
+			{T: resp.T_BulkString, IsNil: true},
+		}},
+		{T: resp.T_Array, Array: []*resp.Data{{T: resp.T_BulkString, String: []byte("v2")}}},
+	}
+	for i, data := range replies {
+		mc.OnSubCmdFinished(&PipelineResponse{
+			rsp: resp.NewObjectFromData(data),
+			ctx: &PipelineRequest{subSeq: i},
+		})
+	}
+	if !mc.Finished() {
+		t.Fatal("expected finished")
+	}
+	if raw := string(mc.CoalesceRsp().rsp.Raw()); raw != "*3\r\n$2\r\nv1\r\n$2\r\nv2\r\n$-1\r\n" {
+		t.Errorf("unexpected coalesced reply %q", raw)
+	}
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"sync"
+	"time"
 
 	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
 )
@@ -21,6 +22,20 @@ type PipelineRequest struct {
 	wg *sync.WaitGroup
 	// for multi key command, owner of this command
 	parentCmd *MultiCmd
+	// out of band push frame which does not take part in ordering
+	push bool
+	// push frame written only after replies before this sequence, eg. invalidations
+	barrier int64
+	// reply is cached by the backend connection, which tracks the key read
+	cacheable bool
+	// backend connection pinned by the session until the request is replied
+	pin *backendPin
+	// times written to backend and replied by backend, MOVED and ASK redirections
+	// followed and the time spent on them, for slow log
+	sent         time.Time
+	received     time.Time
+	redirects    []string
+	redirectTime time.Duration
 }
 
 type PipelineResponse struct {
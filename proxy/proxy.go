@@ -2,23 +2,57 @@ package proxy
 
 import (
 	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/drycc-addons/valkey-cluster-proxy/fnet"
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
 	"github.com/golang/glog"
 	"github.com/maurice2k/ultrapool"
 )
 
+// interval to check whether sessions are closed while shutting down
+const SHUTDOWN_CHECK_INTERVAL = 100 * time.Millisecond
+
 type Proxy struct {
-	addr       string
+	addrs      []string
 	workers    *ultrapool.WorkerPool
 	dispatcher *Dispatcher
 	valkeyConn *ValkeyConn
 	exitChan   chan struct{}
+	sessionID  atomic.Int64
+	tlsConfig  *tls.Config
+	acl        atomic.Pointer[ACL]
+	servers    atomic.Pointer[[]*fnet.Server]
+	// connected sessions by id
+	sessions sync.Map
+	draining atomic.Bool
+	// inherited listener sockets by addr served instead of listening
+	listenerFiles map[string]*os.File
+	// permission and owner of unix sockets, owner is unchanged if uid and gid are -1
+	unixSocketPerm os.FileMode
+	unixSocketUID  int
+	unixSocketGID  int
+	// PROXY protocol header accepted on TCP listeners, nil if disabled
+	proxyProtocol *ProxyProtocol
+	// commands replied are logged if set
+	accessLog *AccessLog
+	slowLog   *SlowLog
+	tracker   *Tracker
+	// replies of hot keys read are cached if set
+	cache     *Cache
+	startTime time.Time
 }
 
+// NewProxy returns a proxy listening on addr, which is a comma separated list of TCP
+// addresses and unix socket paths prefixed with "unix:", eg. 0.0.0.0:8088,unix:/run/proxy.sock
 func NewProxy(addr string, dispatcher *Dispatcher, valkeyConn *ValkeyConn) *Proxy {
 	workers := ultrapool.NewWorkerPool(func(task ultrapool.Task) {
 		task.(*Session).WritingLoop()
@@ -29,49 +63,278 @@ func NewProxy(addr string, dispatcher *Dispatcher, valkeyConn *ValkeyConn) *Prox
 	workers.Start()
 
 	p := &Proxy{
-		addr:       addr,
+		addrs:      ParseListenAddrs(addr),
 		workers:    workers,
 		dispatcher: dispatcher,
 		valkeyConn: valkeyConn,
 		exitChan:   make(chan struct{}),
+		slowLog:    NewSlowLog(SLOWLOG_LOG_SLOWER_THAN, SLOWLOG_MAX_LEN),
+		tracker:    NewTracker(dispatcher, valkeyConn),
+		startTime:  time.Now(),
 	}
+	p.SetUnixSocketOwner(-1, -1)
+	p.acl.Store(NewACL(valkeyConn.Password(), valkeyConn))
 	return p
 }
 
+// ParseListenAddrs splits comma separated listen addresses
+func ParseListenAddrs(addr string) []string {
+	var addrs []string
+	for _, a := range strings.Split(addr, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// Sets TLS config of TCP listeners, clients must connect with TLS if set.
+// Clients connecting to unix sockets never use TLS.
+func (p *Proxy) SetTLSConfig(config *tls.Config) {
+	p.tlsConfig = config
+}
+
+// Sets PROXY protocol header accepted from load balancers, nil to disable
+func (p *Proxy) SetProxyProtocol(pp *ProxyProtocol) {
+	p.proxyProtocol = pp
+}
+
+// Sets access log of commands replied, nil to disable
+func (p *Proxy) SetAccessLog(accessLog *AccessLog) {
+	p.accessLog = accessLog
+}
+
+// Sets the cache of replies of hot keys read, it must be set before serving
+func (p *Proxy) SetCache(cache *Cache) {
+	p.cache = cache
+	p.dispatcher.backendServerPool.SetCache(cache)
+}
+
+// SlowLog returns the slow log of commands from being received to replied
+func (p *Proxy) SlowLog() *SlowLog {
+	return p.slowLog
+}
+
+// Sets permission of unix sockets created, 0 to keep the one given by umask
+func (p *Proxy) SetUnixSocketPerm(perm os.FileMode) {
+	p.unixSocketPerm = perm
+}
+
+// Sets owner of unix sockets created, -1 to keep uid or gid unchanged
+func (p *Proxy) SetUnixSocketOwner(uid, gid int) {
+	p.unixSocketUID, p.unixSocketGID = uid, gid
+}
+
+// Sets the listener sockets by addr inherited from the parent process to accept connections from
+func (p *Proxy) SetListenerFiles(files map[string]*os.File) {
+	p.listenerFiles = files
+}
+
+// ListenerFiles returns duplicates of listener sockets by addr to be passed to a new process
+func (p *Proxy) ListenerFiles() (map[string]*os.File, error) {
+	servers := p.listeners()
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("proxy is not listening")
+	}
+	files := make(map[string]*os.File)
+	for i, server := range servers {
+		f, err := server.ListenerFile()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files[p.addrs[i]] = f
+	}
+	return files, nil
+}
+
+// listeners returns servers of each addr, nil if not listening yet
+func (p *Proxy) listeners() []*fnet.Server {
+	if servers := p.servers.Load(); servers != nil {
+		return *servers
+	}
+	return nil
+}
+
+// Sets users clients authenticate as, the default user has the backend password if not set.
+// Sessions keep authenticated users if the ACL is replaced at runtime.
+func (p *Proxy) SetACL(acl *ACL) {
+	p.acl.Store(acl)
+}
+
 func (p *Proxy) Exit() {
 	defer p.workers.Stop()
 	close(p.exitChan)
 }
 
+/*
+Shutdown stops accepting connections and closes sessions once they are idle, that is
+every request received is replied in order and no transaction is in progress. Sessions
+still open after grace are closed forcibly, then connections to backend servers are
+released and the proxy exits.
+*/
+func (p *Proxy) Shutdown(grace time.Duration) {
+	p.draining.Store(true)
+	for _, server := range p.listeners() {
+		if err := server.Shutdown(grace); err != nil {
+			glog.Error(err)
+		}
+	}
+	p.sessions.Range(func(key, value any) bool {
+		value.(*Session).Drain()
+		return true
+	})
+	deadline := time.Now().Add(grace)
+	for p.sessionCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(SHUTDOWN_CHECK_INTERVAL)
+	}
+	if n := p.sessionCount(); n > 0 {
+		glog.Warningf("close %d sessions not finished in %v", n, grace)
+		p.sessions.Range(func(key, value any) bool {
+			value.(*Session).Conn.Close()
+			return true
+		})
+	}
+	p.tracker.Close()
+	p.dispatcher.backendServerPool.Close()
+	if p.accessLog != nil {
+		p.accessLog.Close()
+	}
+	p.Exit()
+	glog.Info("proxy shutdown")
+}
+
+func (p *Proxy) sessionCount() (n int) {
+	p.sessions.Range(func(key, value any) bool {
+		n++
+		return true
+	})
+	return
+}
+
 func (p *Proxy) handleConnection(cc fnet.Connection) {
+	var conn net.Conn = cc
+	var remoteAddr, localAddr net.Addr
+	// the PROXY protocol header is sent before TLS handshake, so TLS is handled here
+	// instead of by the server, unix sockets are neither of them
+	if cc.GetClientAddr() != nil {
+		if p.proxyProtocol != nil && p.proxyProtocol.Trusted(cc.RemoteAddr()) {
+			var err error
+			if remoteAddr, localAddr, err = p.proxyProtocol.ReadHeader(cc); err != nil {
+				glog.Errorf("read PROXY protocol header from %s failed, err=%v", cc.RemoteAddr(), err)
+				return
+			}
+		}
+		if p.tlsConfig != nil {
+			conn = tls.Server(cc, p.tlsConfig)
+		}
+	}
 	session := &Session{
-		Conn:        cc,
-		r:           bufio.NewReaderSize(cc, 1024*512),
+		Conn:        conn,
+		r:           bufio.NewReaderSize(conn, 1024*512),
+		remoteAddr:  remoteAddr,
+		localAddr:   localAddr,
+		id:          p.sessionID.Add(1),
+		createTime:  time.Now(),
+		protocol:    resp.RESP2,
 		cached:      make(map[string]map[string]string),
 		backQ:       make(chan *PipelineResponse, 1000),
 		closeSignal: &sync.WaitGroup{},
 		reqWg:       &sync.WaitGroup{},
 		valkeyConn:  p.valkeyConn,
+		acl:         p.acl.Load(),
 		dispatcher:  p.dispatcher,
 		rspHeap:     &PipelineResponseHeap{},
+		accessLog:   p.accessLog,
+		slowLog:     p.slowLog,
+		tracker:     p.tracker,
+		cache:       p.cache,
+		proxy:       p,
 	}
+	session.user.Store(session.acl.DefaultUser())
 	session.Prepare()
+	p.sessions.Store(session.id, session)
+	defer p.sessions.Delete(session.id)
+	if p.draining.Load() {
+		// accepted while shutting down
+		session.Drain()
+	}
 	p.workers.AddTask(session)
 	session.ReadingLoop()
 	defer session.Close()
 }
 
 func (p *Proxy) Run() {
-	server, err := fnet.NewServer(p.addr)
-	if err != nil {
+	if err := p.Listen(); err != nil {
 		glog.Fatal(err)
 	}
+	p.Serve()
+}
+
+// Listen starts listening on each addr, or the inherited listener socket if set
+func (p *Proxy) Listen() error {
+	if len(p.addrs) == 0 {
+		return fmt.Errorf("no listen address")
+	}
+	servers := make([]*fnet.Server, 0, len(p.addrs))
+	for _, addr := range p.addrs {
+		server, err := p.listen(addr)
+		if err != nil {
+			for _, server := range servers {
+				server.Halt()
+			}
+			return err
+		}
+		servers = append(servers, server)
+	}
+	// sockets inherited but not listened on any more
+	for addr, f := range p.listenerFiles {
+		glog.Infof("close inherited listener %s", addr)
+		f.Close()
+	}
+	p.listenerFiles = nil
+	p.servers.Store(&servers)
+	return nil
+}
+
+func (p *Proxy) listen(addr string) (*fnet.Server, error) {
+	server, err := fnet.NewServer(addr)
+	if err != nil {
+		return nil, err
+	}
 	config := server.GetListenConfig()
 	config.SocketDeferAccept = true
 	config.SocketFastOpen = true
 	config.SocketReusePort = true
 
 	server.SetRequestHandler(p.handleConnection)
-	server.Listen()
-	server.Serve()
+	server.SetUnixSocketMode(p.unixSocketPerm, p.unixSocketUID, p.unixSocketGID)
+	if f, ok := p.listenerFiles[addr]; ok {
+		delete(p.listenerFiles, addr)
+		err = server.ListenFile(f)
+		f.Close()
+		return server, err
+	}
+	if err = server.Listen(); err != nil {
+		return nil, err
+	}
+	glog.Infof("listen on %s", addr)
+	return server, nil
+}
+
+// Serve accepts connections on all listeners until shutdown
+func (p *Proxy) Serve() {
+	var wg sync.WaitGroup
+	for _, server := range p.listeners() {
+		wg.Add(1)
+		go func(server *fnet.Server) {
+			defer wg.Done()
+			if err := server.Serve(); err != nil {
+				glog.Error(err)
+			}
+		}(server)
+	}
+	wg.Wait()
 }
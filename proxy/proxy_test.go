@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProxyListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	conn := NewValkeyConn(1, time.Second, "", false)
+	p := &Proxy{addrs: ParseListenAddrs("127.0.0.1:0, unix:" + path), valkeyConn: conn}
+	p.SetUnixSocketPerm(0600)
+	p.SetUnixSocketOwner(-1, -1)
+	// a socket file left by previous run
+	if l, err := net.Listen("unix", path); err != nil {
+		t.Fatal(err)
+	} else {
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+	}
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	servers := p.listeners()
+	if len(servers) != 2 || servers[0].GetListenAddr().Network() != "tcp" || servers[1].GetListenAddr().Network() != "unix" {
+		t.Fatalf("expected listening on TCP and unix socket, got %v", servers)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected unix socket with permission 0600, got %v %v", fi, err)
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	for _, server := range servers {
+		server.Halt()
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected unix socket removed once closed, got %v", err)
+	}
+}
+
+func TestProxyListenUnixInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn := NewValkeyConn(1, time.Second, "", false)
+	p := &Proxy{addrs: ParseListenAddrs("unix:" + path), valkeyConn: conn}
+	p.SetUnixSocketOwner(-1, -1)
+	if err := p.Listen(); err == nil {
+		t.Fatal("expected unix socket of a live process refused")
+	}
+	// the socket of the live process is kept
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("expected unix socket kept, got %v", err)
+	}
+	c.Close()
+}
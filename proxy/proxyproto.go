@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// max time to wait for the PROXY protocol header after accepted
+	PROXY_HEADER_TIMEOUT = 5 * time.Second
+	// max length of a PROXY protocol v1 header including CRLF
+	PROXY_V1_MAX_LENGTH = 107
+)
+
+var (
+	PROXY_V1_SIGNATURE = []byte("PROXY ")
+	PROXY_V2_SIGNATURE = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	errProxyHeader     = errors.New("invalid PROXY protocol header")
+)
+
+/*
+ProxyProtocol accepts the PROXY protocol header of HAProxy, by which load balancers
+tell the client address of connections they forward. Headers are only read from
+connections of trusted sources, others are served as is.
+
+Both the text format of v1 and the binary format of v2 are supported. The header is
+read without reading ahead, so that the connection is passed on to TLS handshake or
+the session intact. A v1 UNKNOWN or v2 LOCAL header keeps the addresses of the
+connection, eg. health checks of the load balancer itself.
+*/
+type ProxyProtocol struct {
+	trusted []*net.IPNet
+}
+
+// NewProxyProtocol returns PROXY protocol accepted from the comma separated CIDRs or IPs
+func NewProxyProtocol(cidrs string) (*ProxyProtocol, error) {
+	pp := &ProxyProtocol{}
+	for _, cidr := range strings.Split(cidrs, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			pp.trusted = append(pp.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		pp.trusted = append(pp.trusted, ipNet)
+	}
+	if len(pp.trusted) == 0 {
+		return nil, fmt.Errorf("no trusted CIDR")
+	}
+	return pp, nil
+}
+
+// Trusted returns whether the header is expected from addr
+func (pp *ProxyProtocol) Trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range pp.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadHeader reads the header from conn, it returns the source and destination
+// addresses told by the header, or nil if the addresses of conn are kept
+func (pp *ProxyProtocol) ReadHeader(conn net.Conn) (src, dst net.Addr, err error) {
+	conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+	return ReadProxyHeader(conn)
+}
+
+// ReadProxyHeader reads PROXY protocol v1 or v2 header from r without reading ahead
+func ReadProxyHeader(r io.Reader) (src, dst net.Addr, err error) {
+	buf := make([]byte, len(PROXY_V2_SIGNATURE), PROXY_V1_MAX_LENGTH)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(buf, PROXY_V2_SIGNATURE) {
+		return readProxyHeaderV2(r)
+	}
+	if !bytes.HasPrefix(buf, PROXY_V1_SIGNATURE) {
+		return nil, nil, errProxyHeader
+	}
+	// the rest of v1 header is read byte by byte up to CRLF
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) == PROXY_V1_MAX_LENGTH {
+			return nil, nil, errProxyHeader
+		}
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, nil, err
+		}
+		buf = append(buf, b[0])
+	}
+	return parseProxyHeaderV1(string(buf[len(PROXY_V1_SIGNATURE) : len(buf)-2]))
+}
+
+// parseProxyHeaderV1 parses "TCP4 src dst sport dport", "TCP6 ..." or "UNKNOWN ..."
+func parseProxyHeaderV1(header string) (src, dst net.Addr, err error) {
+	fields := strings.Split(header, " ")
+	if fields[0] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, nil, errProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[1]), net.ParseIP(fields[2])
+	srcPort, err1 := strconv.ParseUint(fields[3], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[4], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil || (srcIP.To4() != nil) != (fields[0] == "TCP4") {
+		return nil, nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyHeaderV2 reads the rest of v2 header after the signature
+func readProxyHeaderV2(r io.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	version, command, family := header[0]>>4, header[0]&0x0F, header[1]
+	if version != 2 || command > 1 {
+		return nil, nil, errProxyHeader
+	}
+	// addresses are followed by optional TLVs, which are skipped
+	body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	// LOCAL command
+	if command == 0 {
+		return nil, nil, nil
+	}
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default: // UNSPEC, UDP or unix sockets are accepted but the addresses are unknown
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errProxyHeader
+	}
+	src = &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(body[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func proxyHeaderV2(command, family byte, addrs []byte, tlvs []byte) []byte {
+	header := append([]byte{}, PROXY_V2_SIGNATURE...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)+len(tlvs)))
+	return append(append(header, addrs...), tlvs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 168, 0, 1, 10, 0, 0, 1, 0x30, 0x39, 0x1F, 0x98}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x1F, 0x98)
+	for header, expected := range map[string]string{
+		"PROXY TCP4 192.168.0.1 10.0.0.1 12345 8088\r\n":    "192.168.0.1:12345 10.0.0.1:8088",
+		"PROXY TCP6 2001:db8::1 2001:db8::2 12345 8088\r\n": "[2001:db8::1]:12345 [2001:db8::2]:8088",
+		"PROXY UNKNOWN\r\n":                                    "<nil> <nil>",
+		"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n":                "<nil> <nil>",
+		string(proxyHeaderV2(1, 0x11, ipv4, nil)):              "192.168.0.1:12345 10.0.0.1:8088",
+		string(proxyHeaderV2(1, 0x21, ipv6, []byte{1, 0, 0})):  "[2001:db8::1]:12345 [2001:db8::2]:8088",
+		string(proxyHeaderV2(0, 0x00, nil, nil)):               "<nil> <nil>",
+		string(proxyHeaderV2(1, 0x31, make([]byte, 216), nil)): "<nil> <nil>",
+	} {
+		// the command after header is left unread
+		r := strings.NewReader(header + "PING\r\n")
+		src, dst, err := ReadProxyHeader(r)
+		if err != nil {
+			t.Errorf("read %q failed, err=%v", header, err)
+			continue
+		}
+		if got := fmtAddr(src) + " " + fmtAddr(dst); got != expected {
+			t.Errorf("expected %s for %q, got %s", expected, header, got)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "PING\r\n" {
+			t.Errorf("expected command left unread after %q, got %q", header, rest)
+		}
+	}
+
+	for _, header := range []string{
+		"PING\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 12345\r\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 12345 8088\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 123456 8088\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 12345 8088" + strings.Repeat(" ", 100) + "\r\n",
+		string(proxyHeaderV2(2, 0x11, ipv4, nil)),
+		string(proxyHeaderV2(1, 0x11, ipv4[:8], nil)),
+		string(proxyHeaderV2(1, 0x11, ipv4, nil)[:20]),
+	} {
+		if _, _, err := ReadProxyHeader(bytes.NewReader([]byte(header))); err == nil {
+			t.Errorf("expected %q refused", header)
+		}
+	}
+}
+
+func fmtAddr(addr net.Addr) string {
+	if addr == nil {
+		return "<nil>"
+	}
+	return addr.String()
+}
+
+func TestProxyProtocolTrusted(t *testing.T) {
+	pp, err := NewProxyProtocol("10.0.0.0/8, 192.168.1.1,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, trusted := range map[string]bool{
+		"10.1.2.3:1000":     true,
+		"192.168.1.1:1000":  true,
+		"192.168.1.2:1000":  false,
+		"[2001:db8::1]:100": true,
+		"[2001:db9::1]:100": false,
+	} {
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+		if pp.Trusted(tcpAddr) != trusted {
+			t.Errorf("expected %s trusted %v", addr, trusted)
+		}
+	}
+	if pp.Trusted(&net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}) {
+		t.Error("expected unix socket not trusted")
+	}
+	for _, cidrs := range []string{"", "10.0.0.0/33", "localhost"} {
+		if _, err := NewProxyProtocol(cidrs); err == nil {
+			t.Errorf("expected %q refused", cidrs)
+		}
+	}
+}
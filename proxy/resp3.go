@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"strings"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// reply shapes of commands whose RESP3 reply is not just the RESP2 one with nulls
+const (
+	REPLY_SHAPE_PLAIN = iota
+	REPLY_SHAPE_MAP
+	REPLY_SHAPE_MAP_ARRAY
+	REPLY_SHAPE_SET
+	REPLY_SHAPE_DOUBLE
+	REPLY_SHAPE_DOUBLE_ARRAY
+	REPLY_SHAPE_SCORE_PAIRS
+	REPLY_SHAPE_SCORE_PAIR
+)
+
+var replyShapeTable = map[string]int{
+	"HGETALL":  REPLY_SHAPE_MAP,
+	"SMEMBERS": REPLY_SHAPE_SET,
+	"SINTER":   REPLY_SHAPE_SET,
+	"SUNION":   REPLY_SHAPE_SET,
+	"SDIFF":    REPLY_SHAPE_SET,
+	"ZSCORE":   REPLY_SHAPE_DOUBLE,
+	"ZINCRBY":  REPLY_SHAPE_DOUBLE,
+	"ZMSCORE":  REPLY_SHAPE_DOUBLE_ARRAY,
+}
+
+// ReplyShape returns how the RESP3 reply of cmd differs from its RESP2 reply
+func ReplyShape(cmd *resp.Command) int {
+	if shape, ok := replyShapeTable[cmd.Name()]; ok {
+		return shape
+	}
+	switch cmd.Name() {
+	case "CONFIG":
+		if strings.ToUpper(cmd.Value(1)) == "GET" {
+			return REPLY_SHAPE_MAP
+		}
+	case "XINFO":
+		switch strings.ToUpper(cmd.Value(1)) {
+		case "STREAM":
+			return REPLY_SHAPE_MAP
+		case "GROUPS", "CONSUMERS":
+			return REPLY_SHAPE_MAP_ARRAY
+		}
+	case "ZADD":
+		if cmdHasArg(cmd, 2, "INCR") {
+			return REPLY_SHAPE_DOUBLE
+		}
+	case "ZRANGE", "ZRANGEBYSCORE", "ZREVRANGE", "ZREVRANGEBYSCORE", "ZUNION", "ZINTER", "ZDIFF", "ZRANDMEMBER":
+		if cmdHasArg(cmd, 2, "WITHSCORES") {
+			return REPLY_SHAPE_SCORE_PAIRS
+		}
+	case "ZPOPMIN", "ZPOPMAX":
+		if len(cmd.Args) > 2 {
+			return REPLY_SHAPE_SCORE_PAIRS
+		}
+		return REPLY_SHAPE_SCORE_PAIR
+	}
+	return REPLY_SHAPE_PLAIN
+}
+
+// cmdHasArg reports whether any argument from index start equals to arg case insensitively
+func cmdHasArg(cmd *resp.Command, start int, arg string) bool {
+	for i := start; i < len(cmd.Args); i++ {
+		if strings.EqualFold(cmd.Args[i], arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConvertReply converts the reply of cmd from protocol version from to protocol version to.
+// The input data is never modified.
+func ConvertReply(cmd *resp.Command, data *resp.Data, from, to int) *resp.Data {
+	if from == to || data.IsError() {
+		return data
+	}
+	if to == resp.RESP2 {
+		if ReplyShape(cmd) == REPLY_SHAPE_SCORE_PAIRS {
+			data = flattenPairs(data)
+		}
+		return downgradeNull(cmd, data.Downgrade())
+	}
+	return upgradeReply(ReplyShape(cmd), data)
+}
+
+func upgradeReply(shape int, data *resp.Data) *resp.Data {
+	data = upgradeNull(data)
+	if data.T != resp.T_Array && !(shape == REPLY_SHAPE_DOUBLE && data.T == resp.T_BulkString) {
+		return data
+	}
+	switch shape {
+	case REPLY_SHAPE_MAP:
+		return &resp.Data{T: resp.T_Map, Array: data.Array}
+	case REPLY_SHAPE_SET:
+		return &resp.Data{T: resp.T_Set, Array: data.Array}
+	case REPLY_SHAPE_DOUBLE:
+		return &resp.Data{T: resp.T_Double, String: data.String}
+	case REPLY_SHAPE_MAP_ARRAY, REPLY_SHAPE_DOUBLE_ARRAY:
+		elemShape := REPLY_SHAPE_MAP
+		if shape == REPLY_SHAPE_DOUBLE_ARRAY {
+			elemShape = REPLY_SHAPE_DOUBLE
+		}
+		ret := &resp.Data{T: resp.T_Array, Array: make([]*resp.Data, len(data.Array))}
+		for i, elem := range data.Array {
+			ret.Array[i] = upgradeReply(elemShape, elem)
+		}
+		return ret
+	case REPLY_SHAPE_SCORE_PAIR:
+		if len(data.Array) != 2 {
+			return data
+		}
+		return &resp.Data{T: resp.T_Array, Array: []*resp.Data{data.Array[0], upgradeReply(REPLY_SHAPE_DOUBLE, data.Array[1])}}
+	case REPLY_SHAPE_SCORE_PAIRS:
+		ret := &resp.Data{T: resp.T_Array, Array: make([]*resp.Data, 0, len(data.Array)/2)}
+		for i := 0; i+1 < len(data.Array); i += 2 {
+			pair := &resp.Data{T: resp.T_Array, Array: data.Array[i : i+2]}
+			ret.Array = append(ret.Array, upgradeReply(REPLY_SHAPE_SCORE_PAIR, pair))
+		}
+		return ret
+	}
+	return data
+}
+
+// upgradeNull replaces RESP2 nil bulk strings and nil arrays with RESP3 null
+func upgradeNull(data *resp.Data) *resp.Data {
+	if data.IsNil {
+		return &resp.Data{T: resp.T_Null}
+	}
+	if data.Array == nil {
+		return data
+	}
+	ret := &resp.Data{T: data.T, Array: make([]*resp.Data, len(data.Array))}
+	for i, elem := range data.Array {
+		ret.Array[i] = upgradeNull(elem)
+	}
+	return ret
+}
+
+// nullArrayReply reports whether cmd replies a nil array instead of a nil bulk string
+// in RESP2 for RESP3 null, eg. EXEC aborted by WATCH and BLPOP timed out
+func nullArrayReply(cmd *resp.Command) bool {
+	switch cmd.Name() {
+	case "EXEC", "BLPOP", "BRPOP", "BZPOPMIN", "BZPOPMAX", "BLMPOP", "BZMPOP", "LMPOP", "ZMPOP", "XREAD", "XREADGROUP":
+		return true
+	case "LPOP", "RPOP":
+		// popping with count replies an array
+		return len(cmd.Args) > 2
+	}
+	return false
+}
+
+// downgradeNull turns the nil bulk strings downgraded from RESP3 null into nil arrays
+// where cmd replies nil arrays in RESP2, data is the downgraded copy
+func downgradeNull(cmd *resp.Command, data *resp.Data) *resp.Data {
+	if data.IsNil && nullArrayReply(cmd) {
+		return &resp.Data{T: resp.T_Array, IsNil: true}
+	}
+	if cmd.Name() == "GEOPOS" && data.T == resp.T_Array {
+		// positions of missing members
+		for i, elem := range data.Array {
+			if elem.IsNil {
+				data.Array[i] = &resp.Data{T: resp.T_Array, IsNil: true}
+			}
+		}
+	}
+	return data
+}
+
+// flattenPairs turns RESP3 [[member, score], ...] into RESP2 [member, score, ...]
+func flattenPairs(data *resp.Data) *resp.Data {
+	if data.T != resp.T_Array {
+		return data
+	}
+	ret := &resp.Data{T: resp.T_Array, Array: make([]*resp.Data, 0, len(data.Array)*2)}
+	for _, pair := range data.Array {
+		if pair.T != resp.T_Array {
+			return data
+		}
+		ret.Array = append(ret.Array, pair.Array...)
+	}
+	return ret
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestConvertReply(t *testing.T) {
+	cases := []struct {
+		args  []string
+		resp2 string
+		resp3 string
+	}{
+		{[]string{"GET", "a"}, "$-1\r\n", "_\r\n"},
+		{[]string{"MGET", "a", "b"}, "*2\r\n$1\r\n1\r\n$-1\r\n", "*2\r\n$1\r\n1\r\n_\r\n"},
+		{[]string{"HGETALL", "h"}, "*2\r\n$1\r\nf\r\n$1\r\nv\r\n", "%1\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{[]string{"SMEMBERS", "s"}, "*1\r\n$1\r\nm\r\n", "~1\r\n$1\r\nm\r\n"},
+		{[]string{"ZSCORE", "z", "m"}, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{[]string{"ZRANGE", "z", "0", "-1", "withscores"}, "*2\r\n$1\r\nm\r\n$1\r\n2\r\n", "*1\r\n*2\r\n$1\r\nm\r\n,2\r\n"},
+		{[]string{"CONFIG", "get", "maxmemory"}, "*2\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n", "%1\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n"},
+		{[]string{"GET", "a"}, "-ERR wrong\r\n", "-ERR wrong\r\n"},
+		{[]string{"EXEC"}, "*-1\r\n", "_\r\n"},
+		{[]string{"BLPOP", "q", "1"}, "*-1\r\n", "_\r\n"},
+		{[]string{"BZPOPMIN", "z", "1"}, "*-1\r\n", "_\r\n"},
+		{[]string{"LPOP", "l", "2"}, "*-1\r\n", "_\r\n"},
+		{[]string{"LPOP", "l"}, "$-1\r\n", "_\r\n"},
+		{[]string{"BLMOVE", "a", "b", "LEFT", "LEFT", "1"}, "$-1\r\n", "_\r\n"},
+		{[]string{"GEOPOS", "g", "m", "n"}, "*2\r\n*-1\r\n*-1\r\n", "*2\r\n_\r\n_\r\n"},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		data, err := resp.ReadData(bufio.NewReader(bytes.NewBufferString(c.resp2)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		upgraded := ConvertReply(cmd, data, resp.RESP2, resp.RESP3)
+		if got := string(upgraded.Format()); got != c.resp3 {
+			t.Errorf("%v upgrade expected: %q, got: %q", c.args, c.resp3, got)
+		}
+		if got := string(ConvertReply(cmd, upgraded, resp.RESP3, resp.RESP2).Format()); got != c.resp2 {
+			t.Errorf("%v downgrade expected: %q, got: %q", c.args, c.resp2, got)
+		}
+	}
+}
+
+func TestSessionConvertRaw(t *testing.T) {
+	cases := []struct {
+		args  []string
+		resp2 string
+		resp3 string
+	}{
+		{[]string{"GET", "a"}, "$1\r\nv\r\n", "$1\r\nv\r\n"},
+		{[]string{"GET", "a"}, "$-1\r\n", "_\r\n"},
+		{[]string{"LRANGE", "l", "0", "-1"}, "*2\r\n$1\r\na\r\n:1\r\n", "*2\r\n$1\r\na\r\n:1\r\n"},
+		{[]string{"HGETALL", "h"}, "*2\r\n$1\r\nf\r\n$1\r\nv\r\n", "%1\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{[]string{"ZSCORE", "z", "m"}, "$3\r\n1.5\r\n", ",1.5\r\n"},
+	}
+	backend2, backend3 := NewValkeyConn(1, 0, "", false), NewValkeyConn(1, 0, "", false)
+	backend3.SetProtocol(resp.RESP3)
+	upgrading := &Session{valkeyConn: backend2, protocol: resp.RESP3}
+	downgrading := &Session{valkeyConn: backend3, protocol: resp.RESP2}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		if got := string(upgrading.convertRaw(cmd, []byte(c.resp2))); got != c.resp3 {
+			t.Errorf("%v upgrade expected: %q, got: %q", c.args, c.resp3, got)
+		}
+		if got := string(downgrading.convertRaw(cmd, []byte(c.resp3))); got != c.resp2 {
+			t.Errorf("%v downgrade expected: %q, got: %q", c.args, c.resp2, got)
+		}
+	}
+}
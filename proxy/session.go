@@ -4,11 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"container/heap"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
 	"github.com/golang/glog"
@@ -19,17 +24,34 @@ var (
 	MOVED           = []byte("-MOVED")
 	ASK             = []byte("-ASK")
 	ASK_CMD_BYTES   = []byte("+ASKING\r\n")
-	AUTH_CMD_ERR    = []byte("ERR invalid password")
 	UNKNOWN_CMD_ERR = []byte("ERR unknown command")
 	ARGUMENTS_ERR   = []byte("ERR wrong number of arguments")
 	NOAUTH_ERR      = []byte("NOAUTH Authentication required.")
+	NOPROTO_ERR     = []byte("NOPROTO unsupported protocol version")
+	SYNTAX_ERR      = []byte("ERR syntax error")
+	CROSSSLOT_ERR   = []byte("CROSSSLOT Keys in request don't hash to the same slot")
+	HELLO_AUTH_ERR  = []byte("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
 	OK_DATA         = &resp.Data{T: resp.T_SimpleString, String: OK}
 )
 
+// valkey server version reported to clients
+const SERVER_VERSION = "7.2.4"
+
+// while draining, a session is closed once idle for this long, so that requests
+// already sent by client are still read rather than reset by closing
+const SESSION_DRAIN_IDLE = 100 * time.Millisecond
+
 type Session struct {
 	net.Conn
 	r           *bufio.Reader
-	auth        bool
+	remoteAddr  net.Addr
+	localAddr   net.Addr
+	id          int64
+	createTime  time.Time
+	name        string
+	user        atomic.Pointer[ACLUser]
+	acl         *ACL
+	protocol    int
 	reqSeq      int64
 	rspSeq      int64
 	backQ       chan *PipelineResponse
@@ -40,8 +62,80 @@ type Session struct {
 	rspHeap     *PipelineResponseHeap
 	valkeyConn  *ValkeyConn
 	dispatcher  *Dispatcher
-	multiCmd    *[]*resp.Command
-	multiCmdErr bool
+	// backend connection of each server requests are pinned to, used by reader only
+	pins    map[string]*backendPin
+	tx      *Transaction
+	channel *Channel
+	blocker *Blocker
+	// commands waiting for replies to be written, in the order received
+	trackLock sync.Mutex
+	tracked   []trackedCmd
+	// attributes set by CLIENT and the state listed by CLIENT LIST, guarded by
+	// trackLock as well since they are read by other sessions
+	libName string
+	libVer  string
+	noEvict bool
+	state   clientState
+	// killed by CLIENT KILL itself, closed once the replies before are written
+	closeAfterReply bool
+	// client side caching, tracking is turned on by CLIENT TRACKING and read by reader
+	// only, untracked is set once removed from tracker and guarded by tracker
+	tracker   *Tracker
+	tracking  bool
+	untracked bool
+	// push frames waiting for their barriers, written by writer only
+	deferred []*PipelineResponse
+	// replies of hot keys read are cached in proxy if set
+	cache *Cache
+	// number of replies written
+	written int64
+	// the proxy is shutting down, session is closed once idle
+	draining atomic.Bool
+	// commands replied are logged if set
+	accessLog *AccessLog
+	slowLog   *SlowLog
+	// the proxy accepting the session, nil in tests
+	proxy *Proxy
+}
+
+// trackedCmd is a command whose replies are sequenced up to lastSeq
+type trackedCmd struct {
+	cmd     *resp.Command
+	name    string
+	start   time.Time
+	lastSeq int64
+	failed  bool
+	// routing and replies of the command for access log
+	slot      int
+	backend   string
+	replyType string
+	replySize int
+	err       string
+	// client name when received and the time of each phase for slow log
+	clientName   string
+	queueTime    time.Duration
+	waitTime     time.Duration
+	redirectTime time.Duration
+	redirects    []string
+	// keys cached being written by the command
+	writes []string
+}
+
+// RemoteAddr returns the client address, which is told by the PROXY protocol header if any
+func (s *Session) RemoteAddr() net.Addr {
+	if s.remoteAddr != nil {
+		return s.remoteAddr
+	}
+	return s.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address client connects to, which is the load balancer's
+// if connected through PROXY protocol
+func (s *Session) LocalAddr() net.Addr {
+	if s.localAddr != nil {
+		return s.localAddr
+	}
+	return s.Conn.LocalAddr()
 }
 
 func (s *Session) Prepare() {
@@ -53,65 +147,285 @@ func (s *Session) Prepare() {
 // and continue loop until the reader has exited
 func (s *Session) WritingLoop() {
 	for rsp := range s.backQ {
+		if pin := rsp.ctx.pin; pin != nil {
+			pin.done()
+		}
 		if err := s.handleRespPipeline(rsp); err != nil {
 			s.Close()
 			continue
 		}
 	}
-	defer s.Close()
+	// closed before notifying the reader, which closes the session as well
 	defer s.closeSignal.Done()
+	defer s.Close()
 }
 
 func (s *Session) checkAuth() bool {
-	return s.auth || s.valkeyConn.Auth("")
+	return s.user.Load() != nil
+}
+
+// backend returns the connection settings to backend servers of the user authenticated as
+func (s *Session) backend() *ValkeyConn {
+	if user := s.user.Load(); user != nil && user.valkeyConn != nil {
+		return user.valkeyConn
+	}
+	return s.valkeyConn
+}
+
+// setUser authenticates the session as user, dedicated backend connections of
+// the previous user are released if the user connects to backends as another one
+func (s *Session) setUser(user *ACLUser) {
+	if s.checkAuth() && s.backend() != user.valkeyConn {
+		s.reqWg.Wait()
+		if s.blocker != nil {
+			s.blocker.Close()
+			s.blocker = nil
+		}
+		if s.tx != nil {
+			s.tx.Close()
+		}
+	}
+	s.user.Store(user)
 }
 
 func (s *Session) ReadingLoop() {
+	s.saveState()
 	for {
 		cmd, err := resp.ReadCommand(s.r)
 		if err != nil {
+			if s.draining.Load() && errors.Is(err, os.ErrDeadlineExceeded) && !s.drained() {
+				// woken up with replies still to be written, the deadline is set again once idle
+				s.SetReadDeadline(time.Time{})
+				continue
+			}
 			glog.V(2).Info(err)
 			break
 		}
 		// convert all command name to upper case
 		cmd.Args[0] = strings.ToUpper(cmd.Args[0])
 
-		if len(cmd.Args) > 1 {
-			glog.Infof("access %s %s %s", s.RemoteAddr(), cmd.Name(), cmd.Args[1])
-		} else {
-			glog.Infof("access %s %s", s.RemoteAddr(), cmd.Name())
-		}
+		seq := s.reqSeq
+		s.track(cmd)
 		s.handle(cmd)
+		s.trackSeq(seq, s.reqSeq)
+		s.saveState()
+		if s.closeAfterReply || (s.r.Buffered() == 0 && s.drained()) {
+			break
+		}
+	}
+	// cancel blocked commands, then wait for all request done
+	if s.blocker != nil {
+		s.blocker.Close()
 	}
-	// wait for all request done
 	s.reqWg.Wait()
+	if s.tx != nil {
+		s.tx.Close()
+	}
+	// stop forwarding push frames before closing backQ
+	if s.channel != nil {
+		s.channel.Close()
+	}
+	if s.tracker != nil {
+		s.tracker.Remove(s)
+	}
 	// notify writer
 	close(s.backQ)
 	s.closeSignal.Wait()
+	if s.cache != nil {
+		// commands never replied since the connection is closed
+		for _, tc := range s.tracked {
+			s.cache.EndWrite(tc.writes)
+		}
+	}
 }
 
 func (s *Session) handle(cmd *resp.Command) {
+	if s.tracking {
+		s.trackRead(cmd)
+	}
 	if CmdAuthRequired(cmd) && !s.checkAuth() {
 		s.handleErrorCmd(NOAUTH_ERR)
-	} else if cmd.Name() == "MULTI" || s.multiCmd != nil || cmd.Name() == "EXEC" {
-		s.handleMultiCmd(cmd)
+	} else if err := s.checkPermission(cmd); err != nil {
+		s.handleErrorCmd(err)
+	} else if s.subscribed() && s.protocol == resp.RESP2 && !CmdSubscribedAllowed(cmd) {
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(cmd.Name()))))
+	} else if CmdTransaction(cmd) || (s.tx != nil && s.tx.Multi()) {
+		s.handleTransactionCmd(cmd)
+	} else if CmdPubSub(cmd) || (cmd.Name() == "PING" && s.subscribed() && s.protocol == resp.RESP2) {
+		s.handlePubSubCmd(cmd)
 	} else if cmd.Name() == "AUTH" {
 		s.handleAuthCmd(cmd)
-	} else if cmd.Name() == "SELECT" {
+	} else if cmd.Name() == "HELLO" {
+		s.handleHelloCmd(cmd)
+	} else if cmd.Name() == "SELECT" || cmd.Name() == "READONLY" || cmd.Name() == "READWRITE" {
 		s.handleSimpleStringCmd(OK)
 	} else if cmd.Name() == "PING" {
 		s.handleSimpleStringCmd([]byte("PONG"))
+	} else if cmd.Name() == "CLUSTER" {
+		s.handleClusterCmd(cmd)
+	} else if cmd.Name() == "SLOWLOG" {
+		s.handleSlowlogCmd(cmd)
+	} else if cmd.Name() == "INFO" {
+		s.handleInfoCmd(cmd)
+	} else if cmd.Name() == "CLIENT" {
+		s.handleClientCmd(cmd)
 	} else if CmdUnknown(cmd) {
 		s.handleErrorCmd(UNKNOWN_CMD_ERR)
+	} else if CmdBlocking(cmd) {
+		s.handleBlockingCmd(cmd)
 	} else if CmdReadAll(cmd) {
 		s.handleReadAll(cmd)
 	} else if yes, numKeys := IsMultiCmd(cmd); yes && numKeys > 1 {
-		s.handleMultiKeyCmd(cmd, numKeys)
+		s.handleMultiKeyCmd(cmd)
 	} else { // other general cmd
 		s.handleGeneralCmd(cmd)
 	}
 }
 
+// track registers cmd before handling it, so that its replies are matched by sequence
+func (s *Session) track(cmd *resp.Command) {
+	name, start := metricCommandName(cmd), time.Now()
+	var writes []string
+	if s.cache != nil {
+		writes = s.cache.BeginWrite(s.cacheWrites(cmd))
+	}
+	s.trackLock.Lock()
+	s.tracked = append(s.tracked, trackedCmd{cmd: cmd, name: name, start: start, lastSeq: -1, slot: -1, clientName: s.name, writes: writes})
+	s.state.cmd, s.state.time = name, start
+	s.trackLock.Unlock()
+}
+
+// saveState saves the state of session after a command is handled for CLIENT LIST,
+// called by reader only
+func (s *Session) saveState() {
+	multi, pubsub := s.tx != nil && s.tx.Multi(), s.subscribed()
+	qbuf := s.r.Buffered()
+	s.trackLock.Lock()
+	s.state.protocol, s.state.multi, s.state.pubsub = s.protocol, multi, pubsub
+	s.state.qbuf, s.state.qbufFree = qbuf, s.r.Size()-qbuf
+	s.trackLock.Unlock()
+}
+
+// route records the slot and backend server the command being handled is sent to,
+// slot is -1 if its keys hash to more than one slot
+func (s *Session) route(slot int, server string) {
+	if s.accessLog == nil && s.slowLog == nil {
+		return
+	}
+	s.trackLock.Lock()
+	defer s.trackLock.Unlock()
+	if len(s.tracked) == 0 {
+		return
+	}
+	tc := &s.tracked[len(s.tracked)-1]
+	if tc.backend == "" {
+		tc.slot, tc.backend = slot, server
+		return
+	}
+	if tc.slot != slot {
+		tc.slot = -1
+	}
+	if !strings.Contains(","+tc.backend+",", ","+server+",") {
+		tc.backend += "," + server
+	}
+}
+
+// trackSeq sets the sequences of replies of the command just handled to [first, next),
+// the command is finished if there is nothing to reply or the replies are written already
+func (s *Session) trackSeq(first, next int64) {
+	s.trackLock.Lock()
+	tc := &s.tracked[len(s.tracked)-1]
+	tc.lastSeq = next - 1
+	if next > first && tc.lastSeq >= s.written {
+		s.trackLock.Unlock()
+		return
+	}
+	finished := *tc
+	s.tracked = s.tracked[:len(s.tracked)-1]
+	s.trackLock.Unlock()
+	s.finish(&finished)
+}
+
+// replied is called once the reply of req is written to client
+func (s *Session) replied(req *PipelineRequest, reply []byte) {
+	seq := req.seq
+	s.trackLock.Lock()
+	s.written = seq + 1
+	if len(s.tracked) == 0 {
+		s.trackLock.Unlock()
+		return
+	}
+	tc := &s.tracked[0]
+	if len(reply) > 0 && (reply[0] == resp.T_Error || reply[0] == resp.T_BlobError) {
+		if !tc.failed && s.accessLog != nil {
+			tc.err = accessError(reply)
+		}
+		tc.failed = true
+	}
+	if s.accessLog != nil {
+		if tc.replySize == 0 {
+			tc.replyType = accessReplyType(reply)
+		}
+		tc.replySize += len(reply)
+	}
+	if !req.sent.IsZero() && tc.queueTime == 0 {
+		tc.queueTime = req.sent.Sub(tc.start)
+		tc.waitTime = req.received.Sub(req.sent)
+		tc.redirectTime, tc.redirects = req.redirectTime, req.redirects
+	}
+	// the command is still being handled, or more replies to write
+	if tc.lastSeq < 0 || seq < tc.lastSeq {
+		s.trackLock.Unlock()
+		return
+	}
+	finished := *tc
+	s.tracked = s.tracked[1:]
+	s.trackLock.Unlock()
+	s.finish(&finished)
+}
+
+// finish records a command with all its replies written in metrics and access log
+func (s *Session) finish(tc *trackedCmd) {
+	if tc.writes != nil {
+		s.cache.EndWrite(tc.writes)
+	}
+	latency := time.Since(tc.start)
+	metrics.ObserveCommand(tc.name, latency, tc.failed)
+	if s.slowLog != nil && s.slowLog.Slower(latency) {
+		s.slowLog.Add(&SlowLogEntry{
+			Time:      tc.start,
+			Duration:  latency,
+			Args:      slowLogArgs(tc.cmd),
+			Client:    s.RemoteAddr().String(),
+			Name:      tc.clientName,
+			Backend:   tc.backend,
+			Queue:     tc.queueTime,
+			Wait:      tc.waitTime,
+			Redirect:  tc.redirectTime,
+			Reply:     max(latency-tc.queueTime-tc.waitTime-tc.redirectTime, 0),
+			Redirects: tc.redirects,
+		})
+	}
+	if s.accessLog == nil || !s.accessLog.Sampled(tc.cmd, tc.failed) {
+		return
+	}
+	entry := &AccessEntry{
+		Time:      tc.start,
+		ID:        s.id,
+		Client:    s.RemoteAddr().String(),
+		Slot:      tc.slot,
+		Backend:   tc.backend,
+		LatencyUs: latency.Microseconds(),
+		ReplyType: tc.replyType,
+		ReplySize: tc.replySize,
+		Error:     tc.err,
+	}
+	if user := s.user.Load(); user != nil {
+		entry.User = user.Name
+	}
+	s.accessLog.Log(tc.cmd, entry)
+}
+
 // 将resp写出去。如果是multi key command，只有在全部完成后才汇总输出
 func (s *Session) writeResp(plRsp *PipelineResponse) error {
 	var buf []byte
@@ -125,12 +439,21 @@ func (s *Session) writeResp(plRsp *PipelineResponse) error {
 		s.rspSeq++
 	} else {
 		buf = plRsp.rsp.Raw()
+		// replies generated by proxy are already encoded in client's protocol
+		if plRsp.ctx.cmd != nil && s.protocol != s.valkeyConn.Protocol() {
+			buf = s.convertRaw(plRsp.ctx.cmd, buf)
+		}
 	}
 	// write to client directly with non-buffered io
 	if _, err := s.Write(buf); err != nil {
 		glog.Error(err)
 		return err
 	}
+	s.replied(plRsp.ctx, buf)
+	if s.draining.Load() && s.idle() {
+		// wake up reader to close the session
+		s.SetReadDeadline(time.Now().Add(SESSION_DRAIN_IDLE))
+	}
 
 	return nil
 }
@@ -141,7 +464,7 @@ func (s *Session) redirect(server string, plRsp *PipelineResponse, ask bool) {
 	var err error
 
 	plRsp.err = nil
-	conn, err = s.valkeyConn.Conn(server)
+	conn, err = s.backend().Conn(server)
 	if err != nil {
 		glog.Error(err)
 		plRsp.err = err
@@ -196,14 +519,21 @@ func (s *Session) handleResp(plRsp *PipelineResponse) error {
 	} else {
 		raw := plRsp.rsp.Raw()
 		if raw[0] == resp.T_Error {
+			start := time.Now()
 			if bytes.HasPrefix(raw, MOVED) {
 				_, server := ParseRedirectInfo(string(raw))
+				metrics.ObserveRedirect(false)
 				s.dispatcher.TriggerReloadSlots()
 				s.redirect(server, plRsp, false)
 			} else if bytes.HasPrefix(raw, ASK) {
 				_, server := ParseRedirectInfo(string(raw))
+				metrics.ObserveRedirect(true)
 				s.redirect(server, plRsp, true)
 			}
+			if bytes.HasPrefix(raw, MOVED) || bytes.HasPrefix(raw, ASK) {
+				plRsp.ctx.redirects = append(plRsp.ctx.redirects, redirectHop(raw))
+				plRsp.ctx.redirectTime += time.Since(start)
+			}
 		}
 	}
 
@@ -224,6 +554,17 @@ func (s *Session) handleResp(plRsp *PipelineResponse) error {
 // response sequence number, otherwise, put it to a heap to keep the response order is same
 // to request order
 func (s *Session) handleRespPipeline(plRsp *PipelineResponse) error {
+	if plRsp.ctx.push {
+		if s.closed {
+			return nil
+		}
+		if plRsp.ctx.barrier > s.rspSeq || len(s.deferred) > 0 {
+			s.deferred = append(s.deferred, plRsp)
+			return s.writeDeferred()
+		}
+		_, err := s.Write(plRsp.rsp.Raw())
+		return err
+	}
 	if plRsp.ctx.seq != s.rspSeq {
 		heap.Push(s.rspHeap, plRsp)
 		return nil
@@ -235,7 +576,7 @@ func (s *Session) handleRespPipeline(plRsp *PipelineResponse) error {
 	// continue to check the heap
 	for {
 		if rsp := s.rspHeap.Top(); rsp == nil || rsp.ctx.seq != s.rspSeq {
-			return nil
+			return s.writeDeferred()
 		}
 		rsp := heap.Pop(s.rspHeap).(*PipelineResponse)
 		if err := s.handleResp(rsp); err != nil {
@@ -244,45 +585,96 @@ func (s *Session) handleRespPipeline(plRsp *PipelineResponse) error {
 	}
 }
 
-func (s *Session) handleMultiCmd(cmd *resp.Command) {
-	if cmd.Name() == "MULTI" {
-		if s.multiCmd != nil {
-			s.handleErrorCmd([]byte("ERR MULTI calls can not be nested"))
-		} else {
-			s.multiCmd = &[]*resp.Command{}
-			s.handleSimpleStringCmd(OK)
+// writeDeferred writes push frames in order once the replies before their barriers are written
+func (s *Session) writeDeferred() error {
+	for len(s.deferred) > 0 && s.deferred[0].ctx.barrier <= s.rspSeq && !s.closed {
+		if _, err := s.Write(s.deferred[0].rsp.Raw()); err != nil {
+			return err
 		}
-	} else if cmd.Name() == "EXEC" {
-		if s.multiCmd == nil {
-			s.handleErrorCmd([]byte("ERR EXEC without MULTI"))
-		} else if s.multiCmdErr {
-			s.multiCmdErr = false
-			s.handleErrorCmd([]byte("EXECABORT Transaction discarded"))
-		} else {
-			exec := NewMultiCmdExec(s)
-			data, err := exec.Exec()
-			if err != nil {
-				s.handleErrorCmd([]byte(fmt.Sprintf("ERR EXEC error %v", err)))
-			} else {
-				s.reqWg.Add(1)
-				plRsp := &PipelineResponse{
-					rsp: resp.NewObjectFromData(data),
-					ctx: &PipelineRequest{seq: s.getNextReqSeq(), wg: s.reqWg},
-				}
-				s.backQ <- plRsp
-			}
+		s.deferred = s.deferred[1:]
+	}
+	return nil
+}
+
+// handleTransactionCmd handles WATCH/MULTI/EXEC/DISCARD and commands queued in a transaction
+func (s *Session) handleTransactionCmd(cmd *resp.Command) {
+	if s.tx == nil {
+		s.tx = NewTransaction(s)
+	}
+	switch cmd.Name() {
+	case "WATCH", "UNWATCH", "EXEC", "DISCARD":
+		// keys must be watched and transaction executed after all the requests before
+		s.reqWg.Wait()
+	}
+	s.handleDataCmd(s.tx.Handle(cmd))
+}
+
+func (s *Session) subscribed() bool {
+	return s.channel != nil && s.channel.Subscribed()
+}
+
+// handlePubSubCmd sends subscribe commands through the session's dedicated channel,
+// their replies are forwarded as push frames by the channel
+func (s *Session) handlePubSubCmd(cmd *resp.Command) {
+	switch cmd.Name() {
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE":
+		if len(cmd.Args) < 2 {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+			return
 		}
-		s.multiCmd = nil
-	} else {
-		flag := CmdFlag(cmd)
-		if flag == CMD_FLAG_GENERAL || flag == CMD_FLAG_READ {
-			*s.multiCmd = append(*s.multiCmd, cmd)
-			s.handleSimpleStringCmd([]byte("QUEUED"))
-		} else {
-			s.multiCmdErr = true
-			s.handleErrorCmd([]byte(UNKNOWN_CMD_ERR))
+	case "PING":
+		if len(cmd.Args) > 2 {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+			return
 		}
 	}
+	// push frames must follow all the replies before
+	s.reqWg.Wait()
+	if cmd.Name() == "PING" {
+		// answered by proxy, a subscriber of sharded channels only has no classic link
+		s.push(&resp.Data{T: resp.T_Array, Array: []*resp.Data{
+			{T: resp.T_BulkString, String: []byte("pong")},
+			{T: resp.T_BulkString, String: []byte(cmd.Value(1))},
+		}})
+		return
+	}
+	if s.channel == nil {
+		s.channel = NewChannel(s)
+	}
+	if err := s.channel.Request(cmd); err != nil {
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR %v", err)))
+	}
+}
+
+// push sends an out of band frame to client, eg. messages of subscribed channels,
+// it is encoded as RESP3 push or RESP2 array according to client's protocol
+func (s *Session) push(data *resp.Data) {
+	if s.protocol == resp.RESP2 {
+		data = data.Downgrade()
+	} else if data.T == resp.T_Array {
+		data = &resp.Data{T: resp.T_Push, Array: upgradeNull(data).Array}
+	}
+	s.backQ <- &PipelineResponse{
+		rsp: resp.NewObjectFromData(data),
+		ctx: &PipelineRequest{push: true},
+	}
+}
+
+// tryPush sends an out of band frame written after the replies before barrier,
+// it returns false instead of blocking if backQ is full
+func (s *Session) tryPush(data *resp.Data, barrier int64) bool {
+	if s.respVersion() == resp.RESP2 {
+		data = data.Downgrade()
+	}
+	select {
+	case s.backQ <- &PipelineResponse{
+		rsp: resp.NewObjectFromData(data),
+		ctx: &PipelineRequest{push: true, barrier: barrier},
+	}:
+		return true
+	default:
+		return false
+	}
 }
 
 func (s *Session) handleErrorCmd(msg []byte) {
@@ -300,9 +692,14 @@ func (s *Session) handleErrorCmd(msg []byte) {
 }
 
 func (s *Session) handleReadAll(cmd *resp.Command) {
-	seq := s.getNextReqSeq()
 	slots := s.dispatcher.slotTable.ServerSlots()
-	mc := NewMultiCmd(s, cmd, len(slots))
+	s.scheduleReadAll(NewMultiCmd(s, cmd, len(slots)), slots, true)
+}
+
+// scheduleReadAll sends the command of mc to the server of each slot, one slot of each master,
+// the command is read from replicas if readOnly
+func (s *Session) scheduleReadAll(mc *MultiCmd, slots []int, readOnly bool) {
+	seq := s.getNextReqSeq()
 	for i, slot := range slots {
 		subCmd, err := mc.SubCmd(i, len(slots))
 		if err != nil {
@@ -310,7 +707,7 @@ func (s *Session) handleReadAll(cmd *resp.Command) {
 		}
 		plReq := &PipelineRequest{
 			cmd:       subCmd,
-			readOnly:  true,
+			readOnly:  readOnly,
 			slot:      slot,
 			seq:       seq,
 			subSeq:    i,
@@ -323,17 +720,148 @@ func (s *Session) handleReadAll(cmd *resp.Command) {
 	}
 }
 
+// checkPermission returns the NOPERM error if the user is not allowed to run cmd
+func (s *Session) checkPermission(cmd *resp.Command) []byte {
+	user := s.user.Load()
+	if user == nil || !CmdAuthRequired(cmd) {
+		return nil
+	}
+	err := user.Check(cmd)
+	if err != nil {
+		glog.V(1).Infof("%s from %s", err, s.RemoteAddr())
+	}
+	return err
+}
+
+// handleAuthCmd authenticates with AUTH <password> as the default user, or AUTH <username> <password>
 func (s *Session) handleAuthCmd(cmd *resp.Command) {
-	if len(cmd.Args) == 2 {
-		if s.valkeyConn.Auth(cmd.Args[1]) {
-			s.handleSimpleStringCmd(OK)
-			s.auth = true
-		} else {
-			s.handleErrorCmd(AUTH_CMD_ERR)
-		}
-	} else {
+	name, password := ACL_DEFAULT_USER, ""
+	switch len(cmd.Args) {
+	case 2:
+		password = cmd.Args[1]
+	case 3:
+		name, password = cmd.Args[1], cmd.Args[2]
+	default:
 		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	user := s.acl.Authenticate(name, password)
+	if user == nil {
+		glog.Warningf("auth failed for user %s from %s", name, s.RemoteAddr())
+		s.handleErrorCmd(WRONGPASS_ERR)
+		return
+	}
+	s.setUser(user)
+	s.handleSimpleStringCmd(OK)
+}
+
+func (s *Session) handleHelloCmd(cmd *resp.Command) {
+	protocol := s.protocol
+	if len(cmd.Args) > 1 {
+		version, err := strconv.Atoi(cmd.Args[1])
+		if err != nil {
+			s.handleErrorCmd([]byte("ERR Protocol version is not an integer or out of range"))
+			return
+		}
+		if version != resp.RESP2 && version != resp.RESP3 {
+			s.handleErrorCmd(NOPROTO_ERR)
+			return
+		}
+		protocol = version
+	}
+
+	user := s.user.Load()
+	name, setName := "", false
+	for i := 2; i < len(cmd.Args); i++ {
+		switch strings.ToUpper(cmd.Args[i]) {
+		case "AUTH":
+			if i+2 >= len(cmd.Args) {
+				s.handleErrorCmd(SYNTAX_ERR)
+				return
+			}
+			if user = s.acl.Authenticate(cmd.Args[i+1], cmd.Args[i+2]); user == nil {
+				glog.Warningf("auth failed for user %s from %s", cmd.Args[i+1], s.RemoteAddr())
+				s.handleErrorCmd(WRONGPASS_ERR)
+				return
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(cmd.Args) {
+				s.handleErrorCmd(SYNTAX_ERR)
+				return
+			}
+			name, setName = cmd.Args[i+1], true
+			if !validClientName(name) {
+				s.handleErrorCmd(CLIENT_NAME_ERR)
+				return
+			}
+			i += 1
+		default:
+			s.handleErrorCmd(SYNTAX_ERR)
+			return
+		}
+	}
+	if user == nil {
+		s.handleErrorCmd(HELLO_AUTH_ERR)
+		return
+	}
+
+	s.setUser(user)
+	s.protocol = protocol
+	if setName {
+		s.setName(name)
 	}
+	s.handleDataCmd(&resp.Data{T: resp.T_Map, Array: []*resp.Data{
+		{T: resp.T_BulkString, String: []byte("server")},
+		{T: resp.T_BulkString, String: []byte("valkey")},
+		{T: resp.T_BulkString, String: []byte("version")},
+		{T: resp.T_BulkString, String: []byte(SERVER_VERSION)},
+		{T: resp.T_BulkString, String: []byte("proto")},
+		{T: resp.T_Integer, Integer: int64(protocol)},
+		{T: resp.T_BulkString, String: []byte("id")},
+		{T: resp.T_Integer, Integer: s.id},
+		{T: resp.T_BulkString, String: []byte("mode")},
+		{T: resp.T_BulkString, String: []byte("standalone")},
+		{T: resp.T_BulkString, String: []byte("role")},
+		{T: resp.T_BulkString, String: []byte("master")},
+		{T: resp.T_BulkString, String: []byte("modules")},
+		{T: resp.T_Array, Array: []*resp.Data{}},
+	}})
+}
+
+// handleDataCmd replies data generated by proxy, RESP3 types are downgraded for RESP2 clients
+func (s *Session) handleDataCmd(data *resp.Data) {
+	if s.protocol == resp.RESP2 {
+		data = data.Downgrade()
+	}
+	s.reqWg.Add(1)
+	plRsp := &PipelineResponse{
+		rsp: resp.NewObjectFromData(data),
+		ctx: &PipelineRequest{
+			seq: s.getNextReqSeq(),
+			wg:  s.reqWg,
+		},
+	}
+	s.backQ <- plRsp
+}
+
+// convertReply converts a reply of cmd from backend's protocol to client's protocol
+func (s *Session) convertReply(cmd *resp.Command, data *resp.Data) *resp.Data {
+	return ConvertReply(cmd, data, s.valkeyConn.Protocol(), s.protocol)
+}
+
+// convertRaw converts a raw reply of cmd from backend's protocol to client's, a reply
+// encoded the same in both protocols is written as is without being parsed
+func (s *Session) convertRaw(cmd *resp.Command, raw []byte) []byte {
+	if ReplyShape(cmd) == REPLY_SHAPE_PLAIN && resp.IsProtocolNeutral(raw) {
+		return raw
+	}
+	data, err := resp.ReadData(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		glog.Errorf("re-parse response err=%s", err)
+		return raw
+	}
+	return s.convertReply(cmd, data).Format()
 }
 
 func (s *Session) handleSimpleStringCmd(msg []byte) {
@@ -349,36 +877,84 @@ func (s *Session) handleSimpleStringCmd(msg []byte) {
 }
 
 func (s *Session) handleGeneralCmd(cmd *resp.Command) {
-	key := cmd.Value(1)
-	slot := Key2Slot(key)
+	slot, ok := s.cmdSlot(cmd)
+	if !ok {
+		return
+	}
+	cacheable := s.cache != nil && s.cache.Cacheable(cmd)
+	if cacheable && s.handleCachedCmd(cmd) {
+		return
+	}
 	plReq := &PipelineRequest{
-		cmd:      cmd,
-		readOnly: CmdReadOnly(cmd),
-		slot:     slot,
-		seq:      s.getNextReqSeq(),
-		backQ:    s.backQ,
-		wg:       s.reqWg,
+		cmd:       cmd,
+		readOnly:  s.readOnly(cmd),
+		slot:      slot,
+		seq:       s.getNextReqSeq(),
+		backQ:     s.backQ,
+		wg:        s.reqWg,
+		cacheable: cacheable,
 	}
 
 	s.reqWg.Add(1)
 	s.Schedule(plReq)
 }
 
-func (s *Session) handleMultiKeyCmd(cmd *resp.Command, numKeys int) {
-	mc := NewMultiCmd(s, cmd, numKeys)
+// handleBlockingCmd runs a blocking command on session's dedicated connections
+func (s *Session) handleBlockingCmd(cmd *resp.Command) {
+	slot, ok := s.cmdSlot(cmd)
+	if !ok {
+		return
+	}
+	if s.blocker == nil {
+		s.blocker = NewBlocker(s)
+	}
+	// the server may change by redirection while blocking
+	s.route(slot, s.dispatcher.slotTable.WriteServer(slot))
+	// the dedicated connection must not overtake the requests before on the pool
+	s.reqWg.Wait()
+	plReq := &PipelineRequest{
+		cmd:   cmd,
+		slot:  slot,
+		seq:   s.getNextReqSeq(),
+		backQ: s.backQ,
+		wg:    s.reqWg,
+	}
+	s.reqWg.Add(1)
+	s.blocker.Schedule(plReq)
+}
+
+// cmdSlot returns the slot cmd routes to, a random one for command without key.
+// It replies CROSSSLOT error and returns false if the keys hash to different slots.
+func (s *Session) cmdSlot(cmd *resp.Command) (int, bool) {
+	slot, crossSlot := CmdSlot(cmd)
+	if crossSlot {
+		s.handleErrorCmd(CROSSSLOT_ERR)
+		return 0, false
+	}
+	if slot < 0 {
+		slot = rand.Intn(NumSlots)
+	}
+	return slot, true
+}
+
+func (s *Session) handleMultiKeyCmd(cmd *resp.Command) {
+	mc := NewMultiKeyCmd(s, cmd)
+	if len(mc.groups) == 1 {
+		// all keys are in the same slot
+		s.handleGeneralCmd(cmd)
+		return
+	}
 	// multi sub cmd share the same seq number
 	seq := s.getNextReqSeq()
-	for i := 0; i < numKeys; i++ {
-		subCmd, err := mc.SubCmd(i, numKeys)
+	for i, group := range mc.groups {
+		subCmd, err := mc.SubCmd(i, len(mc.groups))
 		if err != nil {
 			panic(err)
 		}
-		key := subCmd.Value(1)
-		slot := Key2Slot(key)
 		plReq := &PipelineRequest{
 			cmd:       subCmd,
-			readOnly:  CmdReadOnly(cmd),
-			slot:      slot,
+			readOnly:  s.readOnly(cmd),
+			slot:      group.slot,
 			seq:       seq,
 			subSeq:    i,
 			backQ:     s.backQ,
@@ -390,6 +966,13 @@ func (s *Session) handleMultiKeyCmd(cmd *resp.Command, numKeys int) {
 	}
 }
 
+// readOnly returns whether cmd may be read from replicas. Reads of a tracking client
+// go to masters, which invalidations are tracked on, otherwise a value read from a
+// lagging replica could be cached after its invalidation. Called by reader only.
+func (s *Session) readOnly(cmd *resp.Command) bool {
+	return CmdReadOnly(cmd) && !s.tracking
+}
+
 func (s *Session) Schedule(req *PipelineRequest) {
 	var server string
 	if req.readOnly {
@@ -398,23 +981,83 @@ func (s *Session) Schedule(req *PipelineRequest) {
 		server = s.dispatcher.slotTable.WriteServer(req.slot)
 	}
 
-	backendServer, err := s.dispatcher.backendServerPool.Get(server)
-	if err != nil {
-		s.handleErrorCmd([]byte(fmt.Sprintf("ERR %v", err)))
-	} else {
-		defer s.dispatcher.backendServerPool.Put(backendServer)
-		resp, err := backendServer.Request(req)
-		if err == nil {
-			s.backQ <- resp
-		} else {
-			s.handleErrorCmd([]byte(fmt.Sprintf("ERR %v", err)))
+	s.route(req.slot, server)
+	pin := s.pin(server)
+	pin.add()
+	req.pin = pin
+	if err := pin.conn.Request(req); err != nil {
+		s.backQ <- &PipelineResponse{ctx: req, err: err}
+	}
+}
+
+// backendPin is the backend connection requests of a session to a server go through,
+// and the number of them not replied yet
+type backendPin struct {
+	conn       *BackendServer
+	valkeyConn *ValkeyConn
+	pending    atomic.Int64
+	wg         sync.WaitGroup
+}
+
+func (p *backendPin) add() {
+	p.pending.Add(1)
+	p.wg.Add(1)
+}
+
+func (p *backendPin) done() {
+	p.pending.Add(-1)
+	p.wg.Done()
+}
+
+// pin returns the backend connection to server for the next request. Requests keep
+// going through the same connection while any of them is not replied, so that the
+// pool resized never reorders them, and a connection removed from pool is left once
+// all of them are replied. Called by reader only.
+func (s *Session) pin(server string) *backendPin {
+	valkeyConn := s.backend()
+	p, ok := s.pins[server]
+	if ok && p.valkeyConn == valkeyConn && p.pending.Load() > 0 {
+		if !p.conn.removed.Load() {
+			return p
 		}
+		// requests to the successor must not overtake the ones to the connection removed
+		p.wg.Wait()
+	}
+	conn := s.dispatcher.backendServerPool.Get(valkeyConn, server, s.id)
+	if ok && p.conn == conn && p.valkeyConn == valkeyConn {
+		return p
+	}
+	if s.pins == nil {
+		s.pins = make(map[string]*backendPin)
+	}
+	p = &backendPin{conn: conn, valkeyConn: valkeyConn}
+	s.pins[server] = p
+	return p
+}
+
+// Drain closes the session once all replies are written, pipelined requests already
+// received are handled, and a transaction in progress is finished by client
+func (s *Session) Drain() {
+	s.draining.Store(true)
+	if s.idle() {
+		s.SetReadDeadline(time.Now().Add(SESSION_DRAIN_IDLE))
 	}
-	glog.Infof("request count: %d, response count: %d", s.reqSeq, s.rspSeq)
+}
+
+// idle returns whether every command received is replied
+func (s *Session) idle() bool {
+	s.trackLock.Lock()
+	defer s.trackLock.Unlock()
+	return len(s.tracked) == 0
+}
+
+// drained returns whether the session is idle to close while draining, called by reader only
+func (s *Session) drained() bool {
+	return s.draining.Load() && s.idle() && (s.tx == nil || !s.tx.Pending())
 }
 
 func (s *Session) Close() {
-	glog.Infof("close session %p", s)
+	glog.V(2).Infof("close session %p", s)
 	if !s.closed {
 		s.closed = true
 		s.Conn.Close()
@@ -431,6 +1074,11 @@ func (s *Session) getNextReqSeq() (seq int64) {
 	return
 }
 
+// redirectHop returns the MOVED or ASK error without prefix and CRLF, eg. "MOVED 3999 10.0.0.2:7001"
+func redirectHop(raw []byte) string {
+	return strings.TrimSpace(string(raw[1:]))
+}
+
 // ParseRedirectInfo parse slot redirect information from MOVED and ASK Error
 func ParseRedirectInfo(msg string) (slot int, server string) {
 	var err error
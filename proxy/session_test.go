@@ -1,9 +1,15 @@
 package proxy
 
 import (
+	"bufio"
 	"container/heap"
 	"errors"
+	"net"
+	"sync"
 	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
 )
 
 var (
@@ -87,3 +93,76 @@ func TestHandleRespPipeline(t *testing.T) {
 		}
 	}
 }
+
+// serveTestSession runs a session on conn, done is closed once the session exits
+func serveTestSession(conn net.Conn) (s *Session, done chan struct{}) {
+	s = newTestSession(conn)
+	return s, serveSession(s)
+}
+
+// newTestSession returns a session on conn authenticated as the default user
+func newTestSession(conn net.Conn) *Session {
+	s := &Session{
+		Conn:        conn,
+		r:           bufio.NewReader(conn),
+		protocol:    resp.RESP2,
+		cached:      make(map[string]map[string]string),
+		backQ:       make(chan *PipelineResponse, 1000),
+		closeSignal: &sync.WaitGroup{},
+		reqWg:       &sync.WaitGroup{},
+		valkeyConn:  NewValkeyConn(1, 0, "", false),
+		rspHeap:     &PipelineResponseHeap{},
+	}
+	s.acl = NewACL("", s.valkeyConn)
+	s.user.Store(s.acl.DefaultUser())
+	return s
+}
+
+// serveSession runs the reader and writer of s, done is closed once the session exits
+func serveSession(s *Session) (done chan struct{}) {
+	s.Prepare()
+	done = make(chan struct{})
+	go s.WritingLoop()
+	go func() {
+		// connection is closed by writer
+		s.ReadingLoop()
+		close(done)
+	}()
+	return
+}
+
+func TestSessionDrain(t *testing.T) {
+	conn, client := net.Pipe()
+	defer client.Close()
+	s, done := serveTestSession(conn)
+	r := bufio.NewReader(client)
+	request := func(cmd string) string {
+		client.Write([]byte(cmd + "\r\n"))
+		line, _ := r.ReadString('\n')
+		return line
+	}
+	if reply := request("PING"); reply != "+PONG\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if reply := request("MULTI"); reply != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+
+	s.Drain()
+	select {
+	case <-done:
+		t.Fatal("expected session kept until transaction finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if reply := request("DISCARD"); reply != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected session closed once idle")
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("expected connection closed")
+	}
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"bytes"
 	"fmt"
+	"slices"
 	"sort"
 
 	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
@@ -59,6 +60,58 @@ func (st *SlotTable) ServerSlots() []int {
 	return values
 }
 
+// Masters returns the servers writes are sent to in order
+func (st *SlotTable) Masters() []string {
+	seen := make(map[string]bool)
+	var masters []string
+	for _, serverGroup := range st.serverGroups {
+		if serverGroup != nil && serverGroup.write != "" && !seen[serverGroup.write] {
+			seen[serverGroup.write] = true
+			masters = append(masters, serverGroup.write)
+		}
+	}
+	sort.Strings(masters)
+	return masters
+}
+
+// AssignedSlots returns the number of slots served by any server
+func (st *SlotTable) AssignedSlots() int {
+	assigned := 0
+	for _, serverGroup := range st.serverGroups {
+		if serverGroup != nil && serverGroup.write != "" {
+			assigned++
+		}
+	}
+	return assigned
+}
+
+// SlotRange is a range of consecutive slots served by the same servers
+type SlotRange struct {
+	Start int      `json:"start"`
+	End   int      `json:"end"`
+	Write string   `json:"write"`
+	Read  []string `json:"read"`
+}
+
+// Ranges returns the slots grouped into ranges, unassigned slots are left out
+func (st *SlotTable) Ranges() []SlotRange {
+	var ranges []SlotRange
+	for slot, serverGroup := range st.serverGroups {
+		if serverGroup == nil || serverGroup.write == "" {
+			continue
+		}
+		if n := len(ranges); n > 0 {
+			last := &ranges[n-1]
+			if last.End == slot-1 && last.Write == serverGroup.write && slices.Equal(last.Read, serverGroup.read) {
+				last.End = slot
+				continue
+			}
+		}
+		ranges = append(ranges, SlotRange{Start: slot, End: slot, Write: serverGroup.write, Read: serverGroup.read})
+	}
+	return ranges
+}
+
 func (st *SlotTable) SetSlotInfo(si *SlotInfo) {
 	for i := si.start; i <= si.end; i++ {
 		st.serverGroups[i] = &ServerGroup{
@@ -1,6 +1,9 @@
 package proxy
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestKey2Slot(t *testing.T) {
 	pairs := map[string]string{
@@ -17,3 +20,25 @@ func TestKey2Slot(t *testing.T) {
 		}
 	}
 }
+
+func TestAssignedSlots(t *testing.T) {
+	st := NewSlotTable()
+	st.SetSlotInfo(&SlotInfo{start: 0, end: 99, write: "127.0.0.1:7001"})
+	if assigned := st.AssignedSlots(); assigned != 100 {
+		t.Errorf("expected 100 assigned slots, got %d", assigned)
+	}
+}
+
+func TestSlotTableRanges(t *testing.T) {
+	st := NewSlotTable()
+	st.SetSlotInfo(&SlotInfo{start: 0, end: 99, write: "127.0.0.1:7001", read: []string{"127.0.0.1:7004"}})
+	st.SetSlotInfo(&SlotInfo{start: 100, end: 199, write: "127.0.0.1:7001", read: []string{"127.0.0.1:7004"}})
+	st.SetSlotInfo(&SlotInfo{start: 300, end: 399, write: "127.0.0.1:7002"})
+	expected := []SlotRange{
+		{Start: 0, End: 199, Write: "127.0.0.1:7001", Read: []string{"127.0.0.1:7004"}},
+		{Start: 300, End: 399, Write: "127.0.0.1:7002"},
+	}
+	if ranges := st.Ranges(); !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("expected ranges %v, got %v", expected, ranges)
+	}
+}
@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+const (
+	// default settings the same as valkey, commands slower than 10ms are logged and 128 entries kept
+	SLOWLOG_LOG_SLOWER_THAN = 10 * time.Millisecond
+	SLOWLOG_MAX_LEN         = 128
+	// entries replied by SLOWLOG GET without count
+	SLOWLOG_DEFAULT_COUNT = 10
+	// arguments and bytes of each argument kept in an entry, the same as valkey
+	SLOWLOG_ENTRY_MAX_ARGC   = 32
+	SLOWLOG_ENTRY_MAX_STRING = 128
+)
+
+// views of SLOWLOG subcommands given as the last argument
+const (
+	SLOWLOG_VIEW_ALL     = "ALL"
+	SLOWLOG_VIEW_PROXY   = "PROXY"
+	SLOWLOG_VIEW_CLUSTER = "CLUSTER"
+)
+
+var SLOWLOG_HELP = []string{
+	"SLOWLOG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"GET [<count>] [PROXY|CLUSTER|ALL]",
+	"    Return top <count> entries from the slowlog (default: 10, -1 mean all).",
+	"    Entries of the proxy have the time spent in each phase as the 7th field.",
+	"LEN [PROXY|CLUSTER|ALL]",
+	"    Return the length of the slowlog.",
+	"RESET [PROXY|CLUSTER|ALL]",
+	"    Reset the slowlog.",
+	"The proxy view has commands slower end to end from proxy, and the cluster view",
+	"has the ones slower executed by masters, both of them by default.",
+	"HELP",
+	"    Print this help.",
+}
+
+/*
+SlowLog keeps the latest commands slower than a threshold from being received to all
+their replies written, so that the time queued in proxy and spent on redirections are
+seen as well as the time of backend. Entries are replied by SLOWLOG GET in the same
+format as valkey, with the time of each phase appended.
+*/
+type SlowLog struct {
+	lock       sync.Mutex
+	slowerThan time.Duration
+	maxLen     int
+	nextID     int64
+	// newest first
+	entries []*SlowLogEntry
+}
+
+// SlowLogEntry is a command logged in slow log
+type SlowLogEntry struct {
+	ID       int64
+	Time     time.Time
+	Duration time.Duration
+	Args     []string
+	Client   string
+	Name     string
+	Backend  string
+	// time from received to written to backend, waiting for the reply from backend,
+	// following redirections and writing replies to client
+	Queue    time.Duration
+	Wait     time.Duration
+	Redirect time.Duration
+	Reply    time.Duration
+	// MOVED and ASK redirections followed, eg. "MOVED 3999 10.0.0.2:7001"
+	Redirects []string
+}
+
+// NewSlowLog returns slow log of commands slower than slowerThan, negative to disable,
+// at most maxLen entries are kept
+func NewSlowLog(slowerThan time.Duration, maxLen int) *SlowLog {
+	l := &SlowLog{}
+	l.Configure(slowerThan, maxLen)
+	return l
+}
+
+// Configure changes the threshold and max length, older entries beyond are removed
+func (l *SlowLog) Configure(slowerThan time.Duration, maxLen int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.slowerThan, l.maxLen = slowerThan, maxLen
+	if len(l.entries) > maxLen {
+		l.entries = l.entries[:maxLen]
+	}
+}
+
+// Slower returns whether a command taking d is logged
+func (l *SlowLog) Slower(d time.Duration) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.slowerThan >= 0 && d >= l.slowerThan && l.maxLen > 0
+}
+
+// Add logs entry with the next id
+func (l *SlowLog) Add(entry *SlowLogEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.maxLen <= 0 {
+		return
+	}
+	entry.ID = l.nextID
+	l.nextID++
+	n := min(len(l.entries)+1, l.maxLen)
+	entries := make([]*SlowLogEntry, n)
+	entries[0] = entry
+	copy(entries[1:], l.entries)
+	l.entries = entries
+}
+
+// Get returns the latest count entries, all of them if count is negative
+func (l *SlowLog) Get(count int) []*SlowLogEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if count < 0 || count > len(l.entries) {
+		count = len(l.entries)
+	}
+	return l.entries[:count]
+}
+
+func (l *SlowLog) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.entries)
+}
+
+func (l *SlowLog) Reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = nil
+}
+
+// slowLogArgs returns the arguments of cmd kept in an entry, trimmed the same as valkey
+func slowLogArgs(cmd *resp.Command) []string {
+	argc := min(len(cmd.Args), SLOWLOG_ENTRY_MAX_ARGC)
+	args := make([]string, argc)
+	for i := range args {
+		if i == argc-1 && argc < len(cmd.Args) {
+			args[i] = fmt.Sprintf("... (%d more arguments)", len(cmd.Args)-argc+1)
+			break
+		}
+		args[i] = cmd.Args[i]
+		if len(args[i]) > SLOWLOG_ENTRY_MAX_STRING {
+			args[i] = fmt.Sprintf("%s... (%d more bytes)", args[i][:SLOWLOG_ENTRY_MAX_STRING], len(args[i])-SLOWLOG_ENTRY_MAX_STRING)
+		}
+	}
+	return args
+}
+
+// Data returns the entry in the format of valkey's SLOWLOG GET, the time of each phase
+// is appended as an array of field and value pairs
+func (e *SlowLogEntry) Data() *resp.Data {
+	args := make([]*resp.Data, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = &resp.Data{T: resp.T_BulkString, String: []byte(arg)}
+	}
+	redirects := make([]*resp.Data, len(e.Redirects))
+	for i, redirect := range e.Redirects {
+		redirects[i] = &resp.Data{T: resp.T_BulkString, String: []byte(redirect)}
+	}
+	phases := []*resp.Data{
+		{T: resp.T_BulkString, String: []byte("backend")},
+		{T: resp.T_BulkString, String: []byte(e.Backend)},
+	}
+	for _, phase := range []struct {
+		name string
+		d    time.Duration
+	}{{"queue", e.Queue}, {"backend_wait", e.Wait}, {"redirect", e.Redirect}, {"reply", e.Reply}} {
+		phases = append(phases,
+			&resp.Data{T: resp.T_BulkString, String: []byte(phase.name)},
+			&resp.Data{T: resp.T_Integer, Integer: phase.d.Microseconds()})
+	}
+	phases = append(phases,
+		&resp.Data{T: resp.T_BulkString, String: []byte("redirects")},
+		&resp.Data{T: resp.T_Array, Array: redirects})
+	return &resp.Data{T: resp.T_Array, Array: []*resp.Data{
+		{T: resp.T_Integer, Integer: e.ID},
+		{T: resp.T_Integer, Integer: e.Time.Unix()},
+		{T: resp.T_Integer, Integer: e.Duration.Microseconds()},
+		{T: resp.T_Array, Array: args},
+		{T: resp.T_BulkString, String: []byte(e.Client)},
+		{T: resp.T_BulkString, String: []byte(e.Name)},
+		{T: resp.T_Array, Array: phases},
+	}}
+}
+
+// handleSlowlogCmd answers SLOWLOG from the slow log of proxy, masters of the cluster,
+// or both of them by the view given as the last argument
+func (s *Session) handleSlowlogCmd(cmd *resp.Command) {
+	if len(cmd.Args) < 2 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	view := SLOWLOG_VIEW_ALL
+	args := cmd.Args
+	switch last := strings.ToUpper(args[len(args)-1]); last {
+	case SLOWLOG_VIEW_ALL, SLOWLOG_VIEW_PROXY, SLOWLOG_VIEW_CLUSTER:
+		if len(args) > 2 {
+			view, args = last, args[:len(args)-1]
+		}
+	}
+	sub := strings.ToUpper(args[1])
+	count := SLOWLOG_DEFAULT_COUNT
+	switch {
+	case sub == "HELP" && len(args) == 2:
+		help := make([]*resp.Data, len(SLOWLOG_HELP))
+		for i, line := range SLOWLOG_HELP {
+			help[i] = &resp.Data{T: resp.T_SimpleString, String: []byte(line)}
+		}
+		s.handleDataCmd(&resp.Data{T: resp.T_Array, Array: help})
+		return
+	case sub == "GET" && len(args) <= 3:
+		if len(args) == 3 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < -1 {
+				s.handleErrorCmd([]byte("ERR count should be greater than or equal to -1"))
+				return
+			}
+			count = n
+		}
+	case (sub == "LEN" || sub == "RESET") && len(args) == 2:
+	default:
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try SLOWLOG HELP.", args[1])))
+		return
+	}
+
+	var data *resp.Data
+	if view != SLOWLOG_VIEW_CLUSTER {
+		switch sub {
+		case "GET":
+			entries := s.slowLog.Get(count)
+			data = &resp.Data{T: resp.T_Array, Array: make([]*resp.Data, len(entries))}
+			for i, entry := range entries {
+				data.Array[i] = entry.Data()
+			}
+		case "LEN":
+			data = &resp.Data{T: resp.T_Integer, Integer: int64(s.slowLog.Len())}
+		case "RESET":
+			s.slowLog.Reset()
+			data = OK_DATA
+		}
+		if view == SLOWLOG_VIEW_PROXY {
+			s.handleDataCmd(data)
+			return
+		}
+	}
+	backendCmd, _ := resp.NewCommand(args...)
+	slots := s.dispatcher.slotTable.ServerSlots()
+	mc := NewMultiCmd(s, backendCmd, len(slots))
+	mc.slowlog = data
+	s.scheduleReadAll(mc, slots, true)
+}
+
+// mergeSlowlogRsp merges entries of proxy into the reply of masters
+func (mc *MultiCmd) mergeSlowlogRsp(rsp *resp.Data) *resp.Data {
+	switch strings.ToUpper(mc.cmd.Value(1)) {
+	case "GET":
+		rsp.Array = append(rsp.Array, mc.slowlog.Array...)
+		// latest first by timestamp
+		sort.SliceStable(rsp.Array, func(i, j int) bool {
+			return slowlogTime(rsp.Array[i]) > slowlogTime(rsp.Array[j])
+		})
+		count := SLOWLOG_DEFAULT_COUNT
+		if len(mc.cmd.Args) == 3 {
+			count, _ = strconv.Atoi(mc.cmd.Value(2))
+		}
+		if count >= 0 && len(rsp.Array) > count {
+			rsp.Array = rsp.Array[:count]
+		}
+	case "LEN":
+		rsp.Integer += mc.slowlog.Integer
+	}
+	return rsp
+}
+
+func slowlogTime(entry *resp.Data) int64 {
+	if len(entry.Array) < 2 {
+		return 0
+	}
+	return entry.Array[1].Integer
+}
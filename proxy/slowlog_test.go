@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestSlowLog(t *testing.T) {
+	l := NewSlowLog(10*time.Millisecond, 2)
+	if l.Slower(time.Millisecond) || !l.Slower(10*time.Millisecond) {
+		t.Error("unexpected threshold")
+	}
+	for i := 0; i < 3; i++ {
+		l.Add(&SlowLogEntry{Duration: time.Duration(i)})
+	}
+	entries := l.Get(-1)
+	if len(entries) != 2 || entries[0].ID != 2 || entries[1].ID != 1 {
+		t.Errorf("expected latest 2 entries, got %v", entries)
+	}
+	if entries = l.Get(1); len(entries) != 1 || entries[0].ID != 2 {
+		t.Errorf("expected latest entry, got %v", entries)
+	}
+	l.Configure(-1, 1)
+	if l.Len() != 1 || l.Slower(time.Hour) {
+		t.Error("expected slow log shrunk and disabled")
+	}
+	l.Reset()
+	if l.Len() != 0 {
+		t.Error("expected slow log reset")
+	}
+
+	args := make([]string, 40)
+	args[0], args[1] = "MSET", strings.Repeat("k", 130)
+	for i := 2; i < len(args); i++ {
+		args[i] = "v"
+	}
+	cmd, _ := resp.NewCommand(args...)
+	trimmed := slowLogArgs(cmd)
+	if len(trimmed) != SLOWLOG_ENTRY_MAX_ARGC || trimmed[31] != "... (9 more arguments)" ||
+		trimmed[1] != strings.Repeat("k", 128)+"... (2 more bytes)" {
+		t.Errorf("unexpected arguments %v", trimmed)
+	}
+}
+
+func TestSessionSlowLog(t *testing.T) {
+	conn, client := net.Pipe()
+	defer conn.Close()
+	defer client.Close()
+	s := &Session{Conn: conn, name: "worker", slowLog: NewSlowLog(0, 10)}
+
+	get, _ := resp.NewCommand("GET", "a")
+	s.track(get)
+	s.route(15495, "127.0.0.1:7001")
+	s.trackSeq(0, 1)
+	// received 10ms ago
+	start := time.Now().Add(-10 * time.Millisecond)
+	s.tracked[0].start = start
+	req := &PipelineRequest{
+		seq:          0,
+		sent:         start.Add(time.Millisecond),
+		received:     start.Add(3 * time.Millisecond),
+		redirects:    []string{"MOVED 15495 127.0.0.1:7002"},
+		redirectTime: 2 * time.Millisecond,
+	}
+	s.replied(req, []byte("$1\r\n1\r\n"))
+
+	entries := s.slowLog.Get(-1)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %v", entries)
+	}
+	e := entries[0]
+	if !reflect.DeepEqual(e.Args, []string{"GET", "a"}) || e.Name != "worker" || e.Client != "pipe" || e.Backend != "127.0.0.1:7001" ||
+		e.Queue != time.Millisecond || e.Wait != 2*time.Millisecond || e.Redirect != 2*time.Millisecond ||
+		!reflect.DeepEqual(e.Redirects, req.redirects) || e.Duration < 10*time.Millisecond || e.Reply < 5*time.Millisecond {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestMergeSlowlogRsp(t *testing.T) {
+	entry := func(id, timestamp int64) *resp.Data {
+		return &resp.Data{T: resp.T_Array, Array: []*resp.Data{
+			{T: resp.T_Integer, Integer: id},
+			{T: resp.T_Integer, Integer: timestamp},
+		}}
+	}
+	s := &Session{protocol: resp.RESP2, valkeyConn: NewValkeyConn(1, 0, "", false)}
+	cmd, _ := resp.NewCommand("SLOWLOG", "GET", "3")
+	mc := NewMultiCmd(s, cmd, 2)
+	mc.slowlog = &resp.Data{T: resp.T_Array, Array: []*resp.Data{entry(100, 30), entry(101, 10)}}
+	replies := []*resp.Data{
+		{T: resp.T_Array, Array: []*resp.Data{entry(1, 40), entry(0, 5)}},
+		{T: resp.T_Array, Array: []*resp.Data{entry(7, 20)}},
+	}
+	for i, data := range replies {
+		mc.OnSubCmdFinished(&PipelineResponse{
+			rsp: resp.NewObjectFromData(data),
+			ctx: &PipelineRequest{subSeq: i},
+		})
+	}
+	expected := &resp.Data{T: resp.T_Array, Array: []*resp.Data{entry(1, 40), entry(100, 30), entry(7, 20)}}
+	if raw := string(mc.CoalesceRsp().rsp.Raw()); raw != string(expected.Format()) {
+		t.Errorf("expected %q, got %q", expected.Format(), raw)
+	}
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// certificates are checked for rotation at most once in this interval
+const TLS_RELOAD_CHECK_INTERVAL = 5 * time.Second
+
+// values of tls-auth-clients, the same as valkey's
+const (
+	TLS_AUTH_CLIENTS_NO       = "no"
+	TLS_AUTH_CLIENTS_YES      = "yes"
+	TLS_AUTH_CLIENTS_OPTIONAL = "optional"
+)
+
+/*
+certReloader serves the TLS config of client connections. Certificate files are
+checked on handshakes and loaded again once modified, so rotated certificates
+are used by new connections while established sessions are not affected.
+A failed reload keeps the previous certificates.
+*/
+type certReloader struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientAuth tls.ClientAuthType
+	lock       sync.Mutex
+	config     *tls.Config
+	modTime    time.Time
+	checked    time.Time
+}
+
+// NewServerTLSConfig creates the TLS config of proxy listener, authClients is one of
+// no, yes and optional, client certificates are verified with caFile if required
+func NewServerTLSConfig(certFile, keyFile, caFile, authClients string) (*tls.Config, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	switch authClients {
+	case TLS_AUTH_CLIENTS_NO, "":
+		r.clientAuth = tls.NoClientCert
+	case TLS_AUTH_CLIENTS_YES:
+		r.clientAuth = tls.RequireAndVerifyClientCert
+	case TLS_AUTH_CLIENTS_OPTIONAL:
+		r.clientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("invalid tls auth clients %q", authClients)
+	}
+	if r.clientAuth != tls.NoClientCert && caFile == "" {
+		return nil, fmt.Errorf("CA certificate is required to authenticate clients")
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: r.configForClient,
+	}, nil
+}
+
+func (r *certReloader) load() error {
+	modTime := r.latestModTime()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.clientAuth,
+	}
+	if r.caFile != "" {
+		if config.ClientCAs, err = loadCertPool(r.caFile); err != nil {
+			return err
+		}
+	}
+	r.config = config
+	r.modTime = modTime
+	return nil
+}
+
+func (r *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if now := time.Now(); now.Sub(r.checked) >= TLS_RELOAD_CHECK_INTERVAL {
+		r.checked = now
+		if r.latestModTime().After(r.modTime) {
+			if err := r.load(); err != nil {
+				glog.Errorf("reload tls certificates failed, err=%v", err)
+			} else {
+				glog.Infof("tls certificates reloaded from %s", r.certFile)
+			}
+		}
+	}
+	return r.config, nil
+}
+
+// latestModTime returns the latest modification time of certificate files
+func (r *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// NewClientTLSConfig creates the TLS config of backend connections. Servers are verified
+// with caFile or system CAs unless skipVerify, certFile and keyFile are the client certificate
+// presented to servers, serverName overrides the host name of backend address to verify.
+func NewClientTLSConfig(caFile, certFile, keyFile, serverName string, skipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
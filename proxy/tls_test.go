@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate for 127.0.0.1 and its key to dir
+func writeTestCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// handshake returns the common name of the certificate presented by server
+func handshake(t *testing.T, config *tls.Config, clientCert *tls.Certificate) (string, error) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go tls.Server(serverConn, config).Handshake()
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+	if clientCert != nil {
+		clientConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	client := tls.Client(clientConn, clientConfig)
+	if err := client.Handshake(); err != nil {
+		return "", err
+	}
+	// the server verifies client certificate after client finished handshake
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := client.Read(make([]byte, 1)); err != nil {
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			return "", err
+		}
+	}
+	return client.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestServerTLSConfigReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "server")
+	config, err := NewServerTLSConfig(certFile, keyFile, "", TLS_AUTH_CLIENTS_NO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, err := handshake(t, config, nil); err != nil || name != "server" {
+		t.Fatalf("unexpected handshake %s %v", name, err)
+	}
+
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	// rotate certificates
+	rotatedCert, rotatedKey := writeTestCert(t, dir, "rotated")
+	os.Rename(rotatedCert, certFile)
+	os.Rename(rotatedKey, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	commonName := func() string {
+		config, _ := r.configForClient(nil)
+		cert, _ := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		return cert.Subject.CommonName
+	}
+	if name := commonName(); name != "rotated" {
+		t.Errorf("expected rotated certificate, got %s", name)
+	}
+	// a broken key keeps the previous certificates
+	os.WriteFile(keyFile, []byte("broken"), 0600)
+	later := future.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	r.checked = time.Time{}
+	if name := commonName(); name != "rotated" {
+		t.Errorf("expected previous certificate kept, got %s", name)
+	}
+}
+
+func TestServerTLSConfigAuthClients(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "server")
+	if _, err := NewServerTLSConfig(certFile, keyFile, "", TLS_AUTH_CLIENTS_YES); err == nil {
+		t.Error("expected CA certificate required")
+	}
+	caFile, caKeyFile := writeTestCert(t, dir, "client")
+	config, err := NewServerTLSConfig(certFile, keyFile, caFile, TLS_AUTH_CLIENTS_YES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(t, config, nil); err == nil {
+		t.Error("expected client certificate required")
+	}
+	clientCert, err := tls.LoadX509KeyPair(caFile, caKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(t, config, &clientCert); err != nil {
+		t.Errorf("unexpected handshake error %v", err)
+	}
+}
+
+func TestValkeyConnTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "server")
+	serverConfig, err := NewServerTLSConfig(certFile, keyFile, "", TLS_AUTH_CLIENTS_NO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// reply READONLY sent after connected
+			go func() {
+				defer conn.Close()
+				if _, err := conn.Read(make([]byte, 64)); err == nil {
+					conn.Write([]byte("+OK\r\n"))
+				}
+			}()
+		}
+	}()
+
+	valkeyConn := NewValkeyConn(1, time.Second, "", false)
+	config, err := NewClientTLSConfig(certFile, "", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valkeyConn.SetTLSConfig(config)
+	conn, err := valkeyConn.Conn(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	otherCert, _ := writeTestCert(t, dir, "other")
+	if config, err = NewClientTLSConfig(otherCert, "", "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	valkeyConn.SetTLSConfig(config)
+	if _, err := valkeyConn.Conn(l.Addr().String()); err == nil {
+		t.Error("expected unknown authority refused")
+	}
+	if config, err = NewClientTLSConfig(otherCert, "", "", "", true); err != nil {
+		t.Fatal(err)
+	}
+	valkeyConn.SetTLSConfig(config)
+	if conn, err = valkeyConn.Conn(l.Addr().String()); err != nil {
+		t.Errorf("expected verification skipped, got %v", err)
+	} else {
+		conn.Close()
+	}
+}
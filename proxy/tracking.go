@@ -0,0 +1,582 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+const (
+	// keys read by sessions in default mode remembered at most, the same as valkey's
+	// tracking-table-max-keys, older keys are invalidated once exceeded
+	TRACKING_TABLE_MAX_KEYS = 1000000
+	// interval to reconnect a broken tracking link
+	TRACKING_RETRY_INTERVAL = 100 * time.Millisecond
+	// channel invalidations are published to for RESP2 clients redirected to
+	TRACKING_CHANNEL = "__redis__:invalidate"
+)
+
+var (
+	TRACKING_REDIRECT_ERR = []byte("ERR The client ID you want redirect to does not exist")
+	TRACKING_PREFIX_ERR   = []byte("ERR PREFIX option requires BCAST mode to be enabled")
+	TRACKING_BCAST_ERR    = []byte("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+	TRACKING_OPTION_ERR   = []byte("ERR OPTIN, OPTOUT and NOLOOP are not supported by proxy")
+	TRACKING_CACHING_ERR  = []byte("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+)
+
+/*
+Tracker implements client side caching for sessions with CLIENT TRACKING on. Backend
+connections are shared by sessions, so keys are not tracked on them. Instead, tracker
+keeps a link to each master with tracking on in BCAST mode, and fans in invalidations
+of all keys modified. They are delivered to sessions reading the keys in default mode,
+or registering prefixes of them in BCAST mode.
+
+An invalidation is written to client after the replies of commands reading keys before,
+so that a value replied is never cached after its invalidation. Links are opened once
+any session turns on tracking, and follow masters after topology reloads. Invalidations
+are lost while a link is broken, so tracking sessions are told to flush their caches
+once a link is broken or connected.
+*/
+type Tracker struct {
+	dispatcher *Dispatcher
+	valkeyConn *ValkeyConn
+	lock       sync.Mutex
+	clients    map[*Session]*trackingClient
+	bcast      map[*trackingClient]bool
+	// key -> clients read it in default mode
+	keys map[string]map[*trackingClient]bool
+	// links to masters keyed by server
+	links  map[string]*trackingLink
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type trackingClient struct {
+	session *Session
+	bcast   bool
+	// prefixes of keys in BCAST mode, all keys if empty
+	prefixes []string
+	// id of the session invalidations are redirected to, and the session, nil if gone
+	redirectID int64
+	redirect   *Session
+	keys       map[string]bool
+	// sequence of the latest reply reading keys plus one, invalidations are written after it
+	barrier int64
+}
+
+type trackingLink struct {
+	server  string
+	conn    net.Conn
+	closing bool
+}
+
+func NewTracker(dispatcher *Dispatcher, valkeyConn *ValkeyConn) *Tracker {
+	t := &Tracker{
+		dispatcher: dispatcher,
+		valkeyConn: valkeyConn,
+		clients:    make(map[*Session]*trackingClient),
+		bcast:      make(map[*trackingClient]bool),
+		keys:       make(map[string]map[*trackingClient]bool),
+		links:      make(map[string]*trackingLink),
+	}
+	dispatcher.AddTopologyListener(t, t.onTopologyChanged)
+	return t
+}
+
+// On turns on tracking of s, invalidations are sent to redirect if it is not nil
+func (t *Tracker) On(s *Session, bcast bool, prefixes []string, redirect *Session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	c := t.clients[s]
+	if c == nil {
+		c = &trackingClient{session: s, keys: make(map[string]bool)}
+		t.clients[s] = c
+	}
+	c.bcast = bcast
+	for _, prefix := range prefixes {
+		if !slices.Contains(c.prefixes, prefix) {
+			c.prefixes = append(c.prefixes, prefix)
+		}
+	}
+	c.redirectID, c.redirect = 0, redirect
+	if redirect != nil {
+		c.redirectID = redirect.id
+		if redirect.untracked {
+			// closed after looked up
+			c.redirect = nil
+		}
+	}
+	if bcast {
+		t.bcast[c] = true
+	}
+	if len(t.links) == 0 {
+		t.follow(t.dispatcher.slotTable.Masters())
+	}
+}
+
+// Off turns off tracking of s and forgets keys it read
+func (t *Tracker) Off(s *Session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.off(s)
+}
+
+func (t *Tracker) off(s *Session) {
+	c := t.clients[s]
+	if c == nil {
+		return
+	}
+	for key := range c.keys {
+		t.forget(key, c)
+	}
+	delete(t.bcast, c)
+	delete(t.clients, s)
+	if len(t.clients) == 0 {
+		// stop tracking on backends until any session turns on again
+		t.follow(nil)
+	}
+}
+
+// Remove turns off tracking of a closed session, clients redirecting to it are told
+// the redirection is broken. No invalidation is sent to s once returned.
+func (t *Tracker) Remove(s *Session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.off(s)
+	s.untracked = true
+	for _, c := range t.clients {
+		if c.redirect == s {
+			c.redirect = nil
+			if c.session.respVersion() == resp.RESP3 {
+				t.send(c.session, &resp.Data{T: resp.T_Push, Array: []*resp.Data{
+					{T: resp.T_BulkString, String: []byte("tracking-redir-broken")},
+					{T: resp.T_Integer, Integer: c.redirectID},
+				}}, c.barrier)
+			}
+		}
+	}
+}
+
+// Read records keys read by the command of seq of s, their invalidations are written
+// after its reply
+func (t *Tracker) Read(s *Session, keys []string, seq int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	c := t.clients[s]
+	if c == nil {
+		return
+	}
+	c.barrier = seq + 1
+	if c.bcast {
+		return
+	}
+	for _, key := range keys {
+		if c.keys[key] {
+			continue
+		}
+		clients := t.keys[key]
+		if clients == nil {
+			if len(t.keys) >= TRACKING_TABLE_MAX_KEYS {
+				t.evict()
+			}
+			clients = make(map[*trackingClient]bool)
+			t.keys[key] = clients
+		}
+		clients[c] = true
+		c.keys[key] = true
+	}
+}
+
+// evict invalidates a random key to keep the table under TRACKING_TABLE_MAX_KEYS
+func (t *Tracker) evict() {
+	for key := range t.keys {
+		t.invalidate([]string{key})
+		return
+	}
+}
+
+func (t *Tracker) forget(key string, c *trackingClient) {
+	delete(c.keys, key)
+	if clients := t.keys[key]; clients != nil {
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(t.keys, key)
+		}
+	}
+}
+
+// invalidate delivers invalidations of keys modified to clients read them or
+// registered their prefixes, called with lock held
+func (t *Tracker) invalidate(keys []string) {
+	invalidated := make(map[*trackingClient][]string)
+	for _, key := range keys {
+		for c := range t.keys[key] {
+			invalidated[c] = append(invalidated[c], key)
+			delete(c.keys, key)
+		}
+		delete(t.keys, key)
+		for c := range t.bcast {
+			if c.matches(key) {
+				invalidated[c] = append(invalidated[c], key)
+			}
+		}
+	}
+	for c, keys := range invalidated {
+		t.deliver(c, keys)
+	}
+}
+
+// flush tells all clients to flush their caches
+func (t *Tracker) flush() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	clear(t.keys)
+	for _, c := range t.clients {
+		clear(c.keys)
+		t.deliver(c, nil)
+	}
+}
+
+// matches returns whether c in BCAST mode is notified of key, keys not readable by
+// the user authenticated as are never told
+func (c *trackingClient) matches(key string) bool {
+	if user := c.session.user.Load(); user == nil || !user.keyAllowed(key, ACL_KEY_READ) {
+		return false
+	}
+	if len(c.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver sends invalidations of keys to c or the session it redirects to,
+// nil keys to flush all, called with lock held
+func (t *Tracker) deliver(c *trackingClient, keys []string) {
+	data := &resp.Data{T: resp.T_Null}
+	if keys != nil {
+		data = &resp.Data{T: resp.T_Array, Array: make([]*resp.Data, len(keys))}
+		for i, key := range keys {
+			data.Array[i] = &resp.Data{T: resp.T_BulkString, String: []byte(key)}
+		}
+	}
+	invalidate := &resp.Data{T: resp.T_BulkString, String: []byte("invalidate")}
+	if c.redirectID == 0 {
+		// RESP2 clients have no way to receive invalidations without redirection
+		if c.session.respVersion() == resp.RESP3 {
+			t.send(c.session, &resp.Data{T: resp.T_Push, Array: []*resp.Data{invalidate, data}}, c.barrier)
+		}
+		return
+	}
+	target := c.redirect
+	if target == nil {
+		return
+	}
+	target.trackLock.Lock()
+	protocol, subscribed := target.state.protocol, target.state.pubsub
+	target.trackLock.Unlock()
+	// replies of the client are written to another connection, so nothing to wait for
+	if protocol == resp.RESP3 {
+		t.send(target, &resp.Data{T: resp.T_Push, Array: []*resp.Data{invalidate, data}}, 0)
+	} else if subscribed {
+		if keys == nil {
+			// RESP2 has no null in arrays
+			data = &resp.Data{T: resp.T_BulkString, IsNil: true}
+		}
+		t.send(target, &resp.Data{T: resp.T_Push, Array: []*resp.Data{
+			{T: resp.T_BulkString, String: []byte("message")},
+			{T: resp.T_BulkString, String: []byte(TRACKING_CHANNEL)},
+			data,
+		}}, 0)
+	}
+}
+
+// send pushes data to s without blocking, s is closed if it can not keep up with
+// invalidations, the same as exceeding client output buffer limit of valkey
+func (t *Tracker) send(s *Session, data *resp.Data, barrier int64) {
+	if !s.tryPush(data, barrier) {
+		glog.Warningf("close client %d %s too slow to receive invalidations", s.id, s.RemoteAddr())
+		s.Conn.Close()
+	}
+}
+
+// follow opens links to masters not linked yet, and closes links to servers not in masters
+func (t *Tracker) follow(masters []string) {
+	wanted := make(map[string]bool)
+	for _, server := range masters {
+		wanted[server] = true
+		if _, ok := t.links[server]; !ok && !t.closed {
+			link := &trackingLink{server: server}
+			t.links[server] = link
+			t.wg.Add(1)
+			go t.loop(link)
+		}
+	}
+	for server, link := range t.links {
+		if !wanted[server] {
+			link.closing = true
+			if link.conn != nil {
+				link.conn.Close()
+			}
+			delete(t.links, server)
+		}
+	}
+}
+
+func (t *Tracker) onTopologyChanged(servers map[string]bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.clients) > 0 {
+		t.follow(t.dispatcher.slotTable.Masters())
+	}
+}
+
+func (t *Tracker) loop(link *trackingLink) {
+	defer t.wg.Done()
+	for {
+		r, err := t.connect(link)
+		if err == nil {
+			glog.Infof("tracking invalidations of %s", link.server)
+			// invalidations before connected are lost
+			t.flush()
+			for {
+				var data *resp.Data
+				if data, err = resp.ReadData(r); err != nil {
+					break
+				}
+				t.handleFrame(data)
+			}
+		}
+		t.lock.Lock()
+		closing := link.closing || t.closed
+		t.lock.Unlock()
+		if closing {
+			return
+		}
+		glog.Errorf("tracking link to %s broken: %v", link.server, err)
+		t.flush()
+		t.dispatcher.TriggerReloadSlots()
+		time.Sleep(TRACKING_RETRY_INTERVAL)
+	}
+}
+
+// connect opens link in RESP3 with tracking on in BCAST mode, the reader is returned
+// to read invalidations from
+func (t *Tracker) connect(link *trackingLink) (*bufio.Reader, error) {
+	conn, err := t.valkeyConn.Conn(link.server)
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	if link.closing || t.closed {
+		t.lock.Unlock()
+		conn.Close()
+		return nil, fmt.Errorf("link closed")
+	}
+	link.conn = conn
+	t.lock.Unlock()
+	hello, _ := resp.NewCommand("HELLO", "3")
+	if _, err := t.valkeyConn.Request(hello, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// read with the same reader, invalidations may follow the reply immediately
+	tracking, _ := resp.NewCommand("CLIENT", "TRACKING", "ON", "BCAST")
+	if _, err := conn.Write(tracking.Format()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	data, err := resp.ReadData(r)
+	if err == nil && data.IsError() {
+		err = fmt.Errorf("%s", data.String)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (t *Tracker) handleFrame(data *resp.Data) {
+	if data.T != resp.T_Push || len(data.Array) < 2 || !strings.EqualFold(string(data.Array[0].String), "invalidate") {
+		return
+	}
+	if keys := data.Array[1]; keys.T == resp.T_Null || keys.IsNil {
+		// FLUSHALL or FLUSHDB
+		t.flush()
+	} else {
+		names := make([]string, len(keys.Array))
+		for i, key := range keys.Array {
+			names[i] = string(key.String)
+		}
+		t.lock.Lock()
+		t.invalidate(names)
+		t.lock.Unlock()
+	}
+}
+
+// Close closes all links and waits for their loops to exit
+func (t *Tracker) Close() {
+	t.dispatcher.RemoveTopologyListener(t)
+	t.lock.Lock()
+	t.closed = true
+	t.follow(nil)
+	t.lock.Unlock()
+	t.wg.Wait()
+}
+
+// Stats returns the number of clients with tracking on, keys read by them in default
+// mode and prefixes registered in BCAST mode
+func (t *Tracker) Stats() (clients, keys, prefixes int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for c := range t.bcast {
+		prefixes += len(c.prefixes)
+	}
+	return len(t.clients), len(t.keys), prefixes
+}
+
+// info returns whether s has tracking on, in BCAST mode, its prefixes, the id it
+// redirects to and whether the redirection is broken
+func (t *Tracker) info(s *Session) (on, bcast bool, prefixes []string, redirect int64, broken bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	c := t.clients[s]
+	if c == nil {
+		return
+	}
+	return true, c.bcast, slices.Clone(c.prefixes), c.redirectID, c.redirectID != 0 && c.redirect == nil
+}
+
+// trackRead records keys read by cmd before it is sent, transactions are read at EXEC
+func (s *Session) trackRead(cmd *resp.Command) {
+	if cmd.Name() == "EXEC" {
+		s.tracker.Read(s, nil, s.reqSeq)
+		return
+	}
+	if spec := LookupCommand(cmd); spec != nil && spec.Flags&COMMAND_FLAG_READONLY != 0 {
+		s.tracker.Read(s, CmdKeys(cmd), s.reqSeq)
+	}
+}
+
+// handleClientTrackingCmd answers CLIENT TRACKING ON|OFF [REDIRECT id] [BCAST] [PREFIX prefix ...]
+func (s *Session) handleClientTrackingCmd(cmd *resp.Command) {
+	var on bool
+	switch strings.ToUpper(cmd.Args[2]) {
+	case "ON":
+		on = true
+	case "OFF":
+	default:
+		s.handleErrorCmd(SYNTAX_ERR)
+		return
+	}
+	var bcast bool
+	var prefixes []string
+	var redirect *Session
+	for i := 3; i < len(cmd.Args); i++ {
+		switch strings.ToUpper(cmd.Args[i]) {
+		case "BCAST":
+			bcast = true
+		case "PREFIX", "REDIRECT":
+			if i+1 >= len(cmd.Args) {
+				s.handleErrorCmd(SYNTAX_ERR)
+				return
+			}
+			if strings.EqualFold(cmd.Args[i], "PREFIX") {
+				prefixes = append(prefixes, cmd.Args[i+1])
+			} else {
+				id, err := strconv.ParseInt(cmd.Args[i+1], 10, 64)
+				if err != nil {
+					s.handleErrorCmd([]byte("ERR value is not an integer or out of range"))
+					return
+				}
+				for _, c := range s.clients() {
+					if c.id == id {
+						redirect = c
+					}
+				}
+				if redirect == nil {
+					s.handleErrorCmd(TRACKING_REDIRECT_ERR)
+					return
+				}
+			}
+			i++
+		case "OPTIN", "OPTOUT", "NOLOOP":
+			s.handleErrorCmd(TRACKING_OPTION_ERR)
+			return
+		default:
+			s.handleErrorCmd(SYNTAX_ERR)
+			return
+		}
+	}
+	if !on {
+		s.tracker.Off(s)
+		s.tracking = false
+		s.handleSimpleStringCmd(OK)
+		return
+	}
+	if len(prefixes) > 0 && !bcast {
+		s.handleErrorCmd(TRACKING_PREFIX_ERR)
+		return
+	}
+	tracking, wasBcast, registered, _, _ := s.tracker.info(s)
+	if tracking && wasBcast != bcast {
+		s.handleErrorCmd(TRACKING_BCAST_ERR)
+		return
+	}
+	// the same as valkey, prefixes must not overlap, otherwise a key is told twice
+	for _, prefix := range prefixes {
+		for _, other := range registered {
+			if prefix != other && (strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix)) {
+				s.handleErrorCmd([]byte(fmt.Sprintf("ERR Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.", prefix, other)))
+				return
+			}
+		}
+		registered = append(registered, prefix)
+	}
+	s.tracker.On(s, bcast, prefixes, redirect)
+	s.tracking = true
+	s.handleSimpleStringCmd(OK)
+}
+
+// handleClientTrackingInfoCmd answers CLIENT TRACKINGINFO
+func (s *Session) handleClientTrackingInfoCmd() {
+	on, bcast, prefixes, redirect, broken := s.tracker.info(s)
+	flags := []*resp.Data{{T: resp.T_BulkString, String: []byte("off")}}
+	if on {
+		flags[0].String = []byte("on")
+		if bcast {
+			flags = append(flags, &resp.Data{T: resp.T_BulkString, String: []byte("bcast")})
+		}
+		if broken {
+			flags = append(flags, &resp.Data{T: resp.T_BulkString, String: []byte("broken_redirect")})
+		}
+	} else {
+		redirect = -1
+	}
+	data := &resp.Data{T: resp.T_Array, Array: make([]*resp.Data, len(prefixes))}
+	for i, prefix := range prefixes {
+		data.Array[i] = &resp.Data{T: resp.T_BulkString, String: []byte(prefix)}
+	}
+	s.handleDataCmd(&resp.Data{T: resp.T_Map, Array: []*resp.Data{
+		{T: resp.T_BulkString, String: []byte("flags")},
+		{T: resp.T_Set, Array: flags},
+		{T: resp.T_BulkString, String: []byte("redirect")},
+		{T: resp.T_Integer, Integer: redirect},
+		{T: resp.T_BulkString, String: []byte("prefixes")},
+		data,
+	}})
+}
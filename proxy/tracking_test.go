@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestTracker(t *testing.T) {
+	conn := NewValkeyConn(1, 0, "", false)
+	tracker := NewTracker(NewDispatcher(nil, 0, conn, 0), conn)
+	acl := NewACL("", conn)
+	newSession := func(id int64, protocol int) *Session {
+		s := &Session{id: id, backQ: make(chan *PipelineResponse, 10)}
+		s.state.protocol = protocol
+		s.user.Store(acl.DefaultUser())
+		return s
+	}
+	expectPush := func(s *Session, expected string, barrier int64) {
+		t.Helper()
+		select {
+		case rsp := <-s.backQ:
+			if raw := string(rsp.rsp.Raw()); raw != expected || rsp.ctx.barrier != barrier {
+				t.Errorf("expected %q after %d, got %q after %d", expected, barrier, raw, rsp.ctx.barrier)
+			}
+		default:
+			t.Errorf("expected %q pushed", expected)
+		}
+	}
+	expectNothing := func(s *Session) {
+		t.Helper()
+		if len(s.backQ) > 0 {
+			t.Errorf("unexpected push %q", (<-s.backQ).rsp.Raw())
+		}
+	}
+	invalidate := func(keys ...string) {
+		data := &resp.Data{T: resp.T_Null}
+		if keys != nil {
+			data = &resp.Data{T: resp.T_Array}
+			for _, key := range keys {
+				data.Array = append(data.Array, &resp.Data{T: resp.T_BulkString, String: []byte(key)})
+			}
+		}
+		tracker.handleFrame(&resp.Data{T: resp.T_Push, Array: []*resp.Data{{T: resp.T_BulkString, String: []byte("invalidate")}, data}})
+	}
+
+	a := newSession(1, resp.RESP3)
+	tracker.On(a, false, nil, nil)
+	tracker.Read(a, []string{"k1", "k2"}, 4)
+	invalidate("k1", "k3")
+	expectPush(a, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$2\r\nk1\r\n", 5)
+	// invalidated once until read again
+	invalidate("k1")
+	expectNothing(a)
+
+	b := newSession(2, resp.RESP3)
+	tracker.On(b, true, []string{"user:"}, nil)
+	invalidate("user:1", "order:1")
+	expectPush(b, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$6\r\nuser:1\r\n", 0)
+	expectNothing(a)
+
+	// RESP2 clients receive invalidations as messages of a subscribed session redirected to
+	c := newSession(3, resp.RESP2)
+	c.state.pubsub = true
+	d := newSession(4, resp.RESP3)
+	tracker.On(d, false, nil, c)
+	tracker.Read(d, []string{"k2"}, 0)
+	invalidate("k2")
+	expectPush(a, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$2\r\nk2\r\n", 5)
+	expectPush(c, "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$2\r\nk2\r\n", 0)
+
+	tracker.Remove(c)
+	expectPush(d, ">2\r\n$21\r\ntracking-redir-broken\r\n:3\r\n", 1)
+	if on, _, _, redirect, broken := tracker.info(d); !on || redirect != 3 || !broken {
+		t.Errorf("expected broken redirection, got %v %v %v", on, redirect, broken)
+	}
+
+	invalidate()
+	expectPush(a, ">2\r\n$10\r\ninvalidate\r\n_\r\n", 5)
+	expectPush(b, ">2\r\n$10\r\ninvalidate\r\n_\r\n", 0)
+	expectNothing(c)
+	expectNothing(d)
+
+	tracker.Off(a)
+	tracker.Off(b)
+	tracker.Off(d)
+	if clients, keys, prefixes := tracker.Stats(); clients != 0 || keys != 0 || prefixes != 0 {
+		t.Errorf("expected nothing tracked, got %d clients, %d keys and %d prefixes", clients, keys, prefixes)
+	}
+}
+
+func TestSessionDeferredPush(t *testing.T) {
+	conn, client := net.Pipe()
+	defer client.Close()
+	s, _ := serveTestSession(conn)
+	r := bufio.NewReader(client)
+	// state of the session is saved once a command is handled
+	client.Write([]byte("PING\r\n"))
+	if line, _ := r.ReadString('\n'); line != "+PONG\r\n" {
+		t.Fatalf("unexpected reply %q", line)
+	}
+
+	// the invalidation is read by tracker before the reply of the read after PING
+	s.tryPush(&resp.Data{T: resp.T_Push, Array: []*resp.Data{{T: resp.T_BulkString, String: []byte("invalidate")}}}, 2)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	s.backQ <- &PipelineResponse{
+		rsp: resp.NewObjectFromData(&resp.Data{T: resp.T_BulkString, String: []byte("v")}),
+		ctx: &PipelineRequest{seq: 1, wg: wg},
+	}
+	expected := "$1\r\nv\r\n*1\r\n$10\r\ninvalidate\r\n"
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Errorf("expected %q, got %q", expected, buf)
+	}
+}
+
+// namedBackend replies GET with name, and OK to anything else
+func namedBackend(t *testing.T, name string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					cmd, err := resp.ReadCommand(r)
+					if err != nil {
+						return
+					}
+					reply := "+OK\r\n"
+					if cmd.Name() == "GET" {
+						reply = fmt.Sprintf("$%d\r\n%s\r\n", len(name), name)
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestSessionTrackingReadsMaster(t *testing.T) {
+	master, replica := namedBackend(t, "master"), namedBackend(t, "replica")
+	defer master.Close()
+	defer replica.Close()
+	conn, client := net.Pipe()
+	defer client.Close()
+	valkeyConn := NewValkeyConn(1, time.Second, "", true)
+	dispatcher := NewDispatcher(nil, 0, valkeyConn, READ_PREFER_SLAVE)
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: master.Addr().String(), read: []string{replica.Addr().String()}})
+	s := newTestSession(conn)
+	s.dispatcher, s.valkeyConn = dispatcher, valkeyConn
+	s.tracker = NewTracker(dispatcher, valkeyConn)
+	defer s.tracker.Close()
+	serveSession(s)
+	r := bufio.NewReader(client)
+	request := func(args ...string) string {
+		t.Helper()
+		cmd, _ := resp.NewCommand(args...)
+		client.Write(cmd.Format())
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line[0] == '$' {
+			line, _ = r.ReadString('\n')
+		}
+		return line
+	}
+	if reply := request("GET", "k"); reply != "replica\r\n" {
+		t.Errorf("expected read from replica, got %q", reply)
+	}
+	// a lagging replica could reply a value already invalidated by master
+	if reply := request("CLIENT", "TRACKING", "ON"); reply != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if reply := request("GET", "k"); reply != "master\r\n" {
+		t.Errorf("expected read from master while tracking, got %q", reply)
+	}
+}
@@ -0,0 +1,346 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+var (
+	QUEUED         = []byte("QUEUED")
+	EXECABORT_ERR  = []byte("EXECABORT Transaction discarded because of previous errors.")
+	EXEC_CMD, _    = resp.NewCommand("EXEC")
+	MULTI_CMD, _   = resp.NewCommand("MULTI")
+	UNWATCH_CMD, _ = resp.NewCommand("UNWATCH")
+)
+
+/*
+Transaction implements optimistic transactions of a session.
+
+All keys of a transaction, including the WATCHed ones, must hash to one slot
+the same as valkey cluster, a CROSSSLOT error is replied otherwise. The slot is
+pinned by the first key and one backend connection to its owner is held from
+WATCH through EXEC or DISCARD. Commands are queued at proxy side after MULTI,
+and sent in one batch with MULTI and EXEC, so that a transaction without WATCH
+never holds a connection while client is still queueing. PING, ECHO and SELECT
+queued are answered by proxy, their replies are merged into the reply of EXEC.
+
+The dedicated connections are kept by server for the next transactions of the
+session like the Blocker does, and closed with the session. Replies are read
+with the connect timeout as deadline, so that a stalled node never blocks the
+reader of the session.
+*/
+type Transaction struct {
+	session *Session
+	// slot pinned, -1 if no key yet
+	slot   int
+	server string
+	conn   net.Conn
+	r      *bufio.Reader
+	// idle dedicated connections keyed by server
+	conns   map[string]net.Conn
+	watched bool
+	multi   bool
+	// a command is refused while queueing
+	aborted bool
+	queued  []*resp.Command
+}
+
+func NewTransaction(session *Session) *Transaction {
+	return &Transaction{session: session, slot: -1, conns: make(map[string]net.Conn)}
+}
+
+// Multi returns whether commands are being queued
+func (tx *Transaction) Multi() bool {
+	return tx.multi
+}
+
+// Pending returns whether a transaction is started by WATCH or MULTI and not finished
+func (tx *Transaction) Pending() bool {
+	return tx.watched || tx.multi
+}
+
+// Handle handles a transaction command or a command queued after MULTI,
+// the reply returned is encoded in client's protocol
+func (tx *Transaction) Handle(cmd *resp.Command) *resp.Data {
+	switch cmd.Name() {
+	case "MULTI":
+		if tx.multi {
+			return errorData([]byte("ERR MULTI calls can not be nested"))
+		}
+		tx.multi = true
+		return OK_DATA
+	case "WATCH":
+		if tx.multi {
+			return errorData([]byte("ERR WATCH inside MULTI is not allowed"))
+		}
+		if len(cmd.Args) < 2 {
+			return errorData(ARGUMENTS_ERR)
+		}
+		return tx.watch(cmd)
+	case "UNWATCH":
+		if !tx.multi {
+			tx.finish(false)
+			return OK_DATA
+		}
+	case "DISCARD":
+		if !tx.multi {
+			return errorData([]byte("ERR DISCARD without MULTI"))
+		}
+		tx.finish(false)
+		return OK_DATA
+	case "EXEC":
+		if !tx.multi {
+			return errorData([]byte("ERR EXEC without MULTI"))
+		}
+		if tx.aborted {
+			tx.finish(false)
+			return errorData(EXECABORT_ERR)
+		}
+		// EXEC unwatches all keys anyway
+		defer tx.finish(true)
+		return tx.exec(cmd)
+	}
+
+	if answeredLocally(cmd) {
+		if data := localReply(cmd); data.IsError() {
+			tx.aborted = true
+			return data
+		}
+		tx.queued = append(tx.queued, cmd)
+		return &resp.Data{T: resp.T_SimpleString, String: QUEUED}
+	}
+	switch CmdFlag(cmd) {
+	case CMD_FLAG_GENERAL, CMD_FLAG_READ, CMD_FLAG_BLOCKING:
+		// the same as valkey cluster, keys of another slot are refused while queueing
+		if !tx.pin(CmdKeys(cmd)) {
+			tx.aborted = true
+			return errorData(CROSSSLOT_ERR)
+		}
+		tx.queued = append(tx.queued, cmd)
+		return &resp.Data{T: resp.T_SimpleString, String: QUEUED}
+	case CMD_FLAG_PROXY:
+		if cmd.Name() == "UNWATCH" {
+			tx.queued = append(tx.queued, cmd)
+			return &resp.Data{T: resp.T_SimpleString, String: QUEUED}
+		}
+	}
+	tx.aborted = true
+	return errorData(UNKNOWN_CMD_ERR)
+}
+
+// localReply returns the reply of PING, ECHO or SELECT queued, which are answered by proxy
+func localReply(cmd *resp.Command) *resp.Data {
+	switch {
+	case cmd.Name() == "PING" && len(cmd.Args) == 1:
+		return &resp.Data{T: resp.T_SimpleString, String: []byte("PONG")}
+	case cmd.Name() == "PING" && len(cmd.Args) == 2, cmd.Name() == "ECHO" && len(cmd.Args) == 2:
+		return &resp.Data{T: resp.T_BulkString, String: []byte(cmd.Args[1])}
+	case cmd.Name() == "SELECT" && len(cmd.Args) == 2:
+		return OK_DATA
+	default:
+		return errorData(ARGUMENTS_ERR)
+	}
+}
+
+func (tx *Transaction) watch(cmd *resp.Command) *resp.Data {
+	if !tx.pin(CmdKeys(cmd)) {
+		return errorData(CROSSSLOT_ERR)
+	}
+	if err := tx.connect(); err != nil {
+		return tx.fail(err)
+	}
+	data, err := tx.request(cmd)
+	if err != nil {
+		return tx.fail(err)
+	}
+	if data.IsError() {
+		if !tx.watched {
+			tx.finish(true)
+		}
+		return data
+	}
+	tx.watched = true
+	return data
+}
+
+// exec sends MULTI, all queued commands and EXEC in one batch to the node of the pinned slot
+func (tx *Transaction) exec(cmd *resp.Command) *resp.Data {
+	if err := tx.connect(); err != nil {
+		return tx.fail(err)
+	}
+
+	buf := bytes.NewBuffer(MULTI_CMD.Format())
+	var sent []*resp.Command
+	for _, queued := range tx.queued {
+		if !answeredLocally(queued) {
+			buf.Write(queued.Format())
+			sent = append(sent, queued)
+		}
+	}
+	buf.Write(EXEC_CMD.Format())
+	if err := tx.setDeadline(); err != nil {
+		return tx.fail(err)
+	}
+	if _, err := tx.conn.Write(buf.Bytes()); err != nil {
+		return tx.fail(err)
+	}
+
+	// replies of MULTI and queued commands are expected to be OK and QUEUED,
+	// any error makes valkey abort the transaction on EXEC
+	for i := 0; i <= len(sent); i++ {
+		data, err := resp.ReadData(tx.r)
+		if err != nil {
+			return tx.fail(err)
+		}
+		if data.IsError() {
+			glog.Warningf("transaction on %s refused: %s", tx.server, data.String)
+			if bytes.HasPrefix(data.String, MOVED[1:]) || bytes.HasPrefix(data.String, ASK[1:]) {
+				tx.session.dispatcher.TriggerReloadSlots()
+			}
+		}
+	}
+	data, err := resp.ReadData(tx.r)
+	if err != nil {
+		return tx.fail(err)
+	}
+	if data.IsError() || data.IsNil || data.T == resp.T_Null {
+		return tx.session.convertReply(cmd, data)
+	}
+	if len(data.Array) != len(sent) {
+		return tx.fail(fmt.Errorf("unexpected EXEC reply size %d", len(data.Array)))
+	}
+	replies := data.Array
+	data.Array = make([]*resp.Data, len(tx.queued))
+	for i, queued := range tx.queued {
+		if answeredLocally(queued) {
+			data.Array[i] = localReply(queued)
+			continue
+		}
+		data.Array[i] = tx.session.convertReply(queued, replies[0])
+		replies = replies[1:]
+	}
+	return data
+}
+
+// answeredLocally returns whether cmd queued is answered by proxy
+func answeredLocally(cmd *resp.Command) bool {
+	switch cmd.Name() {
+	case "PING", "ECHO", "SELECT":
+		return true
+	default:
+		return false
+	}
+}
+
+// pin checks all keys hash to the pinned slot, the slot is pinned by the first key
+// if no slot pinned yet
+func (tx *Transaction) pin(keys []string) bool {
+	slot := tx.slot
+	for _, key := range keys {
+		keySlot := Key2Slot(key)
+		if slot < 0 {
+			slot = keySlot
+		} else if slot != keySlot {
+			return false
+		}
+	}
+	tx.slot = slot
+	return true
+}
+
+func (tx *Transaction) connect() error {
+	if tx.conn != nil {
+		return nil
+	}
+	if tx.slot >= 0 {
+		tx.server = tx.session.dispatcher.slotTable.WriteServer(tx.slot)
+	} else {
+		// no key at all, any master works
+		tx.server = tx.session.dispatcher.slotTable.WriteServer(rand.Intn(NumSlots))
+	}
+	tx.session.route(tx.slot, tx.server)
+	if conn, ok := tx.conns[tx.server]; ok {
+		delete(tx.conns, tx.server)
+		tx.conn, tx.r = conn, bufio.NewReader(conn)
+		return nil
+	}
+	conn, err := tx.session.backend().Conn(tx.server)
+	metrics.ObserveDial(tx.server, err)
+	if err != nil {
+		return err
+	}
+	tx.conn, tx.r = conn, bufio.NewReader(conn)
+	return nil
+}
+
+// setDeadline sets the deadline of reading the replies of a request on the pinned connection
+func (tx *Transaction) setDeadline() error {
+	deadline := time.Time{}
+	if timeout := tx.session.backend().ConnTimeout(); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	return tx.conn.SetReadDeadline(deadline)
+}
+
+func (tx *Transaction) request(cmd *resp.Command) (*resp.Data, error) {
+	if err := tx.setDeadline(); err != nil {
+		return nil, err
+	}
+	if _, err := tx.conn.Write(cmd.Format()); err != nil {
+		return nil, err
+	}
+	return resp.ReadData(tx.r)
+}
+
+func (tx *Transaction) fail(err error) *resp.Data {
+	glog.Errorf("transaction on %s failed: %v", tx.server, err)
+	tx.session.dispatcher.TriggerReloadSlots()
+	if tx.conn != nil {
+		// the connection state is unknown after error or timeout
+		tx.conn.Close()
+		tx.conn = nil
+	}
+	tx.finish(true)
+	return errorData([]byte(fmt.Sprintf("ERR %v", err)))
+}
+
+// finish discards queued commands and releases the pinned connection to be reused by
+// the next transaction, keys watched are unwatched first unless already unwatched
+func (tx *Transaction) finish(unwatched bool) {
+	if conn := tx.conn; conn != nil {
+		if tx.watched && !unwatched {
+			if data, err := tx.request(UNWATCH_CMD); err != nil || data.IsError() {
+				glog.Errorf("unwatch on %s failed: %v", tx.server, err)
+				conn.Close()
+				conn = nil
+			}
+		}
+		if conn != nil {
+			tx.conns[tx.server] = conn
+		}
+	}
+	*tx = Transaction{session: tx.session, slot: -1, conns: tx.conns}
+}
+
+// Close discards the transaction and closes all dedicated connections, closing
+// connections unwatches all keys
+func (tx *Transaction) Close() {
+	if tx.conn != nil {
+		tx.conn.Close()
+	}
+	for _, conn := range tx.conns {
+		conn.Close()
+	}
+	*tx = Transaction{session: tx.session, slot: -1, conns: make(map[string]net.Conn)}
+}
+
+func errorData(msg []byte) *resp.Data {
+	return &resp.Data{T: resp.T_Error, String: msg}
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func newTestTransaction() *Transaction {
+	dispatcher := &Dispatcher{slotTable: NewSlotTable()}
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: 8191, write: "127.0.0.1:7001"})
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 8192, end: NumSlots - 1, write: "127.0.0.1:7002"})
+	return NewTransaction(&Session{dispatcher: dispatcher})
+}
+
+func TestTransactionPin(t *testing.T) {
+	tx := newTestTransaction()
+	// slot of "a" is 15495, "d" is 11298 of the same node, "b" is 3300 of the other
+	if !tx.pin([]string{"{a}1", "{a}2"}) || tx.slot != 15495 {
+		t.Errorf("expected pinned to slot 15495, got %d", tx.slot)
+	}
+	// keys of the same node but another slot are refused the same as valkey cluster
+	if tx.pin([]string{"d"}) || tx.pin([]string{"b"}) {
+		t.Error("expected keys of different slots to be refused")
+	}
+	if tx.slot != 15495 {
+		t.Errorf("pinned slot should not change, got %d", tx.slot)
+	}
+}
+
+func TestTransactionQueue(t *testing.T) {
+	tx := newTestTransaction()
+	command := func(args ...string) *resp.Command {
+		cmd, _ := resp.NewCommand(args...)
+		return cmd
+	}
+	if data := tx.Handle(command("EXEC")); !data.IsError() {
+		t.Error("expected EXEC without MULTI refused")
+	}
+	tx.Handle(command("MULTI"))
+	if data := tx.Handle(command("MULTI")); !data.IsError() {
+		t.Error("expected nested MULTI refused")
+	}
+	if data := tx.Handle(command("SET", "a", "1")); string(data.String) != "QUEUED" {
+		t.Errorf("expected QUEUED, got %s", data.String)
+	}
+	if data := tx.Handle(command("SET", "d", "1")); string(data.String) != string(CROSSSLOT_ERR) {
+		t.Errorf("expected CROSSSLOT while queueing, got %s", data.String)
+	}
+	for _, cmd := range []*resp.Command{command("PING"), command("ECHO", "hi"), command("SELECT", "0")} {
+		if data := tx.Handle(cmd); string(data.String) != "QUEUED" {
+			t.Errorf("expected %s queued, got %s", cmd.Name(), data.String)
+		}
+	}
+	if data := tx.Handle(command("KEYS", "*")); !data.IsError() {
+		t.Error("expected KEYS refused in transaction")
+	}
+	if data := tx.Handle(command("EXEC")); string(data.String) != string(EXECABORT_ERR) {
+		t.Errorf("expected EXECABORT, got %s", data.String)
+	}
+	if tx.Multi() || len(tx.queued) != 0 {
+		t.Error("expected transaction reset after EXEC")
+	}
+}
+
+// multiBackend replies a transaction the way valkey does, each command queued is replied
+// with its name in EXEC, and counts the connections accepted
+func multiBackend(t *testing.T, conns *atomic.Int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				var queued []string
+				// WATCH of key changed aborts EXEC
+				protocol, aborted := resp.RESP2, false
+				for {
+					cmd, err := resp.ReadCommand(r)
+					if err != nil {
+						return
+					}
+					reply := "+QUEUED\r\n"
+					switch cmd.Name() {
+					case "HELLO":
+						protocol, reply = resp.RESP3, "%0\r\n"
+					case "MULTI", "READONLY", "WATCH", "UNWATCH":
+						reply = "+OK\r\n"
+						aborted = aborted || cmd.Name() == "WATCH" && cmd.Value(1) == "changed"
+					case "EXEC":
+						if aborted {
+							reply = "*-1\r\n"
+							if protocol == resp.RESP3 {
+								reply = "_\r\n"
+							}
+							queued, aborted = nil, false
+							break
+						}
+						reply = fmt.Sprintf("*%d\r\n", len(queued))
+						for _, name := range queued {
+							reply += "+" + name + "\r\n"
+						}
+						queued = nil
+					default:
+						queued = append(queued, cmd.Name())
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTransactionExec(t *testing.T) {
+	var conns atomic.Int32
+	l := multiBackend(t, &conns)
+	defer l.Close()
+	dispatcher := &Dispatcher{slotTable: NewSlotTable()}
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: l.Addr().String()})
+	tx := NewTransaction(&Session{dispatcher: dispatcher, valkeyConn: NewValkeyConn(1, time.Second, "", false), protocol: resp.RESP2})
+	command := func(args ...string) *resp.Command {
+		cmd, _ := resp.NewCommand(args...)
+		return cmd
+	}
+	tx.Handle(command("MULTI"))
+	for _, cmd := range []*resp.Command{command("SET", "a", "1"), command("PING"), command("ECHO", "hi"), command("SELECT", "0"), command("GET", "a")} {
+		if data := tx.Handle(cmd); string(data.String) != "QUEUED" {
+			t.Fatalf("expected %s queued, got %s", cmd.Name(), data.String)
+		}
+	}
+	// commands answered by proxy are merged into the replies of backend
+	data := tx.Handle(command("EXEC"))
+	var replies []string
+	for _, reply := range data.Array {
+		replies = append(replies, string(reply.String))
+	}
+	if expected := []string{"SET", "PONG", "hi", "OK", "GET"}; !reflect.DeepEqual(replies, expected) {
+		t.Errorf("expected %v, got %v %s", expected, replies, data.String)
+	}
+}
+
+func TestTransactionAbortedResp3Backend(t *testing.T) {
+	var conns atomic.Int32
+	l := multiBackend(t, &conns)
+	defer l.Close()
+	dispatcher := &Dispatcher{slotTable: NewSlotTable()}
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: l.Addr().String()})
+	valkeyConn := NewValkeyConn(1, time.Second, "", false)
+	valkeyConn.SetProtocol(resp.RESP3)
+	tx := NewTransaction(&Session{dispatcher: dispatcher, valkeyConn: valkeyConn, protocol: resp.RESP2})
+	defer tx.Close()
+	command := func(args ...string) *resp.Command {
+		cmd, _ := resp.NewCommand(args...)
+		return cmd
+	}
+	for _, args := range [][]string{{"WATCH", "changed"}, {"MULTI"}, {"SET", "changed", "1"}} {
+		if data := tx.Handle(command(args...)); data.IsError() {
+			t.Fatalf("%v failed: %s", args, data.String)
+		}
+	}
+	// the null of RESP3 is a nil array for EXEC of RESP2 clients
+	if data := tx.Handle(command("EXEC")); string(data.Format()) != "*-1\r\n" {
+		t.Errorf("expected nil array, got %q", data.Format())
+	}
+}
+
+func TestTransactionReuseConn(t *testing.T) {
+	var conns atomic.Int32
+	l := multiBackend(t, &conns)
+	defer l.Close()
+	dispatcher := &Dispatcher{slotTable: NewSlotTable()}
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: l.Addr().String()})
+	tx := NewTransaction(&Session{dispatcher: dispatcher, valkeyConn: NewValkeyConn(1, time.Second, "", false), protocol: resp.RESP2})
+	defer tx.Close()
+	command := func(args ...string) *resp.Command {
+		cmd, _ := resp.NewCommand(args...)
+		return cmd
+	}
+	for i := 0; i < 3; i++ {
+		for _, args := range [][]string{{"WATCH", "a"}, {"MULTI"}, {"SET", "a", "1"}, {"EXEC"}, {"WATCH", "a"}, {"UNWATCH"}} {
+			if data := tx.Handle(command(args...)); data.IsError() {
+				t.Fatalf("%v failed: %s", args, data.String)
+			}
+		}
+	}
+	// the dedicated connection is kept for the next transactions of the session
+	if n := conns.Load(); n != 1 {
+		t.Errorf("expected a single connection, got %d", n)
+	}
+}
+
+func TestTransactionStalledNode(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// completes the handshake but never replies the commands after
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					cmd, err := resp.ReadCommand(r)
+					if err != nil {
+						return
+					}
+					if cmd.Name() == "READONLY" {
+						conn.Write([]byte("+OK\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	dispatcher := &Dispatcher{slotTable: NewSlotTable()}
+	dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: l.Addr().String()})
+	dispatcher.slotReloadChan = make(chan struct{}, 1)
+	tx := NewTransaction(&Session{dispatcher: dispatcher, valkeyConn: NewValkeyConn(1, 100*time.Millisecond, "", false), protocol: resp.RESP2})
+	defer tx.Close()
+	watch, _ := resp.NewCommand("WATCH", "a")
+	start := time.Now()
+	if data := tx.Handle(watch); !data.IsError() {
+		t.Errorf("expected WATCH on a stalled node failed, got %s", data.String)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected WATCH failed after the connect timeout, took %v", elapsed)
+	}
+}
@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"strings"
+
 	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
 )
 
@@ -10,6 +12,7 @@ const (
 	CMD_FLAG_PROXY
 	CMD_FLAG_UNKNOWN
 	CMD_FLAG_GENERAL
+	CMD_FLAG_BLOCKING
 )
 
 /*
@@ -19,118 +22,89 @@ CMD_FLAG_READ_ALL stands for read all command
 CMD_FLAG_PROXY stands for proxy command
 CMD_FLAG_UNKNOWN stands for unknown command
 CMD_FLAG_GENERAL stands for general command
+CMD_FLAG_BLOCKING stands for blocking command
+
+proxyCmdTable only lists commands handled by proxy itself, fanned out to all
+nodes, or not supported, the others are classified by their key specs.
 */
-var cmdTable = map[string]int{
-	"HELLO":            CMD_FLAG_UNKNOWN,
-	"ASKING":           CMD_FLAG_UNKNOWN,
-	"AUTH":             CMD_FLAG_PROXY,
-	"BGREWRITEAOF":     CMD_FLAG_UNKNOWN,
-	"BGSAVE":           CMD_FLAG_UNKNOWN,
-	"BITCOUNT":         CMD_FLAG_READ,
-	"BITOP":            CMD_FLAG_UNKNOWN,
-	"BITPOS":           CMD_FLAG_READ,
-	"BLPOP":            CMD_FLAG_UNKNOWN,
-	"BRPOP":            CMD_FLAG_UNKNOWN,
-	"BRPOPLPUSH":       CMD_FLAG_UNKNOWN,
-	"CLIENT":           CMD_FLAG_UNKNOWN,
-	"CLUSTER":          CMD_FLAG_UNKNOWN,
-	"COMMAND":          CMD_FLAG_READ,
-	"CONFIG":           CMD_FLAG_UNKNOWN,
-	"DBSIZE":           CMD_FLAG_UNKNOWN,
-	"DEBUG":            CMD_FLAG_UNKNOWN,
-	"DISCARD":          CMD_FLAG_UNKNOWN,
-	"DUMP":             CMD_FLAG_READ,
-	"ECHO":             CMD_FLAG_UNKNOWN,
-	"EXEC":             CMD_FLAG_READ_ALL,
-	"EXISTS":           CMD_FLAG_READ,
-	"FLUSHALL":         CMD_FLAG_UNKNOWN,
-	"FLUSHDB":          CMD_FLAG_UNKNOWN,
-	"GET":              CMD_FLAG_READ,
-	"GETBIT":           CMD_FLAG_READ,
-	"GETRANGE":         CMD_FLAG_READ,
-	"HEXISTS":          CMD_FLAG_READ,
-	"HGET":             CMD_FLAG_READ,
-	"HGETALL":          CMD_FLAG_READ,
-	"HKEYS":            CMD_FLAG_READ,
-	"HLEN":             CMD_FLAG_READ,
-	"HMGET":            CMD_FLAG_READ,
-	"HSCAN":            CMD_FLAG_READ,
-	"HVALS":            CMD_FLAG_READ,
-	"INFO":             CMD_FLAG_READ,
-	"KEYS":             CMD_FLAG_READ_ALL,
-	"LASTSAVE":         CMD_FLAG_UNKNOWN,
-	"LATENCY":          CMD_FLAG_READ,
-	"LINDEX":           CMD_FLAG_READ,
-	"LLEN":             CMD_FLAG_READ,
-	"LRANGE":           CMD_FLAG_READ,
-	"MGET":             CMD_FLAG_READ,
-	"MIGRATE":          CMD_FLAG_UNKNOWN,
-	"MONITOR":          CMD_FLAG_UNKNOWN,
-	"MOVE":             CMD_FLAG_UNKNOWN,
-	"MSETNX":           CMD_FLAG_UNKNOWN,
-	"MULTI":            CMD_FLAG_READ_ALL,
-	"OBJECT":           CMD_FLAG_UNKNOWN,
-	"PFCOUNT":          CMD_FLAG_READ,
-	"PFSELFTEST":       CMD_FLAG_READ,
-	"PING":             CMD_FLAG_PROXY,
-	"PSUBSCRIBE":       CMD_FLAG_UNKNOWN,
-	"PSYNC":            CMD_FLAG_READ,
-	"PTTL":             CMD_FLAG_READ,
-	"PUBLISH":          CMD_FLAG_UNKNOWN,
-	"PUBSUB":           CMD_FLAG_READ,
-	"PUNSUBSCRIBE":     CMD_FLAG_UNKNOWN,
-	"RANDOMKEY":        CMD_FLAG_UNKNOWN,
-	"READONLY":         CMD_FLAG_READ,
-	"READWRITE":        CMD_FLAG_READ,
-	"RENAME":           CMD_FLAG_UNKNOWN,
-	"RENAMENX":         CMD_FLAG_UNKNOWN,
-	"REPLCONF":         CMD_FLAG_READ,
-	"SAVE":             CMD_FLAG_UNKNOWN,
-	"SCAN":             CMD_FLAG_READ_ALL,
-	"SCARD":            CMD_FLAG_READ,
-	"SCRIPT":           CMD_FLAG_UNKNOWN,
-	"SDIFF":            CMD_FLAG_READ,
-	"SELECT":           CMD_FLAG_PROXY,
-	"SHUTDOWN":         CMD_FLAG_UNKNOWN,
-	"SINTER":           CMD_FLAG_READ,
-	"SISMEMBER":        CMD_FLAG_READ,
-	"SLAVEOF":          CMD_FLAG_UNKNOWN,
-	"SLOWLOG":          CMD_FLAG_READ_ALL,
-	"SMEMBERS":         CMD_FLAG_READ,
-	"SRANDMEMBER":      CMD_FLAG_READ,
-	"SSCAN":            CMD_FLAG_READ,
-	"STRLEN":           CMD_FLAG_READ,
-	"SUBSCRIBE":        CMD_FLAG_UNKNOWN,
-	"SUBSTR":           CMD_FLAG_READ,
-	"SUNION":           CMD_FLAG_READ,
-	"SYNC":             CMD_FLAG_UNKNOWN,
-	"TIME":             CMD_FLAG_UNKNOWN,
-	"TTL":              CMD_FLAG_READ,
-	"TYPE":             CMD_FLAG_READ,
-	"UNSUBSCRIBE":      CMD_FLAG_UNKNOWN,
-	"UNWATCH":          CMD_FLAG_UNKNOWN,
-	"WAIT":             CMD_FLAG_READ,
-	"WATCH":            CMD_FLAG_UNKNOWN,
-	"ZCARD":            CMD_FLAG_READ,
-	"ZCOUNT":           CMD_FLAG_READ,
-	"ZLEXCOUNT":        CMD_FLAG_READ,
-	"ZRANGE":           CMD_FLAG_READ,
-	"ZRANGEBYLEX":      CMD_FLAG_READ,
-	"ZRANGEBYSCORE":    CMD_FLAG_READ,
-	"ZRANK":            CMD_FLAG_READ,
-	"ZREVRANGE":        CMD_FLAG_READ,
-	"ZREVRANGEBYLEX":   CMD_FLAG_READ,
-	"ZREVRANGEBYSCORE": CMD_FLAG_READ,
-	"ZREVRANK":         CMD_FLAG_READ,
-	"ZSCAN":            CMD_FLAG_READ,
-	"ZSCORE":           CMD_FLAG_READ,
+var proxyCmdTable = map[string]int{
+	"ASKING":       CMD_FLAG_UNKNOWN,
+	"AUTH":         CMD_FLAG_PROXY,
+	"BGREWRITEAOF": CMD_FLAG_UNKNOWN,
+	"BGSAVE":       CMD_FLAG_UNKNOWN,
+	"CLIENT":       CMD_FLAG_PROXY,
+	"CLUSTER":      CMD_FLAG_PROXY,
+	"CONFIG":       CMD_FLAG_UNKNOWN,
+	"DBSIZE":       CMD_FLAG_UNKNOWN,
+	"DEBUG":        CMD_FLAG_UNKNOWN,
+	"DISCARD":      CMD_FLAG_PROXY,
+	"EXEC":         CMD_FLAG_PROXY,
+	"FLUSHALL":     CMD_FLAG_UNKNOWN,
+	"FLUSHDB":      CMD_FLAG_UNKNOWN,
+	"HELLO":        CMD_FLAG_PROXY,
+	"INFO":         CMD_FLAG_PROXY,
+	"KEYS":         CMD_FLAG_READ_ALL,
+	"LASTSAVE":     CMD_FLAG_UNKNOWN,
+	"MIGRATE":      CMD_FLAG_UNKNOWN,
+	"MONITOR":      CMD_FLAG_UNKNOWN,
+	"MOVE":         CMD_FLAG_UNKNOWN,
+	"MULTI":        CMD_FLAG_PROXY,
+	"PING":         CMD_FLAG_PROXY,
+	"PSUBSCRIBE":   CMD_FLAG_PROXY,
+	"PSYNC":        CMD_FLAG_UNKNOWN,
+	"PUNSUBSCRIBE": CMD_FLAG_PROXY,
+	"RANDOMKEY":    CMD_FLAG_UNKNOWN,
+	"READONLY":     CMD_FLAG_PROXY,
+	"READWRITE":    CMD_FLAG_PROXY,
+	"REPLCONF":     CMD_FLAG_UNKNOWN,
+	"REPLICAOF":    CMD_FLAG_UNKNOWN,
+	"SAVE":         CMD_FLAG_UNKNOWN,
+	"SCAN":         CMD_FLAG_READ_ALL,
+	"SCRIPT":       CMD_FLAG_UNKNOWN,
+	"SELECT":       CMD_FLAG_PROXY,
+	"SHUTDOWN":     CMD_FLAG_UNKNOWN,
+	"SLAVEOF":      CMD_FLAG_UNKNOWN,
+	"SLOWLOG":      CMD_FLAG_READ_ALL,
+	"SSUBSCRIBE":   CMD_FLAG_PROXY,
+	"SUBSCRIBE":    CMD_FLAG_PROXY,
+	"SUNSUBSCRIBE": CMD_FLAG_PROXY,
+	"SYNC":         CMD_FLAG_UNKNOWN,
+	"UNSUBSCRIBE":  CMD_FLAG_PROXY,
+	"UNWATCH":      CMD_FLAG_PROXY,
+	"WAIT":         CMD_FLAG_UNKNOWN,
+	"WAITAOF":      CMD_FLAG_UNKNOWN,
+	"WATCH":        CMD_FLAG_PROXY,
+}
+
+// proxySubcmdTable lists subcommands not supported while their container is, eg. functions
+// changed on one random node would make it differ from the others
+var proxySubcmdTable = map[string]int{
+	"FUNCTION|DELETE":  CMD_FLAG_UNKNOWN,
+	"FUNCTION|FLUSH":   CMD_FLAG_UNKNOWN,
+	"FUNCTION|LOAD":    CMD_FLAG_UNKNOWN,
+	"FUNCTION|RESTORE": CMD_FLAG_UNKNOWN,
 }
 
 func CmdFlag(cmd *resp.Command) int {
-	if flag, ok := cmdTable[cmd.Name()]; ok {
+	if flag, ok := proxyCmdTable[cmd.Name()]; ok {
 		return flag
 	}
-	return CMD_FLAG_GENERAL
+	if len(cmd.Args) > 1 {
+		if flag, ok := proxySubcmdTable[cmd.Name()+"|"+strings.ToUpper(cmd.Args[1])]; ok {
+			return flag
+		}
+	}
+	spec := LookupCommand(cmd)
+	switch {
+	case spec == nil:
+		return CMD_FLAG_GENERAL
+	case spec.Flags&COMMAND_FLAG_BLOCKING != 0:
+		return CMD_FLAG_BLOCKING
+	case spec.Flags&COMMAND_FLAG_READONLY != 0:
+		return CMD_FLAG_READ
+	default:
+		return CMD_FLAG_GENERAL
+	}
 }
 
 func CmdUnknown(cmd *resp.Command) bool {
@@ -151,6 +125,81 @@ func CmdAuthRequired(cmd *resp.Command) bool {
 	}
 }
 
+// CmdPubSub returns whether cmd changes subscriptions of a subscriber
+func CmdPubSub(cmd *resp.Command) bool {
+	switch cmd.Name() {
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SSUBSCRIBE", "SUNSUBSCRIBE":
+		return true
+	default:
+		return false
+	}
+}
+
+// CmdSubscribedAllowed returns whether cmd is allowed for a RESP2 client in subscriber mode
+func CmdSubscribedAllowed(cmd *resp.Command) bool {
+	return CmdPubSub(cmd) || cmd.Name() == "PING"
+}
+
+// CmdTransaction returns whether cmd controls a transaction
+func CmdTransaction(cmd *resp.Command) bool {
+	switch cmd.Name() {
+	case "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH":
+		return true
+	default:
+		return false
+	}
+}
+
+// CmdKeys returns the keys of cmd located by its key specs, a command without spec
+// has no key known and is sent to a random node
+func CmdKeys(cmd *resp.Command) []string {
+	spec := LookupCommand(cmd)
+	if spec == nil {
+		return nil
+	}
+	indexes := spec.KeyIndexes(cmd.Args)
+	if len(indexes) == 0 {
+		return nil
+	}
+	keys := make([]string, len(indexes))
+	for i, index := range indexes {
+		keys[i] = cmd.Args[index]
+	}
+	return keys
+}
+
+// CmdSlot returns the slot of the keys of cmd, or -1 if cmd has no key.
+// crossSlot is true if the keys hash to different slots.
+func CmdSlot(cmd *resp.Command) (slot int, crossSlot bool) {
+	slot = -1
+	for _, key := range CmdKeys(cmd) {
+		keySlot := Key2Slot(key)
+		if slot >= 0 && keySlot != slot {
+			return slot, true
+		}
+		slot = keySlot
+	}
+	return slot, false
+}
+
+// CmdBlocking returns whether cmd may block the connection waiting for data
+func CmdBlocking(cmd *resp.Command) bool {
+	switch cmd.Name() {
+	case "XREAD", "XREADGROUP":
+		for i := 1; i < len(cmd.Args); i++ {
+			if strings.EqualFold(cmd.Args[i], "BLOCK") {
+				return true
+			}
+			if strings.EqualFold(cmd.Args[i], "STREAMS") {
+				return false
+			}
+		}
+		return false
+	default:
+		return CmdFlag(cmd) == CMD_FLAG_BLOCKING
+	}
+}
+
 func CmdReadAll(cmd *resp.Command) bool {
 	switch CmdFlag(cmd) {
 	case CMD_FLAG_READ_ALL: